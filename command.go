@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/keyring"
+	"os"
+)
+
+const keyringUsage = `usage: drive-manager-api keyring <command>
+
+  generate                    print a new random master key
+  migrate                     encrypt the keys still stored as plaintext
+  rotate-master -new-key-file <path> | -new-key <base64>
+                              wrap the data key with a new master key`
+
+// runKeyringCommand handles "keyring" on the command line. The current master key comes from
+// KEYRING_MASTER_KEY or KEYRING_MASTER_KEY_FILE, as for the server.
+func runKeyringCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(keyringUsage)
+	}
+	switch args[0] {
+	case "generate":
+		key, err := keyring.GenerateMasterKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	}
+	if err := dao.Init(); err != nil {
+		return err
+	}
+	defer dao.Close()
+	switch args[0] {
+	case "migrate":
+		if err := keyring.Init(); err != nil {
+			return err
+		}
+		results, err := keyring.MigrateStoredKeys()
+		for _, r := range results {
+			fmt.Printf("%s.%s: %d encrypted, %d failed\n", r.Collection, r.Field, r.Encrypted, r.Failed)
+		}
+		return err
+	case "rotate-master":
+		fs := flag.NewFlagSet("rotate-master", flag.ContinueOnError)
+		newKeyFile := fs.String("new-key-file", "", "file holding the new master key")
+		newKey := fs.String("new-key", "", "new master key, base64 encoded")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		current, err := keyring.LoadMasterKey()
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return keyring.ErrNoMasterKey
+		}
+		var next []byte
+		switch {
+		case *newKeyFile != "":
+			next, err = keyring.ReadMasterKeyFile(*newKeyFile)
+		case *newKey != "":
+			next, err = keyring.ParseMasterKey([]byte(*newKey))
+		default:
+			return errors.New(keyringUsage)
+		}
+		if err != nil {
+			return err
+		}
+		if err := keyring.RotateMasterKey(current, next); err != nil {
+			return err
+		}
+		fmt.Println("Master key rotated, restart the servers with the new key")
+		return nil
+	}
+	return errors.New(keyringUsage)
+}
+
+// runCommand runs the command given on the command line, if any, and tells whether it did.
+func runCommand() bool {
+	if len(os.Args) < 2 || os.Args[1] != "keyring" {
+		return false
+	}
+	if err := runKeyringCommand(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	return true
+}
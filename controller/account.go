@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"github.com/gin-gonic/gin"
 	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/keyring"
 	"github.com/ndphu/drive-manager-api/middleware"
 	"github.com/ndphu/drive-manager-api/service"
 	"go.mongodb.org/mongo-driver/bson"
@@ -23,7 +24,7 @@ func AccountController(r *gin.RouterGroup) {
 	r.GET("/account/:id", func(c *gin.Context) {
 		userId := CurrentUser(c).Id.Hex()
 		accountId := c.Param("id")
-		acc, err := accountService.FindAccountLookup(accountId, userId)
+		acc, err := accountService.FindAccountLookup(accountId, userId, c.Query("cursor"))
 		if err != nil {
 			status := 500
 			if err == mongo.ErrNoDocuments {
@@ -99,8 +100,12 @@ func AccountController(r *gin.RouterGroup) {
 			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
 			return
 		} else {
-			if err := accountService.UpdateCachedQuotaByAccountIdAndAdditionalSize(accountId, file.Size); err != nil {
-				c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			if err := service.GetQuotaService().CommitFile(user.Id, fv.AccountId, c.Query("reservationId"), file.Id, file.Size); err != nil {
+				status := 500
+				if err == service.ErrReservationNotFound {
+					status = 404
+				}
+				c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
 			} else {
 				c.JSON(200, gin.H{"success": true, "file": fv})
 			}
@@ -130,7 +135,11 @@ func AccountController(r *gin.RouterGroup) {
 			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
 			return
 		}
-		key := []byte(account.Key)
+		key, err := keyring.Decrypt(account.Key)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
 		c.String(200, base64.StdEncoding.EncodeToString(key))
 	})
 
@@ -146,6 +155,16 @@ func AccountController(r *gin.RouterGroup) {
 		}
 	})
 
+	r.GET("/account/:id/reservations", func(c *gin.Context) {
+		hex, _ := primitive.ObjectIDFromHex(c.Param("id"))
+		reservations, err := service.GetQuotaService().FindReservations(CurrentUser(c).Id, hex)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"reservations": reservations})
+	})
+
 	r.GET("/account/:id/accessToken", func(c *gin.Context) {
 		hex, _ := primitive.ObjectIDFromHex(c.Param("id"))
 		account, err := accountService.FindAccountById(hex, CurrentUser(c).Id)
@@ -160,4 +179,98 @@ func AccountController(r *gin.RouterGroup) {
 		}
 		c.JSON(200, gin.H{"accessToken": token})
 	})
+
+	r.POST("/account/:id/retire", func(c *gin.Context) {
+		hex, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		retirement, err := service.GetRetirementService().Retire(CurrentUser(c).Id, hex)
+		if err != nil {
+			status := 500
+			switch err {
+			case mongo.ErrNoDocuments:
+				status = 404
+			case service.ErrCannotRetire:
+				status = 400
+			case service.ErrRetirementRunning:
+				status = 409
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(202, gin.H{"success": true, "retirement": retirement})
+	})
+
+	r.GET("/account/:id/retirement", func(c *gin.Context) {
+		hex, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		retirement, err := service.GetRetirementService().FindRetirement(CurrentUser(c).Id, hex)
+		if err != nil {
+			status := 500
+			if err == mongo.ErrNoDocuments {
+				status = 404
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"retirement": retirement})
+	})
+
+	r.POST("/account/:id/checkHealth", func(c *gin.Context) {
+		hex, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		result, err := service.GetHealthChecker().CheckAccount(CurrentUser(c).Id, hex)
+		if err != nil {
+			status := 500
+			if err == mongo.ErrNoDocuments {
+				status = 404
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"health": result})
+	})
+
+	r.GET("/accounts/health", func(c *gin.Context) {
+		summary, err := service.AccountHealthSummary(CurrentUser(c).Id)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		circuits, err := service.OpenCircuits(CurrentUser(c).Id)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"health": summary, "openCircuits": circuits})
+	})
+
+	r.POST("/account/:id/rotateKey", func(c *gin.Context) {
+		hex, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		job, err := service.GetKeyRotationService().EnqueueAccountRotation(CurrentUser(c).Id, hex)
+		if err != nil {
+			status := 500
+			switch err {
+			case mongo.ErrNoDocuments:
+				status = 404
+			case service.ErrCannotRotate:
+				status = 400
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(202, gin.H{"success": true, "job": job})
+	})
 }
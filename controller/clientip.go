@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"net"
+	"os"
+	"strings"
+)
+
+// trustedProxies lists the addresses or CIDR ranges, from TRUSTED_PROXIES, allowed to tell
+// the client address through X-Forwarded-For or X-Real-IP.
+var trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+
+func parseTrustedProxies(value string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		if _, n, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// remoteIp is the address of the peer, or the one forwarded by a trusted proxy. Unlike
+// c.ClientIP it cannot be set by the client with a header.
+func remoteIp(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		host = strings.TrimSpace(c.Request.RemoteAddr)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return c.ClientIP()
+		}
+	}
+	return host
+}
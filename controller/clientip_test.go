@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []string
+	}{
+		{"", nil},
+		{"10.0.0.1", []string{"10.0.0.1/32"}},
+		{"10.0.0.0/8, ::1", []string{"10.0.0.0/8", "::1/128"}},
+		{"not an address,192.168.1.0/24", []string{"192.168.1.0/24"}},
+	}
+	for _, tt := range tests {
+		nets := parseTrustedProxies(tt.value)
+		if len(nets) != len(tt.expected) {
+			t.Errorf("%q: got %v", tt.value, nets)
+			continue
+		}
+		for i, n := range nets {
+			if n.String() != tt.expected[i] {
+				t.Errorf("%q: got %v", tt.value, nets)
+			}
+		}
+	}
+}
+
+func TestRemoteIp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previous := trustedProxies
+	defer func() { trustedProxies = previous }()
+	trustedProxies = parseTrustedProxies("10.0.0.0/8")
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"direct client", "203.0.113.7:5000", "", "203.0.113.7"},
+		{"spoofed header from an untrusted peer", "203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+		{"forwarded by a trusted proxy", "10.1.2.3:5000", "198.51.100.1", "198.51.100.1"},
+		{"no port", "203.0.113.7", "198.51.100.1", "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/", nil)
+		c.Request.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			c.Request.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := remoteIp(c); got != tt.expected {
+			t.Errorf("%s: got %s, expected %s", tt.name, got, tt.expected)
+		}
+	}
+}
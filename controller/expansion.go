@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ndphu/drive-manager-api/service"
+	"strconv"
+)
+
+type ExpansionPolicyRequest struct {
+	Enabled              bool  `json:"enabled"`
+	MinAvailable         int64 `json:"minAvailable"`
+	AccountsPerExpansion int   `json:"accountsPerExpansion"`
+	MaxAccounts          int   `json:"maxAccounts"`
+}
+
+func ExpansionController(r *gin.RouterGroup) {
+	expansionService := service.GetExpansionService()
+
+	r.GET("/policy", func(c *gin.Context) {
+		policy, err := expansionService.FindPolicy(CurrentUser(c).Id)
+		if err != nil {
+			abortExpansionError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"policy": policy})
+	})
+
+	r.PUT("/policy", func(c *gin.Context) {
+		var req ExpansionPolicyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		policy, err := expansionService.SetPolicy(CurrentUser(c).Id, req.Enabled, req.MinAvailable, req.AccountsPerExpansion, req.MaxAccounts)
+		if err != nil {
+			abortExpansionError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "policy": policy})
+	})
+
+	r.GET("/forecast", func(c *gin.Context) {
+		plan, err := expansionService.Plan(CurrentUser(c).Id)
+		if err != nil {
+			abortExpansionError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"dryRun": true, "plan": plan})
+	})
+
+	r.POST("/check", func(c *gin.Context) {
+		expansion, err := expansionService.Check(CurrentUser(c).Id, service.ExpansionTriggerManual)
+		if err != nil {
+			abortExpansionError(c, err)
+			return
+		}
+		if expansion == nil {
+			c.JSON(200, gin.H{"success": true, "expanded": false})
+			return
+		}
+		c.JSON(202, gin.H{"success": true, "expanded": true, "expansion": expansion})
+	})
+
+	r.GET("", func(c *gin.Context) {
+		limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "50"), 10, 64)
+		if limit <= 0 {
+			limit = 50
+		}
+		expansions, err := expansionService.FindExpansions(CurrentUser(c).Id, limit)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"expansions": expansions})
+	})
+}
+
+func abortExpansionError(c *gin.Context, err error) {
+	status := 500
+	switch err {
+	case service.ErrNoExpansionPolicy:
+		status = 404
+	case service.ErrInvalidExpansionPolicy:
+		status = 400
+	case service.ErrExpansionPending, service.ErrNoProjectCapacity:
+		status = 409
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
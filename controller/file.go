@@ -2,6 +2,11 @@ package controller
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/ndphu/drive-manager-api/service"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
 )
 
 func FileController(r *gin.RouterGroup) {
@@ -19,4 +24,89 @@ func FileController(r *gin.RouterGroup) {
 		//}
 		c.JSON(200, gin.H{"count": 0})
 	})
+
+	contentService := service.GetContentService()
+	erasureService := service.GetErasureService()
+
+	r.GET("/:id/manifest", func(c *gin.Context) {
+		fi, ok := findOwnedFile(c, contentService)
+		if !ok {
+			return
+		}
+		if fi.Storage != service.StorageChunked {
+			c.AbortWithStatusJSON(404, gin.H{"error": "file is not chunked"})
+			return
+		}
+		m, err := service.FindManifest(*fi.ManifestId)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "manifest": m})
+	})
+
+	r.GET("/:id/layout", func(c *gin.Context) {
+		fi, ok := findOwnedFile(c, contentService)
+		if !ok {
+			return
+		}
+		if fi.Storage != service.StorageErasure {
+			c.AbortWithStatusJSON(404, gin.H{"error": "file is not erasure coded"})
+			return
+		}
+		layout, err := service.FindErasureLayout(*fi.ManifestId)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "layout": layout})
+	})
+
+	r.POST("/:id/scrub", func(c *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(c.Param("id"))
+		layout, err := erasureService.ScrubFile(CurrentUser(c).Id, id)
+		if err != nil {
+			status := 500
+			if err == mongo.ErrNoDocuments {
+				status = 404
+			} else if err == service.ErrTooManyShardsLost {
+				status = 409
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error(), "layout": layout})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "layout": layout})
+	})
+
+	r.POST("/scrub", func(c *gin.Context) {
+		owner := CurrentUser(c).Id
+		go func() {
+			if err := erasureService.ScrubAll(bson.D{{"owner", owner}}); err != nil {
+				log.Println("Fail to scrub erasure layouts of user", owner.Hex(), "by error", err.Error())
+			}
+		}()
+		c.JSON(202, gin.H{"success": true})
+	})
+
+	r.DELETE("/:id", func(c *gin.Context) {
+		fi, ok := findOwnedFile(c, contentService)
+		if !ok {
+			return
+		}
+		if err := contentService.Delete(fi); err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true})
+	})
+}
+
+func findOwnedFile(c *gin.Context, contentService *service.ContentService) (*service.FileIndex, bool) {
+	id, _ := primitive.ObjectIDFromHex(c.Param("id"))
+	fi, err := contentService.FindFileIndex(id)
+	if err != nil || fi.Owner != CurrentUser(c).Id {
+		c.AbortWithStatusJSON(404, gin.H{"error": "file not found"})
+		return nil, false
+	}
+	return fi, true
 }
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ndphu/drive-manager-api/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strconv"
+)
+
+func JobController(r *gin.RouterGroup) {
+	jobService := service.GetJobService()
+
+	r.GET("", func(c *gin.Context) {
+		limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "50"), 10, 64)
+		if limit <= 0 {
+			limit = 50
+		}
+		jobs, err := jobService.FindJobs(CurrentUser(c).Id, c.Query("type"), c.Query("status"), limit)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"jobs": jobs})
+	})
+
+	r.GET("/:id", func(c *gin.Context) {
+		hex, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		job, err := jobService.FindJob(CurrentUser(c).Id, hex)
+		if err != nil {
+			abortJobError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"job": job})
+	})
+
+	r.POST("/:id/cancel", func(c *gin.Context) {
+		hex, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		job, err := jobService.Cancel(CurrentUser(c).Id, hex)
+		if err != nil {
+			abortJobError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "job": job})
+	})
+
+	r.POST("/:id/retry", func(c *gin.Context) {
+		hex, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		job, err := jobService.Retry(CurrentUser(c).Id, hex)
+		if err != nil {
+			abortJobError(c, err)
+			return
+		}
+		c.JSON(202, gin.H{"success": true, "job": job})
+	})
+}
+
+func abortJobError(c *gin.Context, err error) {
+	status := 500
+	switch err {
+	case mongo.ErrNoDocuments:
+		status = 404
+	case service.ErrJobFinished, service.ErrJobNotRetryable:
+		status = 409
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ndphu/drive-manager-api/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/api/googleapi"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+)
+
+type SignedLinkRequest struct {
+	FileIndexId  string `json:"fileIndexId"`
+	TTL          int64  `json:"ttl"`
+	IP           string `json:"ip"`
+	MaxDownloads int    `json:"maxDownloads"`
+}
+
+// LinkController serves signed links publicly, without login.
+func LinkController(r *gin.RouterGroup) {
+	linkService := service.GetLinkService()
+	contentService := service.GetContentService()
+
+	handler := func(c *gin.Context) {
+		claims, err := linkService.Verify(c.Param("token"), remoteIp(c))
+		if err != nil {
+			status := 403
+			if err == service.ErrLinkExpired {
+				status = 410
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		byteRange := c.GetHeader("Range")
+		id, _ := primitive.ObjectIDFromHex(claims.FileIndexId)
+		fi, err := contentService.FindFileIndex(id)
+		if err != nil {
+			c.AbortWithStatusJSON(404, gin.H{"error": "file not found"})
+			return
+		}
+		res, err := contentService.Open(fi, byteRange)
+		if isRangeError(err) {
+			c.Header("Content-Range", fmt.Sprintf("bytes */%d", fi.Size))
+			c.AbortWithStatusJSON(416, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Println("Fail to open file", fi.Id.Hex(), "for signed link by error", err.Error())
+			c.AbortWithStatusJSON(502, gin.H{"error": "fail to read file"})
+			return
+		}
+		defer res.Body.Close()
+		if c.Request.Method == "GET" {
+			served := res.ContentLength
+			if served < 0 {
+				served = fi.Size
+			}
+			if err := linkService.CountDownload(claims, fi.Size, served); err != nil {
+				status := 500
+				if err == service.ErrLinkExhausted {
+					status = 410
+				}
+				c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fi.Name}))
+		writeMediaResponse(c, res)
+	}
+	r.GET("/:token", handler)
+	r.HEAD("/:token", handler)
+}
+
+// isRangeError tells whether the content could not be opened because the range lies outside of it.
+func isRangeError(err error) bool {
+	if err == service.ErrRangeNotSatisfiable {
+		return true
+	}
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusRequestedRangeNotSatisfiable
+}
+
+func SignedLinkController(r *gin.RouterGroup) {
+	linkService := service.GetLinkService()
+
+	r.POST("", func(c *gin.Context) {
+		var req SignedLinkRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		link, err := linkService.CreateLink(CurrentUser(c).Id, req.FileIndexId, time.Duration(req.TTL)*time.Second, req.IP, req.MaxDownloads)
+		if err != nil {
+			status := 500
+			if err == mongo.ErrNoDocuments || err == service.ErrLinkForbidden {
+				status = 404
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "link": link})
+	})
+}
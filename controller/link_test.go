@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"errors"
+	"github.com/ndphu/drive-manager-api/service"
+	"google.golang.org/api/googleapi"
+	"testing"
+)
+
+func TestIsRangeError(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		unsatisfiable bool
+	}{
+		{"none", nil, false},
+		{"range outside a chunked file", service.ErrRangeNotSatisfiable, true},
+		{"range refused by Drive", &googleapi.Error{Code: 416}, true},
+		{"other Drive error", &googleapi.Error{Code: 500}, false},
+		{"other error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := isRangeError(tt.err); got != tt.unsatisfiable {
+			t.Errorf("%s: isRangeError = %v", tt.name, got)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/ndphu/drive-manager-api/dao"
 	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
 	"github.com/ndphu/drive-manager-api/service"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -14,6 +15,7 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ProjectCreateRequest struct {
@@ -33,7 +35,6 @@ type ProjectLookup struct {
 
 func ProjectController(r *gin.RouterGroup) {
 	s := service.GetProjectService()
-	accountService := service.GetAccountService()
 
 	r.GET("/projects", func(c *gin.Context) {
 		user := CurrentUser(c)
@@ -143,7 +144,7 @@ func ProjectController(r *gin.RouterGroup) {
 			return
 		}
 
-		project, err := s.CreateProject(displayName, key, numberOfAccounts, user.Id)
+		project, job, err := s.CreateProject(displayName, key, numberOfAccounts, user.Id)
 		if err != nil {
 			c.JSON(500, gin.H{"error": err.Error()})
 			return
@@ -153,11 +154,32 @@ func ProjectController(r *gin.RouterGroup) {
 		if err != nil {
 			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
 		} else {
-			c.JSON(200, gin.H{"success": true, "project": p})
+			c.JSON(200, gin.H{"success": true, "project": p, "job": job})
 		}
 
 	})
 
+	// a project for local and S3 accounts, with no Google project behind it
+	r.POST("/projects/storage", func(c *gin.Context) {
+		user := CurrentUser(c)
+		displayName := strings.TrimSpace(c.Request.FormValue("displayName"))
+		if displayName == "" {
+			c.AbortWithStatusJSON(400, gin.H{"error": "Project name could not be empty"})
+			return
+		}
+		project, err := s.CreateStorageProject(displayName, user.Id)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		p, err := queryProjectLookup(user.Id.Hex(), project.Id.Hex())
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, gin.H{"success": true, "project": p})
+		}
+	})
+
 	r.DELETE("/project/:id", func(c *gin.Context) {
 		user := CurrentUser(c)
 		projectId := c.Param("id")
@@ -208,25 +230,55 @@ func ProjectController(r *gin.RouterGroup) {
 		user := CurrentUser(c)
 		projectId := c.Param("id")
 		count, err := strconv.Atoi(c.Query("count"))
-		if err != nil {
+		if err != nil || count < 1 {
 			count = 1
 		}
 		log.Println("Adding", count, "new account(s) for project", projectId)
-		accounts := make([]*entity.DriveAccount, 0)
-		for i := 0; i < count; i++ {
-			if account, err := accountService.CreateServiceAccount(projectId, user.Id.Hex()); err != nil {
-				break
-			} else {
-				account.Key = ""
-				accounts = append(accounts, account)
-			}
+		job, err := s.EnqueueProjectJob(user.Id, projectId, service.JobProvisionProject, map[string]string{
+			"count": strconv.Itoa(count),
+		})
+		if err != nil {
+			abortProjectJobError(c, err)
+			return
 		}
-		c.JSON(200, gin.H{
-			"success":  true,
-			"accounts": accounts,
+		c.JSON(202, gin.H{
+			"success": true,
+			"job":     job,
 		})
 	})
 
+	// adds a local or S3 account, the file is its JSON credential
+	r.POST("/project/:id/storageAccount", func(c *gin.Context) {
+		user := CurrentUser(c)
+		uploadFile, _, err := c.Request.FormFile("file")
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		key, err := ioutil.ReadAll(uploadFile)
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		acc, err := service.GetAccountService().AddStorageAccount(user.Id, c.Param("id"), c.Request.FormValue("name"), key)
+		if err != nil {
+			status := 500
+			if err == service.ErrProjectNotFound {
+				status = 404
+			} else if err == service.ErrInvalidStorageKey || err == helper.ErrLocalRootNotAllowed || err == helper.ErrS3EndpointNotAllowed {
+				status = 400
+			} else if err == helper.ErrLocalStorageDisabled {
+				status = 403
+			} else if err == service.ErrLocalRootInUse {
+				status = 409
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		acc.Key = ""
+		c.JSON(200, gin.H{"success": true, "account": acc})
+	})
+
 	r.POST("/project/:id/syncQuota", func(c *gin.Context) {
 		//user := CurrentUser(c)
 		projectId := c.Param("id")
@@ -281,26 +333,105 @@ func ProjectController(r *gin.RouterGroup) {
 
 	r.POST("/project/:id/sync", func(c *gin.Context) {
 		user := CurrentUser(c)
-		projectId := c.Param("id")
-		projectIdHex, _ := primitive.ObjectIDFromHex(projectId)
-		if count, err := dao.RawCollection("project").CountDocuments(context.Background(), bson.D{
-			{"_id", projectIdHex},
-			{"owner", user.Id}}); err != nil {
-			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+		job, err := s.EnqueueProjectJob(user.Id, c.Param("id"), service.JobSyncProjectWithGoogle, nil)
+		if err != nil {
+			abortProjectJobError(c, err)
+			return
+		}
+		c.JSON(202, gin.H{"success": true, "job": job})
+	})
+
+	// dryRun queues the plan, read it with GET once its job is done; planId applies a reviewed plan
+	r.POST("/project/:id/reconcile", func(c *gin.Context) {
+		user := CurrentUser(c)
+		if c.Query("dryRun") == "true" {
+			job, planId, err := s.PlanReconcile(user.Id, c.Param("id"))
+			if err != nil {
+				abortProjectJobError(c, err)
+				return
+			}
+			c.JSON(202, gin.H{"dryRun": true, "planId": planId.Hex(), "job": job})
+			return
+		}
+		var job *entity.Job
+		var err error
+		if planId := c.Query("planId"); planId != "" {
+			job, err = s.ApplyReconcile(user.Id, c.Param("id"), planId)
 		} else {
-			if count == 0 {
-				c.JSON(404, gin.H{"error": "project not found"})
-			} else {
-				if err := s.SyncProjectWithGoogle(projectId); err != nil {
-					c.AbortWithStatusJSON(500, gin.H{"error": "fail to sync project by error" + err.Error()})
-				} else {
-					c.JSON(200, gin.H{"success": true})
-				}
+			job, err = s.EnqueueProjectJob(user.Id, c.Param("id"), service.JobReconcileProject, nil)
+		}
+		if err != nil {
+			abortProjectJobError(c, err)
+			return
+		}
+		c.JSON(202, gin.H{"success": true, "job": job})
+	})
+
+	r.GET("/project/:id/reconcile/:planId", func(c *gin.Context) {
+		plan, err := s.FindReconcilePlan(CurrentUser(c).Id, c.Param("id"), c.Param("planId"))
+		if err != nil {
+			abortProjectJobError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"report": plan, "changes": len(plan.Changes())})
+	})
+
+	r.POST("/project/:id/rotateKeys", func(c *gin.Context) {
+		user := CurrentUser(c)
+		params := make(map[string]string)
+		if maxAge := c.Query("maxAge"); maxAge != "" {
+			if _, err := time.ParseDuration(maxAge); err != nil {
+				c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			params["maxAge"] = maxAge
+		}
+		job, err := s.EnqueueProjectJob(user.Id, c.Param("id"), service.JobRotateProjectKeys, params)
+		if err != nil {
+			abortProjectJobError(c, err)
+			return
+		}
+		c.JSON(202, gin.H{"success": true, "job": job})
+	})
+
+	r.GET("/project/:id/provisionEvents", func(c *gin.Context) {
+		user := CurrentUser(c)
+		projectId, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		var jobId *primitive.ObjectID
+		if hex := c.Query("jobId"); hex != "" {
+			id, err := primitive.ObjectIDFromHex(hex)
+			if err != nil {
+				c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+				return
 			}
+			jobId = &id
+		}
+		events, err := service.FindProvisionEvents(user.Id, projectId, jobId)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
 		}
+		c.JSON(200, gin.H{"events": events})
 	})
 }
 
+func abortProjectJobError(c *gin.Context, err error) {
+	status := 500
+	switch err {
+	case service.ErrProjectNotFound, service.ErrReconcilePlanNotFound:
+		status = 404
+	case service.ErrNotGoogleProject, service.ErrReconcilePlanApplied:
+		status = 409
+	case service.ErrReconcilePlanExpired:
+		status = 410
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
+
 func queryProjectLookup(userId, projectId string) (*ProjectLookup, error) {
 	var projects []ProjectLookup
 	projectIdHex, _ := primitive.ObjectIDFromHex(projectId)
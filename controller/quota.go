@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ndphu/drive-manager-api/middleware"
+	"github.com/ndphu/drive-manager-api/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strconv"
+)
+
+func QuotaController(r *gin.RouterGroup) {
+	refresher := service.GetQuotaRefresher()
+	r.Use(middleware.AdminFilter())
+
+	r.GET("/refresh", func(c *gin.Context) {
+		limit, _ := strconv.ParseInt(c.DefaultQuery("limit", "20"), 10, 64)
+		if limit <= 0 {
+			limit = 20
+		}
+		runs, err := refresher.FindRuns(limit)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"runs": runs})
+	})
+
+	r.GET("/refresh/:id", func(c *gin.Context) {
+		hex, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		run, err := refresher.FindRun(hex)
+		if err != nil {
+			status := 500
+			if err == mongo.ErrNoDocuments {
+				status = 404
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"run": run})
+	})
+
+	r.POST("/refresh", func(c *gin.Context) {
+		run, err := refresher.Trigger()
+		if err != nil {
+			status := 500
+			if err == service.ErrRefreshRunning {
+				status = 409
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(202, gin.H{"success": true, "run": run})
+	})
+}
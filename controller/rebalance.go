@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ndphu/drive-manager-api/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type RebalanceRequest struct {
+	DryRun          bool     `json:"dryRun"`
+	Tolerance       float64  `json:"tolerance"`
+	MaxMoves        int      `json:"maxMoves"`
+	MaxBytes        int64    `json:"maxBytes"`
+	DrainAccountIds []string `json:"drainAccountIds"`
+}
+
+func RebalanceController(r *gin.RouterGroup) {
+	rebalanceService := service.GetRebalanceService()
+
+	r.POST("", func(c *gin.Context) {
+		var req RebalanceRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		opts := service.RebalanceOptions{
+			DryRun:    req.DryRun || c.Query("dryRun") == "true",
+			Tolerance: req.Tolerance,
+			MaxMoves:  req.MaxMoves,
+			MaxBytes:  req.MaxBytes,
+		}
+		for _, id := range req.DrainAccountIds {
+			hex, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			opts.DrainAccountIds = append(opts.DrainAccountIds, hex)
+		}
+		run, err := rebalanceService.Rebalance(CurrentUser(c).Id, opts)
+		if err != nil {
+			status := 500
+			if err == service.ErrRebalanceRunning {
+				status = 409
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "run": run})
+	})
+
+	r.GET("", func(c *gin.Context) {
+		runs, err := rebalanceService.FindRuns(CurrentUser(c).Id)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "runs": runs})
+	})
+
+	r.GET("/:id", func(c *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(c.Param("id"))
+		run, err := rebalanceService.FindRun(CurrentUser(c).Id, id)
+		if err != nil {
+			status := 500
+			if err == mongo.ErrNoDocuments {
+				status = 404
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "run": run})
+	})
+
+	r.POST("/:id/cancel", func(c *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(c.Param("id"))
+		if err := rebalanceService.Cancel(CurrentUser(c).Id, id); err != nil {
+			status := 500
+			if err == mongo.ErrNoDocuments {
+				status = 404
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true})
+	})
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ndphu/drive-manager-api/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+)
+
+type ReplicationPolicyRequest struct {
+	Replicas int `json:"replicas"`
+}
+
+func ReplicationController(r *gin.RouterGroup) {
+	replicationService := service.GetReplicationService()
+
+	r.GET("/policies", func(c *gin.Context) {
+		policies, err := replicationService.FindPolicies(CurrentUser(c).Id)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "policies": policies, "default": replicationService.DefaultReplicas})
+	})
+
+	setPolicy := func(c *gin.Context, folderId *primitive.ObjectID) {
+		var req ReplicationPolicyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		policy, err := replicationService.SetPolicy(CurrentUser(c).Id, folderId, req.Replicas)
+		if err != nil {
+			abortReplicationError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "policy": policy})
+	}
+
+	r.PUT("/policy", func(c *gin.Context) {
+		setPolicy(c, nil)
+	})
+
+	r.PUT("/policy/folder/:itemId", func(c *gin.Context) {
+		folderId, err := primitive.ObjectIDFromHex(c.Param("itemId"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		setPolicy(c, &folderId)
+	})
+
+	r.DELETE("/policy/folder/:itemId", func(c *gin.Context) {
+		folderId, err := primitive.ObjectIDFromHex(c.Param("itemId"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if err := replicationService.DeletePolicy(CurrentUser(c).Id, &folderId); err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true})
+	})
+
+	r.GET("/file/:id", func(c *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(c.Param("id"))
+		status, err := replicationService.Status(CurrentUser(c).Id, id)
+		if err != nil {
+			abortReplicationError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "replication": status})
+	})
+
+	r.POST("/file/:id/repair", func(c *gin.Context) {
+		id, _ := primitive.ObjectIDFromHex(c.Param("id"))
+		status, err := replicationService.RepairFile(CurrentUser(c).Id, id)
+		if err != nil {
+			abortReplicationError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "replication": status})
+	})
+
+	r.POST("/repair", func(c *gin.Context) {
+		owner := CurrentUser(c).Id
+		go func() {
+			if err := replicationService.RepairOwner(owner); err != nil {
+				log.Println("Fail to repair replicas of user", owner.Hex(), "by error", err.Error())
+			}
+		}()
+		c.JSON(202, gin.H{"success": true})
+	})
+}
+
+func abortReplicationError(c *gin.Context, err error) {
+	status := 500
+	switch err {
+	case mongo.ErrNoDocuments:
+		status = 404
+	case service.ErrInvalidReplicaCount:
+		status = 400
+	case service.ErrNoSuitableAccount, service.ErrNoHealthyCopy:
+		status = 409
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
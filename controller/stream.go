@@ -1,30 +1,178 @@
 package controller
 
 import (
-	"github.com/ndphu/drive-manager-api/service"
 	"github.com/gin-gonic/gin"
+	"github.com/ndphu/drive-manager-api/service"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
 )
 
+type StreamSessionRequest struct {
+	FileIndexId string `json:"fileIndexId"`
+	TTL         int64  `json:"ttl"`
+}
+
+var forwardedRequestHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"}
+
+var forwardedResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified", "Cache-Control"}
+
 func StreamController(r *gin.RouterGroup) error {
 	redisService, err := service.GetRedisService()
 	if err != nil {
 		panic(err)
 	}
-	r.GET("/:id", func(c *gin.Context) {
+	streamService := service.GetStreamService()
+	contentService := service.GetContentService()
+	handler := func(c *gin.Context) {
 		fileId := c.Param("id")
+		if session, err := streamService.GetSession(fileId); err == nil && (session.Storage != "" || session.Proxied) {
+			streamContent(c, contentService, session)
+			return
+		}
+		if err := streamService.RefreshIfNeeded(fileId); err != nil {
+			log.Println("Fail to refresh stream session", fileId, "by error", err.Error())
+		}
 		authCookie, err := redisService.Get("file:" + fileId + ":auth")
 		if err != nil || authCookie == "" {
-			c.JSON(500, gin.H{"error": "stream " + fileId + " not found"})
+			c.JSON(404, gin.H{"error": "stream " + fileId + " not found"})
 			return
 		}
 		url, err := redisService.Get("file:" + fileId + ":url")
 		if err != nil || url == "" {
-			c.JSON(500, gin.H{"error": "stream " + fileId + " not found"})
+			c.JSON(404, gin.H{"error": "stream " + fileId + " not found"})
 			return
 		}
 
-		//stream(c, url, authCookie)
-	})
+		stream(c, url, authCookie)
+	}
+	r.GET("/:id", handler)
+	r.HEAD("/:id", handler)
 
 	return nil
 }
+
+func StreamSessionController(r *gin.RouterGroup) {
+	streamService := service.GetStreamService()
+
+	r.POST("/sessions", func(c *gin.Context) {
+		var req StreamSessionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		session, err := streamService.CreateSession(CurrentUser(c).Id, req.FileIndexId, time.Duration(req.TTL)*time.Second)
+		if err != nil {
+			status := 500
+			if err == mongo.ErrNoDocuments {
+				status = 404
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "session": session})
+	})
+
+	r.GET("/sessions", func(c *gin.Context) {
+		sessions, err := streamService.ListSessions(CurrentUser(c).Id)
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "sessions": sessions})
+	})
+
+	r.DELETE("/sessions/:id", func(c *gin.Context) {
+		if err := streamService.RevokeSession(CurrentUser(c).Id, c.Param("id")); err != nil {
+			status := 500
+			if err == service.ErrStreamSessionNotFound {
+				status = 404
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true})
+	})
+}
+
+// streamContent serves sessions whose file has no single Drive url, like chunked or erasure coded files.
+func streamContent(c *gin.Context, contentService *service.ContentService, session *service.StreamSession) {
+	fi, err := contentService.FindFileIndex(session.FileIndexId)
+	if err != nil {
+		c.AbortWithStatusJSON(404, gin.H{"error": "stream " + session.Id + " not found"})
+		return
+	}
+	res, err := contentService.Open(fi, c.GetHeader("Range"))
+	if err != nil {
+		log.Println("Fail to open file", fi.Id.Hex(), "for stream", session.Id, "by error", err.Error())
+		c.AbortWithStatusJSON(502, gin.H{"error": "fail to read file"})
+		return
+	}
+	defer res.Body.Close()
+	writeMediaResponse(c, res)
+}
+
+func stream(c *gin.Context, url string, authCookie string) {
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, url, nil)
+	if err != nil {
+		c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !strings.HasPrefix(authCookie, "Bearer ") {
+		authCookie = "Bearer " + authCookie
+	}
+	req.Header.Set("Authorization", authCookie)
+	for _, h := range forwardedRequestHeaders {
+		if v := c.GetHeader(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if c.Request.Context().Err() != nil {
+			log.Println("Client disconnected before stream started", c.Request.URL.Path)
+			return
+		}
+		log.Println("Fail to request stream upstream by error", err.Error())
+		c.AbortWithStatusJSON(502, gin.H{"error": "fail to reach upstream"})
+		return
+	}
+	defer res.Body.Close()
+	writeMediaResponse(c, res)
+}
+
+// writeMediaResponse relays status, media headers and body of an upstream response. Upstream
+// errors are reported without their body so nothing from Google leaks to the client.
+func writeMediaResponse(c *gin.Context, res *http.Response) {
+	if res.StatusCode >= 400 && res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		log.Println("Upstream responded", res.Status, "for", c.Request.URL.Path)
+		status := res.StatusCode
+		if status != 404 {
+			status = 502
+		}
+		c.AbortWithStatusJSON(status, gin.H{"error": "upstream responded " + res.Status})
+		return
+	}
+	for _, h := range forwardedResponseHeaders {
+		if v := res.Header.Get(h); v != "" {
+			c.Header(h, v)
+		}
+	}
+	if res.Header.Get("Accept-Ranges") == "" {
+		c.Header("Accept-Ranges", "bytes")
+	}
+	c.Status(res.StatusCode)
+	if c.Request.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(c.Writer, res.Body); err != nil {
+		if c.Request.Context().Err() != nil {
+			log.Println("Client disconnected while streaming", c.Request.URL.Path)
+		} else {
+			log.Println("Fail to stream", c.Request.URL.Path, "by error", err.Error())
+		}
+	}
+}
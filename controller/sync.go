@@ -3,18 +3,23 @@ package controller
 import (
 	"github.com/ndphu/drive-manager-api/service"
 	"github.com/gin-gonic/gin"
+	"strconv"
 )
 
 func SyncController(r *gin.RouterGroup) {
-	s := service.ProjectService{}
+	s := service.GetProjectService()
 
 	r.POST("/project/:id", func(c *gin.Context) {
 		user := CurrentUser(c)
 		projectId := c.Param("id")
-		if err := s.SyncProject(projectId, user.Id.Hex()); err != nil {
-			c.AbortWithStatusJSON(500, gin.H{"error": err})
-		} else {
-			c.JSON(200, gin.H{"success": true})
+		full := c.Query("full") == "true"
+		job, err := s.EnqueueProjectJob(user.Id, projectId, service.JobSyncProject, map[string]string{
+			"full": strconv.FormatBool(full),
+		})
+		if err != nil {
+			abortProjectJobError(c, err)
+			return
 		}
+		c.JSON(202, gin.H{"success": true, "job": job})
 	})
 }
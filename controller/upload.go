@@ -1,24 +1,40 @@
 package controller
 
 import (
-	"context"
 	"github.com/gin-gonic/gin"
-	"github.com/ndphu/drive-manager-api/dao"
-	"github.com/ndphu/drive-manager-api/entity"
 	"github.com/ndphu/drive-manager-api/service"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type FileUploadRequest struct {
-	Name string `json:"name"`
-	Size int64  `json:"size"`
-	Type string `json:"type"`
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	Type         string `json:"type"`
+	StorageClass string `json:"storageClass"`
+	DataShards   int    `json:"dataShards"`
+	ParityShards int    `json:"parityShards"`
+	// placement strategy for this upload, the user's one when empty
+	PlacementStrategy string `json:"placementStrategy"`
+	FolderId          string `json:"folderId"`
+}
+
+func (ur *FileUploadRequest) folderId() (*primitive.ObjectID, error) {
+	if ur.FolderId == "" {
+		return nil, nil
+	}
+	hex, err := primitive.ObjectIDFromHex(ur.FolderId)
+	if err != nil {
+		return nil, err
+	}
+	return &hex, nil
 }
 
 type UploadResponse struct {
 	AccessToken string `json:"accessToken"`
 	AccountId   string `json:"accountId"`
+	// pass back as ?reservationId= when syncing the uploaded file
+	ReservationId string `json:"reservationId"`
 }
 
 func UploadController(r *gin.RouterGroup) {
@@ -31,52 +47,182 @@ func UploadController(r *gin.RouterGroup) {
 			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		var accounts []entity.DriveAccount
-		uploadBuffer := int64(3221223823) // 3GB
-		if cursor, err := dao.DriveAccount().Aggregate(context.Background(), mongo.Pipeline{
-			{
-				{"$match", bson.D{
-					{"owner", user.Id},
-					{"type", "service_account"},
-					{"disabled", bson.D{{"$ne", true}}},
-					{"available", bson.D{{"$gt", ur.Size + uploadBuffer}}},
-				},
-				}},
-			{{"$sample", bson.D{{"size", 1}}}},
-			{{
-				"$project", bson.D{
-					{"_id", 1},
-					{"key", 1},
-					{"projectId", 1},
-					{"usage", 1},
-					{"available", 1},
-					{"limit", 1},
-				},
-			}}}); err != nil {
-			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+		folderId, err := ur.folderId()
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
 			return
-		} else if err := cursor.All(context.Background(), &accounts); err != nil {
+		}
+		// the client uploads with the access token, so only Drive accounts will do
+		placement, err := accountService.ReserveUpload(&service.PlacementRequest{
+			Owner:     user.Id,
+			Size:      ur.Size,
+			FolderId:  folderId,
+			DriveOnly: true,
+		}, ur.PlacementStrategy)
+		if err != nil {
+			abortPlacementError(c, err)
+			return
+		}
+		account := placement.Account
+		token, err := accountService.GetAccessToken(account)
+		if err != nil {
+			service.GetQuotaService().Release(placement.Reservation.Id)
 			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
 			return
 		}
+		c.JSON(200, gin.H{
+			"uploadInfo": UploadResponse{
+				AccessToken:   token,
+				AccountId:     account.Id.Hex(),
+				ReservationId: placement.Reservation.Id.Hex(),
+			},
+		})
+	})
 
-		for _, account := range accounts {
-			if account.Limit-account.Usage > ur.Size {
-				// pickup account
-				token, err := accountService.GetAccessToken(&account)
-				if err != nil {
-					// going to next account
-					continue
-				}
-				c.JSON(200, gin.H{
-					"uploadInfo": UploadResponse{
-						AccessToken: token,
-						AccountId:   account.Id.Hex(),
-					},
-				})
-				return
+	r.DELETE("/reservation/:id", func(c *gin.Context) {
+		hex, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if err := service.GetQuotaService().ReleaseOwned(CurrentUser(c).Id, hex); err != nil {
+			status := 500
+			if err == mongo.ErrNoDocuments {
+				status = 404
 			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
 		}
-		c.AbortWithStatusJSON(500, gin.H{"error": "cannot find suitable account for upload request"})
+		c.JSON(200, gin.H{"success": true})
 	})
+
+	// dry run: which account an upload would go to, and why
+	r.POST("/placement", func(c *gin.Context) {
+		var ur FileUploadRequest
+		if err := c.ShouldBindJSON(&ur); err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		folderId, err := ur.folderId()
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		placement, err := accountService.PlaceUpload(&service.PlacementRequest{
+			Owner:    CurrentUser(c).Id,
+			Size:     ur.Size,
+			FolderId: folderId,
+		}, ur.PlacementStrategy)
+		if err != nil {
+			abortPlacementError(c, err)
+			return
+		}
+		placement.Account.Key = ""
+		c.JSON(200, gin.H{"placement": placement})
+	})
+
+	r.GET("/placement/strategy", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"strategy":   service.UserPlacementStrategy(CurrentUser(c).Id),
+			"strategies": service.PlacementStrategies(),
+		})
+	})
+
+	r.PUT("/placement/strategy", func(c *gin.Context) {
+		var req struct {
+			Strategy string `json:"strategy"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if err := service.SetUserPlacementStrategy(CurrentUser(c).Id, req.Strategy); err != nil {
+			abortPlacementError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "strategy": service.UserPlacementStrategy(CurrentUser(c).Id)})
+	})
+
+	// proxied resumable upload: the API talks to Drive, the client never sees account credentials
+	uploadService := service.GetUploadService()
+
+	r.POST("/sessions", func(c *gin.Context) {
+		var ur FileUploadRequest
+		if err := c.ShouldBindJSON(&ur); err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		folderId, err := ur.folderId()
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		var state *service.UploadState
+		if ur.StorageClass == service.StorageErasure {
+			state, err = uploadService.StartErasure(CurrentUser(c).Id, ur.Name, ur.Size, ur.Type, ur.DataShards, ur.ParityShards)
+		} else {
+			state, err = uploadService.Start(CurrentUser(c).Id, ur.Name, ur.Size, ur.Type, ur.PlacementStrategy, folderId)
+		}
+		if err != nil {
+			status := 500
+			if err == service.ErrInvalidErasureCoding || err == service.ErrUnknownPlacementStrategy {
+				status = 400
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "upload": state})
+	})
+
+	r.PUT("/sessions/:id", func(c *gin.Context) {
+		state, err := uploadService.WriteChunk(CurrentUser(c).Id, c.Param("id"), c.GetHeader("Content-Range"), c.Request.Body)
+		if err != nil {
+			abortUploadError(c, state, err)
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "upload": state})
+	})
+
+	r.GET("/sessions/:id", func(c *gin.Context) {
+		state, err := uploadService.Status(CurrentUser(c).Id, c.Param("id"))
+		if err != nil {
+			abortUploadError(c, state, err)
+			return
+		}
+		c.JSON(200, gin.H{"success": true, "upload": state})
+	})
+
+	r.DELETE("/sessions/:id", func(c *gin.Context) {
+		if err := uploadService.Cancel(CurrentUser(c).Id, c.Param("id")); err != nil {
+			abortUploadError(c, nil, err)
+			return
+		}
+		c.JSON(200, gin.H{"success": true})
+	})
+}
+
+func abortPlacementError(c *gin.Context, err error) {
+	status := 500
+	switch err {
+	case service.ErrUnknownPlacementStrategy:
+		status = 400
+	case service.ErrNoSuitableAccount:
+		status = 507
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
+
+func abortUploadError(c *gin.Context, state *service.UploadState, err error) {
+	status := 500
+	switch err {
+	case service.ErrUploadNotFound:
+		status = 404
+	case service.ErrUploadOffsetMismatch, service.ErrTooManyShardsLost:
+		status = 409
+	case service.ErrInvalidContentRange:
+		status = 416
+	case service.ErrInvalidChunkSize:
+		status = 400
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error(), "upload": state})
 }
@@ -18,6 +18,54 @@ func FileIndex() *mongo.Collection {
 	return RawCollection("file_index")
 }
 
+func FileManifest() *mongo.Collection {
+	return RawCollection("file_manifest")
+}
+
+func ErasureLayout() *mongo.Collection {
+	return RawCollection("erasure_layout")
+}
+
+func RebalanceRun() *mongo.Collection {
+	return RawCollection("rebalance_run")
+}
+
+func AccountRetirement() *mongo.Collection {
+	return RawCollection("account_retirement")
+}
+
+func QuotaReservation() *mongo.Collection {
+	return RawCollection("quota_reservation")
+}
+
+func QuotaRefreshRun() *mongo.Collection {
+	return RawCollection("quota_refresh_run")
+}
+
+func Job() *mongo.Collection {
+	return RawCollection("job")
+}
+
+func ReconcilePlan() *mongo.Collection {
+	return RawCollection("reconcile_plan")
+}
+
+func ProvisionEvent() *mongo.Collection {
+	return RawCollection("provision_event")
+}
+
+func ExpansionPolicy() *mongo.Collection {
+	return RawCollection("expansion_policy")
+}
+
+func Expansion() *mongo.Collection {
+	return RawCollection("expansion")
+}
+
+func Keyring() *mongo.Collection {
+	return RawCollection("keyring")
+}
+
 func FirebaseAdmin() *mongo.Collection {
 	return RawCollection("firebase_admin")
 }
@@ -46,3 +94,7 @@ func FirebaseConfig() *mongo.Collection {
 	return RawCollection("firebase_config")
 }
 
+
+func ReplicationPolicy() *mongo.Collection {
+	return RawCollection("replication_policy")
+}
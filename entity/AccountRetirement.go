@@ -0,0 +1,30 @@
+package entity
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// AccountRetirement records the progress of retiring a DriveAccount, one entry per step,
+// so a failed retirement resumes from the first step not done.
+type AccountRetirement struct {
+	Id          primitive.ObjectID `json:"id" bson:"_id"`
+	AccountId   primitive.ObjectID `json:"accountId" bson:"accountId"`
+	Owner       primitive.ObjectID `json:"owner" bson:"owner"`
+	ProjectId   primitive.ObjectID `json:"projectId" bson:"projectId"`
+	ClientEmail string             `json:"clientEmail" bson:"clientEmail"`
+	Status      string             `json:"status" bson:"status"`
+	Steps       []RetirementStep   `json:"steps" bson:"steps"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt   time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+type RetirementStep struct {
+	Name       string     `json:"name" bson:"name"`
+	Status     string     `json:"status" bson:"status"`
+	Detail     string     `json:"detail,omitempty" bson:"detail,omitempty"`
+	Error      string     `json:"error,omitempty" bson:"error,omitempty"`
+	Attempts   int        `json:"attempts" bson:"attempts"`
+	StartedAt  *time.Time `json:"startedAt,omitempty" bson:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty" bson:"finishedAt,omitempty"`
+}
@@ -13,10 +13,19 @@ type DriveAccount struct {
 	ClientEmail          string        `json:"clientEmail" bson:"clientEmail"`
 	ClientId             string        `json:"clientId" bson:"clientId"`
 	Key                  string        `json:"key,omitempty" bson:"key"`
+	KeyCreatedAt         *time.Time    `json:"keyCreatedAt,omitempty" bson:"keyCreatedAt,omitempty"`
 	Usage                int64         `json:"usage" bson:"usage"`
 	Available            int64         `json:"available" bson:"available"`
 	Limit                int64         `json:"limit" bson:"limit"`
+	Reserved             int64         `json:"reserved" bson:"reserved,omitempty"`
 	Owner                primitive.ObjectID `json:"owner" bson:"owner"`
 	ProjectId            primitive.ObjectID `json:"projectId" bson:"projectId"`
 	QuotaUpdateTimestamp time.Time     `json:"quotaUpdateTimestamp" bson:"quotaUpdateTimestamp"`
+	Disabled             bool          `json:"disabled" bson:"disabled,omitempty"`
+	ReadOnly             bool          `json:"readOnly" bson:"readOnly,omitempty"`
+	HealthStatus         string        `json:"healthStatus,omitempty" bson:"healthStatus,omitempty"`
+	HealthError          string        `json:"healthError,omitempty" bson:"healthError,omitempty"`
+	HealthCheckedAt      *time.Time    `json:"healthCheckedAt,omitempty" bson:"healthCheckedAt,omitempty"`
+	ChangesPageToken     string        `json:"-" bson:"changesPageToken,omitempty"`
+	ChangesSyncTimestamp time.Time     `json:"changesSyncTimestamp" bson:"changesSyncTimestamp,omitempty"`
 }
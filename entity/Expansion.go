@@ -0,0 +1,26 @@
+package entity
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// Expansion is one automatic provisioning of new accounts, split over the projects with room left.
+type Expansion struct {
+	Id           primitive.ObjectID    `json:"id" bson:"_id"`
+	Owner        primitive.ObjectID    `json:"owner" bson:"owner"`
+	Trigger      string                `json:"trigger" bson:"trigger"`
+	Available    int64                 `json:"available" bson:"available"`
+	MinAvailable int64                 `json:"minAvailable" bson:"minAvailable"`
+	Requested    int                   `json:"requested" bson:"requested"`
+	Allocations  []ExpansionAllocation `json:"allocations" bson:"allocations"`
+	Error        string                `json:"error,omitempty" bson:"error,omitempty"`
+	CreatedAt    time.Time             `json:"createdAt" bson:"createdAt"`
+}
+
+type ExpansionAllocation struct {
+	ProjectId primitive.ObjectID  `json:"projectId" bson:"projectId"`
+	Accounts  int                 `json:"accounts" bson:"accounts"`
+	JobId     *primitive.ObjectID `json:"jobId,omitempty" bson:"jobId,omitempty"`
+	Error     string              `json:"error,omitempty" bson:"error,omitempty"`
+}
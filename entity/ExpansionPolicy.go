@@ -0,0 +1,18 @@
+package entity
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// ExpansionPolicy provisions new accounts for the user once the available space of the enabled
+// accounts falls below MinAvailable.
+type ExpansionPolicy struct {
+	Id                   primitive.ObjectID `json:"id" bson:"_id"`
+	Owner                primitive.ObjectID `json:"owner" bson:"owner"`
+	Enabled              bool               `json:"enabled" bson:"enabled"`
+	MinAvailable         int64              `json:"minAvailable" bson:"minAvailable"`
+	AccountsPerExpansion int                `json:"accountsPerExpansion" bson:"accountsPerExpansion"`
+	MaxAccounts          int                `json:"maxAccounts" bson:"maxAccounts"`
+	UpdatedAt            time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
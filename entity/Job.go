@@ -0,0 +1,38 @@
+package entity
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// Job is a long operation run by the background workers instead of the HTTP request.
+type Job struct {
+	Id              primitive.ObjectID `json:"id" bson:"_id"`
+	Owner           primitive.ObjectID `json:"owner" bson:"owner"`
+	Type            string             `json:"type" bson:"type"`
+	Params          map[string]string  `json:"params" bson:"params"`
+	Status          string             `json:"status" bson:"status"`
+	Total           int                `json:"total" bson:"total"`
+	Done            int                `json:"done" bson:"done"`
+	Failed          int                `json:"failed" bson:"failed"`
+	Errors          []JobItemError     `json:"errors,omitempty" bson:"errors,omitempty"`
+	Error           string             `json:"error,omitempty" bson:"error,omitempty"`
+	Attempts        int                `json:"attempts" bson:"attempts"`
+	MaxAttempts     int                `json:"maxAttempts" bson:"maxAttempts"`
+	CancelRequested bool               `json:"cancelRequested" bson:"cancelRequested"`
+	RunAfter        time.Time          `json:"runAfter" bson:"runAfter"`
+	CreatedAt       time.Time          `json:"createdAt" bson:"createdAt"`
+	StartedAt       *time.Time         `json:"startedAt,omitempty" bson:"startedAt,omitempty"`
+	FinishedAt      *time.Time         `json:"finishedAt,omitempty" bson:"finishedAt,omitempty"`
+	UpdatedAt       time.Time          `json:"updatedAt" bson:"updatedAt"`
+	// the worker running the job holds it until LeaseUntil, renewing it while running
+	WorkerId   string     `json:"workerId,omitempty" bson:"workerId,omitempty"`
+	LeaseUntil *time.Time `json:"leaseUntil,omitempty" bson:"leaseUntil,omitempty"`
+}
+
+type JobItemError struct {
+	Item    string    `json:"item" bson:"item"`
+	Error   string    `json:"error" bson:"error"`
+	Attempt int       `json:"attempt" bson:"attempt"`
+	At      time.Time `json:"at" bson:"at"`
+}
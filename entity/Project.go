@@ -8,4 +8,5 @@ type Project struct {
 	Owner       primitive.ObjectID `json:"owner" bson:"owner"`
 	ProjectId   string        `json:"projectId" bson:"projectId"`
 	AdminKey   string        `json:"adminKey,omitempty" bson:"adminKey,omitempty"`
+	Type        string        `json:"type,omitempty" bson:"type,omitempty"`
 }
@@ -0,0 +1,24 @@
+package entity
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// ProvisionEvent records one step of creating a service account for a project. The events of a
+// provisioning job tell where each account got to, so an interrupted job can pick up from there.
+type ProvisionEvent struct {
+	Id          primitive.ObjectID `json:"id" bson:"_id"`
+	JobId       primitive.ObjectID `json:"jobId" bson:"jobId"`
+	ProjectId   primitive.ObjectID `json:"projectId" bson:"projectId"`
+	Owner       primitive.ObjectID `json:"owner" bson:"owner"`
+	Slot        int                `json:"slot" bson:"slot"`
+	AccountName string             `json:"accountName" bson:"accountName"`
+	Email       string             `json:"email,omitempty" bson:"email,omitempty"`
+	KeyId       string             `json:"keyId,omitempty" bson:"keyId,omitempty"`
+	Step        string             `json:"step" bson:"step"`
+	Status      string             `json:"status" bson:"status"`
+	Error       string             `json:"error,omitempty" bson:"error,omitempty"`
+	Attempt     int                `json:"attempt" bson:"attempt"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+}
@@ -0,0 +1,25 @@
+package entity
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// QuotaRefreshRun is one pass of the background quota refresher over the stale accounts.
+type QuotaRefreshRun struct {
+	Id         primitive.ObjectID  `json:"id" bson:"_id"`
+	Trigger    string              `json:"trigger" bson:"trigger"`
+	Status     string              `json:"status" bson:"status"`
+	MaxAge     string              `json:"maxAge" bson:"maxAge"`
+	Candidates int                 `json:"candidates" bson:"candidates"`
+	Refreshed  int                 `json:"refreshed" bson:"refreshed"`
+	Failed     int                 `json:"failed" bson:"failed"`
+	Errors     []QuotaRefreshError `json:"errors,omitempty" bson:"errors,omitempty"`
+	StartedAt  time.Time           `json:"startedAt" bson:"startedAt"`
+	FinishedAt *time.Time          `json:"finishedAt,omitempty" bson:"finishedAt,omitempty"`
+}
+
+type QuotaRefreshError struct {
+	AccountId primitive.ObjectID `json:"accountId" bson:"accountId"`
+	Error     string             `json:"error" bson:"error"`
+}
@@ -0,0 +1,20 @@
+package entity
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// QuotaReservation holds bytes of an account for an upload in flight. The bytes are taken from
+// the account available space when reserved and given back if the upload never completes.
+type QuotaReservation struct {
+	Id          primitive.ObjectID `json:"id" bson:"_id"`
+	AccountId   primitive.ObjectID `json:"accountId" bson:"accountId"`
+	Owner       primitive.ObjectID `json:"owner" bson:"owner"`
+	Size        int64              `json:"size" bson:"size"`
+	Status      string             `json:"status" bson:"status"`
+	FileId      string             `json:"fileId,omitempty" bson:"fileId,omitempty"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt   time.Time          `json:"expiresAt" bson:"expiresAt"`
+	CompletedAt *time.Time         `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+}
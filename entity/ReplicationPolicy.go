@@ -0,0 +1,16 @@
+package entity
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// ReplicationPolicy sets how many copies of a file are kept. A policy without FolderId is the
+// user default, a folder policy applies to everything below that folder.
+type ReplicationPolicy struct {
+	Id        primitive.ObjectID  `json:"id" bson:"_id"`
+	Owner     primitive.ObjectID  `json:"owner" bson:"owner"`
+	FolderId  *primitive.ObjectID `json:"folderId,omitempty" bson:"folderId"`
+	Replicas  int                 `json:"replicas" bson:"replicas"`
+	UpdatedAt time.Time           `json:"updatedAt" bson:"updatedAt"`
+}
@@ -9,4 +9,5 @@ type User struct {
 	Email string `json:"email" bson:"email"`
 	DisplayName string `json:"displayName" bson:"displayName"`
 	Roles []string `json:"roles" bson:"roles"`
+	PlacementStrategy string `json:"placementStrategy,omitempty" bson:"placementStrategy,omitempty"`
 }
@@ -0,0 +1,120 @@
+package helper
+
+import (
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"io"
+	"net/http"
+)
+
+// DriveBackend is the set of Drive operations the services rely on.
+// DriveService is the Google implementation, LocalBackend and S3Backend store files in a
+// directory or a bucket, FakeDriveBackend keeps everything in memory.
+type DriveBackend interface {
+	GetQuotaUsage() (*Quota, error)
+	ListFilePage(opts ListOptions) (*FilePage, error)
+	GetFile(fileId string) (*drive.File, error)
+	UploadFileFromStream(name string, description string, mimeType string, is io.Reader) (*drive.File, error)
+	Download(fileId string, byteRange string) (*http.Response, error)
+	DeleteFile(fileId string) error
+	CreatePermission(fileId string, perm *drive.Permission) (*drive.Permission, error)
+	GetAccessToken() (string, error)
+	GetToken() (*oauth2.Token, error)
+	GetStartPageToken() (string, error)
+	ListChanges(pageToken string) (*ChangePage, error)
+	CreateUploadSession(name string, mimeType string, size int64) (string, error)
+	UploadChunk(sessionUri string, chunk io.Reader, start int64, end int64, total int64) (*UploadProgress, error)
+	QueryUpload(sessionUri string, total int64) (*UploadProgress, error)
+	CancelUpload(sessionUri string) error
+}
+
+var _ DriveBackend = (*DriveService)(nil)
+
+// NewDriveBackend builds the backend for an account key, chosen by the type of the key. It can be
+// swapped to return fakes when running offline.
+var NewDriveBackend = func(key []byte) (DriveBackend, error) {
+	switch KeyType(key) {
+	case KeyTypeLocal:
+		return NewLocalBackend(key)
+	case KeyTypeS3:
+		return NewS3Backend(key)
+	}
+	return GetDriveService(key)
+}
+
+const DefaultListFields = "id, name, size, mimeType, createdTime, modifiedTime, md5Checksum"
+
+const DefaultListPageSize = 100
+
+// ListOptions selects one page of a Drive listing. PageToken is the opaque cursor
+// returned as NextPageToken by the previous page, empty for the first page.
+type ListOptions struct {
+	Query     string
+	Fields    string
+	PageSize  int64
+	PageToken string
+}
+
+// QueryNotTrashed lists only the files outside the trash.
+const QueryNotTrashed = "trashed = false"
+
+type FilePage struct {
+	Files         []*File `json:"files"`
+	NextPageToken string  `json:"nextPageToken,omitempty"`
+}
+
+func (o ListOptions) fields() string {
+	if o.Fields == "" {
+		return DefaultListFields
+	}
+	return o.Fields
+}
+
+func (o ListOptions) pageSize() int64 {
+	if o.PageSize <= 0 {
+		return DefaultListPageSize
+	}
+	return o.PageSize
+}
+
+// EachFile walks every page of the listing by following NextPageToken, stopping at the first error.
+func EachFile(backend DriveBackend, opts ListOptions, fn func(file *File) error) error {
+	for {
+		page, err := backend.ListFilePage(opts)
+		if err != nil {
+			return err
+		}
+		for _, file := range page.Files {
+			if err := fn(file); err != nil {
+				return err
+			}
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		opts.PageToken = page.NextPageToken
+	}
+}
+
+// Change is one entry of the Drive changes feed. File is nil when the file was removed.
+type Change struct {
+	FileId  string `json:"fileId"`
+	Removed bool   `json:"removed"`
+	Trashed bool   `json:"trashed"`
+	File    *File  `json:"file,omitempty"`
+}
+
+// ChangePage holds either NextPageToken (more changes to read) or NewStartPageToken
+// (caught up, token to store for the next sync).
+type ChangePage struct {
+	Changes           []*Change `json:"changes"`
+	NextPageToken     string    `json:"nextPageToken,omitempty"`
+	NewStartPageToken string    `json:"newStartPageToken,omitempty"`
+}
+
+// UploadProgress reports a resumable upload: Offset is the next byte expected,
+// File is set once the last byte has been received.
+type UploadProgress struct {
+	Offset int64       `json:"offset"`
+	File   *drive.File `json:"file,omitempty"`
+}
@@ -0,0 +1,485 @@
+package helper
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FakeOpQuota      = "quota"
+	FakeOpList       = "list"
+	FakeOpGet        = "get"
+	FakeOpUpload     = "upload"
+	FakeOpDownload   = "download"
+	FakeOpDelete     = "delete"
+	FakeOpPermission = "permission"
+	FakeOpToken      = "token"
+	FakeOpChanges    = "changes"
+)
+
+type FakeFile struct {
+	File        *drive.File
+	Content     []byte
+	Permissions []*drive.Permission
+}
+
+// FakeDriveBackend is an in-memory DriveBackend. Errors can be injected per operation
+// with FailWith (every call) or FailNext (next call only).
+type FakeDriveBackend struct {
+	Limit int64
+
+	mu        sync.Mutex
+	files     map[string]*FakeFile
+	errors    map[string]error
+	nextError map[string]error
+	sequence  int
+	changes   []*Change
+	uploads   map[string]*fakeUpload
+}
+
+type fakeUpload struct {
+	name     string
+	mimeType string
+	size     int64
+	content  []byte
+}
+
+func NewFakeDriveBackend(limit int64) *FakeDriveBackend {
+	return &FakeDriveBackend{
+		Limit:     limit,
+		files:     make(map[string]*FakeFile),
+		errors:    make(map[string]error),
+		nextError: make(map[string]error),
+		uploads:   make(map[string]*fakeUpload),
+	}
+}
+
+func (f *FakeDriveBackend) FailWith(op string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.errors, op)
+	} else {
+		f.errors[op] = err
+	}
+}
+
+func (f *FakeDriveBackend) FailNext(op string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextError[op] = err
+}
+
+func (f *FakeDriveBackend) PutFile(name string, mimeType string, content []byte) *drive.File {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.insert(name, "", mimeType, content)
+}
+
+func (f *FakeDriveBackend) Files() []*FakeFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	files := make([]*FakeFile, 0, len(f.files))
+	for _, file := range f.files {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].File.Id < files[j].File.Id })
+	return files
+}
+
+func (f *FakeDriveBackend) injected(op string) error {
+	if err, ok := f.nextError[op]; ok {
+		delete(f.nextError, op)
+		return err
+	}
+	return f.errors[op]
+}
+
+func (f *FakeDriveBackend) usage() int64 {
+	var usage int64
+	for _, file := range f.files {
+		usage += int64(len(file.Content))
+	}
+	return usage
+}
+
+func (f *FakeDriveBackend) insert(name string, description string, mimeType string, content []byte) *drive.File {
+	f.sequence++
+	now := time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	file := &drive.File{
+		Id:           fmt.Sprintf("fake-%06d", f.sequence),
+		Name:         name,
+		Description:  description,
+		MimeType:     mimeType,
+		Size:         int64(len(content)),
+		CreatedTime:  now,
+		ModifiedTime: now,
+		Md5Checksum:  fmt.Sprintf("%x", md5.Sum(content)),
+	}
+	f.files[file.Id] = &FakeFile{File: file, Content: content}
+	f.changes = append(f.changes, &Change{FileId: file.Id, File: toFile(file)})
+	return file
+}
+
+func (f *FakeDriveBackend) Rename(fileId string, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := f.find(fileId)
+	if err != nil {
+		return err
+	}
+	file.File.Name = name
+	file.File.ModifiedTime = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	f.changes = append(f.changes, &Change{FileId: fileId, File: toFile(file.File)})
+	return nil
+}
+
+// Trash moves the file to the trash: it stays in the listing unless QueryNotTrashed is asked,
+// and the changes feed reports it trashed.
+func (f *FakeDriveBackend) Trash(fileId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := f.find(fileId)
+	if err != nil {
+		return err
+	}
+	file.File.Trashed = true
+	f.changes = append(f.changes, &Change{FileId: fileId, Trashed: true, File: toFile(file.File)})
+	return nil
+}
+
+func (f *FakeDriveBackend) find(fileId string) (*FakeFile, error) {
+	file, ok := f.files[fileId]
+	if !ok {
+		return nil, &googleapi.Error{Code: 404, Message: "File not found: " + fileId}
+	}
+	return file, nil
+}
+
+func (f *FakeDriveBackend) GetQuotaUsage() (*Quota, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injected(FakeOpQuota); err != nil {
+		return nil, err
+	}
+	usage := f.usage()
+	return &Quota{
+		Limit:   f.Limit,
+		Usage:   usage,
+		Percent: fmt.Sprintf("%.3f", float64(usage)*100/float64(f.Limit)),
+	}, nil
+}
+
+// ListFilePage pages through the files ordered by id. The page token is the offset of the next
+// file; of the queries only QueryNotTrashed is evaluated.
+func (f *FakeDriveBackend) ListFilePage(opts ListOptions) (*FilePage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injected(FakeOpList); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(f.files))
+	for id, file := range f.files {
+		if opts.Query == QueryNotTrashed && file.File.Trashed {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	offset := 0
+	if opts.PageToken != "" {
+		parsed, err := strconv.Atoi(opts.PageToken)
+		if err != nil || parsed < 0 {
+			return nil, &googleapi.Error{Code: 400, Message: "Invalid page token: " + opts.PageToken}
+		}
+		offset = parsed
+	}
+	page := &FilePage{Files: make([]*File, 0)}
+	for i := offset; i < len(ids) && int64(len(page.Files)) < opts.pageSize(); i++ {
+		page.Files = append(page.Files, toFile(f.files[ids[i]].File))
+	}
+	if next := offset + len(page.Files); next < len(ids) {
+		page.NextPageToken = strconv.Itoa(next)
+	}
+	return page, nil
+}
+
+func (f *FakeDriveBackend) GetFile(fileId string) (*drive.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injected(FakeOpGet); err != nil {
+		return nil, err
+	}
+	file, err := f.find(fileId)
+	if err != nil {
+		return nil, err
+	}
+	copied := *file.File
+	return &copied, nil
+}
+
+func (f *FakeDriveBackend) UploadFileFromStream(name string, description string, mimeType string, is io.Reader) (*drive.File, error) {
+	content, err := ioutil.ReadAll(is)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injected(FakeOpUpload); err != nil {
+		return nil, err
+	}
+	if f.usage()+int64(len(content)) > f.Limit {
+		return nil, &googleapi.Error{
+			Code:    403,
+			Message: "The user's Drive storage quota has been exceeded.",
+			Errors:  []googleapi.ErrorItem{{Reason: "storageQuotaExceeded"}},
+		}
+	}
+	file := f.insert(name, description, mimeType, content)
+	copied := *file
+	return &copied, nil
+}
+
+func (f *FakeDriveBackend) Download(fileId string, byteRange string) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injected(FakeOpDownload); err != nil {
+		return nil, err
+	}
+	file, err := f.find(fileId)
+	if err != nil {
+		return nil, err
+	}
+	total := int64(len(file.Content))
+	res := &http.Response{
+		StatusCode: 200,
+		Header:     make(http.Header),
+	}
+	res.Header.Set("Content-Type", file.File.MimeType)
+	start, end := int64(0), total-1
+	if byteRange != "" {
+		start, end, err = parseByteRange(byteRange, total)
+		if err != nil {
+			return nil, &googleapi.Error{Code: 416, Message: err.Error()}
+		}
+		res.StatusCode = 206
+		res.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	}
+	body := file.Content[start : end+1]
+	res.Status = strconv.Itoa(res.StatusCode) + " " + http.StatusText(res.StatusCode)
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+func parseByteRange(byteRange string, total int64) (int64, int64, error) {
+	spec := strings.TrimPrefix(byteRange, "bytes=")
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %q", byteRange)
+	}
+	var start, end int64
+	var err error
+	if parts[0] == "" {
+		suffix, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		start, end = total-suffix, total-1
+	} else {
+		if start, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+			return 0, 0, err
+		}
+		end = total - 1
+		if parts[1] != "" {
+			if end, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("unsatisfiable range %q", byteRange)
+	}
+	return start, end, nil
+}
+
+func (f *FakeDriveBackend) DeleteFile(fileId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injected(FakeOpDelete); err != nil {
+		return err
+	}
+	if _, err := f.find(fileId); err != nil {
+		return err
+	}
+	delete(f.files, fileId)
+	f.changes = append(f.changes, &Change{FileId: fileId, Removed: true})
+	return nil
+}
+
+func (f *FakeDriveBackend) CreatePermission(fileId string, perm *drive.Permission) (*drive.Permission, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injected(FakeOpPermission); err != nil {
+		return nil, err
+	}
+	file, err := f.find(fileId)
+	if err != nil {
+		return nil, err
+	}
+	created := *perm
+	created.Id = fmt.Sprintf("perm-%d", len(file.Permissions)+1)
+	file.Permissions = append(file.Permissions, &created)
+	file.File.Shared = true
+	return &created, nil
+}
+
+func (f *FakeDriveBackend) GetAccessToken() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injected(FakeOpToken); err != nil {
+		return "", err
+	}
+	return "fake-access-token", nil
+}
+
+func (f *FakeDriveBackend) GetToken() (*oauth2.Token, error) {
+	token, err := f.GetAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(time.Hour),
+	}, nil
+}
+
+func (f *FakeDriveBackend) GetStartPageToken() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injected(FakeOpChanges); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(len(f.changes)), nil
+}
+
+// ListChanges uses the position in the change log as page token and returns at most 100 changes per page.
+func (f *FakeDriveBackend) ListChanges(pageToken string) (*ChangePage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injected(FakeOpChanges); err != nil {
+		return nil, err
+	}
+	position, err := strconv.Atoi(pageToken)
+	if err != nil || position < 0 || position > len(f.changes) {
+		return nil, &googleapi.Error{Code: 404, Message: "Invalid page token: " + pageToken}
+	}
+	end := position + 100
+	if end > len(f.changes) {
+		end = len(f.changes)
+	}
+	page := &ChangePage{Changes: make([]*Change, 0, end-position)}
+	for _, change := range f.changes[position:end] {
+		copied := *change
+		page.Changes = append(page.Changes, &copied)
+	}
+	if end < len(f.changes) {
+		page.NextPageToken = strconv.Itoa(end)
+	} else {
+		page.NewStartPageToken = strconv.Itoa(end)
+	}
+	return page, nil
+}
+
+func (f *FakeDriveBackend) CreateUploadSession(name string, mimeType string, size int64) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injected(FakeOpUpload); err != nil {
+		return "", err
+	}
+	f.sequence++
+	uri := fmt.Sprintf("fake-upload://%06d", f.sequence)
+	f.uploads[uri] = &fakeUpload{name: name, mimeType: mimeType, size: size}
+	return uri, nil
+}
+
+// UploadChunk only accepts chunks continuing exactly where the previous one ended.
+func (f *FakeDriveBackend) UploadChunk(sessionUri string, chunk io.Reader, start int64, end int64, total int64) (*UploadProgress, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(chunk, end-start+1))
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injected(FakeOpUpload); err != nil {
+		return nil, err
+	}
+	upload, ok := f.uploads[sessionUri]
+	if !ok {
+		return nil, &googleapi.Error{Code: 404, Message: "Upload session not found"}
+	}
+	if start != int64(len(upload.content)) || total != upload.size || int64(len(content)) != end-start+1 {
+		return nil, &googleapi.Error{Code: 400, Message: "Invalid Content-Range"}
+	}
+	upload.content = append(upload.content, content...)
+	if int64(len(upload.content)) < upload.size {
+		return &UploadProgress{Offset: int64(len(upload.content))}, nil
+	}
+	if f.usage()+upload.size > f.Limit {
+		return nil, &googleapi.Error{
+			Code:    403,
+			Message: "The user's Drive storage quota has been exceeded.",
+			Errors:  []googleapi.ErrorItem{{Reason: "storageQuotaExceeded"}},
+		}
+	}
+	delete(f.uploads, sessionUri)
+	file := f.insert(upload.name, "", upload.mimeType, upload.content)
+	copied := *file
+	return &UploadProgress{Offset: upload.size, File: &copied}, nil
+}
+
+func (f *FakeDriveBackend) QueryUpload(sessionUri string, total int64) (*UploadProgress, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upload, ok := f.uploads[sessionUri]
+	if !ok {
+		return nil, &googleapi.Error{Code: 404, Message: "Upload session not found"}
+	}
+	return &UploadProgress{Offset: int64(len(upload.content))}, nil
+}
+
+func (f *FakeDriveBackend) CancelUpload(sessionUri string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.uploads, sessionUri)
+	return nil
+}
+
+// Uploads counts the resumable sessions neither finished nor cancelled.
+func (f *FakeDriveBackend) Uploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.uploads)
+}
+
+var _ DriveBackend = (*FakeDriveBackend)(nil)
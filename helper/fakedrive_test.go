@@ -0,0 +1,165 @@
+package helper
+
+import (
+	"bytes"
+	"google.golang.org/api/googleapi"
+	"io/ioutil"
+	"testing"
+)
+
+func listAll(t *testing.T, f *FakeDriveBackend, opts ListOptions) []string {
+	var names []string
+	for {
+		page, err := f.ListFilePage(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range page.Files {
+			names = append(names, file.Name)
+		}
+		if page.NextPageToken == "" {
+			return names
+		}
+		opts.PageToken = page.NextPageToken
+	}
+}
+
+func TestFakeListFilePage(t *testing.T) {
+	f := NewFakeDriveBackend(1 << 20)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		f.PutFile(name, "text/plain", []byte(name))
+	}
+	trashed := f.PutFile("trashed", "text/plain", []byte("x"))
+	if err := f.Trash(trashed.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     ListOptions
+		expected int
+	}{
+		{"one page", ListOptions{PageSize: 100}, 6},
+		{"pages of two", ListOptions{PageSize: 2}, 6},
+		{"pages of one", ListOptions{PageSize: 1}, 6},
+		{"not trashed", ListOptions{PageSize: 2, Query: QueryNotTrashed}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := listAll(t, f, tt.opts)
+			if len(names) != tt.expected {
+				t.Fatalf("listed %v, expected %d files", names, tt.expected)
+			}
+			seen := make(map[string]bool)
+			for _, name := range names {
+				if seen[name] {
+					t.Fatalf("%s listed twice", name)
+				}
+				seen[name] = true
+			}
+			if tt.opts.Query == QueryNotTrashed && seen["trashed"] {
+				t.Fatal("trashed file listed")
+			}
+		})
+	}
+}
+
+func TestFakeDownloadRange(t *testing.T) {
+	f := NewFakeDriveBackend(1 << 20)
+	file := f.PutFile("digits", "text/plain", []byte("0123456789"))
+
+	tests := []struct {
+		byteRange string
+		status    int
+		body      string
+	}{
+		{"", 200, "0123456789"},
+		{"bytes=0-3", 206, "0123"},
+		{"bytes=5-", 206, "56789"},
+		{"bytes=-2", 206, "89"},
+		{"bytes=8-100", 206, "89"},
+		{"bytes=20-30", 416, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.byteRange, func(t *testing.T) {
+			res, err := f.Download(file.Id, tt.byteRange)
+			if tt.status == 416 {
+				if e, ok := err.(*googleapi.Error); !ok || e.Code != 416 {
+					t.Fatalf("expected 416, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			if res.StatusCode != tt.status || string(body) != tt.body {
+				t.Fatalf("got %d %q, expected %d %q", res.StatusCode, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestFakeResumableUpload(t *testing.T) {
+	content := []byte("abcdefghij")
+	tests := []struct {
+		name   string
+		limit  int64
+		chunks [][2]int64
+		// index of the chunk expected to fail, -1 for none
+		fails int
+	}{
+		{"single chunk", 100, [][2]int64{{0, 9}}, -1},
+		{"in order", 100, [][2]int64{{0, 3}, {4, 7}, {8, 9}}, -1},
+		{"gap", 100, [][2]int64{{0, 3}, {5, 9}}, 1},
+		{"over quota", 5, [][2]int64{{0, 4}, {5, 9}}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFakeDriveBackend(tt.limit)
+			uri, err := f.CreateUploadSession("upload", "text/plain", int64(len(content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var progress *UploadProgress
+			for i, c := range tt.chunks {
+				progress, err = f.UploadChunk(uri, bytes.NewReader(content[c[0]:c[1]+1]), c[0], c[1], int64(len(content)))
+				if i == tt.fails {
+					if err == nil {
+						t.Fatalf("chunk %d accepted", i)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("chunk %d: %v", i, err)
+				}
+			}
+			if progress.File == nil || f.Uploads() != 0 {
+				t.Fatal("upload not completed")
+			}
+			if got := f.Files()[0].Content; !bytes.Equal(got, content) {
+				t.Fatalf("stored %q", got)
+			}
+		})
+	}
+}
+
+func TestFakeCancelUpload(t *testing.T) {
+	f := NewFakeDriveBackend(100)
+	uri, err := f.CreateUploadSession("upload", "text/plain", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.UploadChunk(uri, bytes.NewReader([]byte("abcd")), 0, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.CancelUpload(uri); err != nil {
+		t.Fatal(err)
+	}
+	if f.Uploads() != 0 {
+		t.Fatal("session kept after cancel")
+	}
+	if _, err := f.QueryUpload(uri, 10); err == nil {
+		t.Fatal("cancelled session still answers")
+	}
+}
@@ -4,12 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 )
@@ -29,11 +32,13 @@ type File struct {
 	CreatedTime  string `json:"createdTime"`
 	ModifiedTime string `json:"modifiedTime"`
 	FileId       string `json:"fileId"`
+	Md5Checksum  string `json:"md5Checksum,omitempty"`
 }
 
 type DriveService struct {
-	Service *drive.Service
-	Config  *jwt.Config
+	Service     *drive.Service
+	Config      *jwt.Config
+	TokenSource oauth2.TokenSource
 }
 
 type DownloadDetails struct {
@@ -51,19 +56,35 @@ func GetDriveService(token []byte) (*DriveService, error) {
 	if err != nil {
 		return nil, err
 	}
-	srv, err := drive.NewService(context.Background(), option.WithTokenSource(config.TokenSource(context.Background())))
+	ts := NewTokenSource(config)
+	srv, err := drive.NewService(context.Background(), option.WithTokenSource(ts))
 	if err != nil {
 		return nil, err
 	}
 	return &DriveService{
-		Service: srv,
-		Config:  config,
+		Service:     srv,
+		Config:      config,
+		TokenSource: ts,
 	}, nil
 }
 
+// NewTokenSource builds the token source of a service account key. It can be swapped to share
+// tokens between services built from the same key, or between processes.
+var NewTokenSource = func(config *jwt.Config) oauth2.TokenSource {
+	return config.TokenSource(context.Background())
+}
+
+func (d *DriveService) client() *http.Client {
+	return oauth2.NewClient(context.Background(), d.TokenSource)
+}
+
 func (d *DriveService) GetQuotaUsage() (*Quota, error) {
 	srv := d.Service
-	about, err := srv.About.Get().Fields("user,storageQuota").Do()
+	var about *drive.About
+	err := retry(func() (err error) {
+		about, err = srv.About.Get().Fields("user,storageQuota").Do()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -74,53 +95,45 @@ func (d *DriveService) GetQuotaUsage() (*Quota, error) {
 	}, nil
 }
 
-func (d *DriveService) ListFiles(page int, size int64) ([]*File, error) {
-	if page == 1 {
-		return d.retrieveFiles("", size)
-	} else {
-		pageToken, err := d.getPageToken(page, size)
-		if err != nil {
-			return nil, err
-		}
-		return d.retrieveFiles(pageToken, size)
+func (d *DriveService) ListFilePage(opts ListOptions) (*FilePage, error) {
+	call := d.Service.Files.List().
+		PageSize(opts.pageSize()).
+		Fields(googleapi.Field("nextPageToken, files(" + opts.fields() + ")"))
+	if opts.Query != "" {
+		call = call.Q(opts.Query)
 	}
-
-}
-
-func (d *DriveService) getPageToken(page int, size int64) (string, error) {
-	srv := d.Service
-	call := srv.Files.List().PageSize(size)
-	pageToken := ""
-	for cp := 1; cp < page; cp++ {
-		token, err := call.Fields("nextPageToken").PageToken(pageToken).Do()
-		if err != nil {
-			return "", err
-		}
-		pageToken = token.NextPageToken
+	if opts.PageToken != "" {
+		call = call.PageToken(opts.PageToken)
 	}
-	return pageToken, nil
-}
-
-func (d *DriveService) retrieveFiles(pageToken string, size int64) ([]*File, error) {
-	srv := d.Service
-	call := srv.Files.List().PageSize(size)
-	r, err := call.PageToken(pageToken).Fields("files(id, name, size, mimeType,createdTime,modifiedTime)").Do()
+	var r *drive.FileList
+	err := retry(func() (err error) {
+		r, err = call.Do()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	files := make([]*File, len(r.Files))
 	for i, file := range r.Files {
-		files[i] = &File{
-			Id:           file.Id,
-			FileId:       file.Id,
-			Name:         file.Name,
-			Size:         file.Size,
-			MimeType:     file.MimeType,
-			CreatedTime:  file.CreatedTime,
-			ModifiedTime: file.ModifiedTime,
-		}
+		files[i] = toFile(file)
+	}
+	return &FilePage{
+		Files:         files,
+		NextPageToken: r.NextPageToken,
+	}, nil
+}
+
+func toFile(file *drive.File) *File {
+	return &File{
+		Id:           file.Id,
+		FileId:       file.Id,
+		Name:         file.Name,
+		Size:         file.Size,
+		MimeType:     file.MimeType,
+		CreatedTime:  file.CreatedTime,
+		ModifiedTime: file.ModifiedTime,
+		Md5Checksum:  file.Md5Checksum,
 	}
-	return files, nil
 }
 
 func (d *DriveService) DeleteAllFiles() error {
@@ -163,11 +176,15 @@ func (d *DriveService) DownloadFile(fileId string) (details *DownloadDetails, er
 	}
 }
 
-func (d *DriveService) GetFile(fileId string) (*drive.File, error) {
-	return d.Service.Files.
-		Get(fileId).
-		Fields("id, name, size, mimeType, webContentLink, webViewLink, shared").
-		Do()
+func (d *DriveService) GetFile(fileId string) (file *drive.File, err error) {
+	err = retry(func() error {
+		file, err = d.Service.Files.
+			Get(fileId).
+			Fields("id, name, size, mimeType, webContentLink, webViewLink, shared").
+			Do()
+		return err
+	})
+	return file, err
 }
 
 func (d *DriveService) GetDownloadLink(fileId string) (*drive.File, *DownloadDetails, error) {
@@ -204,17 +221,39 @@ func (d *DriveService) UploadFile(name string, description string, mimeType stri
 	return d.Service.Files.Create(f).Media(localFile).Do()
 }
 
+// UploadFileFromStream is not retried, the stream cannot be read twice.
 func (d *DriveService) UploadFileFromStream(name string, description string, mimeType string, is io.Reader) (*drive.File, error) {
 	f := &drive.File{Name: name, Description: description, MimeType: mimeType}
 	return d.Service.Files.Create(f).Media(is).Do()
 }
 
+func (d *DriveService) Download(fileId string, byteRange string) (*http.Response, error) {
+	call := d.Service.Files.Get(fileId)
+	if byteRange != "" {
+		call.Header().Set("Range", byteRange)
+	}
+	var res *http.Response
+	err := retry(func() (err error) {
+		res, err = call.Download()
+		return err
+	})
+	return res, err
+}
+
+func (d *DriveService) CreatePermission(fileId string, perm *drive.Permission) (created *drive.Permission, err error) {
+	err = retry(func() error {
+		created, err = d.Service.Permissions.Create(fileId, perm).Do()
+		return err
+	})
+	return created, err
+}
+
 func (d *DriveService) GetSharableLink(fileId string) (*drive.File, string, error) {
 	perm := drive.Permission{
 		Type: "anyone",
 		Role: "reader",
 	}
-	_, err := d.Service.Permissions.Create(fileId, &perm).Do()
+	_, err := d.CreatePermission(fileId, &perm)
 	if err != nil {
 		return nil, "", err
 	}
@@ -229,15 +268,64 @@ func (d *DriveService) GetSharableLink(fileId string) (*drive.File, string, erro
 }
 
 func (d *DriveService) GetAccessToken() (string, error) {
-	token, err := d.Config.TokenSource(context.Background()).Token()
+	token, err := d.GetToken()
 	if err != nil {
 		return "", err
 	}
 	return token.AccessToken, nil
 }
 
+func (d *DriveService) GetToken() (*oauth2.Token, error) {
+	return d.TokenSource.Token()
+}
+
+func (d *DriveService) GetStartPageToken() (string, error) {
+	var token *drive.StartPageToken
+	err := retry(func() (err error) {
+		token, err = d.Service.Changes.GetStartPageToken().Do()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token.StartPageToken, nil
+}
+
+func (d *DriveService) ListChanges(pageToken string) (*ChangePage, error) {
+	var r *drive.ChangeList
+	err := retry(func() (err error) {
+		r, err = d.Service.Changes.List(pageToken).
+			PageSize(1000).
+			Fields(googleapi.Field("nextPageToken, newStartPageToken, changes(fileId, removed, file(" + DefaultListFields + ", trashed))")).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]*Change, len(r.Changes))
+	for i, c := range r.Changes {
+		change := &Change{
+			FileId:  c.FileId,
+			Removed: c.Removed,
+		}
+		if c.File != nil {
+			change.File = toFile(c.File)
+			change.Trashed = c.File.Trashed
+		}
+		changes[i] = change
+	}
+	return &ChangePage{
+		Changes:           changes,
+		NextPageToken:     r.NextPageToken,
+		NewStartPageToken: r.NewStartPageToken,
+	}, nil
+}
+
 func (d *DriveService) DeleteFile(fileId string) error {
-	return d.Service.Files.
-		Delete(fileId).
-		Do()
+	return retry(func() error {
+		return d.Service.Files.
+			Delete(fileId).
+			Do()
+	})
 }
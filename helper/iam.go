@@ -29,7 +29,7 @@ func NewIamService(key []byte) (*IamService, error) {
 		return nil, err
 	}
 
-	service, err := iam.NewService(context.Background(), option.WithTokenSource(config.TokenSource(context.Background())))
+	service, err := iam.NewService(context.Background(), option.WithTokenSource(NewTokenSource(config)))
 	if err != nil {
 		log.Println("Fail to initialize Google IAM service instance by error", err.Error())
 		return nil, err
@@ -47,11 +47,20 @@ func (s *IamService) CreateServiceAccount(googleProjectId, accountId, displayNam
 	req.ServiceAccount = &iam.ServiceAccount{
 		DisplayName: displayName,
 	}
-	return s.Service.Projects.ServiceAccounts.Create("projects/"+googleProjectId, &req).Do()
+	var account *iam.ServiceAccount
+	err := retryCreate(func() (err error) {
+		account, err = s.Service.Projects.ServiceAccounts.Create("projects/"+googleProjectId, &req).Do()
+		return err
+	})
+	return account, err
 }
 
 func (s *IamService) CreateServiceAccountKey(account *iam.ServiceAccount) ([]byte, error) {
-	key, err := s.Service.Projects.ServiceAccounts.Keys.Create("projects/-/serviceAccounts/"+account.Email, &iam.CreateServiceAccountKeyRequest{}).Do()
+	var key *iam.ServiceAccountKey
+	err := retryCreate(func() (err error) {
+		key, err = s.Service.Projects.ServiceAccounts.Keys.Create("projects/-/serviceAccounts/"+account.Email, &iam.CreateServiceAccountKeyRequest{}).Do()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -65,14 +74,22 @@ func (s *IamService) CreateServiceAccountKey(account *iam.ServiceAccount) ([]byt
 func (s *IamService) ListServiceAccounts(googleProjectId string) ([]*iam.ServiceAccount, error) {
 	var size int64 = 100
 	accounts := make([]*iam.ServiceAccount, 0)
-	resp, err := s.Service.Projects.ServiceAccounts.List("projects/" + googleProjectId).PageSize(size).Do()
+	var resp *iam.ListServiceAccountsResponse
+	err := retry(func() (err error) {
+		resp, err = s.Service.Projects.ServiceAccounts.List("projects/" + googleProjectId).PageSize(size).Do()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	accounts = append(accounts, resp.Accounts...)
 	nextPageToken := resp.NextPageToken
 	for ; nextPageToken != ""; {
-		r, e := s.Service.Projects.ServiceAccounts.List("projects/" + googleProjectId).PageSize(size).PageToken(nextPageToken).Do()
+		var r *iam.ListServiceAccountsResponse
+		e := retry(func() (err error) {
+			r, err = s.Service.Projects.ServiceAccounts.List("projects/" + googleProjectId).PageSize(size).PageToken(nextPageToken).Do()
+			return err
+		})
 		if e != nil {
 			return nil, e
 		}
@@ -83,7 +100,11 @@ func (s *IamService) ListServiceAccounts(googleProjectId string) ([]*iam.Service
 }
 
 func (s *IamService) RemoveExistingKeys(acc *iam.ServiceAccount) error {
-	list, err := s.Service.Projects.ServiceAccounts.Keys.List("projects/-/serviceAccounts/" + acc.UniqueId).Do()
+	var list *iam.ListServiceAccountKeysResponse
+	err := retry(func() (err error) {
+		list, err = s.Service.Projects.ServiceAccounts.Keys.List("projects/-/serviceAccounts/" + acc.UniqueId).Do()
+		return err
+	})
 	if err != nil {
 		log.Println("Fail to list service account keys")
 		return err
@@ -95,10 +116,66 @@ func (s *IamService) RemoveExistingKeys(acc *iam.ServiceAccount) error {
 		if key.KeyType == "SYSTEM_MANAGED" {
 			continue
 		}
-		if _,err := s.Service.Projects.ServiceAccounts.Keys.Delete(key.Name).Do(); err != nil {
+		if err := s.deleteKey(key.Name); err != nil {
 			log.Println("Fail to to remove key", key.Name)
 		}
 	}
 
 	return nil
 }
+
+// DeleteServiceAccountKeys deletes every user managed key of the service account. Unlike
+// RemoveExistingKeys it stops at the first failure so the caller can retry.
+func (s *IamService) DeleteServiceAccountKeys(email string) error {
+	keys, err := s.ListServiceAccountKeys(email)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.deleteKey(key.Name); err != nil {
+			log.Println("Fail to remove key", key.Name, "by error", err.Error())
+			return err
+		}
+		log.Println("Removed key", key.Name)
+	}
+	return nil
+}
+
+func (s *IamService) DeleteServiceAccount(email string) error {
+	return retry(func() error {
+		_, err := s.Service.Projects.ServiceAccounts.Delete("projects/-/serviceAccounts/" + email).Do()
+		return err
+	})
+}
+
+func (s *IamService) GetServiceAccount(email string) (*iam.ServiceAccount, error) {
+	var account *iam.ServiceAccount
+	err := retry(func() (err error) {
+		account, err = s.Service.Projects.ServiceAccounts.Get("projects/-/serviceAccounts/" + email).Do()
+		return err
+	})
+	return account, err
+}
+
+func (s *IamService) DeleteServiceAccountKey(email string, keyId string) error {
+	return s.deleteKey("projects/-/serviceAccounts/" + email + "/keys/" + keyId)
+}
+
+func (s *IamService) deleteKey(name string) error {
+	return retry(func() error {
+		_, err := s.Service.Projects.ServiceAccounts.Keys.Delete(name).Do()
+		return err
+	})
+}
+
+func (s *IamService) ListServiceAccountKeys(email string) ([]*iam.ServiceAccountKey, error) {
+	var list *iam.ListServiceAccountKeysResponse
+	err := retry(func() (err error) {
+		list, err = s.Service.Projects.ServiceAccounts.Keys.List("projects/-/serviceAccounts/" + email).KeyTypes("USER_MANAGED").Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list.Keys, nil
+}
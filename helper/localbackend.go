@@ -0,0 +1,523 @@
+package helper
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalKey is the credential of an account stored in a local directory. Limit is the quota of
+// the account in bytes.
+type LocalKey struct {
+	Type  string `json:"type"`
+	Root  string `json:"root"`
+	Limit int64  `json:"limit"`
+}
+
+// LocalBackend stores each file of the account as <root>/<id>, its metadata next to it as
+// <root>/<id>.json. Resumable uploads are written under <root>/.uploads until complete.
+type LocalBackend struct {
+	Root  string
+	Limit int64
+
+	mu sync.Mutex
+}
+
+type localUpload struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+}
+
+const localUploadScheme = "local-upload://"
+
+var (
+	ErrLocalStorageDisabled = errors.New("local storage is disabled, LOCAL_STORAGE_BASE is not set")
+	ErrLocalRootNotAllowed  = errors.New("local root must be a directory under LOCAL_STORAGE_BASE, without .. or symbolic links")
+)
+
+func NewLocalBackend(key []byte) (*LocalBackend, error) {
+	var lk LocalKey
+	if err := json.Unmarshal(key, &lk); err != nil {
+		return nil, err
+	}
+	if lk.Limit <= 0 {
+		return nil, errors.New("local key needs a positive limit")
+	}
+	root, err := ResolveLocalRoot(lk.Root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(root, ".uploads"), 0700); err != nil {
+		return nil, err
+	}
+	return &LocalBackend{Root: root, Limit: lk.Limit}, nil
+}
+
+// ResolveLocalRoot confines root to a directory strictly under LOCAL_STORAGE_BASE, creating it when
+// missing. Neither root nor the directories between it and the base may be symbolic links.
+func ResolveLocalRoot(root string) (string, error) {
+	configured := os.Getenv("LOCAL_STORAGE_BASE")
+	if configured == "" {
+		return "", ErrLocalStorageDisabled
+	}
+	configured = filepath.Clean(configured)
+	base, err := filepath.EvalSymlinks(configured)
+	if err != nil {
+		return "", err
+	}
+	if root == "" || !filepath.IsAbs(root) {
+		return "", ErrLocalRootNotAllowed
+	}
+	for _, element := range strings.Split(filepath.ToSlash(root), "/") {
+		if element == ".." {
+			return "", ErrLocalRootNotAllowed
+		}
+	}
+	root = filepath.Clean(root)
+	// the base itself may be a link, roots are kept under its target
+	rel, err := filepath.Rel(configured, root)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel, err = filepath.Rel(base, root)
+	}
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", ErrLocalRootNotAllowed
+	}
+	root = filepath.Join(base, rel)
+	dir := base
+	for _, element := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, element)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 || !info.IsDir() {
+			return "", ErrLocalRootNotAllowed
+		}
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return "", err
+	}
+	// a link swapped in while the directories were created
+	if resolved, err := filepath.EvalSymlinks(root); err != nil {
+		return "", err
+	} else if resolved != root {
+		return "", ErrLocalRootNotAllowed
+	}
+	return root, nil
+}
+
+// LocalRootsOverlap tells whether one root is the other or holds it, the accounts would then read
+// each other's files.
+func LocalRootsOverlap(a string, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	sep := string(filepath.Separator)
+	return a == b || strings.HasPrefix(a, b+sep) || strings.HasPrefix(b, a+sep)
+}
+
+var _ DriveBackend = (*LocalBackend)(nil)
+
+func (l *LocalBackend) dataPath(fileId string) string {
+	return filepath.Join(l.Root, fileId)
+}
+
+func (l *LocalBackend) metaPath(fileId string) string {
+	return filepath.Join(l.Root, fileId+".json")
+}
+
+func (l *LocalBackend) uploadPath(sessionId string) string {
+	return filepath.Join(l.Root, ".uploads", sessionId)
+}
+
+// validId keeps ids coming from requests from walking out of the root.
+func validId(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *LocalBackend) ids() ([]string, error) {
+	entries, err := ioutil.ReadDir(l.Root)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if id := strings.TrimSuffix(e.Name(), ".json"); id != e.Name() && validId(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (l *LocalBackend) readMeta(fileId string) (*drive.File, error) {
+	if !validId(fileId) {
+		return nil, notFoundError(fileId)
+	}
+	data, err := ioutil.ReadFile(l.metaPath(fileId))
+	if os.IsNotExist(err) {
+		return nil, notFoundError(fileId)
+	} else if err != nil {
+		return nil, err
+	}
+	var file drive.File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (l *LocalBackend) usage() (int64, error) {
+	ids, err := l.ids()
+	if err != nil {
+		return 0, err
+	}
+	var usage int64
+	for _, id := range ids {
+		if info, err := os.Stat(l.dataPath(id)); err == nil {
+			usage += info.Size()
+		}
+	}
+	return usage, nil
+}
+
+func (l *LocalBackend) GetQuotaUsage() (*Quota, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	usage, err := l.usage()
+	if err != nil {
+		return nil, err
+	}
+	return &Quota{
+		Limit:   l.Limit,
+		Usage:   usage,
+		Percent: fmt.Sprintf("%.3f", float64(usage)*100/float64(l.Limit)),
+	}, nil
+}
+
+// ListFilePage pages through the files ordered by id. The page token is the offset of the next
+// file; the query is not evaluated.
+func (l *LocalBackend) ListFilePage(opts ListOptions) (*FilePage, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ids, err := l.ids()
+	if err != nil {
+		return nil, err
+	}
+	offset := 0
+	if opts.PageToken != "" {
+		parsed, err := strconv.Atoi(opts.PageToken)
+		if err != nil || parsed < 0 {
+			return nil, &googleapi.Error{Code: 400, Message: "Invalid page token: " + opts.PageToken}
+		}
+		offset = parsed
+	}
+	page := &FilePage{Files: make([]*File, 0)}
+	for i := offset; i < len(ids) && int64(len(page.Files)) < opts.pageSize(); i++ {
+		file, err := l.readMeta(ids[i])
+		if err != nil {
+			return nil, err
+		}
+		page.Files = append(page.Files, toFile(file))
+	}
+	if next := offset + len(page.Files); next < len(ids) {
+		page.NextPageToken = strconv.Itoa(next)
+	}
+	return page, nil
+}
+
+func (l *LocalBackend) GetFile(fileId string) (*drive.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.readMeta(fileId)
+}
+
+func (l *LocalBackend) UploadFileFromStream(name string, description string, mimeType string, is io.Reader) (*drive.File, error) {
+	id, err := newFileId()
+	if err != nil {
+		return nil, err
+	}
+	temp := l.uploadPath(id)
+	out, err := os.OpenFile(temp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), is)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return nil, err
+	}
+	file := &drive.File{
+		Name:        name,
+		Description: description,
+		MimeType:    mimeType,
+		Size:        size,
+		Md5Checksum: hex.EncodeToString(hash.Sum(nil)),
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.store(id, temp, file); err != nil {
+		os.Remove(temp)
+		return nil, err
+	}
+	return file, nil
+}
+
+// store moves the written content in place and saves its metadata, checking the quota first.
+func (l *LocalBackend) store(id string, temp string, file *drive.File) error {
+	usage, err := l.usage()
+	if err != nil {
+		return err
+	}
+	if usage+file.Size > l.Limit {
+		return quotaExceededError()
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	file.Id = id
+	file.CreatedTime = now
+	file.ModifiedTime = now
+	meta, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(temp, l.dataPath(id)); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(l.metaPath(id), meta, 0600); err != nil {
+		os.Remove(l.dataPath(id))
+		return err
+	}
+	return nil
+}
+
+func (l *LocalBackend) Download(fileId string, byteRange string) (*http.Response, error) {
+	l.mu.Lock()
+	file, err := l.readMeta(fileId)
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	in, err := os.Open(l.dataPath(fileId))
+	if os.IsNotExist(err) {
+		return nil, notFoundError(fileId)
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := in.Stat()
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	total := info.Size()
+	res := &http.Response{
+		StatusCode: 200,
+		Header:     make(http.Header),
+	}
+	res.Header.Set("Content-Type", file.MimeType)
+	start, end := int64(0), total-1
+	if byteRange != "" {
+		start, end, err = parseByteRange(byteRange, total)
+		if err != nil {
+			in.Close()
+			return nil, &googleapi.Error{Code: 416, Message: err.Error()}
+		}
+		res.StatusCode = 206
+		res.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	}
+	res.Status = strconv.Itoa(res.StatusCode) + " " + http.StatusText(res.StatusCode)
+	res.ContentLength = end - start + 1
+	res.Header.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(in, start, res.ContentLength), in}
+	return res, nil
+}
+
+func (l *LocalBackend) DeleteFile(fileId string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.readMeta(fileId); err != nil {
+		return err
+	}
+	if err := os.Remove(l.dataPath(fileId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(l.metaPath(fileId))
+}
+
+func (l *LocalBackend) CreatePermission(fileId string, perm *drive.Permission) (*drive.Permission, error) {
+	return nil, ErrNotSupported
+}
+
+func (l *LocalBackend) GetAccessToken() (string, error) {
+	return "", ErrNoAccessToken
+}
+
+func (l *LocalBackend) GetToken() (*oauth2.Token, error) {
+	return nil, ErrNoAccessToken
+}
+
+func (l *LocalBackend) GetStartPageToken() (string, error) {
+	return "full", nil
+}
+
+func (l *LocalBackend) ListChanges(pageToken string) (*ChangePage, error) {
+	return nil, noChangesError()
+}
+
+func (l *LocalBackend) CreateUploadSession(name string, mimeType string, size int64) (string, error) {
+	id, err := newFileId()
+	if err != nil {
+		return "", err
+	}
+	meta, err := json.Marshal(&localUpload{Name: name, MimeType: mimeType, Size: size})
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(l.uploadPath(id), nil, 0600); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(l.uploadPath(id)+".json", meta, 0600); err != nil {
+		os.Remove(l.uploadPath(id))
+		return "", err
+	}
+	return localUploadScheme + id, nil
+}
+
+func (l *LocalBackend) findUpload(sessionUri string) (string, *localUpload, error) {
+	id := strings.TrimPrefix(sessionUri, localUploadScheme)
+	if id == sessionUri || !validId(id) {
+		return "", nil, &googleapi.Error{Code: 404, Message: "Upload session not found"}
+	}
+	data, err := ioutil.ReadFile(l.uploadPath(id) + ".json")
+	if os.IsNotExist(err) {
+		return "", nil, &googleapi.Error{Code: 404, Message: "Upload session not found"}
+	} else if err != nil {
+		return "", nil, err
+	}
+	var upload localUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return "", nil, err
+	}
+	return id, &upload, nil
+}
+
+// UploadChunk only accepts chunks continuing exactly where the previous one ended.
+func (l *LocalBackend) UploadChunk(sessionUri string, chunk io.Reader, start int64, end int64, total int64) (*UploadProgress, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id, upload, err := l.findUpload(sessionUri)
+	if err != nil {
+		return nil, err
+	}
+	path := l.uploadPath(id)
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := out.Stat()
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	if start != info.Size() || total != upload.Size || end < start || end >= total {
+		out.Close()
+		return nil, &googleapi.Error{Code: 400, Message: "Invalid Content-Range"}
+	}
+	written, err := io.Copy(out, io.LimitReader(chunk, end-start+1))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written != end-start+1 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		// drop the partial chunk so the client can send it again
+		os.Truncate(path, start)
+		return nil, err
+	}
+	if end+1 < total {
+		return &UploadProgress{Offset: end + 1}, nil
+	}
+	sum, err := md5File(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &drive.File{Name: upload.Name, MimeType: upload.MimeType, Size: total, Md5Checksum: sum}
+	if err := l.store(id, path, file); err != nil {
+		return nil, err
+	}
+	os.Remove(path + ".json")
+	return &UploadProgress{Offset: total, File: file}, nil
+}
+
+func (l *LocalBackend) QueryUpload(sessionUri string, total int64) (*UploadProgress, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id, _, err := l.findUpload(sessionUri)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(l.uploadPath(id))
+	if err != nil {
+		return nil, err
+	}
+	return &UploadProgress{Offset: info.Size()}, nil
+}
+
+func (l *LocalBackend) CancelUpload(sessionUri string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id, _, err := l.findUpload(sessionUri)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(l.uploadPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(l.uploadPath(id) + ".json")
+}
+
+func md5File(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
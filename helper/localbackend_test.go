@@ -0,0 +1,157 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// localBase points LOCAL_STORAGE_BASE to a new temporary directory until restore is called.
+func localBase(t *testing.T) (base string, restore func()) {
+	dir, err := ioutil.TempDir("", "localbackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	previous, set := os.LookupEnv("LOCAL_STORAGE_BASE")
+	os.Setenv("LOCAL_STORAGE_BASE", dir)
+	return dir, func() {
+		if set {
+			os.Setenv("LOCAL_STORAGE_BASE", previous)
+		} else {
+			os.Unsetenv("LOCAL_STORAGE_BASE")
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestResolveLocalRoot(t *testing.T) {
+	base, restore := localBase(t)
+	defer restore()
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		root     string
+		expected string
+		err      error
+	}{
+		{"directory under the base", filepath.Join(base, "a"), filepath.Join(base, "a"), nil},
+		{"nested directory", filepath.Join(base, "a", "b"), filepath.Join(base, "a", "b"), nil},
+		{"trailing slash", filepath.Join(base, "c") + "/", filepath.Join(base, "c"), nil},
+		{"relative", "a", "", ErrLocalRootNotAllowed},
+		{"empty", "", "", ErrLocalRootNotAllowed},
+		{"the base itself", base, "", ErrLocalRootNotAllowed},
+		{"outside the base", outside, "", ErrLocalRootNotAllowed},
+		{"system directory", "/etc/cron.d", "", ErrLocalRootNotAllowed},
+		{"dot dot back inside", base + "/x/../a", "", ErrLocalRootNotAllowed},
+		{"dot dot out", base + "/../escape", "", ErrLocalRootNotAllowed},
+		{"symbolic link", filepath.Join(base, "link"), "", ErrLocalRootNotAllowed},
+		{"under a symbolic link", filepath.Join(base, "link", "a"), "", ErrLocalRootNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ResolveLocalRoot(tt.root)
+			if err != tt.err || root != tt.expected {
+				t.Fatalf("got %q, %v, expected %q, %v", root, err, tt.expected, tt.err)
+			}
+		})
+	}
+	if entries, _ := ioutil.ReadDir(outside); len(entries) != 0 {
+		t.Fatal("directory created through the symbolic link")
+	}
+}
+
+func TestResolveLocalRootDisabled(t *testing.T) {
+	_, restore := localBase(t)
+	defer restore()
+	os.Unsetenv("LOCAL_STORAGE_BASE")
+	if _, err := ResolveLocalRoot("/tmp/anything"); err != ErrLocalStorageDisabled {
+		t.Fatalf("expected ErrLocalStorageDisabled, got %v", err)
+	}
+}
+
+func TestLocalRootsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"/data/a", "/data/a", true},
+		{"/data/a/", "/data/a", true},
+		{"/data/a", "/data/a/b", true},
+		{"/data/a/.uploads", "/data/a", true},
+		{"/data/a", "/data/ab", false},
+		{"/data/a", "/data/b", false},
+	}
+	for _, tt := range tests {
+		if got := LocalRootsOverlap(tt.a, tt.b); got != tt.overlap {
+			t.Errorf("LocalRootsOverlap(%q, %q) = %v", tt.a, tt.b, got)
+		}
+		if got := LocalRootsOverlap(tt.b, tt.a); got != tt.overlap {
+			t.Errorf("LocalRootsOverlap(%q, %q) = %v", tt.b, tt.a, got)
+		}
+	}
+}
+
+func TestLocalBackendResumableUpload(t *testing.T) {
+	base, restore := localBase(t)
+	defer restore()
+	key, _ := json.Marshal(&LocalKey{Type: KeyTypeLocal, Root: filepath.Join(base, "account"), Limit: 1 << 20})
+	l, err := NewLocalBackend(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("0123456789")
+
+	uri, err := l.CreateUploadSession("kept", "text/plain", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.UploadChunk(uri, bytes.NewReader(content[:4]), 0, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+	progress, err := l.UploadChunk(uri, bytes.NewReader(content[4:]), 4, 9, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.File == nil {
+		t.Fatal("upload not completed")
+	}
+	res, err := l.Download(progress.File.Id, "bytes=2-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "2345" {
+		t.Fatalf("downloaded %q", body)
+	}
+
+	cancelled, err := l.CreateUploadSession("cancelled", "text/plain", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.UploadChunk(cancelled, bytes.NewReader(content[:4]), 0, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CancelUpload(cancelled); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(base, "account", ".uploads")); len(entries) != 0 {
+		t.Fatalf("%d upload files left after cancel", len(entries))
+	}
+	if err := l.CancelUpload(cancelled); err != nil {
+		t.Fatalf("cancelling twice: %v", err)
+	}
+}
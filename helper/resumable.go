@@ -0,0 +1,137 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const resumableUploadUrl = "https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable&fields=" +
+	"id,name,size,mimeType,createdTime,modifiedTime,md5Checksum"
+
+// CreateUploadSession opens a Drive resumable upload and returns its session URI.
+func (d *DriveService) CreateUploadSession(name string, mimeType string, size int64) (string, error) {
+	metadata, err := json.Marshal(&drive.File{Name: name, MimeType: mimeType})
+	if err != nil {
+		return "", err
+	}
+	var location string
+	err = retry(func() error {
+		req, err := http.NewRequest("POST", resumableUploadUrl, bytes.NewReader(metadata))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+		if mimeType != "" {
+			req.Header.Set("X-Upload-Content-Type", mimeType)
+		}
+		res, err := d.client().Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if err := googleapi.CheckResponse(res); err != nil {
+			return err
+		}
+		location = res.Header.Get("Location")
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if location == "" {
+		return "", fmt.Errorf("resumable upload created without session uri")
+	}
+	return location, nil
+}
+
+func (d *DriveService) UploadChunk(sessionUri string, chunk io.Reader, start int64, end int64, total int64) (*UploadProgress, error) {
+	req, err := http.NewRequest("PUT", sessionUri, chunk)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = end - start + 1
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	return d.sendUploadRequest(req)
+}
+
+func (d *DriveService) QueryUpload(sessionUri string, total int64) (*UploadProgress, error) {
+	req, err := http.NewRequest("PUT", sessionUri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+	var progress *UploadProgress
+	err = retry(func() (err error) {
+		progress, err = d.sendUploadRequest(req)
+		return err
+	})
+	return progress, err
+}
+
+// CancelUpload drops the resumable session and the bytes Drive kept for it. Drive answers 499
+// once the session is cancelled; a session already gone is not an error.
+func (d *DriveService) CancelUpload(sessionUri string) error {
+	return retry(func() error {
+		req, err := http.NewRequest("DELETE", sessionUri, nil)
+		if err != nil {
+			return err
+		}
+		res, err := d.client().Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode == 499 || res.StatusCode == 404 || res.StatusCode == 410 {
+			return nil
+		}
+		return googleapi.CheckResponse(res)
+	})
+}
+
+func (d *DriveService) sendUploadRequest(req *http.Request) (*UploadProgress, error) {
+	res, err := d.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 308 {
+		return &UploadProgress{Offset: parseUploadedRange(res.Header.Get("Range"))}, nil
+	}
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var file drive.File
+	if err := json.Unmarshal(body, &file); err != nil {
+		return nil, err
+	}
+	return &UploadProgress{Offset: file.Size, File: &file}, nil
+}
+
+// parseUploadedRange turns the "bytes=0-N" header of a 308 response into the next offset.
+func parseUploadedRange(value string) int64 {
+	if value == "" {
+		return 0
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0
+	}
+	last, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return last + 1
+}
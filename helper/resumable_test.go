@@ -0,0 +1,19 @@
+package helper
+
+import (
+	"testing"
+)
+
+func TestParseUploadedRange(t *testing.T) {
+	tests := map[string]int64{
+		"":            0,
+		"bytes=0-0":   1,
+		"bytes=0-999": 1000,
+		"garbage":     0,
+	}
+	for value, expected := range tests {
+		if got := parseUploadedRange(value); got != expected {
+			t.Errorf("parseUploadedRange(%q) = %d", value, got)
+		}
+	}
+}
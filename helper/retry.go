@@ -0,0 +1,102 @@
+package helper
+
+import (
+	"google.golang.org/api/googleapi"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy retries Google API calls failing with rate limits or server errors, waiting an
+// exponentially growing, fully jittered delay between attempts.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: retryAttemptsFromEnv(),
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+func retryAttemptsFromEnv() int {
+	if v, err := strconv.Atoi(os.Getenv("GOOGLE_API_MAX_ATTEMPTS")); err == nil && v > 0 {
+		return v
+	}
+	return 5
+}
+
+// IsRetryable tells whether a Google API error is worth another attempt: a rate limit or any 5xx.
+func IsRetryable(err error) bool {
+	if e, ok := err.(*googleapi.Error); ok && e.Code >= 500 {
+		return true
+	}
+	return IsRateLimited(err)
+}
+
+// IsRateLimited tells whether the request was turned away by a rate limit, either as a 429 or as
+// the 403 Drive answers with. Such requests were not carried out.
+func IsRateLimited(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	if e.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if e.Code == http.StatusForbidden {
+		for _, item := range e.Errors {
+			if item.Reason == "userRateLimitExceeded" || item.Reason == "rateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Do runs call until it succeeds, fails with an error that is not retryable, or MaxAttempts is reached.
+func (p RetryPolicy) Do(call func() error) error {
+	return p.DoIf(IsRetryable, call)
+}
+
+// DoIf is Do with the retryable errors chosen by the caller.
+func (p RetryPolicy) DoIf(retryable func(error) bool, call func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = call(); err == nil || !retryable(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+		delay := p.delay(attempt)
+		log.Println("Google API call failed by error", err.Error(), "retrying in", delay)
+		time.Sleep(delay)
+	}
+}
+
+// delay is a random duration up to BaseDelay*2^(attempt-1), capped at MaxDelay.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	ceiling := p.MaxDelay
+	if attempt < 32 {
+		if d := p.BaseDelay << uint(attempt-1); d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+func retry(call func() error) error {
+	return DefaultRetryPolicy.Do(call)
+}
+
+// retryCreate retries a call creating something only when it was rate limited: after a server
+// error the object may exist already.
+func retryCreate(call func() error) error {
+	return DefaultRetryPolicy.DoIf(IsRateLimited, call)
+}
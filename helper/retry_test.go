@@ -0,0 +1,53 @@
+package helper
+
+import (
+	"errors"
+	"google.golang.org/api/googleapi"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"server error", &googleapi.Error{Code: 503}, true},
+		{"too many requests", &googleapi.Error{Code: 429}, true},
+		{"rate limit as 403", &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, true},
+		{"quota exceeded", &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "storageQuotaExceeded"}}}, false},
+		{"not found", &googleapi.Error{Code: 404}, false},
+		{"other error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.retryable {
+			t.Errorf("%s: IsRetryable = %v", tt.name, got)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		failed   bool
+	}{
+		{"success", []error{nil}, 1, false},
+		{"retried then success", []error{&googleapi.Error{Code: 500}, nil}, 2, false},
+		{"gives up", []error{&googleapi.Error{Code: 500}, &googleapi.Error{Code: 500}, &googleapi.Error{Code: 500}, nil}, 3, true},
+		{"not retryable", []error{&googleapi.Error{Code: 404}, nil}, 1, true},
+	}
+	for _, tt := range tests {
+		attempts := 0
+		err := policy.Do(func() error {
+			attempts++
+			return tt.errs[attempts-1]
+		})
+		if attempts != tt.attempts || (err != nil) != tt.failed {
+			t.Errorf("%s: %d attempts, error %v", tt.name, attempts, err)
+		}
+	}
+}
@@ -0,0 +1,641 @@
+package helper
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Key is the credential of an account stored in an S3 compatible bucket, such as MinIO.
+// PathStyle addresses the bucket as <endpoint>/<bucket>, as MinIO expects, instead of
+// <bucket>.<endpoint>. Limit is the quota of the account in bytes, S3 has none of its own.
+type S3Key struct {
+	Type            string `json:"type"`
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	AccessKeyId     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	PathStyle       bool   `json:"pathStyle"`
+	Limit           int64  `json:"limit"`
+}
+
+// S3Backend stores each file of the account as the object <prefix><id>, its name in the
+// x-amz-meta-name header. The bucket limit is not enforced here, placement keeps accounts
+// under it. Resumable uploads are multipart uploads; chunks smaller than the 5MiB minimum part
+// size are buffered in <prefix>.uploads/<id> until a part can be sent.
+type S3Backend struct {
+	key      S3Key
+	endpoint *url.URL
+	client   *http.Client
+}
+
+var s3BucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+const (
+	s3UploadScheme = "s3-upload://"
+	s3MinPartSize  = 5 * 1024 * 1024
+)
+
+func NewS3Backend(key []byte) (*S3Backend, error) {
+	var sk S3Key
+	if err := json.Unmarshal(key, &sk); err != nil {
+		return nil, err
+	}
+	if sk.Bucket == "" || sk.AccessKeyId == "" || sk.SecretAccessKey == "" {
+		return nil, errors.New("s3 key needs a bucket, an access key id and a secret access key")
+	}
+	if sk.Limit <= 0 {
+		return nil, errors.New("s3 key needs a positive limit")
+	}
+	if sk.Endpoint == "" {
+		sk.Endpoint = "https://s3.amazonaws.com"
+	}
+	if sk.Region == "" {
+		sk.Region = "us-east-1"
+	}
+	if sk.Prefix != "" && !strings.HasSuffix(sk.Prefix, "/") {
+		sk.Prefix += "/"
+	}
+	endpoint, err := url.Parse(sk.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" || endpoint.User != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", sk.Endpoint)
+	}
+	// the bucket ends up in the host of virtual-hosted requests
+	if !s3BucketPattern.MatchString(sk.Bucket) {
+		return nil, fmt.Errorf("invalid s3 bucket %q", sk.Bucket)
+	}
+	listed, err := s3EndpointAllowed(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Backend{key: sk, endpoint: endpoint, client: newS3Client(listed)}, nil
+}
+
+var _ DriveBackend = (*S3Backend)(nil)
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size,omitempty"`
+}
+
+type s3ListPartsResult struct {
+	Parts                []s3Part `xml:"Part"`
+	IsTruncated          bool     `xml:"IsTruncated"`
+	NextPartNumberMarker int      `xml:"NextPartNumberMarker"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+func (b *S3Backend) objectKey(fileId string) string {
+	return b.key.Prefix + fileId
+}
+
+func (b *S3Backend) pendingKey(fileId string) string {
+	return b.key.Prefix + ".uploads/" + fileId
+}
+
+func (b *S3Backend) objectUrl(objectKey string, query url.Values) *url.URL {
+	u := *b.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if b.key.PathStyle {
+		path += "/" + b.key.Bucket
+	} else {
+		u.Host = b.key.Bucket + "." + u.Host
+	}
+	if objectKey != "" || !b.key.PathStyle {
+		path += "/" + objectKey
+	}
+	u.Path = path
+	u.RawPath = uriEncode(path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// send signs and sends one request. Answers other than 2xx are returned as *googleapi.Error
+// carrying the S3 status and error code, so callers treat them as Drive errors.
+func (b *S3Backend) send(method string, objectKey string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.objectUrl(objectKey, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = size
+	signV4(req, b.key.AccessKeyId, b.key.SecretAccessKey, b.key.Region, payloadHash, time.Now())
+	res, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		return nil, s3ResponseError(res)
+	}
+	return res, nil
+}
+
+func s3ResponseError(res *http.Response) error {
+	e := &googleapi.Error{Code: res.StatusCode, Message: http.StatusText(res.StatusCode)}
+	data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	var se s3Error
+	if xml.Unmarshal(data, &se) == nil && se.Code != "" {
+		e.Message = se.Code + ": " + se.Message
+		e.Errors = []googleapi.ErrorItem{{Reason: se.Code, Message: se.Message}}
+		if se.Code == "SlowDown" {
+			e.Errors[0].Reason = "rateLimitExceeded"
+		}
+	}
+	return e
+}
+
+// call sends a request with an in-memory body, retrying it like the Drive calls.
+func (b *S3Backend) call(method string, objectKey string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var res *http.Response
+	err := retry(func() (err error) {
+		res, err = b.send(method, objectKey, query, header, bytes.NewReader(body), int64(len(body)), sha256Hex(body))
+		return err
+	})
+	return res, err
+}
+
+// callXml sends the request and decodes the XML answer into out.
+func (b *S3Backend) callXml(method string, objectKey string, query url.Values, header http.Header, body []byte, out interface{}) error {
+	res, err := b.call(method, objectKey, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	// CompleteMultipartUpload may fail after answering 200
+	var se s3Error
+	if xml.Unmarshal(data, &se) == nil && se.Code != "" {
+		return &googleapi.Error{Code: 500, Message: se.Code + ": " + se.Message}
+	}
+	return xml.Unmarshal(data, out)
+}
+
+func (b *S3Backend) GetQuotaUsage() (*Quota, error) {
+	var usage int64
+	token := ""
+	for {
+		result, err := b.list(token, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			usage += c.Size
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return &Quota{
+		Limit:   b.key.Limit,
+		Usage:   usage,
+		Percent: fmt.Sprintf("%.3f", float64(usage)*100/float64(b.key.Limit)),
+	}, nil
+}
+
+// list returns one page of the objects directly under the prefix, pending chunks excluded.
+func (b *S3Backend) list(token string, max int64) (*s3ListResult, error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {b.key.Prefix},
+		"delimiter": {"/"},
+		"max-keys":  {strconv.FormatInt(max, 10)},
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	var result s3ListResult
+	if err := b.callXml("GET", "", query, nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ListFilePage lists one page of objects and reads the name and type of each. The page token is
+// the S3 continuation token; the query is not evaluated.
+func (b *S3Backend) ListFilePage(opts ListOptions) (*FilePage, error) {
+	result, err := b.list(opts.PageToken, opts.pageSize())
+	if err != nil {
+		return nil, err
+	}
+	page := &FilePage{Files: make([]*File, 0, len(result.Contents))}
+	for _, c := range result.Contents {
+		id := strings.TrimPrefix(c.Key, b.key.Prefix)
+		if !validId(id) {
+			continue
+		}
+		file, err := b.GetFile(id)
+		if isS3NotFound(err) {
+			// deleted since the listing
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		page.Files = append(page.Files, toFile(file))
+	}
+	if result.IsTruncated {
+		page.NextPageToken = result.NextContinuationToken
+	}
+	return page, nil
+}
+
+func isS3NotFound(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == 404
+}
+
+func (b *S3Backend) GetFile(fileId string) (*drive.File, error) {
+	if !validId(fileId) {
+		return nil, notFoundError(fileId)
+	}
+	res, err := b.call("HEAD", b.objectKey(fileId), nil, nil, nil)
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, notFoundError(fileId)
+		}
+		return nil, err
+	}
+	res.Body.Close()
+	return s3File(fileId, res), nil
+}
+
+func s3File(fileId string, res *http.Response) *drive.File {
+	file := &drive.File{
+		Id:       fileId,
+		MimeType: res.Header.Get("Content-Type"),
+		Size:     res.ContentLength,
+	}
+	if name, err := url.QueryUnescape(res.Header.Get("X-Amz-Meta-Name")); err == nil {
+		file.Name = name
+	}
+	if modified, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		file.CreatedTime = modified.UTC().Format(time.RFC3339)
+		file.ModifiedTime = file.CreatedTime
+	}
+	// the ETag of a multipart upload is not the MD5 of the content
+	if etag := strings.Trim(res.Header.Get("ETag"), `"`); !strings.Contains(etag, "-") {
+		file.Md5Checksum = etag
+	}
+	return file
+}
+
+func objectHeader(name string, mimeType string) http.Header {
+	header := make(http.Header)
+	header.Set("X-Amz-Meta-Name", url.QueryEscape(name))
+	if mimeType != "" {
+		header.Set("Content-Type", mimeType)
+	}
+	return header
+}
+
+// UploadFileFromStream spools the stream to a temporary file first, S3 needs the length and the
+// hash of the body before it is sent.
+func (b *S3Backend) UploadFileFromStream(name string, description string, mimeType string, is io.Reader) (*drive.File, error) {
+	id, err := newFileId()
+	if err != nil {
+		return nil, err
+	}
+	spool, err := ioutil.TempFile("", "s3-upload-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	sha := sha256.New()
+	sum := md5.New()
+	size, err := io.Copy(io.MultiWriter(spool, sha, sum), is)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := hex.EncodeToString(sha.Sum(nil))
+	err = retry(func() error {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		res, err := b.send("PUT", b.objectKey(id), nil, objectHeader(name, mimeType), spool, size, payloadHash)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	return &drive.File{
+		Id:           id,
+		Name:         name,
+		Description:  description,
+		MimeType:     mimeType,
+		Size:         size,
+		CreatedTime:  now,
+		ModifiedTime: now,
+		Md5Checksum:  hex.EncodeToString(sum.Sum(nil)),
+	}, nil
+}
+
+func (b *S3Backend) Download(fileId string, byteRange string) (*http.Response, error) {
+	if !validId(fileId) {
+		return nil, notFoundError(fileId)
+	}
+	var header http.Header
+	if byteRange != "" {
+		header = http.Header{"Range": {byteRange}}
+	}
+	var res *http.Response
+	err := retry(func() (err error) {
+		res, err = b.send("GET", b.objectKey(fileId), nil, header, nil, 0, emptyPayloadHash)
+		return err
+	})
+	if isS3NotFound(err) {
+		return nil, notFoundError(fileId)
+	}
+	return res, err
+}
+
+// DeleteFile checks the object exists first, S3 answers a delete of a missing key with success.
+func (b *S3Backend) DeleteFile(fileId string) error {
+	if _, err := b.GetFile(fileId); err != nil {
+		return err
+	}
+	res, err := b.call("DELETE", b.objectKey(fileId), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (b *S3Backend) CreatePermission(fileId string, perm *drive.Permission) (*drive.Permission, error) {
+	return nil, ErrNotSupported
+}
+
+func (b *S3Backend) GetAccessToken() (string, error) {
+	return "", ErrNoAccessToken
+}
+
+func (b *S3Backend) GetToken() (*oauth2.Token, error) {
+	return nil, ErrNoAccessToken
+}
+
+func (b *S3Backend) GetStartPageToken() (string, error) {
+	return "full", nil
+}
+
+func (b *S3Backend) ListChanges(pageToken string) (*ChangePage, error) {
+	return nil, noChangesError()
+}
+
+func (b *S3Backend) CreateUploadSession(name string, mimeType string, size int64) (string, error) {
+	id, err := newFileId()
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadId string `xml:"UploadId"`
+	}
+	// a retried initiation leaves at most an unused multipart upload behind
+	if err := b.callXml("POST", b.objectKey(id), url.Values{"uploads": {""}}, objectHeader(name, mimeType), nil, &result); err != nil {
+		return "", err
+	}
+	return s3UploadScheme + id + "?" + url.Values{
+		"uploadId": {result.UploadId},
+		"size":     {strconv.FormatInt(size, 10)},
+	}.Encode(), nil
+}
+
+type s3Upload struct {
+	fileId   string
+	uploadId string
+	size     int64
+}
+
+func parseS3Upload(sessionUri string) (*s3Upload, error) {
+	notFound := &googleapi.Error{Code: 404, Message: "Upload session not found"}
+	rest := strings.TrimPrefix(sessionUri, s3UploadScheme)
+	parts := strings.SplitN(rest, "?", 2)
+	if rest == sessionUri || len(parts) != 2 || !validId(parts[0]) {
+		return nil, notFound
+	}
+	query, err := url.ParseQuery(parts[1])
+	if err != nil {
+		return nil, notFound
+	}
+	size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+	if err != nil || query.Get("uploadId") == "" {
+		return nil, notFound
+	}
+	return &s3Upload{fileId: parts[0], uploadId: query.Get("uploadId"), size: size}, nil
+}
+
+func (b *S3Backend) listParts(upload *s3Upload) ([]s3Part, error) {
+	parts := make([]s3Part, 0)
+	marker := 0
+	for {
+		query := url.Values{"uploadId": {upload.uploadId}}
+		if marker > 0 {
+			query.Set("part-number-marker", strconv.Itoa(marker))
+		}
+		var result s3ListPartsResult
+		if err := b.callXml("GET", b.objectKey(upload.fileId), query, nil, nil, &result); err != nil {
+			return nil, err
+		}
+		parts = append(parts, result.Parts...)
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// uploadOffset sums the sent parts and the buffered chunk.
+func (b *S3Backend) uploadOffset(upload *s3Upload) ([]s3Part, int64, int64, error) {
+	parts, err := b.listParts(upload)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var sent int64
+	for _, p := range parts {
+		sent += p.Size
+	}
+	var pending int64
+	res, err := b.call("HEAD", b.pendingKey(upload.fileId), nil, nil, nil)
+	if err == nil {
+		res.Body.Close()
+		pending = res.ContentLength
+	} else if !isS3NotFound(err) {
+		return nil, 0, 0, err
+	}
+	return parts, sent, pending, nil
+}
+
+// UploadChunk only accepts chunks continuing exactly where the previous one ended.
+func (b *S3Backend) UploadChunk(sessionUri string, chunk io.Reader, start int64, end int64, total int64) (*UploadProgress, error) {
+	upload, err := parseS3Upload(sessionUri)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(chunk, end-start+1))
+	if err != nil {
+		return nil, err
+	}
+	parts, sent, pending, err := b.uploadOffset(upload)
+	if err != nil {
+		return nil, err
+	}
+	if start != sent+pending || total != upload.size || int64(len(data)) != end-start+1 {
+		return nil, &googleapi.Error{Code: 400, Message: "Invalid Content-Range"}
+	}
+	if pending > 0 {
+		res, err := b.call("GET", b.pendingKey(upload.fileId), nil, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		buffered, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		data = append(buffered, data...)
+	}
+	last := end+1 == total
+	if len(data) < s3MinPartSize && !last {
+		res, err := b.call("PUT", b.pendingKey(upload.fileId), nil, nil, data)
+		if err != nil {
+			return nil, err
+		}
+		res.Body.Close()
+		return &UploadProgress{Offset: end + 1}, nil
+	}
+	number := len(parts) + 1
+	res, err := b.call("PUT", b.objectKey(upload.fileId), url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {upload.uploadId},
+	}, nil, data)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	parts = append(parts, s3Part{PartNumber: number, ETag: res.Header.Get("ETag")})
+	if pending > 0 {
+		if res, err := b.call("DELETE", b.pendingKey(upload.fileId), nil, nil, nil); err == nil {
+			res.Body.Close()
+		} else {
+			// the part is sent, a leftover buffer would be counted twice
+			return nil, err
+		}
+	}
+	if !last {
+		return &UploadProgress{Offset: end + 1}, nil
+	}
+	return b.completeUpload(upload, parts)
+}
+
+func (b *S3Backend) completeUpload(upload *s3Upload, parts []s3Part) (*UploadProgress, error) {
+	complete := s3CompleteUpload{Parts: make([]s3Part, len(parts))}
+	for i, p := range parts {
+		complete.Parts[i] = s3Part{PartNumber: p.PartNumber, ETag: p.ETag}
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		ETag string `xml:"ETag"`
+	}
+	if err := b.callXml("POST", b.objectKey(upload.fileId), url.Values{"uploadId": {upload.uploadId}}, nil, body, &result); err != nil {
+		return nil, err
+	}
+	file, err := b.GetFile(upload.fileId)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadProgress{Offset: upload.size, File: file}, nil
+}
+
+// QueryUpload reports the finished file once the multipart upload is gone and the object exists.
+func (b *S3Backend) QueryUpload(sessionUri string, total int64) (*UploadProgress, error) {
+	upload, err := parseS3Upload(sessionUri)
+	if err != nil {
+		return nil, err
+	}
+	_, sent, pending, err := b.uploadOffset(upload)
+	if isS3NotFound(err) {
+		file, fileErr := b.GetFile(upload.fileId)
+		if fileErr != nil {
+			return nil, err
+		}
+		return &UploadProgress{Offset: file.Size, File: file}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &UploadProgress{Offset: sent + pending}, nil
+}
+
+// CancelUpload aborts the multipart upload and drops the buffered chunk.
+func (b *S3Backend) CancelUpload(sessionUri string) error {
+	upload, err := parseS3Upload(sessionUri)
+	if err != nil {
+		return nil
+	}
+	if res, err := b.call("DELETE", b.objectKey(upload.fileId), url.Values{"uploadId": {upload.uploadId}}, nil, nil); err == nil {
+		res.Body.Close()
+	} else if !isS3NotFound(err) {
+		return err
+	}
+	if res, err := b.call("DELETE", b.pendingKey(upload.fileId), nil, nil, nil); err == nil {
+		res.Body.Close()
+	} else if !isS3NotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrS3EndpointNotAllowed = errors.New("s3 endpoint is not allowed")
+
+// nonPublicNetworks are refused to endpoints not in S3_ALLOWED_ENDPOINTS, on top of the loopback,
+// link-local, multicast and unspecified addresses.
+var nonPublicNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"fc00::/7",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// s3EndpointAllowed tells whether the host is listed in S3_ALLOWED_ENDPOINTS, as host or host:port.
+// When the list is set, endpoints not in it are refused.
+func s3EndpointAllowed(endpoint *url.URL) (listed bool, err error) {
+	allowed := os.Getenv("S3_ALLOWED_ENDPOINTS")
+	if allowed == "" {
+		return false, nil
+	}
+	for _, host := range strings.Split(allowed, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" && (host == strings.ToLower(endpoint.Host) || host == strings.ToLower(endpoint.Hostname())) {
+			return true, nil
+		}
+	}
+	return false, ErrS3EndpointNotAllowed
+}
+
+// newS3Client builds the client of an endpoint. Listed endpoints may be on a private network, such
+// as a MinIO next to the API; any other endpoint may only resolve to public addresses, checked when
+// dialing so a DNS answer cannot point it inside afterwards. Responses are streamed to the caller, so
+// the timeouts stop at the response headers instead of covering the whole body.
+func newS3Client(listed bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	proxy := http.ProxyFromEnvironment
+	if !listed {
+		dialer.Control = dialPublicOnly
+		proxy = nil
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, address)
+			},
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			ExpectContinueTimeout: time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   8,
+		},
+		// S3 answers with errors rather than redirects, a redirect could lead anywhere
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func dialPublicOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return ErrS3EndpointNotAllowed
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package helper
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"52.216.1.1", true},
+		{"2600:1f18::1", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:169.254.169.254", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("isPublicIP(%s) = %v", tt.ip, got)
+		}
+	}
+}
+
+func TestDialPublicOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"8.8.8.8:443", true},
+		{"169.254.169.254:80", false},
+		{"[::1]:9000", false},
+	}
+	for _, tt := range tests {
+		if err := dialPublicOnly("tcp", tt.address, nil); (err == nil) != tt.allowed {
+			t.Errorf("dialPublicOnly(%s) = %v", tt.address, err)
+		}
+	}
+}
+
+func TestNewS3BackendEndpoint(t *testing.T) {
+	previous, set := os.LookupEnv("S3_ALLOWED_ENDPOINTS")
+	defer func() {
+		if set {
+			os.Setenv("S3_ALLOWED_ENDPOINTS", previous)
+		} else {
+			os.Unsetenv("S3_ALLOWED_ENDPOINTS")
+		}
+	}()
+
+	tests := []struct {
+		name     string
+		allowed  string
+		endpoint string
+		bucket   string
+		ok       bool
+	}{
+		{"default endpoint", "", "", "files", true},
+		{"any public endpoint without a list", "", "https://s3.example.com", "files", true},
+		{"listed host", "minio.internal:9000", "http://minio.internal:9000", "files", true},
+		{"listed host name without port", "minio.internal", "http://minio.internal:9000", "files", true},
+		{"not listed", "minio.internal:9000", "https://s3.amazonaws.com", "files", false},
+		{"unsupported scheme", "", "file:///etc", "files", false},
+		{"user info", "", "https://user@s3.example.com", "files", false},
+		{"bucket moving the host", "", "https://s3.example.com", "x@169.254.169.254#", false},
+		{"bucket with a slash", "", "https://s3.example.com", "a/b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("S3_ALLOWED_ENDPOINTS", tt.allowed)
+			key, _ := json.Marshal(&S3Key{
+				Type:            KeyTypeS3,
+				Endpoint:        tt.endpoint,
+				Bucket:          tt.bucket,
+				AccessKeyId:     "id",
+				SecretAccessKey: "secret",
+				Limit:           1 << 30,
+			})
+			_, err := NewS3Backend(key)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package helper
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"google.golang.org/api/googleapi"
+)
+
+// Account key types. A Google key is the service account JSON, the other backends take a JSON
+// credential of their own with the same "type" field.
+const (
+	KeyTypeServiceAccount = "service_account"
+	KeyTypeLocal          = "local"
+	KeyTypeS3             = "s3"
+)
+
+var ErrNoAccessToken = errors.New("storage backend has no access token, its content is served by the API")
+
+var ErrNotSupported = errors.New("operation not supported by this storage backend")
+
+// KeyType reads the type of an account key, empty when the key is not JSON.
+func KeyType(key []byte) string {
+	var kd KeyDetails
+	if err := json.Unmarshal(key, &kd); err != nil {
+		return ""
+	}
+	return kd.Type
+}
+
+// KeyLabel names the storage behind a key that has no client email: the directory of a local
+// key, the bucket of an S3 key.
+func KeyLabel(key []byte) string {
+	switch KeyType(key) {
+	case KeyTypeLocal:
+		var lk LocalKey
+		if json.Unmarshal(key, &lk) == nil {
+			return "local:" + lk.Root
+		}
+	case KeyTypeS3:
+		var sk S3Key
+		if json.Unmarshal(key, &sk) == nil {
+			return "s3://" + sk.Bucket + "/" + sk.Prefix
+		}
+	}
+	return ""
+}
+
+// newFileId returns a random id for a file stored by a non Google backend.
+func newFileId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func notFoundError(fileId string) error {
+	return &googleapi.Error{Code: 404, Message: "File not found: " + fileId}
+}
+
+func quotaExceededError() error {
+	return &googleapi.Error{
+		Code:    403,
+		Message: "The storage quota has been exceeded.",
+		Errors:  []googleapi.ErrorItem{{Reason: "storageQuotaExceeded"}},
+	}
+}
+
+// noChangesError makes the caller fall back to a full listing, the backend keeps no changes feed.
+func noChangesError() error {
+	return &googleapi.Error{Code: 410, Message: "Storage backend has no changes feed"}
+}
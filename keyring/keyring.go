@@ -0,0 +1,288 @@
+// Package keyring encrypts the private keys stored in Mongo. Values are sealed with AES-GCM under
+// a data key, and the data key is stored wrapped by a master key that never reaches the database.
+package keyring
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/ndphu/drive-manager-api/dao"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sealed values start with prefix, anything else is plaintext from before encryption
+const prefix = "enc:v1:"
+
+const (
+	keySize   = 32
+	dataKeyId = "data_key"
+)
+
+var (
+	ErrNoMasterKey      = errors.New("NoMasterKey")
+	ErrInvalidMasterKey = errors.New("InvalidMasterKey")
+	ErrWrongMasterKey   = errors.New("WrongMasterKey")
+	ErrMalformedValue   = errors.New("MalformedEncryptedValue")
+)
+
+type dataKeyRecord struct {
+	Id          string    `bson:"_id"`
+	Wrapped     []byte    `bson:"wrapped"`
+	MasterKeyId string    `bson:"masterKeyId"`
+	CreatedAt   time.Time `bson:"createdAt"`
+	RotatedAt   time.Time `bson:"rotatedAt,omitempty"`
+}
+
+var (
+	mutex   sync.RWMutex
+	dataKey cipher.AEAD
+)
+
+// LoadMasterKey reads the master key from KEYRING_MASTER_KEY or the file named by
+// KEYRING_MASTER_KEY_FILE. It returns nil when neither is set.
+func LoadMasterKey() ([]byte, error) {
+	if v := os.Getenv("KEYRING_MASTER_KEY"); v != "" {
+		return ParseMasterKey([]byte(v))
+	}
+	if path := os.Getenv("KEYRING_MASTER_KEY_FILE"); path != "" {
+		return ReadMasterKeyFile(path)
+	}
+	return nil, nil
+}
+
+func ReadMasterKeyFile(path string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMasterKey(raw)
+}
+
+// ParseMasterKey accepts 32 raw bytes or their base64 encoding.
+func ParseMasterKey(raw []byte) ([]byte, error) {
+	if len(raw) == keySize {
+		return raw, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(decoded) != keySize {
+		return nil, ErrInvalidMasterKey
+	}
+	return decoded, nil
+}
+
+// GenerateMasterKey returns a new random master key, base64 encoded.
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Init loads the data key, creating it on first use. Without a master key it fails, unless
+// KEYRING_DISABLED=true opts out: then values are stored as plaintext and sealed values cannot be read.
+func Init() error {
+	master, err := LoadMasterKey()
+	if err != nil {
+		return err
+	}
+	if master == nil {
+		if os.Getenv("KEYRING_DISABLED") != "true" {
+			return ErrNoMasterKey
+		}
+		log.Println("Keyring disabled by KEYRING_DISABLED, stored keys are not encrypted")
+		return nil
+	}
+	key, err := loadDataKey(master)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	mutex.Lock()
+	dataKey = aead
+	mutex.Unlock()
+	log.Println("Keyring ready with master key", masterKeyId(master))
+	return nil
+}
+
+func Enabled() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return dataKey != nil
+}
+
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Encrypt seals plain with the data key. It returns plain unchanged when the keyring is disabled.
+func Encrypt(plain []byte) (string, error) {
+	mutex.RLock()
+	aead := dataKey
+	mutex.RUnlock()
+	if aead == nil {
+		return string(plain), nil
+	}
+	sealed, err := seal(aead, plain)
+	if err != nil {
+		return "", err
+	}
+	return prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value from Encrypt. Plaintext values are returned as they are.
+func Decrypt(value string) ([]byte, error) {
+	if !IsEncrypted(value) {
+		return []byte(value), nil
+	}
+	mutex.RLock()
+	aead := dataKey
+	mutex.RUnlock()
+	if aead == nil {
+		return nil, ErrNoMasterKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, prefix))
+	if err != nil {
+		return nil, ErrMalformedValue
+	}
+	return open(aead, sealed)
+}
+
+// RotateMasterKey wraps the data key with next instead of current. Sealed values keep working
+// as the data key itself does not change.
+func RotateMasterKey(current []byte, next []byte) error {
+	if bytes.Equal(current, next) {
+		return errors.New("the new master key is the current one")
+	}
+	key, err := loadDataKey(current)
+	if err != nil {
+		return err
+	}
+	wrapped, err := wrap(next, key)
+	if err != nil {
+		return err
+	}
+	res, err := dao.Keyring().UpdateOne(context.Background(), bson.D{
+		{"_id", dataKeyId},
+		{"masterKeyId", masterKeyId(current)},
+	}, bson.D{{"$set", bson.D{
+		{"wrapped", wrapped},
+		{"masterKeyId", masterKeyId(next)},
+		{"rotatedAt", time.Now()},
+	}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrWrongMasterKey
+	}
+	log.Println("Rotated master key from", masterKeyId(current), "to", masterKeyId(next))
+	return nil
+}
+
+func loadDataKey(master []byte) ([]byte, error) {
+	var record dataKeyRecord
+	err := dao.Keyring().FindOne(context.Background(), bson.D{{"_id", dataKeyId}}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return createDataKey(master)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if record.MasterKeyId != masterKeyId(master) {
+		return nil, ErrWrongMasterKey
+	}
+	return unwrap(master, record.Wrapped)
+}
+
+func createDataKey(master []byte) ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	wrapped, err := wrap(master, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dao.Keyring().InsertOne(context.Background(), dataKeyRecord{
+		Id:          dataKeyId,
+		Wrapped:     wrapped,
+		MasterKeyId: masterKeyId(master),
+		CreatedAt:   time.Now(),
+	}); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			// another instance created it first
+			return loadDataKey(master)
+		}
+		return nil, err
+	}
+	log.Println("Created data key wrapped by master key", masterKeyId(master))
+	return key, nil
+}
+
+func wrap(master []byte, key []byte) ([]byte, error) {
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, key)
+}
+
+func unwrap(master []byte, wrapped []byte) ([]byte, error) {
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	key, err := open(aead, wrapped)
+	if err != nil {
+		return nil, ErrWrongMasterKey
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, plain []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformedValue
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+// masterKeyId identifies a master key without revealing it.
+func masterKeyId(master []byte) string {
+	sum := sha256.Sum256(master)
+	return hex.EncodeToString(sum[:8])
+}
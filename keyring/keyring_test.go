@@ -0,0 +1,151 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+)
+
+// withEnv sets the variables, empty ones unset, until restore is called.
+func withEnv(values map[string]string) (restore func()) {
+	previous := make(map[string]*string)
+	for name, value := range values {
+		if old, ok := os.LookupEnv(name); ok {
+			previous[name] = &old
+		} else {
+			previous[name] = nil
+		}
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+	return func() {
+		for name, old := range previous {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+// withDataKey enables the keyring with a random data key until restore is called.
+func withDataKey(t *testing.T) (restore func()) {
+	encoded, err := GenerateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := base64.StdEncoding.DecodeString(encoded)
+	aead, err := newAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	previous := dataKey
+	dataKey = aead
+	mutex.Unlock()
+	return func() {
+		mutex.Lock()
+		dataKey = previous
+		mutex.Unlock()
+	}
+}
+
+func TestInitWithoutMasterKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled string
+		err      error
+	}{
+		{"refused", "", ErrNoMasterKey},
+		{"refused unless exactly true", "1", ErrNoMasterKey},
+		{"explicitly disabled", "true", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer withEnv(map[string]string{
+				"KEYRING_MASTER_KEY":      "",
+				"KEYRING_MASTER_KEY_FILE": "",
+				"KEYRING_DISABLED":        tt.disabled,
+			})()
+			if err := Init(); err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if Enabled() {
+				t.Fatal("keyring enabled without a master key")
+			}
+		})
+	}
+}
+
+func TestParseMasterKey(t *testing.T) {
+	raw := bytes.Repeat([]byte{7}, keySize)
+	tests := []struct {
+		name  string
+		value []byte
+		err   error
+	}{
+		{"raw bytes", raw, nil},
+		{"base64", []byte(base64.StdEncoding.EncodeToString(raw)), nil},
+		{"base64 with a newline", []byte(base64.StdEncoding.EncodeToString(raw) + "\n"), nil},
+		{"too short", []byte(base64.StdEncoding.EncodeToString(raw[:16])), ErrInvalidMasterKey},
+		{"not base64", []byte("not a key"), ErrInvalidMasterKey},
+	}
+	for _, tt := range tests {
+		key, err := ParseMasterKey(tt.value)
+		if err != tt.err || (err == nil && !bytes.Equal(key, raw)) {
+			t.Errorf("%s: got %x, %v", tt.name, key, err)
+		}
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	defer withDataKey(t)()
+	plain := []byte(`{"type":"service_account","private_key":"secret"}`)
+	sealed, err := Encrypt(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(sealed) || strings.Contains(sealed, "secret") {
+		t.Fatalf("value not sealed: %s", sealed)
+	}
+	tampered := sealed[:len(sealed)-2] + "AA"
+	if tampered == sealed {
+		tampered = sealed[:len(sealed)-2] + "BB"
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		plain []byte
+		ok    bool
+	}{
+		{"sealed", sealed, plain, true},
+		{"plaintext from before encryption", string(plain), plain, true},
+		{"tampered", tampered, nil, false},
+		{"malformed", prefix + "!!!", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := Decrypt(tt.value)
+		if (err == nil) != tt.ok || (tt.ok && !bytes.Equal(got, tt.plain)) {
+			t.Errorf("%s: got %q, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestDecryptWithoutDataKey(t *testing.T) {
+	restore := withDataKey(t)
+	sealed, err := Encrypt([]byte("secret"))
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(sealed); err != ErrNoMasterKey {
+		t.Fatalf("expected ErrNoMasterKey, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package keyring
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/ndphu/drive-manager-api/dao"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+)
+
+// MigrationResult counts the values of one field sealed by MigrateStoredKeys.
+type MigrationResult struct {
+	Collection string `json:"collection"`
+	Field      string `json:"field"`
+	Encrypted  int    `json:"encrypted"`
+	Failed     int    `json:"failed"`
+}
+
+type storedKeyField struct {
+	collection string
+	field      string
+	// the Firebase admin key is stored base64 encoded, it is sealed as plain JSON
+	base64 bool
+}
+
+var storedKeyFields = []storedKeyField{
+	{collection: "drive_account", field: "key"},
+	{collection: "project", field: "adminKey"},
+	{collection: "service_account_admin", field: "key"},
+	{collection: "firebase_admin", field: "key", base64: true},
+}
+
+// MigrateStoredKeys seals every plaintext key still in the database. It can be run again, sealed
+// values are left alone.
+func MigrateStoredKeys() ([]MigrationResult, error) {
+	if !Enabled() {
+		return nil, ErrNoMasterKey
+	}
+	results := make([]MigrationResult, 0, len(storedKeyFields))
+	for _, f := range storedKeyFields {
+		result, err := migrateField(f)
+		if err != nil {
+			return results, err
+		}
+		log.Println("Encrypted", result.Encrypted, "values of", f.collection+"."+f.field+",", result.Failed, "failed")
+		results = append(results, *result)
+	}
+	return results, nil
+}
+
+func migrateField(f storedKeyField) (*MigrationResult, error) {
+	result := &MigrationResult{Collection: f.collection, Field: f.field}
+	collection := dao.RawCollection(f.collection)
+	cursor, err := collection.Find(context.Background(), bson.D{
+		{f.field, bson.D{
+			{"$type", "string"},
+			{"$ne", ""},
+			{"$not", primitive.Regex{Pattern: "^" + prefix}},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		value, _ := doc[f.field].(string)
+		plain := []byte(value)
+		if f.base64 {
+			if plain, err = base64.StdEncoding.DecodeString(value); err != nil {
+				log.Println("Fail to decode", f.collection+"."+f.field, "of", doc["_id"], "by error", err.Error())
+				result.Failed++
+				continue
+			}
+		}
+		sealed, err := Encrypt(plain)
+		if err != nil {
+			return nil, err
+		}
+		// only replace the value that was read, a concurrent update wins
+		if _, err := collection.UpdateOne(context.Background(), bson.D{
+			{"_id", doc["_id"]},
+			{f.field, value},
+		}, bson.D{{"$set", bson.D{{f.field, sealed}}}}); err != nil {
+			log.Println("Fail to encrypt", f.collection+"."+f.field, "of", doc["_id"], "by error", err.Error())
+			result.Failed++
+			continue
+		}
+		result.Encrypted++
+	}
+	return result, cursor.Err()
+}
@@ -6,15 +6,24 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/ndphu/drive-manager-api/controller"
 	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/keyring"
 	"github.com/ndphu/drive-manager-api/middleware"
+	"github.com/ndphu/drive-manager-api/service"
 )
 
 func main() {
+	if runCommand() {
+		return
+	}
 	err := dao.Init()
 	if err != nil {
 		panic(err)
 	}
 	defer dao.Close()
+	if err := keyring.Init(); err != nil {
+		panic(err)
+	}
+	service.GetTokenBroker().Install()
 
 	r := gin.Default()
 
@@ -35,6 +44,7 @@ func main() {
 
 	controller.AdminController(api.Group("/admin"))
 	controller.StreamController(api.Group("/stream"))
+	controller.LinkController(api.Group("/link"))
 
 	manage := api.Group("/manage")
 	manage.Use(middleware.FirebaseAuthMiddleware())
@@ -46,6 +56,21 @@ func main() {
 	controller.UploadController(manage.Group("/upload"))
 	controller.BrowseController(manage.Group("/browse"))
 	controller.FileController(manage.Group("/file"))
+	controller.StreamSessionController(manage.Group("/stream"))
+	controller.SignedLinkController(manage.Group("/link"))
+	controller.ReplicationController(manage.Group("/replication"))
+	controller.RebalanceController(manage.Group("/rebalance"))
+	controller.QuotaController(manage.Group("/quota"))
+	controller.JobController(manage.Group("/job"))
+	controller.ExpansionController(manage.Group("/expansion"))
+
+	service.GetReplicationService().Start()
+	service.GetErasureService().Start()
+	service.GetQuotaService().Start()
+	service.GetJobService().Start()
+	service.GetExpansionService().Start()
+	service.GetKeyRotationService().Start()
+	service.GetHealthChecker().Start()
 
 	//updateProjects()
 
@@ -3,15 +3,18 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ndphu/drive-manager-api/dao"
 	"github.com/ndphu/drive-manager-api/entity"
 	"github.com/ndphu/drive-manager-api/helper"
+	"github.com/ndphu/drive-manager-api/keyring"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 	"log"
 	"strconv"
 	"sync"
@@ -20,6 +23,8 @@ import (
 
 type AccountService struct {
 	//accountCache map[string]*helper.DriveService
+	store   Store
+	backend func(acc *entity.DriveAccount) (helper.DriveBackend, error)
 }
 
 type KeyDetails struct {
@@ -99,9 +104,10 @@ type AccountLookup struct {
 	Limit       int64              `json:"limit" bson:"limit"`
 	Project     entity.Project     `json:"project" bson:"project"`
 	Files       []*helper.File     `json:"files"`
+	NextCursor  string             `json:"nextCursor,omitempty"`
 }
 
-func (s *AccountService) FindAccountLookup(id string, userId string) (*AccountLookup, error) {
+func (s *AccountService) FindAccountLookup(id string, userId string, cursor string) (*AccountLookup, error) {
 	var accs []AccountLookup
 	hexId, _ := primitive.ObjectIDFromHex(id)
 	hexUserId, _ := primitive.ObjectIDFromHex(userId)
@@ -139,31 +145,46 @@ func (s *AccountService) FindAccountLookup(id string, userId string) (*AccountLo
 	}
 
 	acc := accs[0]
-	srv, err := helper.GetDriveService([]byte(acc.Key))
+	key, err := keyring.Decrypt(acc.Key)
 	if err != nil {
 		return nil, err
 	}
-	files, err := srv.ListFiles(1, 50)
+	srv, err := helper.NewDriveBackend(key)
 	if err != nil {
 		return nil, err
 	}
-	for _, file := range files {
+	page, err := srv.ListFilePage(helper.ListOptions{
+		PageSize:  50,
+		PageToken: cursor,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range page.Files {
 		file.AccountId = id
 	}
-	acc.Files = files
+	acc.Files = page.Files
+	acc.NextCursor = page.NextPageToken
 
 	return &acc, err
 }
 
-func (s *AccountService) FindAccount(id string) (*entity.DriveAccount, error) {
-	hex, _ := primitive.ObjectIDFromHex(id)
-	var res entity.DriveAccount
-	if err := dao.DriveAccount().FindOne(context.Background(), bson.D{
-		{"_id", hex},
-	}).Decode(&res); err != nil {
+const UploadBuffer = int64(3221223823) // 3GB
+
+var ErrNoSuitableAccount = errors.New("cannot find suitable account for upload request")
+
+// FindUploadAccount picks an account with room for size plus UploadBuffer using the placement strategy of the owner.
+func (s *AccountService) FindUploadAccount(owner primitive.ObjectID, size int64) (*entity.DriveAccount, error) {
+	placement, err := s.PlaceUpload(&PlacementRequest{Owner: owner, Size: size}, "")
+	if err != nil {
 		return nil, err
 	}
-	return &res, nil
+	return placement.Account, nil
+}
+
+func (s *AccountService) FindAccount(id string) (*entity.DriveAccount, error) {
+	hex, _ := primitive.ObjectIDFromHex(id)
+	return s.store.FindAccount(hex)
 }
 
 func (s *AccountService) FindAccountById(id primitive.ObjectID, owner primitive.ObjectID) (*entity.DriveAccount, error) {
@@ -183,9 +204,18 @@ func (s *AccountService) InitializeKey(acc *entity.DriveAccount, key []byte) err
 	if err != nil {
 		return err
 	}
-	acc.Key = string(key)
+	sealed, err := keyring.Encrypt(key)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	acc.Key = sealed
+	acc.KeyCreatedAt = &now
 	acc.ClientId = kd.ClientId
 	acc.ClientEmail = kd.ClientEmail
+	if acc.ClientEmail == "" {
+		acc.ClientEmail = helper.KeyLabel(key)
+	}
 	acc.Type = kd.Type
 
 	return nil
@@ -205,34 +235,32 @@ func (s *AccountService) UpdateKey(id string, key []byte) error {
 		return err
 	} else {
 		log.Println("UpdateKey completed with ModifiedCount=", update.ModifiedCount)
+		GetServiceCache().Invalidate(hexId)
+		GetTokenBroker().Evict(acc.ClientEmail)
 		return nil
 	}
 }
 
 func (s *AccountService) UpdateCachedQuotaByAccountId(accountId string) error {
-	var acc entity.DriveAccount
 	hexId, _ := primitive.ObjectIDFromHex(accountId)
-	if err := dao.DriveAccount().FindOne(context.Background(), bson.D{{"_id", hexId}}).Decode(&acc); err != nil {
+	acc, err := s.store.FindAccount(hexId)
+	if err != nil {
 		return err
 	}
-	return s.UpdateCachedQuota(&acc)
+	return s.UpdateCachedQuota(acc)
 }
 
+// UpdateCachedQuotaByAccountIdAndAdditionalSize accounts addedSize on the cached quota without asking Drive.
+// quotaUpdateTimestamp is left alone as the values are only an estimate until the next refresh.
 func (s *AccountService) UpdateCachedQuotaByAccountIdAndAdditionalSize(accountId string, addedSize int64) error {
-	var acc entity.DriveAccount
 	hexId, _ := primitive.ObjectIDFromHex(accountId)
-	if err := dao.DriveAccount().FindOne(context.Background(), bson.D{{"_id", hexId}}).Decode(&acc); err != nil {
-		return err
-	}
-	updatedAt := time.Now()
 	if update, err := dao.DriveAccount().UpdateOne(
 		context.Background(),
 		bson.D{{"_id", hexId}},
 		bson.D{
-			{"$set", bson.D{
-				{"usage", acc.Usage + addedSize},
-				{"available", acc.Limit - addedSize},
-				{"quotaUpdateTimestamp", updatedAt},
+			{"$inc", bson.D{
+				{"usage", addedSize},
+				{"available", -addedSize},
 			}},
 		}); err != nil {
 		return err
@@ -243,7 +271,7 @@ func (s *AccountService) UpdateCachedQuotaByAccountIdAndAdditionalSize(accountId
 }
 
 func (s *AccountService) UpdateCachedQuota(acc *entity.DriveAccount) error {
-	driveService, err := helper.GetDriveService([]byte(acc.Key))
+	driveService, err := s.GetDriveBackend(acc)
 	if err != nil {
 		return err
 	}
@@ -254,24 +282,9 @@ func (s *AccountService) UpdateCachedQuota(acc *entity.DriveAccount) error {
 	updatedAt := time.Now()
 	acc.Usage = quota.Usage
 	acc.Limit = quota.Limit
-	acc.Available = quota.Limit - quota.Usage
+	acc.Available = quota.Limit - quota.Usage - acc.Reserved
 	acc.QuotaUpdateTimestamp = updatedAt
-	if update, err := dao.DriveAccount().UpdateOne(
-		context.Background(),
-		bson.D{{"_id", acc.Id}},
-		bson.D{
-			{"$set", bson.D{
-				{"usage", quota.Usage},
-				{"limit", quota.Limit},
-				{"available", quota.Limit - quota.Usage},
-				{"quotaUpdateTimestamp", updatedAt},
-			}},
-		}); err != nil {
-		return err
-	} else {
-		log.Println("UpdateCachedQuota completed with ModifiedCount=", update.ModifiedCount)
-		return nil
-	}
+	return s.store.SaveQuota(acc.Id, quota, updatedAt)
 }
 
 type FileLookup struct {
@@ -312,7 +325,11 @@ func (s *AccountService) GetDownloadLinkByFileId(fileId string) (*drive.File, *h
 	if err := cursor.Decode(&res); err != nil {
 		return nil, nil, err
 	}
-	srv, err := helper.GetDriveService([]byte(res.AccountKey))
+	key, err := keyring.Decrypt(res.AccountKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	srv, err := helper.GetDriveService(key)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -354,13 +371,13 @@ func (s *AccountService) UpdateAllAccountQuota() error {
 	wg := sync.WaitGroup{}
 	for _, acc := range all {
 		wg.Add(1)
-		go func(id string, name string) {
+		go func(acc *entity.DriveAccount) {
 			err := s.UpdateCachedQuota(acc)
 			if err != nil {
-				fmt.Println("fail to update quota for", id, name, "error", err.Error())
+				fmt.Println("fail to update quota for", acc.Id.Hex(), acc.Name, "error", err.Error())
 			}
 			wg.Done()
-		}(acc.Id.Hex(), acc.Name)
+		}(acc)
 	}
 	wg.Wait()
 	fmt.Println("finished update account quota")
@@ -389,7 +406,9 @@ var accountService *AccountService
 func GetAccountService() *AccountService {
 	if accountService == nil {
 		accountService = &AccountService{
+			store: mongoStore{},
 		}
+		accountService.backend = accountService.cachedDriveBackend
 	}
 	return accountService
 }
@@ -398,8 +417,30 @@ func (s *AccountService) GetAccountCount() int64 {
 	n, _ := dao.RawCollection("drive_account").CountDocuments(context.Background(), nil)
 	return n
 }
+// GetDriveBackend returns the backend of the account, the cached one outside of tests.
+func (s *AccountService) GetDriveBackend(acc *entity.DriveAccount) (helper.DriveBackend, error) {
+	return s.backend(acc)
+}
+
+// cachedDriveBackend returns the cached backend of the account, its calls going through the account breaker.
+func (s *AccountService) cachedDriveBackend(acc *entity.DriveAccount) (helper.DriveBackend, error) {
+	backend, err := GetServiceCache().DriveBackend(acc.Id, acc.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &breakerBackend{backend: backend, accountId: acc.Id, breaker: GetAccountBreaker()}, nil
+}
+
+func (s *AccountService) newDriveBackend(acc *entity.DriveAccount) (helper.DriveBackend, error) {
+	key, err := keyring.Decrypt(acc.Key)
+	if err != nil {
+		return nil, err
+	}
+	return helper.NewDriveBackend(key)
+}
+
 func (s *AccountService) GetAccessToken(acc *entity.DriveAccount) (string, error) {
-	srv, err := helper.GetDriveService([]byte(acc.Key))
+	srv, err := s.GetDriveBackend(acc)
 	if err != nil {
 		return "", err
 	}
@@ -413,13 +454,17 @@ func (s *AccountService) CreateServiceAccount(projectId string, userId string) (
 		return nil, err
 	}
 
-	key, err := parseKeyDetails([]byte(admin.Key))
+	adminKey, err := keyring.Decrypt(admin.Key)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKeyDetails(adminKey)
 	if err != nil {
 		log.Println("Fail to parse key of admin account")
 		return nil, err
 	}
 
-	iamService, err := helper.NewIamService([]byte(admin.Key))
+	iamService, err := GetServiceCache().IamService(admin.Id, admin.Key)
 	if err != nil {
 		log.Println("Fail to initialize IAM service with admin key by error", err.Error())
 		return nil, err
@@ -436,6 +481,10 @@ func (s *AccountService) CreateServiceAccount(projectId string, userId string) (
 		log.Println("Fail to generate service account key file by error", err.Error())
 		return nil, err
 	}
+	sealedKey, err := keyring.Encrypt(saKey)
+	if err != nil {
+		return nil, err
+	}
 	userIdHex, _ := primitive.ObjectIDFromHex(userId)
 	projectIdHex, _ := primitive.ObjectIDFromHex(projectId)
 	acc := &entity.DriveAccount{
@@ -445,7 +494,7 @@ func (s *AccountService) CreateServiceAccount(projectId string, userId string) (
 		Type:                 "service_account",
 		ClientEmail:          account.Email,
 		ClientId:             account.Oauth2ClientId,
-		Key:                  string(saKey),
+		Key:                  sealedKey,
 		Usage:                0,
 		Limit:                0,
 		Owner:                userIdHex,
@@ -482,8 +531,12 @@ func (s *AccountService) FindAdminAccount(projectId string) (*entity.DriveAccoun
 
 func migrateAdminAccount(project entity.Project) (*entity.DriveAccount, error) {
 	log.Println("Migrate admin account for project", project.Id.Hex())
+	adminKey, err := keyring.Decrypt(project.AdminKey)
+	if err != nil {
+		return nil, err
+	}
 	kd := KeyDetails{}
-	if err := json.Unmarshal([]byte(project.AdminKey), &kd); err != nil {
+	if err := json.Unmarshal(adminKey, &kd); err != nil {
 		return nil, err
 	}
 	accountId := primitive.NewObjectID()
@@ -506,73 +559,192 @@ func migrateAdminAccount(project entity.Project) (*entity.DriveAccount, error) {
 }
 
 type FileIndex struct {
-	Id           primitive.ObjectID `json:"id" bson:"_id"`
-	FileId       string             `json:"fileId" bson:"fileId"`
-	Name         string             `json:"name" bson:"name"`
-	Size         int64              `json:"size" bson:"size"`
-	MimeType     string             `json:"mimeType" bson:"mimeType"`
-	AccountId    primitive.ObjectID `json:"accountId" bson:"accountId"`
-	Owner        primitive.ObjectID `json:"owner" bson:"owner"`
-	ProjectId    primitive.ObjectID `json:"projectId" bson:"projectId"`
-	CreatedTime  time.Time          `json:"createdTime" bson:"createdTime"`
-	ModifiedTime time.Time          `json:"modifiedTime" bson:"modifiedTime"`
-	SyncTime     time.Time          `json:"syncTime" bson:"syncTime"`
+	Id           primitive.ObjectID  `json:"id" bson:"_id"`
+	FileId       string              `json:"fileId" bson:"fileId"`
+	Name         string              `json:"name" bson:"name"`
+	Size         int64               `json:"size" bson:"size"`
+	MimeType     string              `json:"mimeType" bson:"mimeType"`
+	AccountId    primitive.ObjectID  `json:"accountId" bson:"accountId"`
+	Owner        primitive.ObjectID  `json:"owner" bson:"owner"`
+	ProjectId    primitive.ObjectID  `json:"projectId" bson:"projectId"`
+	CreatedTime  time.Time           `json:"createdTime" bson:"createdTime"`
+	ModifiedTime time.Time           `json:"modifiedTime" bson:"modifiedTime"`
+	SyncTime     time.Time           `json:"syncTime" bson:"syncTime"`
+	Storage      string              `json:"storage,omitempty" bson:"storage,omitempty"`
+	ManifestId   *primitive.ObjectID `json:"manifestId,omitempty" bson:"manifestId,omitempty"`
+	Replicas     []FileReplica       `json:"replicas,omitempty" bson:"replicas,omitempty"`
 }
 
 func (s *AccountService) IndexAccountFiles(acc entity.DriveAccount) error {
-	ds, err := helper.GetDriveService([]byte(acc.Key))
+	ds, err := s.GetDriveBackend(&acc)
 	if err != nil {
 		log.Println("Account", acc.Id.Hex(), "Fail to get drive service from key by error", err.Error())
 		return err
 	}
 
-	if _, err := dao.RawCollection("drive_account").DeleteMany(context.Background(), bson.D{
-		{"accountId", acc.Id},
+	replicas, err := s.store.ReplicaFileIds(acc.Id)
+	if err != nil {
+		log.Println("Account", acc.Id.Hex(), "Fail to list replicas by error", err.Error())
+		return err
+	}
+	syncTime := time.Now()
+	// trashed files are dropped by the delta sync too
+	if err := helper.EachFile(ds, helper.ListOptions{Query: helper.QueryNotTrashed, PageSize: 500}, func(file *helper.File) error {
+		log.Println(file.Id, file.Name, file.AccountId, file.MimeType)
+		if file.MimeType == ChunkPartMimeType {
+			// parts are listed through their manifest
+			return nil
+		}
+		if replicas[file.Id] {
+			return nil
+		}
+		if err := s.store.UpsertFileIndex(fileIndexEntry(acc, file, syncTime)); err != nil {
+			log.Println("Fail to insert file index")
+			return err
+		}
+		return nil
 	}); err != nil {
+		log.Println("Account", acc.Id.Hex(), "Fail to list files in account by error", err.Error())
+		return err
+	}
+
+	// entries not seen by this listing are gone from Drive
+	if deleted, err := s.store.DeleteStaleFileIndex(acc.Id, syncTime); err != nil {
 		log.Println("Fail to remove old files index")
+		return err
+	} else {
+		log.Println("Account", acc.Id.Hex(), "removed", deleted, "stale file_index records")
 	}
+	return nil
 
-	page := 1
-	size := 500
+}
+
+// ReindexAccountFiles lists every file of the account and stores a fresh changes token,
+// taken before the listing so nothing changed meanwhile is missed by the next delta sync.
+func (s *AccountService) ReindexAccountFiles(acc entity.DriveAccount) error {
+	ds, err := s.GetDriveBackend(&acc)
+	if err != nil {
+		log.Println("Account", acc.Id.Hex(), "Fail to get drive service from key by error", err.Error())
+		return err
+	}
+	token, err := ds.GetStartPageToken()
+	if err != nil {
+		log.Println("Account", acc.Id.Hex(), "Fail to get changes start page token by error", err.Error())
+		return err
+	}
+	if err := s.IndexAccountFiles(acc); err != nil {
+		return err
+	}
+	return s.store.SaveChangesPageToken(acc.Id, token)
+}
+
+// SyncAccountChanges applies the Drive changes since the stored token to file_index.
+// Accounts without a token, or with an expired one, fall back to a full reindex.
+func (s *AccountService) SyncAccountChanges(acc entity.DriveAccount) error {
+	if acc.ChangesPageToken == "" {
+		log.Println("Account", acc.Id.Hex(), "has no changes token, performing full reindex")
+		return s.ReindexAccountFiles(acc)
+	}
+	ds, err := s.GetDriveBackend(&acc)
+	if err != nil {
+		log.Println("Account", acc.Id.Hex(), "Fail to get drive service from key by error", err.Error())
+		return err
+	}
+	token := acc.ChangesPageToken
+	applied := 0
 	for {
-		files, err := ds.ListFiles(page, int64(size))
+		page, err := ds.ListChanges(token)
 		if err != nil {
-			log.Println("Account", acc.Id.Hex(), "Fail to list files in account by error", err.Error())
+			if isExpiredPageToken(err) {
+				log.Println("Account", acc.Id.Hex(), "changes token expired, performing full reindex")
+				return s.ReindexAccountFiles(acc)
+			}
+			log.Println("Account", acc.Id.Hex(), "Fail to list changes by error", err.Error())
 			return err
 		}
-
-		for _, file := range files {
-			log.Println(file.Id, file.Name, file.AccountId, file.MimeType)
-			ct, _ := time.Parse("2006-01-02T15:04:05Z", file.CreatedTime)
-			mt, _ := time.Parse("2006-01-02T15:04:05Z", file.ModifiedTime)
-
-			f := FileIndex{
-				Id:           primitive.NewObjectID(),
-				FileId:       file.Id,
-				Name:         file.Name,
-				Size:         file.Size,
-				MimeType:     file.MimeType,
-				AccountId:    acc.Id,
-				Owner:        acc.Owner,
-				ProjectId:    acc.ProjectId,
-				CreatedTime:  ct,
-				ModifiedTime: mt,
-				SyncTime:     time.Now(),
-			}
-			if _, err := dao.FileIndex().InsertOne(context.Background(), f); err != nil {
-				log.Println("Fail to insert file index")
+		syncTime := time.Now()
+		for _, change := range page.Changes {
+			if err := s.applyChange(acc, change, syncTime); err != nil {
+				log.Println("Account", acc.Id.Hex(), "Fail to apply change for file", change.FileId, "by error", err.Error())
 				return err
 			}
 		}
-
-		if len(files) < size {
+		applied += len(page.Changes)
+		if page.NewStartPageToken != "" {
+			token = page.NewStartPageToken
+		} else {
+			token = page.NextPageToken
+		}
+		// saved after every page so an interrupted sync resumes from here
+		if err := s.store.SaveChangesPageToken(acc.Id, token); err != nil {
+			return err
+		}
+		if page.NewStartPageToken != "" {
 			break
 		}
-		page = page + 1
 	}
+	log.Println("Account", acc.Id.Hex(), "applied", applied, "changes")
+	return nil
+}
 
+func (s *AccountService) applyChange(acc entity.DriveAccount, change *helper.Change, syncTime time.Time) error {
+	if change.Removed || change.Trashed || change.File == nil {
+		if err := s.store.DeleteAccountFile(acc.Id, change.FileId); err != nil {
+			return err
+		}
+		return s.store.RemoveReplica(acc.Id, change.FileId)
+	}
+	if change.File.MimeType == ChunkPartMimeType {
+		return nil
+	}
+	if replica, err := s.store.IsReplicaFile(acc.Id, change.File.Id); err != nil || replica {
+		return err
+	}
+	return s.store.UpsertFileIndex(fileIndexEntry(acc, change.File, syncTime))
+}
+
+func fileIndexEntry(acc entity.DriveAccount, file *helper.File, syncTime time.Time) *FileIndex {
+	ct, _ := time.Parse("2006-01-02T15:04:05Z", file.CreatedTime)
+	mt, _ := time.Parse("2006-01-02T15:04:05Z", file.ModifiedTime)
+	return &FileIndex{
+		FileId:       file.Id,
+		Name:         file.Name,
+		Size:         file.Size,
+		MimeType:     file.MimeType,
+		AccountId:    acc.Id,
+		Owner:        acc.Owner,
+		ProjectId:    acc.ProjectId,
+		CreatedTime:  ct,
+		ModifiedTime: mt,
+		SyncTime:     syncTime,
+	}
+}
+
+func saveChangesPageToken(accountId primitive.ObjectID, token string) error {
+	if _, err := dao.DriveAccount().UpdateOne(context.Background(), bson.D{{"_id", accountId}}, bson.D{
+		{"$set", bson.D{
+			{"changesPageToken", token},
+			{"changesSyncTimestamp", time.Now()},
+		}},
+	}); err != nil {
+		log.Println("Account", accountId.Hex(), "Fail to save changes page token by error", err.Error())
+		return err
+	}
 	return nil
+}
+
+func isExpiredPageToken(err error) bool {
+	if e, ok := err.(*googleapi.Error); ok {
+		return e.Code == 400 || e.Code == 404 || e.Code == 410
+	}
+	return false
+}
 
+func isNotFound(err error) bool {
+	if e, ok := err.(*googleapi.Error); ok {
+		return e.Code == 404
+	}
+	return false
 }
 
 type FileFavorite struct {
@@ -651,7 +823,7 @@ func (s *AccountService) SyncFileById(userId string, accountId string, fileId st
 		log.Println("SyncFileById", "failed by error", err.Error())
 		return nil, err
 	}
-	ds, err := helper.GetDriveService([]byte(acc.Key))
+	ds, err := s.GetDriveBackend(&acc)
 	if err != nil {
 		log.Println("SyncFileById", "Account", acc.Id.Hex(), "Fail to get drive service from key by error", err.Error())
 		return nil, err
@@ -688,12 +860,16 @@ func (s *AccountService) ListFile(accountId string) ([]*helper.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	ds, err := helper.GetDriveService([]byte(acc.Key))
+	ds, err := s.GetDriveBackend(acc)
 	if err != nil {
 		log.Println("SyncFileById", "Account", acc.Id.Hex(), "Fail to get drive service from key by error", err.Error())
 		return nil, err
 	}
 
 	//accountService.FindAdminAccount()
-	return ds.ListFiles(1, 1000)
+	page, err := ds.ListFilePage(helper.ListOptions{PageSize: 1000})
+	if err != nil {
+		return nil, err
+	}
+	return page.Files, nil
 }
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/api/googleapi"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// indexFixture is an account on a fake backend, indexed into a memory store.
+type indexFixture struct {
+	store   *memoryStore
+	as      *AccountService
+	acc     *entity.DriveAccount
+	backend *helper.FakeDriveBackend
+}
+
+func newIndexFixture() *indexFixture {
+	store := newMemoryStore()
+	backends := make(map[primitive.ObjectID]*helper.FakeDriveBackend)
+	acc := store.addAccount(backends, primitive.NewObjectID(), 1<<30)
+	return &indexFixture{
+		store:   store,
+		as:      newStoreAccountService(store, backends),
+		acc:     acc,
+		backend: backends[acc.Id],
+	}
+}
+
+// account is the account as stored, with the changes token saved by the last sync.
+func (f *indexFixture) account() entity.DriveAccount {
+	return *f.store.accounts[f.acc.Id]
+}
+
+func TestIndexAccountFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(f *indexFixture)
+		// indexed names after the run
+		expected []string
+		failed   bool
+	}{
+		{"lists every file", func(f *indexFixture) {
+			f.backend.PutFile("b.txt", "text/plain", []byte("b"))
+		}, []string{"a.txt", "b.txt"}, false},
+		{"skips trashed files", func(f *indexFixture) {
+			f.backend.Trash(f.backend.PutFile("trashed.txt", "text/plain", []byte("t")).Id)
+		}, []string{"a.txt"}, false},
+		{"skips chunk parts", func(f *indexFixture) {
+			f.backend.PutFile("big.bin.part0000", ChunkPartMimeType, []byte("p"))
+		}, []string{"a.txt"}, false},
+		{"skips replicas of other files", func(f *indexFixture) {
+			replica := f.backend.PutFile("copy.txt", "text/plain", []byte("c"))
+			f.store.files[primitive.NewObjectID()] = &FileIndex{
+				AccountId: primitive.NewObjectID(),
+				FileId:    "original",
+				Name:      "original.txt",
+				Replicas:  []FileReplica{{AccountId: f.acc.Id, FileId: replica.Id}},
+			}
+		}, []string{"a.txt"}, false},
+		{"drops entries gone from Drive", func(f *indexFixture) {
+			f.store.files[primitive.NewObjectID()] = &FileIndex{
+				AccountId: f.acc.Id,
+				FileId:    "deleted",
+				Name:      "deleted.txt",
+				SyncTime:  time.Now().Add(-time.Hour),
+			}
+		}, []string{"a.txt"}, false},
+		{"keeps the index when the listing fails", func(f *indexFixture) {
+			f.store.files[primitive.NewObjectID()] = &FileIndex{
+				AccountId: f.acc.Id,
+				FileId:    "old",
+				Name:      "old.txt",
+				SyncTime:  time.Now().Add(-time.Hour),
+			}
+			f.backend.FailWith(helper.FakeOpList, &googleapi.Error{Code: 500})
+		}, []string{"old.txt"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newIndexFixture()
+			f.backend.PutFile("a.txt", "text/plain", []byte("a"))
+			tt.setup(f)
+			err := f.as.IndexAccountFiles(f.account())
+			if (err != nil) != tt.failed {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if names := f.store.indexedNames(f.acc.Id); !reflect.DeepEqual(names, tt.expected) {
+				t.Fatalf("indexed %v, expected %v", names, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSyncAccountChanges(t *testing.T) {
+	tests := []struct {
+		name string
+		// runs after a first sync of a.txt and b.txt
+		change   func(f *indexFixture)
+		expected []string
+	}{
+		{"new file", func(f *indexFixture) {
+			f.backend.PutFile("c.txt", "text/plain", []byte("c"))
+		}, []string{"a.txt", "b.txt", "c.txt"}},
+		{"renamed file", func(f *indexFixture) {
+			f.backend.Rename(f.backend.Files()[0].File.Id, "renamed.txt")
+		}, []string{"b.txt", "renamed.txt"}},
+		{"trashed file", func(f *indexFixture) {
+			f.backend.Trash(f.backend.Files()[0].File.Id)
+		}, []string{"b.txt"}},
+		{"deleted file", func(f *indexFixture) {
+			f.backend.DeleteFile(f.backend.Files()[1].File.Id)
+		}, []string{"a.txt"}},
+		{"new chunk part", func(f *indexFixture) {
+			f.backend.PutFile("big.bin.part0000", ChunkPartMimeType, []byte("p"))
+		}, []string{"a.txt", "b.txt"}},
+		{"expired token falls back to a full reindex", func(f *indexFixture) {
+			f.backend.PutFile("c.txt", "text/plain", []byte("c"))
+			f.store.accounts[f.acc.Id].ChangesPageToken = "999"
+		}, []string{"a.txt", "b.txt", "c.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newIndexFixture()
+			f.backend.PutFile("a.txt", "text/plain", []byte("a"))
+			f.backend.PutFile("b.txt", "text/plain", []byte("b"))
+			// no token yet, so this one reindexes
+			if err := f.as.SyncAccountChanges(f.account()); err != nil {
+				t.Fatal(err)
+			}
+			if names := f.store.indexedNames(f.acc.Id); !reflect.DeepEqual(names, []string{"a.txt", "b.txt"}) {
+				t.Fatalf("first sync indexed %v", names)
+			}
+			tt.change(f)
+			if err := f.as.SyncAccountChanges(f.account()); err != nil {
+				t.Fatal(err)
+			}
+			if names := f.store.indexedNames(f.acc.Id); !reflect.DeepEqual(names, tt.expected) {
+				t.Fatalf("indexed %v, expected %v", names, tt.expected)
+			}
+			token, _ := f.backend.GetStartPageToken()
+			if saved := f.account().ChangesPageToken; saved != token {
+				t.Fatalf("saved token %q, expected %q", saved, token)
+			}
+		})
+	}
+}
+
+func TestSyncAccountChangesKeepsTokenOnFailure(t *testing.T) {
+	f := newIndexFixture()
+	if err := f.as.SyncAccountChanges(f.account()); err != nil {
+		t.Fatal(err)
+	}
+	token := f.account().ChangesPageToken
+	f.backend.PutFile("a.txt", "text/plain", []byte("a"))
+	f.backend.FailNext(helper.FakeOpChanges, &googleapi.Error{Code: 500})
+	if err := f.as.SyncAccountChanges(f.account()); err == nil {
+		t.Fatal("sync succeeded")
+	}
+	if f.account().ChangesPageToken != token {
+		t.Fatal("token moved past changes not applied")
+	}
+	if err := f.as.SyncAccountChanges(f.account()); err != nil {
+		t.Fatal(err)
+	}
+	if names := f.store.indexedNames(f.acc.Id); !reflect.DeepEqual(names, []string{"a.txt"}) {
+		t.Fatalf("indexed %v after the retry", names)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/golang-jwt/jwt"
 	"github.com/ndphu/drive-manager-api/dao"
 	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/keyring"
 	"github.com/nu7hatch/gouuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -44,7 +45,7 @@ func GetAuthService() (*AuthService, error) {
 			log.Fatalln("fail to get Firebase Admin key", err.Error())
 		}
 
-		rawKey, err := base64.StdEncoding.DecodeString(adminAccount.Key)
+		rawKey, err := firebaseAdminKey(adminAccount.Key)
 		if err != nil {
 			log.Fatalln("fail to parse admin key")
 		}
@@ -63,6 +64,14 @@ func GetAuthService() (*AuthService, error) {
 	return authService, nil
 }
 
+// firebaseAdminKey returns the JSON key of the Firebase admin, stored sealed or base64 encoded.
+func firebaseAdminKey(value string) ([]byte, error) {
+	if keyring.IsEncrypted(value) {
+		return keyring.Decrypt(value)
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
+
 func (s *AuthService) getAuthClient() (*auth.Client, error) {
 	return s.App.Auth(context.Background())
 }
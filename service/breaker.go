@@ -0,0 +1,354 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrAccountCircuitOpen = errors.New("account is temporarily out of rotation after repeated failures")
+
+// AccountBreaker counts consecutive failed Drive calls per account. After Threshold failures the
+// circuit opens: calls fail fast and the account is left out of placement for Cooldown. Then one
+// trial call is let through, closing the circuit when it succeeds and opening it again otherwise.
+type AccountBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mutex    sync.Mutex
+	accounts map[primitive.ObjectID]*circuit
+}
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+	trial     bool
+	lastError string
+}
+
+// isOpen tells whether the cooldown is still running. Once it is over the circuit is half-open:
+// the account is placeable again and its next call is the trial.
+func (c *circuit) isOpen(now time.Time) bool {
+	return now.Before(c.openUntil)
+}
+
+// CircuitState describes an account whose circuit is not closed.
+type CircuitState struct {
+	AccountId primitive.ObjectID `json:"accountId"`
+	Failures  int                `json:"failures"`
+	OpenUntil time.Time          `json:"openUntil"`
+	LastError string             `json:"lastError,omitempty"`
+}
+
+var accountBreaker *AccountBreaker
+
+func GetAccountBreaker() *AccountBreaker {
+	if accountBreaker == nil {
+		accountBreaker = &AccountBreaker{
+			Threshold: intFromEnv("ACCOUNT_BREAKER_THRESHOLD", 5),
+			Cooldown:  durationFromEnv("ACCOUNT_BREAKER_COOLDOWN", 5*time.Minute),
+			accounts:  make(map[primitive.ObjectID]*circuit),
+		}
+	}
+	return accountBreaker
+}
+
+// Allow tells whether a call to the account may go out.
+func (b *AccountBreaker) Allow(id primitive.ObjectID) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c := b.accounts[id]
+	if c == nil || c.openUntil.IsZero() {
+		return true
+	}
+	if c.trial || time.Now().Before(c.openUntil) {
+		return false
+	}
+	c.trial = true
+	return true
+}
+
+// IsOpen tells whether the account is out of rotation. A half-open account is not.
+func (b *AccountBreaker) IsOpen(id primitive.ObjectID) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c := b.accounts[id]
+	return c != nil && c.isOpen(time.Now())
+}
+
+// Record counts the outcome of a call to the account. Errors telling nothing about the account,
+// such as a missing file, count as success.
+func (b *AccountBreaker) Record(id primitive.ObjectID, err error) {
+	if err == nil || !isAccountFailure(err) {
+		b.Reset(id)
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c := b.accounts[id]
+	if c == nil {
+		c = &circuit{}
+		b.accounts[id] = c
+	}
+	c.failures++
+	c.lastError = err.Error()
+	if c.trial || c.failures >= b.Threshold {
+		if c.openUntil.IsZero() {
+			log.Println("Taking account", id.Hex(), "out of rotation after", c.failures, "failures, last error", c.lastError)
+		}
+		c.openUntil = time.Now().Add(b.Cooldown)
+		c.trial = false
+	}
+}
+
+// Reset closes the circuit of the account.
+func (b *AccountBreaker) Reset(id primitive.ObjectID) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if c := b.accounts[id]; c != nil {
+		if !c.openUntil.IsZero() {
+			log.Println("Account", id.Hex(), "is back in rotation")
+		}
+		delete(b.accounts, id)
+	}
+}
+
+func (b *AccountBreaker) openIds() []primitive.ObjectID {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ids := make([]primitive.ObjectID, 0)
+	now := time.Now()
+	for id, c := range b.accounts {
+		if c.isOpen(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Open lists the accounts currently out of rotation.
+func (b *AccountBreaker) Open() []CircuitState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	states := make([]CircuitState, 0)
+	now := time.Now()
+	for id, c := range b.accounts {
+		if c.isOpen(now) {
+			states = append(states, CircuitState{
+				AccountId: id,
+				Failures:  c.failures,
+				OpenUntil: c.openUntil,
+				LastError: c.lastError,
+			})
+		}
+	}
+	return states
+}
+
+// OpenCircuits lists the accounts of the owner currently out of rotation.
+func OpenCircuits(owner primitive.ObjectID) ([]CircuitState, error) {
+	states := GetAccountBreaker().Open()
+	if len(states) == 0 {
+		return states, nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(states))
+	for _, state := range states {
+		ids = append(ids, state.AccountId)
+	}
+	owned := make(map[primitive.ObjectID]bool)
+	var accounts []entity.DriveAccount
+	cursor, err := dao.DriveAccount().Find(context.Background(), bson.D{
+		{"_id", bson.D{{"$in", ids}}},
+		{"owner", owner},
+	}, options.Find().SetProjection(bson.D{{"_id", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &accounts); err != nil {
+		return nil, err
+	}
+	for _, acc := range accounts {
+		owned[acc.Id] = true
+	}
+	result := make([]CircuitState, 0, len(accounts))
+	for _, state := range states {
+		if owned[state.AccountId] {
+			result = append(result, state)
+		}
+	}
+	return result, nil
+}
+
+// closedCircuitFilter keeps accounts out of rotation out of a drive_account query.
+func closedCircuitFilter() bson.E {
+	return bson.E{Key: "$and", Value: bson.A{bson.D{{"_id", bson.D{{"$nin", GetAccountBreaker().openIds()}}}}}}
+}
+
+// isAccountFailure tells whether the error points at the account or at Google rather than at the
+// request: rate limits and server errors left after retrying, rejected credentials, network errors.
+func isAccountFailure(err error) bool {
+	if helper.IsRetryable(err) {
+		return true
+	}
+	switch e := err.(type) {
+	case *googleapi.Error:
+		return e.Code == http.StatusUnauthorized
+	case *oauth2.RetrieveError:
+		return true
+	case net.Error:
+		return true
+	}
+	if e, ok := err.(interface{ Unwrap() error }); ok && e.Unwrap() != nil {
+		return isAccountFailure(e.Unwrap())
+	}
+	return false
+}
+
+// breakerBackend reports the outcome of every call to the account breaker and fails fast while
+// the circuit is open.
+type breakerBackend struct {
+	backend   helper.DriveBackend
+	accountId primitive.ObjectID
+	breaker   *AccountBreaker
+}
+
+var _ helper.DriveBackend = (*breakerBackend)(nil)
+
+func (b *breakerBackend) call(fn func() error) error {
+	if !b.breaker.Allow(b.accountId) {
+		return ErrAccountCircuitOpen
+	}
+	err := fn()
+	b.breaker.Record(b.accountId, err)
+	return err
+}
+
+func (b *breakerBackend) GetQuotaUsage() (quota *helper.Quota, err error) {
+	err = b.call(func() error {
+		quota, err = b.backend.GetQuotaUsage()
+		return err
+	})
+	return quota, err
+}
+
+func (b *breakerBackend) ListFilePage(opts helper.ListOptions) (page *helper.FilePage, err error) {
+	err = b.call(func() error {
+		page, err = b.backend.ListFilePage(opts)
+		return err
+	})
+	return page, err
+}
+
+func (b *breakerBackend) GetFile(fileId string) (file *drive.File, err error) {
+	err = b.call(func() error {
+		file, err = b.backend.GetFile(fileId)
+		return err
+	})
+	return file, err
+}
+
+func (b *breakerBackend) UploadFileFromStream(name string, description string, mimeType string, is io.Reader) (file *drive.File, err error) {
+	err = b.call(func() error {
+		file, err = b.backend.UploadFileFromStream(name, description, mimeType, is)
+		return err
+	})
+	return file, err
+}
+
+func (b *breakerBackend) Download(fileId string, byteRange string) (res *http.Response, err error) {
+	err = b.call(func() error {
+		res, err = b.backend.Download(fileId, byteRange)
+		return err
+	})
+	return res, err
+}
+
+func (b *breakerBackend) DeleteFile(fileId string) error {
+	return b.call(func() error {
+		return b.backend.DeleteFile(fileId)
+	})
+}
+
+func (b *breakerBackend) CreatePermission(fileId string, perm *drive.Permission) (created *drive.Permission, err error) {
+	err = b.call(func() error {
+		created, err = b.backend.CreatePermission(fileId, perm)
+		return err
+	})
+	return created, err
+}
+
+func (b *breakerBackend) GetAccessToken() (token string, err error) {
+	err = b.call(func() error {
+		token, err = b.backend.GetAccessToken()
+		return err
+	})
+	return token, err
+}
+
+func (b *breakerBackend) GetToken() (token *oauth2.Token, err error) {
+	err = b.call(func() error {
+		token, err = b.backend.GetToken()
+		return err
+	})
+	return token, err
+}
+
+func (b *breakerBackend) GetStartPageToken() (token string, err error) {
+	err = b.call(func() error {
+		token, err = b.backend.GetStartPageToken()
+		return err
+	})
+	return token, err
+}
+
+func (b *breakerBackend) ListChanges(pageToken string) (page *helper.ChangePage, err error) {
+	err = b.call(func() error {
+		page, err = b.backend.ListChanges(pageToken)
+		return err
+	})
+	return page, err
+}
+
+func (b *breakerBackend) CreateUploadSession(name string, mimeType string, size int64) (uri string, err error) {
+	err = b.call(func() error {
+		uri, err = b.backend.CreateUploadSession(name, mimeType, size)
+		return err
+	})
+	return uri, err
+}
+
+func (b *breakerBackend) UploadChunk(sessionUri string, chunk io.Reader, start int64, end int64, total int64) (progress *helper.UploadProgress, err error) {
+	err = b.call(func() error {
+		progress, err = b.backend.UploadChunk(sessionUri, chunk, start, end, total)
+		return err
+	})
+	return progress, err
+}
+
+func (b *breakerBackend) CancelUpload(sessionUri string) error {
+	return b.call(func() error {
+		return b.backend.CancelUpload(sessionUri)
+	})
+}
+
+func (b *breakerBackend) QueryUpload(sessionUri string, total int64) (progress *helper.UploadProgress, err error) {
+	err = b.call(func() error {
+		progress, err = b.backend.QueryUpload(sessionUri, total)
+		return err
+	})
+	return progress, err
+}
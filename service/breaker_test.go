@@ -0,0 +1,132 @@
+package service
+
+import (
+	"errors"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"testing"
+	"time"
+)
+
+func newTestBreaker(threshold int, cooldown time.Duration) *AccountBreaker {
+	return &AccountBreaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		accounts:  make(map[primitive.ObjectID]*circuit),
+	}
+}
+
+func TestIsAccountFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		failure bool
+	}{
+		{"server error", &googleapi.Error{Code: 503}, true},
+		{"rate limited", &googleapi.Error{Code: 429}, true},
+		{"rejected credentials", &googleapi.Error{Code: 401}, true},
+		{"token endpoint", &oauth2.RetrieveError{}, true},
+		{"missing file", &googleapi.Error{Code: 404}, false},
+		{"quota exceeded", &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "storageQuotaExceeded"}}}, false},
+		{"other error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := isAccountFailure(tt.err); got != tt.failure {
+			t.Errorf("%s: isAccountFailure = %v", tt.name, got)
+		}
+	}
+}
+
+func TestAccountBreaker(t *testing.T) {
+	failure := &googleapi.Error{Code: 503}
+	notFound := &googleapi.Error{Code: 404}
+	tests := []struct {
+		name string
+		// outcomes recorded before the check, nil for a success
+		outcomes []error
+		// wait for the cooldown to pass before the check
+		cooledDown bool
+		open       bool
+		allow      bool
+	}{
+		{"closed", nil, false, false, true},
+		{"below the threshold", []error{failure, failure}, false, false, true},
+		{"at the threshold", []error{failure, failure, failure}, false, true, false},
+		{"success resets the count", []error{failure, failure, nil, failure}, false, false, true},
+		{"errors about the request count as success", []error{failure, failure, notFound, failure}, false, false, true},
+		{"half-open after the cooldown", []error{failure, failure, failure}, true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBreaker(3, 20*time.Millisecond)
+			id := primitive.NewObjectID()
+			for _, err := range tt.outcomes {
+				b.Record(id, err)
+			}
+			if tt.cooledDown {
+				time.Sleep(30 * time.Millisecond)
+			}
+			if got := b.IsOpen(id); got != tt.open {
+				t.Errorf("IsOpen = %v", got)
+			}
+			open := false
+			for _, openId := range b.openIds() {
+				open = open || openId == id
+			}
+			if open != tt.open {
+				t.Errorf("listed open = %v", open)
+			}
+			if got := b.Allow(id); got != tt.allow {
+				t.Errorf("Allow = %v", got)
+			}
+		})
+	}
+}
+
+func TestAccountBreakerTrial(t *testing.T) {
+	failure := &googleapi.Error{Code: 503}
+	tests := []struct {
+		name  string
+		trial error
+		open  bool
+	}{
+		{"trial succeeds", nil, false},
+		{"trial fails", failure, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBreaker(1, 20*time.Millisecond)
+			id := primitive.NewObjectID()
+			b.Record(id, failure)
+			time.Sleep(30 * time.Millisecond)
+			if !b.Allow(id) {
+				t.Fatal("trial call refused")
+			}
+			if b.Allow(id) {
+				t.Fatal("second call let through during the trial")
+			}
+			b.Record(id, tt.trial)
+			if got := b.IsOpen(id); got != tt.open {
+				t.Fatalf("IsOpen = %v after the trial", got)
+			}
+		})
+	}
+}
+
+func TestBreakerBackendFailsFast(t *testing.T) {
+	fake := helper.NewFakeDriveBackend(1 << 20)
+	fake.FailWith(helper.FakeOpQuota, &googleapi.Error{Code: 500})
+	backend := &breakerBackend{backend: fake, accountId: primitive.NewObjectID(), breaker: newTestBreaker(2, time.Minute)}
+
+	for i := 0; i < 2; i++ {
+		if _, err := backend.GetQuotaUsage(); err == nil || err == ErrAccountCircuitOpen {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	fake.FailWith(helper.FakeOpQuota, nil)
+	if _, err := backend.GetQuotaUsage(); err != ErrAccountCircuitOpen {
+		t.Fatalf("expected ErrAccountCircuitOpen, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/ndphu/drive-manager-api/dao"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/api/googleapi"
+	"log"
+	"net/http"
+)
+
+// ContentService reads file content on behalf of clients so no account credential leaves the server.
+type ContentService struct {
+	store    Store
+	accounts *AccountService
+}
+
+var contentService *ContentService
+
+func GetContentService() *ContentService {
+	if contentService == nil {
+		contentService = &ContentService{
+			store:    mongoStore{},
+			accounts: GetAccountService(),
+		}
+	}
+	return contentService
+}
+
+func (s *ContentService) FindFileIndex(id primitive.ObjectID) (*FileIndex, error) {
+	var fi FileIndex
+	if err := dao.FileIndex().FindOne(context.Background(), bson.D{{"_id", id}}).Decode(&fi); err != nil {
+		return nil, err
+	}
+	return &fi, nil
+}
+
+// Open returns the content of the indexed file. byteRange is forwarded as the Range header when not empty.
+func (s *ContentService) Open(fi *FileIndex, byteRange string) (*http.Response, error) {
+	switch fi.Storage {
+	case StorageChunked:
+		return openManifest(fi, byteRange)
+	case StorageErasure:
+		return openErasure(fi, byteRange)
+	}
+	return openCopies(fi, routeCopies(fi.Copies()), byteRange)
+}
+
+// openCopies reads from the first copy that answers, so a lost account fails over to a replica.
+func openCopies(fi *FileIndex, copies []FileReplica, byteRange string) (*http.Response, error) {
+	var lastErr error
+	for _, c := range copies {
+		res, err := openCopy(c, byteRange)
+		if err == nil {
+			return res, nil
+		}
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusRequestedRangeNotSatisfiable {
+			return nil, err
+		}
+		log.Println("Fail to read copy", c.FileId, "on account", c.AccountId.Hex(), "of file", fi.Id.Hex(), "by error", err.Error())
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func openCopy(c FileReplica, byteRange string) (*http.Response, error) {
+	acc, err := GetAccountService().FindAccount(c.AccountId.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if acc.Disabled {
+		return nil, errors.New("account " + acc.Id.Hex() + " is disabled")
+	}
+	backend, err := GetAccountService().GetDriveBackend(acc)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Download(c.FileId, byteRange)
+}
+
+// Delete removes the content of the indexed file from Drive, then the index entry.
+func (s *ContentService) Delete(fi *FileIndex) error {
+	switch fi.Storage {
+	case StorageChunked:
+		m, err := s.store.FindManifest(*fi.ManifestId)
+		if err != nil {
+			return err
+		}
+		if err := s.accounts.deleteManifest(m); err != nil {
+			return err
+		}
+	case StorageErasure:
+		layout, err := s.store.FindErasureLayout(*fi.ManifestId)
+		if err != nil {
+			return err
+		}
+		if err := s.accounts.deleteErasureLayout(layout); err != nil {
+			return err
+		}
+	default:
+		for _, c := range fi.Copies() {
+			if err := s.accounts.deletePart(c.AccountId, c.FileId); err != nil {
+				return err
+			}
+			if err := s.accounts.UpdateCachedQuotaByAccountId(c.AccountId.Hex()); err != nil {
+				log.Println("Fail to update quota of account", c.AccountId.Hex(), "by error", err.Error())
+			}
+		}
+	}
+	return s.store.DeleteFileIndex(fi.Id)
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/api/googleapi"
+	"testing"
+)
+
+func TestContentDelete(t *testing.T) {
+	tests := []struct {
+		name string
+		// stores the file on the accounts and returns its index entry
+		setup  func(store *memoryStore, accounts []*entity.DriveAccount, backends []*helper.FakeDriveBackend) *FileIndex
+		failed bool
+		// files left on each account
+		left []int
+		// accounts with their quota refreshed
+		refreshed []bool
+	}{
+		{"single copy", func(store *memoryStore, accounts []*entity.DriveAccount, backends []*helper.FakeDriveBackend) *FileIndex {
+			file := backends[0].PutFile("a.txt", "text/plain", []byte("content"))
+			return &FileIndex{Id: primitive.NewObjectID(), AccountId: accounts[0].Id, FileId: file.Id}
+		}, false, []int{0, 0}, []bool{true, false}},
+		{"every replica", func(store *memoryStore, accounts []*entity.DriveAccount, backends []*helper.FakeDriveBackend) *FileIndex {
+			file := backends[0].PutFile("a.txt", "text/plain", []byte("content"))
+			replica := backends[1].PutFile("a.txt", "text/plain", []byte("content"))
+			return &FileIndex{
+				Id:        primitive.NewObjectID(),
+				AccountId: accounts[0].Id,
+				FileId:    file.Id,
+				Replicas:  []FileReplica{{AccountId: accounts[1].Id, FileId: replica.Id}},
+			}
+		}, false, []int{0, 0}, []bool{true, true}},
+		{"copy already gone from Drive", func(store *memoryStore, accounts []*entity.DriveAccount, backends []*helper.FakeDriveBackend) *FileIndex {
+			return &FileIndex{Id: primitive.NewObjectID(), AccountId: accounts[0].Id, FileId: "gone"}
+		}, false, []int{0, 0}, []bool{true, false}},
+		{"chunked parts on both accounts", func(store *memoryStore, accounts []*entity.DriveAccount, backends []*helper.FakeDriveBackend) *FileIndex {
+			m := &FileManifest{Id: primitive.NewObjectID()}
+			for i, backend := range backends {
+				part := backend.PutFile(partName("big.bin", i), ChunkPartMimeType, []byte("part"))
+				m.Parts = append(m.Parts, ManifestPart{Index: i, AccountId: accounts[i].Id, FileId: part.Id})
+			}
+			store.manifests[m.Id] = m
+			return &FileIndex{Id: primitive.NewObjectID(), Storage: StorageChunked, ManifestId: &m.Id}
+		}, false, []int{0, 0}, []bool{true, true}},
+		{"erasure shards, lost ones skipped", func(store *memoryStore, accounts []*entity.DriveAccount, backends []*helper.FakeDriveBackend) *FileIndex {
+			layout := &ErasureLayout{Id: primitive.NewObjectID()}
+			for i, backend := range backends {
+				shard := backend.PutFile("shard", ChunkPartMimeType, []byte("shard"))
+				layout.Shards = append(layout.Shards, ErasureShard{Index: i, AccountId: accounts[i].Id, FileId: shard.Id})
+			}
+			layout.Shards = append(layout.Shards, ErasureShard{Index: 2, AccountId: accounts[0].Id, Missing: true})
+			store.layouts[layout.Id] = layout
+			return &FileIndex{Id: primitive.NewObjectID(), Storage: StorageErasure, ManifestId: &layout.Id}
+		}, false, []int{0, 0}, []bool{true, true}},
+		{"index kept when Drive refuses", func(store *memoryStore, accounts []*entity.DriveAccount, backends []*helper.FakeDriveBackend) *FileIndex {
+			file := backends[0].PutFile("a.txt", "text/plain", []byte("content"))
+			backends[0].FailWith(helper.FakeOpDelete, &googleapi.Error{Code: 500})
+			return &FileIndex{Id: primitive.NewObjectID(), AccountId: accounts[0].Id, FileId: file.Id}
+		}, true, []int{1, 0}, []bool{false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			fakes := make(map[primitive.ObjectID]*helper.FakeDriveBackend)
+			owner := primitive.NewObjectID()
+			accounts := []*entity.DriveAccount{store.addAccount(fakes, owner, 1<<20), store.addAccount(fakes, owner, 1<<20)}
+			backends := []*helper.FakeDriveBackend{fakes[accounts[0].Id], fakes[accounts[1].Id]}
+			fi := tt.setup(store, accounts, backends)
+			store.files[fi.Id] = fi
+
+			s := &ContentService{store: store, accounts: newStoreAccountService(store, fakes)}
+			err := s.Delete(fi)
+			if (err != nil) != tt.failed {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if _, indexed := store.files[fi.Id]; indexed != tt.failed {
+				t.Fatalf("index entry kept: %v", indexed)
+			}
+			for i, backend := range backends {
+				if left := len(backend.Files()); left != tt.left[i] {
+					t.Fatalf("%d files left on account %d, expected %d", left, i, tt.left[i])
+				}
+				if refreshed := !store.accounts[accounts[i].Id].QuotaUpdateTimestamp.IsZero(); refreshed != tt.refreshed[i] {
+					t.Fatalf("quota of account %d refreshed: %v", i, refreshed)
+				}
+			}
+			if len(store.manifests) != 0 || len(store.layouts) != 0 {
+				t.Fatal("manifest or layout kept")
+			}
+		})
+	}
+}
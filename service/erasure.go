@@ -0,0 +1,968 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"github.com/nu7hatch/gouuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/api/googleapi"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StorageErasure marks a FileIndex whose content is Reed-Solomon coded in shards described by an ErasureLayout.
+const StorageErasure = "erasure"
+
+// Shards receive one block per stripe. Blocks are multiples of 256KiB as Drive wants for resumable chunks.
+const (
+	ErasureMaxBlockSize   = 4 * 1024 * 1024
+	erasureBlockAlignment = 256 * 1024
+	ErasureMaxShards      = 20
+)
+
+var (
+	ErrInvalidErasureCoding = errors.New("InvalidErasureCoding")
+	ErrTooManyShardsLost    = errors.New("TooManyShardsLost")
+)
+
+// ErasureLayout describes a file cut in stripes of DataShards*BlockSize bytes. Block i of every
+// stripe goes to shard i; shards from DataShards on hold the parity blocks.
+type ErasureLayout struct {
+	Id           primitive.ObjectID `json:"id" bson:"_id"`
+	Owner        primitive.ObjectID `json:"owner" bson:"owner"`
+	Name         string             `json:"name" bson:"name"`
+	MimeType     string             `json:"mimeType" bson:"mimeType"`
+	Size         int64              `json:"size" bson:"size"`
+	DataShards   int                `json:"dataShards" bson:"dataShards"`
+	ParityShards int                `json:"parityShards" bson:"parityShards"`
+	BlockSize    int64              `json:"blockSize" bson:"blockSize"`
+	ShardSize    int64              `json:"shardSize" bson:"shardSize"`
+	Shards       []ErasureShard     `json:"shards" bson:"shards"`
+	CreatedAt    time.Time          `json:"createdAt" bson:"createdAt"`
+	ScrubTime    time.Time          `json:"scrubTime" bson:"scrubTime"`
+	UploadId     string             `json:"-" bson:"uploadId,omitempty"`
+}
+
+type ErasureShard struct {
+	Index     int                `json:"index" bson:"index"`
+	AccountId primitive.ObjectID `json:"accountId" bson:"accountId"`
+	ProjectId primitive.ObjectID `json:"projectId" bson:"projectId"`
+	FileId    string             `json:"fileId" bson:"fileId"`
+	Md5       string             `json:"md5" bson:"md5"`
+	Missing   bool               `json:"missing" bson:"missing"`
+}
+
+func (l *ErasureLayout) stripeSize() int64 {
+	return int64(l.DataShards) * l.BlockSize
+}
+
+func (l *ErasureLayout) stripes() int64 {
+	return l.ShardSize / l.BlockSize
+}
+
+func FindErasureLayout(id primitive.ObjectID) (*ErasureLayout, error) {
+	var l ErasureLayout
+	if err := dao.ErasureLayout().FindOne(context.Background(), bson.D{{"_id", id}}).Decode(&l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func intFromEnv(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Println("Invalid number", value, "for", name, "using", defaultValue)
+		return defaultValue
+	}
+	return i
+}
+
+// erasureBlockSize keeps small files from being padded up to full sized blocks.
+func erasureBlockSize(size int64, dataShards int) int64 {
+	block := (size + int64(dataShards) - 1) / int64(dataShards)
+	block = (block + erasureBlockAlignment - 1) / erasureBlockAlignment * erasureBlockAlignment
+	if block > ErasureMaxBlockSize {
+		block = ErasureMaxBlockSize
+	}
+	return block
+}
+
+func shardName(name string, index int) string {
+	return fmt.Sprintf("%s.shard%02d", name, index)
+}
+
+// PlanShards picks count distinct accounts able to hold shardSize bytes, spreading them over as many
+// projects as possible, most free space first. Degraded accounts are only picked when the healthy
+// ones run out. Accounts in exclude are skipped.
+func (s *AccountService) PlanShards(owner primitive.ObjectID, count int, shardSize int64, exclude []primitive.ObjectID) ([]entity.DriveAccount, error) {
+	var accounts []entity.DriveAccount
+	if cursor, err := dao.DriveAccount().Find(context.Background(), bson.D{
+		{"owner", owner},
+		storageTypeFilter(),
+		{"disabled", bson.D{{"$ne", true}}},
+		{"readOnly", bson.D{{"$ne", true}}},
+		healthyFilter(),
+		closedCircuitFilter(),
+		roomFor(shardSize),
+		{"_id", bson.D{{"$nin", exclude}}},
+	}); err != nil {
+		return nil, err
+	} else if err := cursor.All(context.Background(), &accounts); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(accounts, func(i, j int) bool {
+		if healthRank(&accounts[i]) != healthRank(&accounts[j]) {
+			return healthRank(&accounts[i]) < healthRank(&accounts[j])
+		}
+		return accounts[i].Available > accounts[j].Available
+	})
+	usedProjects := make(map[primitive.ObjectID]int)
+	if len(exclude) > 0 {
+		var held []entity.DriveAccount
+		if cursor, err := dao.DriveAccount().Find(context.Background(), bson.D{{"_id", bson.D{{"$in", exclude}}}}); err == nil {
+			cursor.All(context.Background(), &held)
+		}
+		for _, acc := range held {
+			usedProjects[acc.ProjectId]++
+		}
+	}
+	picked := make([]entity.DriveAccount, 0, count)
+	taken := make(map[primitive.ObjectID]bool)
+	for len(picked) < count {
+		best := -1
+		for i, acc := range accounts {
+			if taken[acc.Id] || acc.Limit-acc.Usage <= shardSize {
+				continue
+			}
+			// accounts are sorted healthy first, a degraded one never beats a healthy one
+			if best < 0 || (healthRank(&acc) == healthRank(&accounts[best]) && usedProjects[acc.ProjectId] < usedProjects[accounts[best].ProjectId]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return nil, ErrNoSuitableAccount
+		}
+		taken[accounts[best].Id] = true
+		usedProjects[accounts[best].ProjectId]++
+		picked = append(picked, accounts[best])
+	}
+	return picked, nil
+}
+
+// StartErasure opens one resumable session per shard. The client sends whole stripes
+// (multiples of ChunkSize bytes) per chunk, only the last one may be shorter.
+func (s *UploadService) StartErasure(owner primitive.ObjectID, name string, size int64, mimeType string, dataShards int, parityShards int) (*UploadState, error) {
+	if dataShards <= 0 {
+		dataShards = intFromEnv("ERASURE_DATA_SHARDS", 4)
+	}
+	if parityShards <= 0 {
+		parityShards = intFromEnv("ERASURE_PARITY_SHARDS", 2)
+	}
+	if size <= 0 || dataShards < 1 || parityShards < 1 || dataShards+parityShards > ErasureMaxShards {
+		return nil, ErrInvalidErasureCoding
+	}
+	blockSize := erasureBlockSize(size, dataShards)
+	stripeSize := int64(dataShards) * blockSize
+	shardSize := (size + stripeSize - 1) / stripeSize * blockSize
+
+	as := GetAccountService()
+	accounts, err := as.PlanShards(owner, dataShards+parityShards, shardSize, []primitive.ObjectID{})
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]*UploadPart, 0, len(accounts))
+	for i := range accounts {
+		parts = append(parts, &UploadPart{
+			Index:     i,
+			AccountId: accounts[i].Id,
+			Size:      shardSize,
+		})
+	}
+	if err := reserveParts(owner, parts); err != nil {
+		log.Println("Fail to reserve quota for shards of", name, "by error", err.Error())
+		return nil, err
+	}
+	for i, part := range parts {
+		backend, err := as.GetDriveBackend(&accounts[i])
+		if err != nil {
+			releaseParts(parts)
+			return nil, err
+		}
+		part.SessionUri, err = backend.CreateUploadSession(shardName(name, i), ChunkPartMimeType, shardSize)
+		if err != nil {
+			log.Println("Fail to create upload session for shard", i, "on account", accounts[i].Id.Hex(), "by error", err.Error())
+			releaseParts(parts)
+			return nil, err
+		}
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		releaseParts(parts)
+		return nil, err
+	}
+	now := time.Now()
+	state := &UploadState{
+		Id:           id.String(),
+		Owner:        owner,
+		Name:         name,
+		MimeType:     mimeType,
+		Size:         size,
+		ChunkSize:    stripeSize,
+		Erasure:      true,
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		BlockSize:    blockSize,
+		Parts:        parts,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := s.save(state); err != nil {
+		releaseParts(parts)
+		return nil, err
+	}
+	log.Println("Started erasure coded upload", state.Id, "of", name, size, "bytes as", dataShards, "+", parityShards, "shards of", shardSize, "bytes")
+	return state, nil
+}
+
+// writeStripes sends the chunk stripe by stripe. The chunk starts on a stripe and holds whole
+// stripes, only the one ending the file may be shorter.
+func (s *UploadService) writeStripes(state *UploadState, chunk io.Reader, start int64, end int64) (*UploadState, error) {
+	err := s.sendStripes(state, chunk, start, end)
+	if err == ErrInvalidContentRange {
+		return state, err
+	}
+	if err != nil {
+		s.save(state)
+		return state, err
+	}
+	if state.Offset == state.Size {
+		if err := s.completeErasure(state); err != nil {
+			return state, err
+		}
+	}
+	if err := s.save(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// sendStripes moves state.Offset past every stripe all shards took. On error the client resumes
+// from state.Offset.
+func (s *UploadService) sendStripes(state *UploadState, chunk io.Reader, start int64, end int64) error {
+	stripeSize := state.ChunkSize
+	if start%stripeSize != 0 || ((end-start+1)%stripeSize != 0 && end+1 != state.Size) {
+		return ErrInvalidContentRange
+	}
+	enc, err := reedsolomon.New(state.DataShards, state.ParityShards)
+	if err != nil {
+		return err
+	}
+	for stripeStart := start; stripeStart <= end; stripeStart += stripeSize {
+		stripeEnd := stripeStart + stripeSize - 1
+		if stripeEnd > end {
+			stripeEnd = end
+		}
+		// the last stripe is padded with zeros
+		data := make([]byte, stripeSize)
+		if _, err := io.ReadFull(chunk, data[:stripeEnd-stripeStart+1]); err != nil {
+			return err
+		}
+		if err := s.sendStripe(state, enc, data, stripeStart); err != nil {
+			return err
+		}
+		state.Offset = stripeEnd + 1
+	}
+	return nil
+}
+
+// sendStripe encodes one stripe and sends a block to every shard. A shard whose account refuses
+// the upload for good is given up, as long as no more than ParityShards are lost.
+func (s *UploadService) sendStripe(state *UploadState, enc reedsolomon.Encoder, data []byte, start int64) error {
+	stripeSize := state.ChunkSize
+	blocks := make([][]byte, state.DataShards+state.ParityShards)
+	for i := range blocks {
+		if i < state.DataShards {
+			blocks[i] = data[int64(i)*state.BlockSize : int64(i+1)*state.BlockSize]
+		} else {
+			blocks[i] = make([]byte, state.BlockSize)
+		}
+	}
+	if err := enc.Encode(blocks); err != nil {
+		return err
+	}
+
+	shardOffset := start / stripeSize * state.BlockSize
+	var lastErr error
+	for _, part := range state.Parts {
+		if part.Failed || part.Received > shardOffset {
+			continue
+		}
+		if part.Received < shardOffset {
+			// missed an earlier stripe, the shard can only be rebuilt by the scrubber
+			part.Failed = true
+			continue
+		}
+		backend, err := s.accountBackend(part.AccountId)
+		if err == nil {
+			var progress *helper.UploadProgress
+			progress, err = backend.UploadChunk(part.SessionUri, bytes.NewReader(blocks[part.Index]), shardOffset, shardOffset+state.BlockSize-1, part.Size)
+			if err == nil {
+				part.Received = progress.Offset
+				if progress.File != nil {
+					part.Complete = true
+					part.FileId = progress.File.Id
+					part.Md5 = progress.File.Md5Checksum
+				}
+				continue
+			}
+		}
+		log.Println("Fail to upload shard", part.Index, "of upload", state.Id, "by error", err.Error())
+		if isPermanentUploadError(err) {
+			part.Failed = true
+		} else {
+			lastErr = err
+		}
+	}
+	if failedShards(state) > state.ParityShards {
+		return ErrTooManyShardsLost
+	}
+	// on error the client sends the stripe again, shards already holding it are skipped
+	return lastErr
+}
+
+func (s *UploadService) queryShards(state *UploadState) (*UploadState, error) {
+	stripes := state.Size
+	for _, part := range state.Parts {
+		if part.Failed {
+			continue
+		}
+		if !part.Complete {
+			backend, err := s.accountBackend(part.AccountId)
+			if err != nil {
+				return nil, err
+			}
+			progress, err := backend.QueryUpload(part.SessionUri, part.Size)
+			if err != nil {
+				return nil, err
+			}
+			part.Received = progress.Offset
+			if progress.File != nil {
+				part.Complete = true
+				part.FileId = progress.File.Id
+				part.Md5 = progress.File.Md5Checksum
+			}
+		}
+		if done := part.Received / state.BlockSize; done < stripes {
+			stripes = done
+		}
+	}
+	state.Offset = stripes * state.ChunkSize
+	if state.Offset > state.Size {
+		state.Offset = state.Size
+	}
+	if state.Offset == state.Size {
+		if err := s.completeErasure(state); err != nil {
+			return state, err
+		}
+	}
+	if err := s.save(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func failedShards(state *UploadState) int {
+	failed := 0
+	for _, part := range state.Parts {
+		if part.Failed {
+			failed++
+		}
+	}
+	return failed
+}
+
+func isPermanentUploadError(err error) bool {
+	if err == mongo.ErrNoDocuments {
+		return true
+	}
+	if e, ok := err.(*googleapi.Error); ok {
+		return e.Code >= 400 && e.Code < 500 && e.Code != 408 && e.Code != 429
+	}
+	return false
+}
+
+// completeErasure writes the layout and the file index pointing to it. Failed shards are
+// recorded as missing for the scrubber to re-create.
+func (s *UploadService) completeErasure(state *UploadState) error {
+	as := GetAccountService()
+	now := time.Now()
+	layout := ErasureLayout{
+		Id:           primitive.NewObjectID(),
+		Owner:        state.Owner,
+		Name:         state.Name,
+		MimeType:     state.MimeType,
+		Size:         state.Size,
+		DataShards:   state.DataShards,
+		ParityShards: state.ParityShards,
+		BlockSize:    state.BlockSize,
+		ShardSize:    state.Parts[0].Size,
+		CreatedAt:    now,
+		ScrubTime:    now,
+		UploadId:     state.Id,
+	}
+	for _, part := range state.Parts {
+		shard := ErasureShard{
+			Index:     part.Index,
+			AccountId: part.AccountId,
+			FileId:    part.FileId,
+			Md5:       part.Md5,
+			Missing:   part.Failed || !part.Complete,
+		}
+		if acc, err := as.FindAccount(part.AccountId.Hex()); err == nil {
+			shard.ProjectId = acc.ProjectId
+		}
+		layout.Shards = append(layout.Shards, shard)
+	}
+	layoutId, _, err := insertOnce(dao.ErasureLayout(), bson.D{{"uploadId", state.Id}}, layout)
+	if err != nil {
+		log.Println("Fail to insert erasure layout of upload", state.Id, "by error", err.Error())
+		return err
+	}
+	layout.Id = layoutId
+	fi := FileIndex{
+		Id:           primitive.NewObjectID(),
+		Name:         state.Name,
+		Size:         state.Size,
+		MimeType:     state.MimeType,
+		Owner:        state.Owner,
+		CreatedTime:  now,
+		ModifiedTime: now,
+		SyncTime:     now,
+		Storage:      StorageErasure,
+		ManifestId:   &layout.Id,
+	}
+	fileIndexId, inserted, err := insertOnce(dao.FileIndex(), bson.D{{"manifestId", layout.Id}}, fi)
+	if err != nil {
+		log.Println("Fail to insert file index of upload", state.Id, "by error", err.Error())
+		return err
+	}
+	// quota was settled by the completion that inserted the file index
+	if inserted {
+		for _, part := range state.Parts {
+			if !part.Complete {
+				// a shard given up keeps nothing on its account
+				releaseParts([]*UploadPart{part})
+				continue
+			}
+			if err := commitPart(state.Owner, part); err != nil {
+				log.Println("Fail to update quota after upload", state.Id, "by error", err.Error())
+			}
+		}
+	}
+	state.Complete = true
+	state.FileIndexId = &fileIndexId
+	log.Println("Completed erasure coded upload", state.Id, "with layout", layout.Id.Hex(), failedShards(state), "shards missing")
+	return nil
+}
+
+// openErasure answers like Drive would for the whole object, decoding stripes as they are read.
+func openErasure(fi *FileIndex, byteRange string) (*http.Response, error) {
+	layout, err := FindErasureLayout(*fi.ManifestId)
+	if err != nil {
+		log.Println("Fail to find erasure layout of file", fi.Id.Hex(), "by error", err.Error())
+		return nil, err
+	}
+	return mediaResponse(layout.Size, layout.MimeType, byteRange, func(start int64, end int64) (io.ReadCloser, error) {
+		reader, err := newErasureReader(layout, start, end)
+		if err != nil {
+			return nil, err
+		}
+		// decode the first stripe now so a file beyond repair fails the request instead of the body
+		if start <= end {
+			if err := reader.load(start / layout.stripeSize()); err != nil {
+				reader.Close()
+				return nil, err
+			}
+		}
+		return reader, nil
+	})
+}
+
+type shardStream struct {
+	body io.ReadCloser
+	next int64
+}
+
+// erasureReader reads stripes from the first healthy shards, data shards first, so an intact
+// file is read without decoding. Shards failing on the way are dropped and replaced by parity.
+type erasureReader struct {
+	layout   *ErasureLayout
+	enc      reedsolomon.Encoder
+	pos      int64
+	end      int64
+	last     int64
+	stripe   int64
+	buf      []byte
+	streams  []*shardStream
+	bad      []bool
+	backends map[primitive.ObjectID]helper.DriveBackend
+}
+
+func newErasureReader(layout *ErasureLayout, start int64, end int64) (*erasureReader, error) {
+	enc, err := reedsolomon.New(layout.DataShards, layout.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	r := &erasureReader{
+		layout:   layout,
+		enc:      enc,
+		pos:      start,
+		end:      end,
+		last:     layout.stripes() - 1,
+		stripe:   -1,
+		streams:  make([]*shardStream, len(layout.Shards)),
+		bad:      make([]bool, len(layout.Shards)),
+		backends: make(map[primitive.ObjectID]helper.DriveBackend),
+	}
+	if end >= start {
+		r.last = end / layout.stripeSize()
+	}
+	for i, shard := range layout.Shards {
+		r.bad[i] = shard.Missing
+	}
+	r.skipBrokenShards()
+	return r, nil
+}
+
+// skipBrokenShards marks the shards on broken accounts as bad up front, as long as enough shards
+// are left to decode.
+func (r *erasureReader) skipBrokenShards() {
+	ids := make([]primitive.ObjectID, 0, len(r.layout.Shards))
+	for _, shard := range r.layout.Shards {
+		ids = append(ids, shard.AccountId)
+	}
+	statuses, err := accountHealth(ids)
+	if err != nil {
+		log.Println("Fail to load account health by error", err.Error())
+		return
+	}
+	usable := 0
+	for i, shard := range r.layout.Shards {
+		if !r.bad[i] && !isBroken(statuses[shard.AccountId]) {
+			usable++
+		}
+	}
+	if usable < r.layout.DataShards {
+		return
+	}
+	for i, shard := range r.layout.Shards {
+		if isBroken(statuses[shard.AccountId]) {
+			r.bad[i] = true
+		}
+	}
+}
+
+func (r *erasureReader) backend(accountId primitive.ObjectID) (helper.DriveBackend, error) {
+	if b, ok := r.backends[accountId]; ok {
+		return b, nil
+	}
+	acc, err := GetAccountService().FindAccount(accountId.Hex())
+	if err != nil {
+		return nil, err
+	}
+	b, err := GetAccountService().GetDriveBackend(acc)
+	if err != nil {
+		return nil, err
+	}
+	r.backends[accountId] = b
+	return b, nil
+}
+
+// readBlock reads the block of shard i for the stripe, opening the shard from there up to the last stripe needed.
+func (r *erasureReader) readBlock(i int, stripe int64) ([]byte, error) {
+	stream := r.streams[i]
+	if stream == nil || stream.next != stripe {
+		if stream != nil {
+			stream.body.Close()
+		}
+		r.streams[i] = nil
+		shard := r.layout.Shards[i]
+		backend, err := r.backend(shard.AccountId)
+		if err != nil {
+			return nil, err
+		}
+		res, err := backend.Download(shard.FileId, fmt.Sprintf("bytes=%d-%d", stripe*r.layout.BlockSize, (r.last+1)*r.layout.BlockSize-1))
+		if err != nil {
+			return nil, err
+		}
+		stream = &shardStream{body: res.Body, next: stripe}
+		r.streams[i] = stream
+	}
+	block := make([]byte, r.layout.BlockSize)
+	if _, err := io.ReadFull(stream.body, block); err != nil {
+		return nil, err
+	}
+	stream.next++
+	return block, nil
+}
+
+// blocks returns the blocks of a stripe. With all set, parity blocks are rebuilt too.
+func (r *erasureReader) blocks(stripe int64, all bool) ([][]byte, error) {
+	blocks := make([][]byte, len(r.layout.Shards))
+	got := 0
+	for i := range blocks {
+		if got == r.layout.DataShards {
+			break
+		}
+		if r.bad[i] {
+			continue
+		}
+		block, err := r.readBlock(i, stripe)
+		if err != nil {
+			log.Println("Fail to read shard", i, "of layout", r.layout.Id.Hex(), "by error", err.Error())
+			r.bad[i] = true
+			if r.streams[i] != nil {
+				r.streams[i].body.Close()
+				r.streams[i] = nil
+			}
+			continue
+		}
+		blocks[i] = block
+		got++
+	}
+	if got < r.layout.DataShards {
+		return nil, ErrTooManyShardsLost
+	}
+	var err error
+	if all {
+		err = r.enc.Reconstruct(blocks)
+	} else {
+		err = r.enc.ReconstructData(blocks)
+	}
+	return blocks, err
+}
+
+func (r *erasureReader) load(stripe int64) error {
+	blocks, err := r.blocks(stripe, false)
+	if err != nil {
+		return err
+	}
+	if r.buf == nil {
+		r.buf = make([]byte, r.layout.stripeSize())
+	}
+	for i := 0; i < r.layout.DataShards; i++ {
+		copy(r.buf[int64(i)*r.layout.BlockSize:], blocks[i])
+	}
+	r.stripe = stripe
+	return nil
+}
+
+func (r *erasureReader) Read(p []byte) (int, error) {
+	if r.pos > r.end {
+		return 0, io.EOF
+	}
+	stripeSize := r.layout.stripeSize()
+	stripe := r.pos / stripeSize
+	if stripe != r.stripe {
+		if err := r.load(stripe); err != nil {
+			return 0, err
+		}
+	}
+	from := r.pos - stripe*stripeSize
+	to := stripeSize
+	if r.end-stripe*stripeSize+1 < to {
+		to = r.end - stripe*stripeSize + 1
+	}
+	n := copy(p, r.buf[from:to])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *erasureReader) Close() error {
+	for i, stream := range r.streams {
+		if stream != nil {
+			stream.body.Close()
+			r.streams[i] = nil
+		}
+	}
+	return nil
+}
+
+// deleteErasureLayout removes the shard files from Drive, then the layout itself.
+func (s *AccountService) deleteErasureLayout(layout *ErasureLayout) error {
+	for _, shard := range layout.Shards {
+		if shard.FileId == "" {
+			continue
+		}
+		if err := s.deletePart(shard.AccountId, shard.FileId); err != nil {
+			log.Println("Fail to delete shard", shard.Index, "of layout", layout.Id.Hex(), "by error", err.Error())
+			return err
+		}
+		if err := s.UpdateCachedQuotaByAccountId(shard.AccountId.Hex()); err != nil {
+			log.Println("Fail to update quota of account", shard.AccountId.Hex(), "by error", err.Error())
+		}
+	}
+	return s.store.DeleteErasureLayout(layout.Id)
+}
+
+type ErasureService struct {
+	ScrubInterval time.Duration
+	mutex         sync.Mutex
+	running       bool
+}
+
+var erasureService *ErasureService
+
+func GetErasureService() *ErasureService {
+	if erasureService == nil {
+		erasureService = &ErasureService{
+			ScrubInterval: durationFromEnv("ERASURE_SCRUB_INTERVAL", 6*time.Hour),
+		}
+	}
+	return erasureService
+}
+
+// Start runs the scrubber on ScrubInterval. A zero interval disables it.
+func (s *ErasureService) Start() {
+	if s.ScrubInterval <= 0 {
+		log.Println("Erasure scrubber is disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.ScrubInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.ScrubAll(bson.D{}); err != nil {
+				log.Println("Fail to scrub erasure layouts by error", err.Error())
+			}
+		}
+	}()
+}
+
+// ScrubAll scrubs the layouts matching filter, oldest scrubbed first. Only one scrub runs at a time.
+func (s *ErasureService) ScrubAll(filter bson.D) error {
+	s.mutex.Lock()
+	if s.running {
+		s.mutex.Unlock()
+		log.Println("Erasure scrub already running")
+		return nil
+	}
+	s.running = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.running = false
+		s.mutex.Unlock()
+	}()
+
+	var layouts []ErasureLayout
+	if cursor, err := dao.ErasureLayout().Find(context.Background(), filter); err != nil {
+		return err
+	} else if err := cursor.All(context.Background(), &layouts); err != nil {
+		return err
+	}
+	sort.Slice(layouts, func(i, j int) bool {
+		return layouts[i].ScrubTime.Before(layouts[j].ScrubTime)
+	})
+	rebuilt, failed := 0, 0
+	for i := range layouts {
+		n, err := s.Scrub(&layouts[i])
+		rebuilt += n
+		if err != nil {
+			log.Println("Fail to scrub layout", layouts[i].Id.Hex(), "by error", err.Error())
+			failed++
+		}
+	}
+	log.Println("Erasure scrub checked", len(layouts), "layouts, rebuilt", rebuilt, "shards,", failed, "failed")
+	return nil
+}
+
+func (s *ErasureService) ScrubFile(owner primitive.ObjectID, id primitive.ObjectID) (*ErasureLayout, error) {
+	fi, err := GetContentService().FindFileIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Owner != owner || fi.Storage != StorageErasure {
+		return nil, mongo.ErrNoDocuments
+	}
+	layout, err := FindErasureLayout(*fi.ManifestId)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.Scrub(layout); err != nil {
+		return layout, err
+	}
+	return layout, nil
+}
+
+// Scrub checks every shard and re-creates the missing ones from the others. It returns how many shards were rebuilt.
+func (s *ErasureService) Scrub(layout *ErasureLayout) (int, error) {
+	for i := range layout.Shards {
+		shard := &layout.Shards[i]
+		if shard.Missing {
+			continue
+		}
+		ok, err := s.verifyShard(layout, shard)
+		if err != nil {
+			log.Println("Fail to verify shard", shard.Index, "of layout", layout.Id.Hex(), "by error", err.Error())
+			continue
+		}
+		if !ok {
+			log.Println("Shard", shard.Index, "of layout", layout.Id.Hex(), "is missing")
+			shard.Missing = true
+		}
+	}
+	missing := 0
+	for _, shard := range layout.Shards {
+		if shard.Missing {
+			missing++
+		}
+	}
+	if missing > layout.ParityShards {
+		log.Println("Layout", layout.Id.Hex(), "lost", missing, "shards, more than its", layout.ParityShards, "parity shards")
+		saveErasureShards(layout)
+		return 0, ErrTooManyShardsLost
+	}
+	rebuilt := 0
+	for i := range layout.Shards {
+		if !layout.Shards[i].Missing {
+			continue
+		}
+		if err := s.rebuildShard(layout, i); err != nil {
+			saveErasureShards(layout)
+			return rebuilt, err
+		}
+		rebuilt++
+	}
+	layout.ScrubTime = time.Now()
+	return rebuilt, saveErasureShards(layout)
+}
+
+// verifyShard returns false only when the shard is known to be gone or damaged.
+func (s *ErasureService) verifyShard(layout *ErasureLayout, shard *ErasureShard) (bool, error) {
+	acc, err := GetAccountService().FindAccount(shard.AccountId.Hex())
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if acc.Disabled {
+		return false, nil
+	}
+	backend, err := GetAccountService().GetDriveBackend(acc)
+	if err != nil {
+		return false, err
+	}
+	file, err := backend.GetFile(shard.FileId)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if file.Trashed || file.Size != layout.ShardSize {
+		return false, nil
+	}
+	if shard.Md5 != "" && file.Md5Checksum != "" && file.Md5Checksum != shard.Md5 {
+		return false, nil
+	}
+	return true, nil
+}
+
+// rebuildShard decodes the file stripe by stripe from the remaining shards and uploads
+// the blocks of shard i to an account holding no other shard of the layout.
+func (s *ErasureService) rebuildShard(layout *ErasureLayout, i int) error {
+	exclude := make([]primitive.ObjectID, 0, len(layout.Shards))
+	for _, shard := range layout.Shards {
+		if !shard.Missing {
+			exclude = append(exclude, shard.AccountId)
+		}
+	}
+	accounts, err := GetAccountService().PlanShards(layout.Owner, 1, layout.ShardSize, exclude)
+	if err != nil {
+		return err
+	}
+	target := accounts[0]
+	backend, err := GetAccountService().GetDriveBackend(&target)
+	if err != nil {
+		return err
+	}
+	reader, err := newErasureReader(layout, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		for stripe := int64(0); stripe < layout.stripes(); stripe++ {
+			blocks, err := reader.blocks(stripe, true)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := pw.Write(blocks[i]); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	file, err := backend.UploadFileFromStream(shardName(layout.Name, i), "", ChunkPartMimeType, pr)
+	pr.Close()
+	if err != nil {
+		log.Println("Fail to rebuild shard", i, "of layout", layout.Id.Hex(), "by error", err.Error())
+		return err
+	}
+	if file.Size != layout.ShardSize {
+		backend.DeleteFile(file.Id)
+		return fmt.Errorf("rebuilt shard %d of layout %s has size %d, expected %d", i, layout.Id.Hex(), file.Size, layout.ShardSize)
+	}
+	old := layout.Shards[i]
+	if old.FileId != "" {
+		// whatever is left of the old shard is useless now
+		if err := GetAccountService().deletePart(old.AccountId, old.FileId); err != nil {
+			log.Println("Fail to delete old shard", i, "of layout", layout.Id.Hex(), "by error", err.Error())
+		}
+	}
+	layout.Shards[i] = ErasureShard{
+		Index:     i,
+		AccountId: target.Id,
+		ProjectId: target.ProjectId,
+		FileId:    file.Id,
+		Md5:       file.Md5Checksum,
+	}
+	if err := GetAccountService().UpdateCachedQuotaByAccountIdAndAdditionalSize(target.Id.Hex(), file.Size); err != nil {
+		log.Println("Fail to update quota after shard rebuild by error", err.Error())
+	}
+	log.Println("Rebuilt shard", i, "of layout", layout.Id.Hex(), "on account", target.Id.Hex())
+	return nil
+}
+
+func saveErasureShards(layout *ErasureLayout) error {
+	_, err := dao.ErasureLayout().UpdateOne(context.Background(), bson.D{{"_id", layout.Id}}, bson.D{
+		{"$set", bson.D{
+			{"shards", layout.Shards},
+			{"scrubTime", layout.ScrubTime},
+		}},
+	})
+	return err
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/api/googleapi"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// fakeAccounts swaps accountBackend for in-memory backends, one per account id, until restore is called.
+func fakeAccounts() (backends map[primitive.ObjectID]*helper.FakeDriveBackend, restore func()) {
+	backends = make(map[primitive.ObjectID]*helper.FakeDriveBackend)
+	previous := accountBackend
+	accountBackend = func(accountId primitive.ObjectID) (helper.DriveBackend, error) {
+		backend, ok := backends[accountId]
+		if !ok {
+			return nil, fmt.Errorf("no fake backend for account %s", accountId.Hex())
+		}
+		return backend, nil
+	}
+	return backends, func() { accountBackend = previous }
+}
+
+func newErasureState(t *testing.T, backends map[primitive.ObjectID]*helper.FakeDriveBackend, size int64, dataShards int, parityShards int, blockSize int64) *UploadState {
+	stripeSize := int64(dataShards) * blockSize
+	shardSize := (size + stripeSize - 1) / stripeSize * blockSize
+	state := &UploadState{
+		Id:           "test-upload",
+		Size:         size,
+		ChunkSize:    stripeSize,
+		Erasure:      true,
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		BlockSize:    blockSize,
+	}
+	for i := 0; i < dataShards+parityShards; i++ {
+		backend := helper.NewFakeDriveBackend(1 << 30)
+		accountId := primitive.NewObjectID()
+		backends[accountId] = backend
+		uri, err := backend.CreateUploadSession(shardName("file", i), ChunkPartMimeType, shardSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.Parts = append(state.Parts, &UploadPart{Index: i, AccountId: accountId, Size: shardSize, SessionUri: uri})
+	}
+	return state
+}
+
+// shardContent reads back what the fake account of the shard stored.
+func shardContent(t *testing.T, backend *helper.FakeDriveBackend) []byte {
+	files := backend.Files()
+	if len(files) != 1 {
+		t.Fatalf("expected 1 shard file, got %d", len(files))
+	}
+	return files[0].Content
+}
+
+func TestSendStripesChunkSizes(t *testing.T) {
+	const blockSize = 256 * 1024
+	const dataShards, parityShards = 2, 1
+	const stripeSize = dataShards * blockSize
+	size := int64(2*stripeSize + 1000)
+
+	tests := []struct {
+		name   string
+		chunks []int64
+	}{
+		{"one chunk for the whole file", []int64{size}},
+		{"one stripe per chunk", []int64{stripeSize, stripeSize, 1000}},
+		{"two stripes then the rest", []int64{2 * stripeSize, 1000}},
+		{"one stripe then a final chunk over several stripes", []int64{stripeSize, stripeSize + 1000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends, restore := fakeAccounts()
+			defer restore()
+			state := newErasureState(t, backends, size, dataShards, parityShards, blockSize)
+			content := make([]byte, size)
+			rand.New(rand.NewSource(1)).Read(content)
+
+			s := &UploadService{}
+			var start int64
+			for _, n := range tt.chunks {
+				if err := s.sendStripes(state, bytes.NewReader(content[start:start+n]), start, start+n-1); err != nil {
+					t.Fatalf("chunk at %d: %v", start, err)
+				}
+				start += n
+				if state.Offset != start {
+					t.Fatalf("offset %d after chunk, expected %d", state.Offset, start)
+				}
+			}
+
+			shards := make([][]byte, dataShards+parityShards)
+			for _, part := range state.Parts {
+				if !part.Complete || part.Failed {
+					t.Fatalf("shard %d not complete", part.Index)
+				}
+				shards[part.Index] = shardContent(t, backends[part.AccountId])
+			}
+			// losing a data shard must still decode to the content
+			shards[0] = nil
+			enc, _ := reedsolomon.New(dataShards, parityShards)
+			if err := enc.Reconstruct(shards); err != nil {
+				t.Fatal(err)
+			}
+			var decoded bytes.Buffer
+			for stripe := 0; stripe*blockSize < len(shards[0]); stripe++ {
+				for i := 0; i < dataShards; i++ {
+					decoded.Write(shards[i][stripe*blockSize : (stripe+1)*blockSize])
+				}
+			}
+			if !bytes.Equal(decoded.Bytes()[:size], content) {
+				t.Fatal("decoded content differs from the upload")
+			}
+		})
+	}
+}
+
+func TestSendStripesRejectsMisalignedChunks(t *testing.T) {
+	const blockSize = 256 * 1024
+	const stripeSize = 2 * blockSize
+	size := int64(3 * stripeSize)
+
+	tests := []struct {
+		name       string
+		start, end int64
+	}{
+		{"start inside a stripe", blockSize, 2*stripeSize - 1},
+		{"not whole stripes before the end", 0, stripeSize + blockSize - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends, restore := fakeAccounts()
+			defer restore()
+			state := newErasureState(t, backends, size, 2, 1, blockSize)
+			chunk := bytes.NewReader(make([]byte, tt.end-tt.start+1))
+			if err := (&UploadService{}).sendStripes(state, chunk, tt.start, tt.end); err != ErrInvalidContentRange {
+				t.Fatalf("expected ErrInvalidContentRange, got %v", err)
+			}
+			if state.Offset != 0 {
+				t.Fatalf("offset moved to %d", state.Offset)
+			}
+		})
+	}
+}
+
+// uploadErasure stores content erasure coded on fake accounts and returns its layout.
+func uploadErasure(t *testing.T, backends map[primitive.ObjectID]*helper.FakeDriveBackend, content []byte, dataShards int, parityShards int, blockSize int64) *ErasureLayout {
+	size := int64(len(content))
+	state := newErasureState(t, backends, size, dataShards, parityShards, blockSize)
+	if err := (&UploadService{}).sendStripes(state, bytes.NewReader(content), 0, size-1); err != nil {
+		t.Fatal(err)
+	}
+	layout := &ErasureLayout{
+		Id:           primitive.NewObjectID(),
+		Size:         size,
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		BlockSize:    blockSize,
+		ShardSize:    state.Parts[0].Size,
+	}
+	for _, part := range state.Parts {
+		layout.Shards = append(layout.Shards, ErasureShard{
+			Index:     part.Index,
+			AccountId: part.AccountId,
+			FileId:    backends[part.AccountId].Files()[0].File.Id,
+		})
+	}
+	return layout
+}
+
+// erasureReaderOn builds the reader newErasureReader would, on the fake accounts and without
+// looking up account health.
+func erasureReaderOn(layout *ErasureLayout, backends map[primitive.ObjectID]*helper.FakeDriveBackend, start int64, end int64) *erasureReader {
+	enc, _ := reedsolomon.New(layout.DataShards, layout.ParityShards)
+	r := &erasureReader{
+		layout:   layout,
+		enc:      enc,
+		pos:      start,
+		end:      end,
+		last:     end / layout.stripeSize(),
+		stripe:   -1,
+		streams:  make([]*shardStream, len(layout.Shards)),
+		bad:      make([]bool, len(layout.Shards)),
+		backends: make(map[primitive.ObjectID]helper.DriveBackend),
+	}
+	for i, shard := range layout.Shards {
+		r.bad[i] = shard.Missing
+		r.backends[shard.AccountId] = backends[shard.AccountId]
+	}
+	return r
+}
+
+func TestErasureReaderLostShards(t *testing.T) {
+	const blockSize = 1024
+	const dataShards, parityShards = 3, 2
+	const stripeSize = dataShards * blockSize
+	content := make([]byte, 3*stripeSize+500)
+	rand.New(rand.NewSource(2)).Read(content)
+	size := int64(len(content))
+
+	tests := []struct {
+		name       string
+		start, end int64
+		// shards known missing in the layout, and shards failing when read
+		missing, failing []int
+		lost             bool
+	}{
+		{"intact", 0, size - 1, nil, nil, false},
+		{"range across stripes", stripeSize - 10, 2*stripeSize + 10, nil, nil, false},
+		{"last bytes", size - 20, size - 1, nil, nil, false},
+		{"data shard missing", 0, size - 1, []int{0}, nil, false},
+		{"data shard failing", 0, size - 1, nil, []int{1}, false},
+		{"as many lost as parity", 100, size - 100, []int{0}, []int{2}, false},
+		{"more lost than parity", 0, size - 1, []int{0}, []int{1, 2}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends, restore := fakeAccounts()
+			defer restore()
+			layout := uploadErasure(t, backends, content, dataShards, parityShards, blockSize)
+			for _, i := range tt.missing {
+				layout.Shards[i].Missing = true
+			}
+			for _, i := range tt.failing {
+				backends[layout.Shards[i].AccountId].FailWith(helper.FakeOpDownload, &googleapi.Error{Code: 500})
+			}
+			reader := erasureReaderOn(layout, backends, tt.start, tt.end)
+			defer reader.Close()
+			read, err := ioutil.ReadAll(reader)
+			if tt.lost {
+				if err != ErrTooManyShardsLost {
+					t.Fatalf("expected ErrTooManyShardsLost, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(read, content[tt.start:tt.end+1]) {
+				t.Fatal("read content differs from the upload")
+			}
+		})
+	}
+}
@@ -0,0 +1,436 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ExpansionTriggerSchedule = "schedule"
+	ExpansionTriggerManual   = "manual"
+)
+
+// forecasts further out than this are reported as never
+const maxForecast = 10 * 365 * 24 * time.Hour
+
+var (
+	ErrInvalidExpansionPolicy = errors.New("InvalidExpansionPolicy")
+	ErrNoExpansionPolicy      = errors.New("NoExpansionPolicy")
+	ErrExpansionPending       = errors.New("ExpansionPending")
+	ErrNoProjectCapacity      = errors.New("NoProjectCapacity")
+)
+
+// ExpansionService adds accounts to the pool of a user when its free space runs low, in the
+// projects that have not reached ProjectAccountLimit service accounts yet.
+type ExpansionService struct {
+	Interval            time.Duration
+	ProjectAccountLimit int
+	ForecastWindow      time.Duration
+	mutex               sync.Mutex
+}
+
+type PoolCapacity struct {
+	Accounts  int   `json:"accounts" bson:"accounts"`
+	Available int64 `json:"available" bson:"available"`
+	Usage     int64 `json:"usage" bson:"usage"`
+	Limit     int64 `json:"limit" bson:"limit"`
+}
+
+// CapacityForecast extrapolates the bytes added over the window. Times are nil when the pool is
+// not growing.
+type CapacityForecast struct {
+	Window       string     `json:"window"`
+	Growth       int64      `json:"growth"`
+	GrowthPerDay int64      `json:"growthPerDay"`
+	ThresholdAt  *time.Time `json:"thresholdAt,omitempty"`
+	ExhaustedAt  *time.Time `json:"exhaustedAt,omitempty"`
+}
+
+// ExpansionPlan is what a check would do for the user right now.
+type ExpansionPlan struct {
+	Policy      *entity.ExpansionPolicy      `json:"policy"`
+	Capacity    PoolCapacity                 `json:"capacity"`
+	Forecast    CapacityForecast             `json:"forecast"`
+	Needed      bool                         `json:"needed"`
+	Pending     bool                         `json:"pending"`
+	Accounts    int                          `json:"accounts"`
+	Allocations []entity.ExpansionAllocation `json:"allocations"`
+}
+
+var expansionService *ExpansionService
+
+func GetExpansionService() *ExpansionService {
+	if expansionService == nil {
+		expansionService = &ExpansionService{
+			Interval:            durationFromEnv("EXPANSION_CHECK_INTERVAL", 15*time.Minute),
+			ProjectAccountLimit: intFromEnv("PROJECT_SERVICE_ACCOUNT_LIMIT", 100),
+			ForecastWindow:      durationFromEnv("EXPANSION_FORECAST_WINDOW", 7*24*time.Hour),
+		}
+	}
+	return expansionService
+}
+
+func (s *ExpansionService) FindPolicy(owner primitive.ObjectID) (*entity.ExpansionPolicy, error) {
+	var policy entity.ExpansionPolicy
+	if err := dao.ExpansionPolicy().FindOne(context.Background(), bson.D{{"owner", owner}}).Decode(&policy); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNoExpansionPolicy
+		}
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// SetPolicy stores the expansion policy of the user. maxAccounts caps the service accounts of the
+// user, zero means no cap.
+func (s *ExpansionService) SetPolicy(owner primitive.ObjectID, enabled bool, minAvailable int64, accountsPerExpansion int, maxAccounts int) (*entity.ExpansionPolicy, error) {
+	if minAvailable < 0 || accountsPerExpansion < 1 || maxAccounts < 0 {
+		return nil, ErrInvalidExpansionPolicy
+	}
+	var policy entity.ExpansionPolicy
+	if err := dao.ExpansionPolicy().FindOneAndUpdate(context.Background(), bson.D{
+		{"owner", owner},
+	}, bson.D{
+		{"$set", bson.D{
+			{"enabled", enabled},
+			{"minAvailable", minAvailable},
+			{"accountsPerExpansion", accountsPerExpansion},
+			{"maxAccounts", maxAccounts},
+			{"updatedAt", time.Now()},
+		}},
+		{"$setOnInsert", bson.D{
+			{"_id", primitive.NewObjectID()},
+		}},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// Start checks every enabled policy on Interval. A zero interval disables it.
+func (s *ExpansionService) Start() {
+	if s.Interval <= 0 {
+		log.Println("Automatic pool expansion is disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			owners, err := dao.ExpansionPolicy().Distinct(context.Background(), "owner", bson.D{{"enabled", true}})
+			if err != nil {
+				log.Println("Fail to list expansion policies by error", err.Error())
+				continue
+			}
+			for _, o := range owners {
+				owner, ok := o.(primitive.ObjectID)
+				if !ok {
+					continue
+				}
+				if _, err := s.Check(owner, ExpansionTriggerSchedule); err != nil && err != ErrExpansionPending {
+					log.Println("Fail to expand pool of user", owner.Hex(), "by error", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// Plan works out the capacity, the forecast and the accounts a check would provision, without
+// provisioning anything.
+func (s *ExpansionService) Plan(owner primitive.ObjectID) (*ExpansionPlan, error) {
+	policy, err := s.FindPolicy(owner)
+	if err != nil && err != ErrNoExpansionPolicy {
+		return nil, err
+	}
+	capacity, err := poolCapacity(owner)
+	if err != nil {
+		return nil, err
+	}
+	plan := &ExpansionPlan{
+		Policy:      policy,
+		Capacity:    *capacity,
+		Allocations: make([]entity.ExpansionAllocation, 0),
+	}
+	var minAvailable int64
+	if policy != nil {
+		minAvailable = policy.MinAvailable
+	}
+	if plan.Forecast, err = s.forecast(owner, capacity.Available, minAvailable); err != nil {
+		return nil, err
+	}
+	if policy == nil || capacity.Available >= policy.MinAvailable {
+		return plan, nil
+	}
+	plan.Needed = true
+	if plan.Pending, err = pendingProvisioning(owner); err != nil {
+		return nil, err
+	}
+
+	plan.Accounts = policy.AccountsPerExpansion
+	if policy.MaxAccounts > 0 {
+		total, err := dao.DriveAccount().CountDocuments(context.Background(), bson.D{
+			{"owner", owner},
+			{"type", "service_account"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if left := policy.MaxAccounts - int(total); left < plan.Accounts {
+			plan.Accounts = left
+		}
+		if plan.Accounts < 0 {
+			plan.Accounts = 0
+		}
+	}
+	if plan.Accounts > 0 {
+		if plan.Allocations, err = s.allocate(owner, plan.Accounts); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// Check provisions accounts if the pool is below the threshold of the policy and records the
+// expansion. It returns nil when nothing had to be done. A manual check runs disabled policies too.
+func (s *ExpansionService) Check(owner primitive.ObjectID, trigger string) (*entity.Expansion, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	plan, err := s.Plan(owner)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Policy == nil {
+		return nil, ErrNoExpansionPolicy
+	}
+	if !plan.Needed || (!plan.Policy.Enabled && trigger == ExpansionTriggerSchedule) {
+		return nil, nil
+	}
+	if plan.Pending {
+		return nil, ErrExpansionPending
+	}
+	if plan.Accounts == 0 {
+		log.Println("Pool of user", owner.Hex(), "is low but already has", plan.Policy.MaxAccounts, "accounts")
+		return nil, nil
+	}
+	if len(plan.Allocations) == 0 {
+		return nil, ErrNoProjectCapacity
+	}
+
+	expansion := &entity.Expansion{
+		Id:           primitive.NewObjectID(),
+		Owner:        owner,
+		Trigger:      trigger,
+		Available:    plan.Capacity.Available,
+		MinAvailable: plan.Policy.MinAvailable,
+		Requested:    plan.Accounts,
+		Allocations:  plan.Allocations,
+		CreatedAt:    time.Now(),
+	}
+	failed := 0
+	for i := range expansion.Allocations {
+		allocation := &expansion.Allocations[i]
+		job, err := GetProjectService().EnqueueProjectJob(owner, allocation.ProjectId.Hex(), JobProvisionProject, map[string]string{
+			"count":       strconv.Itoa(allocation.Accounts),
+			"expansionId": expansion.Id.Hex(),
+		})
+		if err != nil {
+			log.Println("Fail to provision", allocation.Accounts, "accounts in project", allocation.ProjectId.Hex(), "by error", err.Error())
+			allocation.Error = err.Error()
+			failed++
+			continue
+		}
+		allocation.JobId = &job.Id
+	}
+	if failed == len(expansion.Allocations) {
+		expansion.Error = "no provisioning could be started"
+	}
+	if _, err := dao.Expansion().InsertOne(context.Background(), expansion); err != nil {
+		log.Println("Fail to record expansion", expansion.Id.Hex(), "by error", err.Error())
+		return nil, err
+	}
+	log.Println("Expanding pool of user", owner.Hex(), "by", plan.Accounts, "accounts, available", plan.Capacity.Available, "below", plan.Policy.MinAvailable)
+	return expansion, nil
+}
+
+func (s *ExpansionService) FindExpansions(owner primitive.ObjectID, limit int64) ([]*entity.Expansion, error) {
+	expansions := make([]*entity.Expansion, 0)
+	cursor, err := dao.Expansion().Find(context.Background(), bson.D{{"owner", owner}},
+		options.Find().SetSort(bson.D{{"createdAt", -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &expansions); err != nil {
+		return nil, err
+	}
+	return expansions, nil
+}
+
+// poolCapacity sums the accounts that take uploads.
+func poolCapacity(owner primitive.ObjectID) (*PoolCapacity, error) {
+	var result []PoolCapacity
+	cursor, err := dao.DriveAccount().Aggregate(context.Background(), mongo.Pipeline{
+		{{"$match", bson.D{
+			{"owner", owner},
+			storageTypeFilter(),
+			{"disabled", bson.D{{"$ne", true}}},
+			{"readOnly", bson.D{{"$ne", true}}},
+			healthyFilter(),
+		}}},
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"accounts", bson.D{{"$sum", 1}}},
+			{"available", bson.D{{"$sum", "$available"}}},
+			{"usage", bson.D{{"$sum", "$usage"}}},
+			{"limit", bson.D{{"$sum", "$limit"}}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return &PoolCapacity{}, nil
+	}
+	return &result[0], nil
+}
+
+// forecast takes the size of the files created over ForecastWindow as the growth rate.
+func (s *ExpansionService) forecast(owner primitive.ObjectID, available int64, minAvailable int64) (CapacityForecast, error) {
+	forecast := CapacityForecast{Window: s.ForecastWindow.String()}
+	var result []struct {
+		Growth int64 `bson:"growth"`
+	}
+	cursor, err := dao.FileIndex().Aggregate(context.Background(), mongo.Pipeline{
+		{{"$match", bson.D{
+			{"owner", owner},
+			{"createdTime", bson.D{{"$gte", time.Now().Add(-s.ForecastWindow)}}},
+		}}},
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"growth", bson.D{{"$sum", "$size"}}},
+		}}},
+	})
+	if err != nil {
+		return forecast, err
+	}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		return forecast, err
+	}
+	if len(result) == 0 || result[0].Growth <= 0 || s.ForecastWindow <= 0 {
+		return forecast, nil
+	}
+	forecast.Growth = result[0].Growth
+	perSecond := float64(forecast.Growth) / s.ForecastWindow.Seconds()
+	forecast.GrowthPerDay = int64(perSecond * 24 * 3600)
+	forecast.ThresholdAt = forecastTime(available-minAvailable, perSecond)
+	forecast.ExhaustedAt = forecastTime(available, perSecond)
+	return forecast, nil
+}
+
+func forecastTime(bytes int64, perSecond float64) *time.Time {
+	if bytes < 0 {
+		bytes = 0
+	}
+	seconds := float64(bytes) / perSecond
+	if seconds > maxForecast.Seconds() {
+		return nil
+	}
+	at := time.Now().Add(time.Duration(seconds * float64(time.Second)))
+	return &at
+}
+
+func pendingProvisioning(owner primitive.ObjectID) (bool, error) {
+	count, err := dao.Job().CountDocuments(context.Background(), bson.D{
+		{"owner", owner},
+		{"type", JobProvisionProject},
+		{"status", bson.D{{"$in", bson.A{JobQueued, JobRunning}}}},
+	})
+	return count > 0, err
+}
+
+// projectServiceAccountCount counts the service accounts against the Google limit of the project, including those only IAM knows about.
+func projectServiceAccountCount(p *entity.Project) (int, error) {
+	// the admin account is a service account of the project as well, local and S3 accounts are not
+	local, err := dao.DriveAccount().CountDocuments(context.Background(), bson.D{
+		{"projectId", p.Id},
+		{"type", bson.D{{"$nin", bson.A{helper.KeyTypeLocal, helper.KeyTypeS3}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	is, err := GetProjectService().GetIamService(p)
+	if err != nil {
+		return 0, err
+	}
+	remote, err := is.ListServiceAccounts(p.ProjectId)
+	if err != nil {
+		return 0, err
+	}
+	if len(remote) > int(local) {
+		return len(remote), nil
+	}
+	return int(local), nil
+}
+
+// allocate spreads count accounts over the enabled projects of the owner, those with the most room first.
+func (s *ExpansionService) allocate(owner primitive.ObjectID, count int) ([]entity.ExpansionAllocation, error) {
+	projects := make([]*entity.Project, 0)
+	cursor, err := dao.Project().Find(context.Background(), bson.D{
+		{"owner", owner},
+		{"disabled", bson.D{{"$ne", true}}},
+		{"type", bson.D{{"$ne", ProjectTypeStorage}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &projects); err != nil {
+		return nil, err
+	}
+	type room struct {
+		projectId primitive.ObjectID
+		free      int
+	}
+	rooms := make([]room, 0)
+	for _, p := range projects {
+		used, err := projectServiceAccountCount(p)
+		if err != nil {
+			// without the IAM count the project may already be full, leave it out
+			log.Println("Fail to count service accounts of project", p.Id.Hex(), "by error", err.Error())
+			continue
+		}
+		if free := s.ProjectAccountLimit - used; free > 0 {
+			rooms = append(rooms, room{projectId: p.Id, free: free})
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].free > rooms[j].free
+	})
+	allocations := make([]entity.ExpansionAllocation, 0)
+	for _, r := range rooms {
+		if count == 0 {
+			break
+		}
+		n := r.free
+		if n > count {
+			n = count
+		}
+		allocations = append(allocations, entity.ExpansionAllocation{ProjectId: r.projectId, Accounts: n})
+		count -= n
+	}
+	return allocations, nil
+}
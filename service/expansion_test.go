@@ -0,0 +1,42 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForecastTime(t *testing.T) {
+	const day = 24 * 3600
+	tests := []struct {
+		name      string
+		bytes     int64
+		perSecond float64
+		// nil for never
+		in *time.Duration
+	}{
+		{"a day away", 100 * day, 100, durationPtr(24 * time.Hour)},
+		{"already reached", -5, 100, durationPtr(0)},
+		{"beyond the forecast horizon", 1 << 62, 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := forecastTime(tt.bytes, tt.perSecond)
+			if tt.in == nil {
+				if at != nil {
+					t.Fatalf("forecast at %v, expected never", at)
+				}
+				return
+			}
+			if at == nil {
+				t.Fatal("forecast never")
+			}
+			if delta := time.Until(*at) - *tt.in; delta > time.Second || delta < -time.Second {
+				t.Fatalf("forecast %v away, expected %v", time.Until(*at), *tt.in)
+			}
+		})
+	}
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
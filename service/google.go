@@ -7,6 +7,7 @@ import (
 	"github.com/ndphu/drive-manager-api/dao"
 	"github.com/ndphu/drive-manager-api/entity"
 	"github.com/ndphu/drive-manager-api/helper"
+	"github.com/ndphu/drive-manager-api/keyring"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/oauth2"
@@ -30,38 +31,38 @@ func (g *GoogleService) GetDownloadLink(accountId, fileId string) (*helper.Downl
 		log.Println("Fail to file drive account by error", err.Error())
 		return nil, err
 	}
-	s, err := helper.GetDriveService([]byte(acc.Key))
+	s, err := accountService.GetDriveBackend(&acc)
 	if err != nil {
 		log.Println("Fail to get drive service from account key", err.Error())
 		return nil, err
 	}
 
-	f, err := s.Service.Files.
-		Get(fileId).
-		Fields("id, name, size, mimeType").
-		Do()
+	f, err := s.GetFile(fileId)
 	if err != nil {
 		log.Println("Fail to get file info from google", err.Error())
 		return nil, err
 	}
 
-	var linkFormat = os.Getenv("DRIVE_FILE_DOWNLOAD_LINK_TEMPLATE")
-	if linkFormat == "" {
-		linkFormat = DefaultDriveFileFormat
-	}
-
 	token, err := s.GetAccessToken()
 	if err != nil {
 		log.Println("Fail to get access token")
 		return nil, err
 	}
 	return &helper.DownloadDetails{
-		Link:  fmt.Sprintf(linkFormat, fileId),
+		Link:  driveFileLink(fileId),
 		Token: token,
 		File:  f,
 	}, nil
 }
 
+func driveFileLink(fileId string) string {
+	var linkFormat = os.Getenv("DRIVE_FILE_DOWNLOAD_LINK_TEMPLATE")
+	if linkFormat == "" {
+		linkFormat = DefaultDriveFileFormat
+	}
+	return fmt.Sprintf(linkFormat, fileId)
+}
+
 func (g *GoogleService) CreateServiceAccount(userId string, projectId string) error {
 	owner, _ := primitive.ObjectIDFromHex(userId)
 	//pid := primitive.ObjectIDFromHex(projectId)
@@ -70,7 +71,10 @@ func (g *GoogleService) CreateServiceAccount(userId string, projectId string) er
 	if err != nil {
 		return err
 	}
-	b := []byte(adminAccount.Key)
+	b, err := keyring.Decrypt(adminAccount.Key)
+	if err != nil {
+		return err
+	}
 	config, err := google.JWTConfigFromJSON(b, iam.CloudPlatformScope)
 	if err != nil {
 		return err
@@ -122,7 +126,7 @@ func (g *GoogleService) DeleteFile(accountId string, fileId string) error {
 		log.Println("Fail to DeleteFile by error", err.Error())
 		return err
 	}
-	s, err := helper.GetDriveService([]byte(acc.Key))
+	s, err := accountService.GetDriveBackend(&acc)
 	if err != nil {
 		log.Println("Fail to get drive service from account key", err.Error())
 		return err
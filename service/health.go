@@ -0,0 +1,305 @@
+package service
+
+import (
+	"context"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health of an account as found by its last probe. Accounts never probed have no status.
+const (
+	HealthHealthy    = "healthy"
+	HealthDegraded   = "degraded"
+	HealthKeyInvalid = "key_invalid"
+	HealthNotFound   = "not_found"
+)
+
+// BrokenStatuses are kept out of placement. A degraded account may only have hit a transient
+// error, so placement and downloads still use it but try it last.
+var BrokenStatuses = bson.A{HealthKeyInvalid, HealthNotFound}
+
+// HealthResult is the outcome of probing one account.
+type HealthResult struct {
+	AccountId primitive.ObjectID `json:"accountId"`
+	Status    string             `json:"status"`
+	Step      string             `json:"step,omitempty"`
+	Error     string             `json:"error,omitempty"`
+	CheckedAt time.Time          `json:"checkedAt"`
+}
+
+// HealthChecker probes every enabled service account on Interval, Concurrency at a time.
+type HealthChecker struct {
+	Interval    time.Duration
+	Concurrency int
+}
+
+var healthChecker *HealthChecker
+
+func GetHealthChecker() *HealthChecker {
+	if healthChecker == nil {
+		healthChecker = &HealthChecker{
+			Interval:    durationFromEnv("HEALTH_CHECK_INTERVAL", 15*time.Minute),
+			Concurrency: intFromEnv("HEALTH_CHECK_CONCURRENCY", 4),
+		}
+		if healthChecker.Concurrency < 1 {
+			healthChecker.Concurrency = 1
+		}
+	}
+	return healthChecker
+}
+
+// healthyFilter keeps accounts known to be broken out of a drive_account query.
+func healthyFilter() bson.E {
+	return bson.E{Key: "healthStatus", Value: bson.D{{"$nin", BrokenStatuses}}}
+}
+
+// healthRank orders accounts for placement, degraded ones after the others.
+func healthRank(acc *entity.DriveAccount) int {
+	if acc.HealthStatus == HealthDegraded {
+		return 1
+	}
+	return 0
+}
+
+// Start probes all accounts on Interval. A zero interval disables it.
+func (s *HealthChecker) Start() {
+	if s.Interval <= 0 {
+		log.Println("Account health checks are disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.CheckAll(); err != nil {
+				log.Println("Fail to check account health by error", err.Error())
+			}
+		}
+	}()
+}
+
+func (s *HealthChecker) CheckAll() error {
+	accounts := make([]*entity.DriveAccount, 0)
+	cursor, err := dao.DriveAccount().Find(context.Background(), bson.D{
+		storageTypeFilter(),
+		{"disabled", bson.D{{"$ne", true}}},
+	}, options.Find().SetSort(bson.D{{"healthCheckedAt", 1}}))
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(context.Background(), &accounts); err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, s.Concurrency)
+	for _, acc := range accounts {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(acc *entity.DriveAccount) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			result := s.Check(acc)
+			mutex.Lock()
+			counts[result.Status]++
+			mutex.Unlock()
+		}(acc)
+	}
+	wg.Wait()
+	log.Println("Checked health of", len(accounts), "accounts:", counts)
+	return nil
+}
+
+// Check probes the account and stores the result on it.
+func (s *HealthChecker) Check(acc *entity.DriveAccount) *HealthResult {
+	result := probe(acc)
+	set := bson.D{
+		{"healthStatus", result.Status},
+		{"healthCheckedAt", result.CheckedAt},
+	}
+	var update bson.D
+	if result.Error != "" {
+		set = append(set, bson.E{Key: "healthError", Value: result.Step + ": " + result.Error})
+		update = bson.D{{"$set", set}}
+	} else {
+		update = bson.D{{"$set", set}, {"$unset", bson.D{{"healthError", ""}}}}
+	}
+	if _, err := dao.DriveAccount().UpdateOne(context.Background(), bson.D{{"_id", acc.Id}}, update); err != nil {
+		log.Println("Fail to save health of account", acc.Id.Hex(), "by error", err.Error())
+	}
+	if result.Status != acc.HealthStatus {
+		log.Println("Account", acc.ClientEmail, "is now", result.Status, result.Error)
+	}
+	return result
+}
+
+func (s *HealthChecker) CheckAccount(owner primitive.ObjectID, accountId primitive.ObjectID) (*HealthResult, error) {
+	acc, err := accountService.FindAccountById(accountId, owner)
+	if err != nil {
+		return nil, err
+	}
+	return s.Check(acc), nil
+}
+
+// probe gets a token, asks Drive for the quota (about.get) and lists one file. It bypasses the
+// account breaker, a healthy probe puts the account back in rotation.
+func probe(acc *entity.DriveAccount) *HealthResult {
+	result := &HealthResult{AccountId: acc.Id, Status: HealthHealthy, CheckedAt: time.Now()}
+	fail := func(step string, status string, err error) *HealthResult {
+		result.Step = step
+		result.Status = status
+		result.Error = err.Error()
+		return result
+	}
+	backend, err := accountService.newDriveBackend(acc)
+	if err != nil {
+		return fail("key", HealthKeyInvalid, err)
+	}
+	// local and S3 accounts have no token
+	if _, err := backend.GetToken(); err != nil && err != helper.ErrNoAccessToken {
+		return fail("token", tokenErrorStatus(err), err)
+	}
+	if _, err := backend.GetQuotaUsage(); err != nil {
+		return fail("about", apiErrorStatus(err), err)
+	}
+	if _, err := backend.ListFilePage(helper.ListOptions{PageSize: 1, Fields: "id"}); err != nil {
+		return fail("list", apiErrorStatus(err), err)
+	}
+	GetAccountBreaker().Reset(acc.Id)
+	return result
+}
+
+// tokenErrorStatus tells a deleted service account from a revoked key. Anything else, such as
+// the token endpoint being unreachable, only degrades the account.
+func tokenErrorStatus(err error) string {
+	e, ok := err.(*oauth2.RetrieveError)
+	if !ok {
+		return HealthDegraded
+	}
+	body := strings.ToLower(string(e.Body))
+	switch {
+	case strings.Contains(body, "account not found"):
+		return HealthNotFound
+	case strings.Contains(body, "invalid_grant"), strings.Contains(body, "invalid_client"):
+		return HealthKeyInvalid
+	}
+	return HealthDegraded
+}
+
+func apiErrorStatus(err error) string {
+	if e, ok := err.(*googleapi.Error); ok {
+		switch e.Code {
+		case http.StatusUnauthorized:
+			return HealthKeyInvalid
+		case http.StatusNotFound:
+			return HealthNotFound
+		}
+	}
+	return HealthDegraded
+}
+
+// accountHealth returns the health status of the accounts, missing for accounts never probed.
+func accountHealth(ids []primitive.ObjectID) (map[primitive.ObjectID]string, error) {
+	statuses := make(map[primitive.ObjectID]string)
+	var accounts []entity.DriveAccount
+	cursor, err := dao.DriveAccount().Find(context.Background(), bson.D{
+		{"_id", bson.D{{"$in", ids}}},
+	}, options.Find().SetProjection(bson.D{{"healthStatus", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &accounts); err != nil {
+		return nil, err
+	}
+	for _, acc := range accounts {
+		statuses[acc.Id] = acc.HealthStatus
+	}
+	return statuses, nil
+}
+
+func isUnhealthy(status string) bool {
+	return status == HealthDegraded || isBroken(status)
+}
+
+func isBroken(status string) bool {
+	return status == HealthKeyInvalid || status == HealthNotFound
+}
+
+// routeCopies orders copies for reading: healthy first, degraded or out of rotation after, broken
+// accounts dropped. When every copy is on a broken account they are all kept, the status may be stale.
+func routeCopies(copies []FileReplica) []FileReplica {
+	if len(copies) < 2 {
+		return copies
+	}
+	ids := make([]primitive.ObjectID, 0, len(copies))
+	for _, c := range copies {
+		ids = append(ids, c.AccountId)
+	}
+	statuses, err := accountHealth(ids)
+	if err != nil {
+		log.Println("Fail to load account health by error", err.Error())
+		return copies
+	}
+	routed := make([]FileReplica, 0, len(copies))
+	degraded := make([]FileReplica, 0)
+	breaker := GetAccountBreaker()
+	for _, c := range copies {
+		switch status := statuses[c.AccountId]; {
+		case isBroken(status):
+			continue
+		case status == HealthDegraded, breaker.IsOpen(c.AccountId):
+			degraded = append(degraded, c)
+		default:
+			routed = append(routed, c)
+		}
+	}
+	routed = append(routed, degraded...)
+	if len(routed) == 0 {
+		return copies
+	}
+	return routed
+}
+
+// AccountHealthSummary counts the accounts of the owner by health status.
+func AccountHealthSummary(owner primitive.ObjectID) (map[string]int, error) {
+	var groups []struct {
+		Status string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	cursor, err := dao.DriveAccount().Aggregate(context.Background(), mongo.Pipeline{
+		{{"$match", bson.D{
+			{"owner", owner},
+			storageTypeFilter(),
+		}}},
+		{{"$group", bson.D{
+			{"_id", bson.D{{"$ifNull", bson.A{"$healthStatus", "unknown"}}}},
+			{"count", bson.D{{"$sum", 1}}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &groups); err != nil {
+		return nil, err
+	}
+	summary := make(map[string]int)
+	for _, g := range groups {
+		summary[g.Status] = g.Count
+	}
+	return summary, nil
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"errors"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"net/http"
+	"testing"
+)
+
+func TestProbe(t *testing.T) {
+	badRequest := &http.Response{Status: "400 Bad Request", StatusCode: 400}
+	tests := []struct {
+		name   string
+		op     string
+		err    error
+		status string
+		step   string
+	}{
+		{"healthy", "", nil, HealthHealthy, ""},
+		{"deleted service account", helper.FakeOpToken, &oauth2.RetrieveError{Response: badRequest, Body: []byte(`{"error":"invalid_grant","error_description":"Account not found"}`)}, HealthNotFound, "token"},
+		{"revoked key", helper.FakeOpToken, &oauth2.RetrieveError{Response: badRequest, Body: []byte(`{"error":"invalid_grant"}`)}, HealthKeyInvalid, "token"},
+		{"token endpoint unreachable", helper.FakeOpToken, errors.New("dial tcp: i/o timeout"), HealthDegraded, "token"},
+		{"unauthorized", helper.FakeOpQuota, &googleapi.Error{Code: 401}, HealthKeyInvalid, "about"},
+		{"transient api error", helper.FakeOpQuota, &googleapi.Error{Code: 503}, HealthDegraded, "about"},
+		{"listing not found", helper.FakeOpList, &googleapi.Error{Code: 404}, HealthNotFound, "list"},
+	}
+	previous := helper.NewDriveBackend
+	defer func() { helper.NewDriveBackend = previous }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := helper.NewFakeDriveBackend(1 << 20)
+			if tt.err != nil {
+				fake.FailWith(tt.op, tt.err)
+			}
+			helper.NewDriveBackend = func(key []byte) (helper.DriveBackend, error) {
+				return fake, nil
+			}
+			result := probe(&entity.DriveAccount{Id: primitive.NewObjectID(), Key: "{}"})
+			if result.Status != tt.status || result.Step != tt.step {
+				t.Fatalf("got %s at %q, expected %s at %q", result.Status, result.Step, tt.status, tt.step)
+			}
+		})
+	}
+}
+
+func TestHealthRank(t *testing.T) {
+	// broken accounts never reach placement, the query leaves them out
+	tests := map[string]int{
+		"":             0,
+		HealthHealthy:  0,
+		HealthDegraded: 1,
+	}
+	for status, rank := range tests {
+		if got := healthRank(&entity.DriveAccount{HealthStatus: status}); got != rank {
+			t.Errorf("healthRank(%q) = %d", status, got)
+		}
+	}
+	for _, status := range BrokenStatuses {
+		if status == HealthDegraded {
+			t.Fatal("degraded accounts are left out of placement")
+		}
+	}
+}
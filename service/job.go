@@ -0,0 +1,452 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// item errors kept on a job, the counters still cover every failure
+const maxJobErrors = 200
+
+var (
+	ErrUnknownJobType  = errors.New("UnknownJobType")
+	ErrJobCancelled    = errors.New("JobCancelled")
+	ErrJobFinished     = errors.New("JobFinished")
+	ErrJobNotRetryable = errors.New("JobNotRetryable")
+)
+
+// JobHandler runs one attempt of a job. Returning an error retries the job until MaxAttempts.
+type JobHandler func(job *JobContext) error
+
+// Progress is how long operations report their items and learn about cancellation.
+type Progress interface {
+	SetTotal(total int)
+	ItemDone(item string)
+	ItemFailed(item string, err error)
+	Cancelled() bool
+}
+
+// JobContext is the job being run, handed to its handler. Handlers may report items from several goroutines.
+type JobContext struct {
+	Job   *entity.Job
+	mutex sync.Mutex
+	// set to 1 once another worker took the job over
+	leaseLost int32
+}
+
+func (j *JobContext) Param(name string) string {
+	return j.Job.Params[name]
+}
+
+func (j *JobContext) SetTotal(total int) {
+	j.Job.Total = total
+	j.update(bson.D{{"$set", bson.D{{"total", total}, {"updatedAt", time.Now()}}}})
+}
+
+func (j *JobContext) ItemDone(item string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Job.Done++
+	j.update(bson.D{
+		{"$inc", bson.D{{"done", 1}}},
+		{"$set", bson.D{{"updatedAt", time.Now()}}},
+	})
+}
+
+func (j *JobContext) ItemFailed(item string, err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Job.Failed++
+	e := entity.JobItemError{Item: item, Error: err.Error(), Attempt: j.Job.Attempts, At: time.Now()}
+	update := bson.D{
+		{"$inc", bson.D{{"failed", 1}}},
+		{"$set", bson.D{{"updatedAt", time.Now()}}},
+	}
+	if len(j.Job.Errors) < maxJobErrors {
+		j.Job.Errors = append(j.Job.Errors, e)
+		update = append(update, bson.E{Key: "$push", Value: bson.D{{"errors", e}}})
+	}
+	j.update(update)
+}
+
+// Cancelled tells whether cancellation was asked for, or the job was taken over by another
+// worker. Handlers check it between items.
+func (j *JobContext) Cancelled() bool {
+	if j.LeaseLost() {
+		return true
+	}
+	var job entity.Job
+	if err := dao.Job().FindOne(context.Background(), bson.D{{"_id", j.Job.Id}},
+		options.FindOne().SetProjection(bson.D{{"cancelRequested", 1}, {"workerId", 1}})).Decode(&job); err != nil {
+		return false
+	}
+	if job.WorkerId != j.Job.WorkerId {
+		j.loseLease()
+		return true
+	}
+	j.Job.CancelRequested = job.CancelRequested
+	return job.CancelRequested
+}
+
+// LeaseLost tells whether another worker took the job over, after which this one must stop.
+func (j *JobContext) LeaseLost() bool {
+	return atomic.LoadInt32(&j.leaseLost) == 1
+}
+
+func (j *JobContext) loseLease() {
+	if atomic.CompareAndSwapInt32(&j.leaseLost, 0, 1) {
+		log.Println("Job", j.Job.Id.Hex(), "was taken over by another worker, stopping")
+	}
+}
+
+// update writes progress only while this worker holds the job, so items are not counted twice
+// once it was taken over.
+func (j *JobContext) update(update bson.D) {
+	res, err := dao.Job().UpdateOne(context.Background(), bson.D{
+		{"_id", j.Job.Id},
+		{"workerId", j.Job.WorkerId},
+	}, update)
+	if err != nil {
+		log.Println("Fail to update progress of job", j.Job.Id.Hex(), "by error", err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		j.loseLease()
+	}
+}
+
+type JobService struct {
+	Workers      int
+	PollInterval time.Duration
+	MaxAttempts  int
+	RetryDelay   time.Duration
+	// a running job whose lease is not renewed for so long is taken over by another worker
+	LeaseDuration time.Duration
+	WorkerId      string
+	handlers      map[string]JobHandler
+	wake          chan struct{}
+}
+
+var jobService *JobService
+
+func GetJobService() *JobService {
+	if jobService == nil {
+		jobService = &JobService{
+			Workers:      intFromEnv("JOB_WORKERS", 4),
+			PollInterval: durationFromEnv("JOB_POLL_INTERVAL", 5*time.Second),
+			MaxAttempts:  intFromEnv("JOB_MAX_ATTEMPTS", 3),
+			RetryDelay:   durationFromEnv("JOB_RETRY_DELAY", 30*time.Second),
+
+			LeaseDuration: durationFromEnv("JOB_LEASE_DURATION", 2*time.Minute),
+			WorkerId:      newWorkerId(),
+			handlers:      make(map[string]JobHandler),
+			wake:          make(chan struct{}, 1),
+		}
+		registerProjectJobs(jobService)
+		registerKeyRotationJobs(jobService)
+	}
+	return jobService
+}
+
+// newWorkerId names this instance on the jobs it runs.
+func newWorkerId() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), primitive.NewObjectID().Hex())
+}
+
+func (s *JobService) Register(jobType string, handler JobHandler) {
+	s.handlers[jobType] = handler
+}
+
+// Enqueue stores a job for the workers and returns it right away.
+func (s *JobService) Enqueue(owner primitive.ObjectID, jobType string, params map[string]string) (*entity.Job, error) {
+	if _, ok := s.handlers[jobType]; !ok {
+		return nil, ErrUnknownJobType
+	}
+	now := time.Now()
+	job := &entity.Job{
+		Id:          primitive.NewObjectID(),
+		Owner:       owner,
+		Type:        jobType,
+		Params:      params,
+		Status:      JobQueued,
+		MaxAttempts: s.MaxAttempts,
+		RunAfter:    now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if _, err := dao.Job().InsertOne(context.Background(), job); err != nil {
+		log.Println("Fail to enqueue job", jobType, "by error", err.Error())
+		return nil, err
+	}
+	log.Println("Enqueued job", job.Id.Hex(), jobType, params)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Start starts the workers. Jobs interrupted by a restart are claimed again once their lease
+// expires, jobs other instances are running keep their lease.
+func (s *JobService) Start() {
+	log.Println("Starting", s.Workers, "job workers as", s.WorkerId)
+	for i := 0; i < s.Workers; i++ {
+		go s.worker(i)
+	}
+}
+
+func (s *JobService) worker(id int) {
+	for {
+		job, err := s.claim()
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Println("Worker", id, "fail to claim job by error", err.Error())
+		}
+		if job == nil {
+			select {
+			case <-s.wake:
+			case <-time.After(s.PollInterval):
+			}
+			continue
+		}
+		s.run(job)
+	}
+}
+
+// claim takes the next queued job, or a running one whose worker stopped renewing its lease.
+func (s *JobService) claim() (*entity.Job, error) {
+	var job entity.Job
+	now := time.Now()
+	leaseUntil := now.Add(s.LeaseDuration)
+	if err := dao.Job().FindOneAndUpdate(context.Background(), bson.D{
+		{"$or", bson.A{
+			bson.D{
+				{"status", JobQueued},
+				{"runAfter", bson.D{{"$lte", now}}},
+			},
+			bson.D{
+				{"status", JobRunning},
+				{"leaseUntil", bson.D{{"$lt", now}}},
+			},
+			// running before leases were recorded
+			bson.D{
+				{"status", JobRunning},
+				{"leaseUntil", bson.D{{"$exists", false}}},
+				{"updatedAt", bson.D{{"$lt", now.Add(-s.LeaseDuration)}}},
+			},
+		}},
+	}, bson.D{
+		// counters restart with each attempt, item errors are kept with their attempt number
+		{"$set", bson.D{
+			{"status", JobRunning},
+			{"workerId", s.WorkerId},
+			{"leaseUntil", leaseUntil},
+			{"startedAt", now},
+			{"updatedAt", now},
+			{"done", 0},
+			{"failed", 0},
+		}},
+		{"$inc", bson.D{{"attempts", 1}}},
+	}, options.FindOneAndUpdate().
+		SetSort(bson.D{{"runAfter", 1}}).
+		SetReturnDocument(options.After)).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// renewLease keeps the job leased to this worker until stop is closed.
+func (s *JobService) renewLease(job *entity.Job, stop chan struct{}) {
+	ticker := time.NewTicker(s.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := dao.Job().UpdateOne(context.Background(), bson.D{
+				{"_id", job.Id},
+				{"workerId", s.WorkerId},
+				{"status", JobRunning},
+			}, bson.D{
+				{"$set", bson.D{{"leaseUntil", time.Now().Add(s.LeaseDuration)}}},
+			}); err != nil {
+				log.Println("Fail to renew lease of job", job.Id.Hex(), "by error", err.Error())
+			}
+		}
+	}
+}
+
+func (s *JobService) run(job *entity.Job) {
+	ctx := &JobContext{Job: job}
+	handler := s.handlers[job.Type]
+	stop := make(chan struct{})
+	go s.renewLease(job, stop)
+	var err error
+	if handler == nil {
+		err = ErrUnknownJobType
+	} else if ctx.Cancelled() {
+		err = ErrJobCancelled
+	} else {
+		err = s.safeRun(handler, ctx)
+	}
+	close(stop)
+
+	now := time.Now()
+	set := bson.D{{"updatedAt", now}}
+	switch {
+	case err == nil:
+		set = append(set, bson.E{Key: "status", Value: JobCompleted}, bson.E{Key: "finishedAt", Value: now})
+		log.Println("Job", job.Id.Hex(), job.Type, "completed:", ctx.Job.Done, "done,", ctx.Job.Failed, "failed")
+	case err == ErrJobCancelled:
+		set = append(set, bson.E{Key: "status", Value: JobCancelled}, bson.E{Key: "finishedAt", Value: now})
+		log.Println("Job", job.Id.Hex(), job.Type, "cancelled")
+	case job.Attempts < job.MaxAttempts && err != ErrUnknownJobType:
+		delay := s.RetryDelay * time.Duration(job.Attempts*job.Attempts)
+		set = append(set, bson.E{Key: "status", Value: JobQueued}, bson.E{Key: "runAfter", Value: now.Add(delay)},
+			bson.E{Key: "error", Value: err.Error()})
+		log.Println("Job", job.Id.Hex(), job.Type, "attempt", job.Attempts, "failed by error", err.Error(), "retrying in", delay)
+	default:
+		set = append(set, bson.E{Key: "status", Value: JobFailed}, bson.E{Key: "finishedAt", Value: now},
+			bson.E{Key: "error", Value: err.Error()})
+		log.Println("Job", job.Id.Hex(), job.Type, "failed by error", err.Error())
+	}
+	// a worker that lost its lease leaves the job to the one that took it over
+	if res, err := dao.Job().UpdateOne(context.Background(), bson.D{
+		{"_id", job.Id},
+		{"workerId", s.WorkerId},
+	}, bson.D{
+		{"$set", set},
+		{"$unset", bson.D{{"leaseUntil", ""}}},
+	}); err != nil {
+		log.Println("Fail to save job", job.Id.Hex(), "by error", err.Error())
+	} else if res.MatchedCount == 0 {
+		log.Println("Job", job.Id.Hex(), "was taken over by another worker, dropping the result")
+	}
+}
+
+// safeRun keeps a panicking handler from taking the worker down.
+func (s *JobService) safeRun(handler JobHandler, ctx *JobContext) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx)
+}
+
+// Cancel stops a queued job at once, and asks a running one to stop after its current item.
+func (s *JobService) Cancel(owner primitive.ObjectID, id primitive.ObjectID) (*entity.Job, error) {
+	now := time.Now()
+	if _, err := dao.Job().UpdateOne(context.Background(), bson.D{
+		{"_id", id},
+		{"owner", owner},
+		{"status", JobQueued},
+	}, bson.D{
+		{"$set", bson.D{{"status", JobCancelled}, {"cancelRequested", true}, {"finishedAt", now}, {"updatedAt", now}}},
+	}); err != nil {
+		return nil, err
+	}
+	var job entity.Job
+	if err := dao.Job().FindOneAndUpdate(context.Background(), bson.D{
+		{"_id", id},
+		{"owner", owner},
+	}, bson.D{
+		{"$set", bson.D{{"cancelRequested", true}, {"updatedAt", now}}},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&job); err != nil {
+		return nil, err
+	}
+	if job.Status == JobCompleted || job.Status == JobFailed {
+		return &job, ErrJobFinished
+	}
+	return &job, nil
+}
+
+// Retry queues a failed or cancelled job again with a fresh set of attempts.
+func (s *JobService) Retry(owner primitive.ObjectID, id primitive.ObjectID) (*entity.Job, error) {
+	job, err := s.FindJob(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != JobFailed && job.Status != JobCancelled {
+		return job, ErrJobNotRetryable
+	}
+	now := time.Now()
+	var requeued entity.Job
+	if err := dao.Job().FindOneAndUpdate(context.Background(), bson.D{
+		{"_id", id},
+		{"owner", owner},
+		{"status", job.Status},
+	}, bson.D{
+		{"$set", bson.D{
+			{"status", JobQueued},
+			{"runAfter", now},
+			{"maxAttempts", job.Attempts + s.MaxAttempts},
+			{"cancelRequested", false},
+			{"updatedAt", now},
+		}},
+		{"$unset", bson.D{{"finishedAt", ""}}},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&requeued); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrJobNotRetryable
+		}
+		return nil, err
+	}
+	log.Println("Requeued job", requeued.Id.Hex(), requeued.Type)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return &requeued, nil
+}
+
+func (s *JobService) FindJob(owner primitive.ObjectID, id primitive.ObjectID) (*entity.Job, error) {
+	var job entity.Job
+	if err := dao.Job().FindOne(context.Background(), bson.D{
+		{"_id", id},
+		{"owner", owner},
+	}).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *JobService) FindJobs(owner primitive.ObjectID, jobType string, status string, limit int64) ([]*entity.Job, error) {
+	filter := bson.D{{"owner", owner}}
+	if jobType != "" {
+		filter = append(filter, bson.E{Key: "type", Value: jobType})
+	}
+	if status != "" {
+		filter = append(filter, bson.E{Key: "status", Value: status})
+	}
+	jobs := make([]*entity.Job, 0)
+	cursor, err := dao.Job().Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{"createdAt", -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
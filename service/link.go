@@ -0,0 +1,183 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/nu7hatch/gouuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidLink   = errors.New("InvalidLink")
+	ErrLinkExpired   = errors.New("LinkExpired")
+	ErrLinkForbidden = errors.New("LinkForbidden")
+	ErrLinkExhausted = errors.New("LinkExhausted")
+)
+
+// LinkClaims is the signed payload of a public download link.
+type LinkClaims struct {
+	FileIndexId  string `json:"f"`
+	Expires      int64  `json:"e"`
+	IP           string `json:"ip,omitempty"`
+	MaxDownloads int    `json:"n,omitempty"`
+	Nonce        string `json:"k"`
+}
+
+type SignedLink struct {
+	Token        string    `json:"token"`
+	Path         string    `json:"path"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	IP           string    `json:"ip,omitempty"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+}
+
+type LinkService struct {
+	secret  []byte
+	counter downloadCounter
+	MaxTTL  time.Duration
+}
+
+// downloadCounter keeps the bytes served per link, RedisService in production.
+type downloadCounter interface {
+	IncrBy(key string, n int64, ttl time.Duration) (int64, error)
+}
+
+var linkService *LinkService
+
+func GetLinkService() *LinkService {
+	if linkService == nil {
+		tokenSecret := os.Getenv("TOKEN_SECRET")
+		if tokenSecret == "" {
+			panic("No Token Secret")
+		}
+		rs, _ := GetRedisService()
+		linkService = &LinkService{
+			secret:  []byte(tokenSecret),
+			counter: rs,
+			MaxTTL:  durationFromEnv("SIGNED_LINK_MAX_TTL", 7*24*time.Hour),
+		}
+	}
+	return linkService
+}
+
+func (s *LinkService) CreateLink(owner primitive.ObjectID, fileIndexId string, ttl time.Duration, ip string, maxDownloads int) (*SignedLink, error) {
+	if ttl <= 0 || ttl > s.MaxTTL {
+		ttl = s.MaxTTL
+	}
+	id, err := primitive.ObjectIDFromHex(fileIndexId)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := GetContentService().FindFileIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Owner != owner {
+		return nil, ErrLinkForbidden
+	}
+	nonce, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(ttl)
+	token, err := s.sign(LinkClaims{
+		FileIndexId:  fileIndexId,
+		Expires:      expiresAt.Unix(),
+		IP:           ip,
+		MaxDownloads: maxDownloads,
+		Nonce:        nonce.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Created signed link for file", fileIndexId, "expires at", expiresAt)
+	return &SignedLink{
+		Token:        token,
+		Path:         "/api/link/" + token,
+		ExpiresAt:    expiresAt,
+		IP:           ip,
+		MaxDownloads: maxDownloads,
+	}, nil
+}
+
+func (s *LinkService) sign(claims LinkClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.mac(encoded)), nil
+}
+
+func (s *LinkService) mac(encodedPayload string) []byte {
+	m := hmac.New(sha256.New, s.secret)
+	m.Write([]byte(encodedPayload))
+	return m.Sum(nil)
+}
+
+// Verify checks signature, expiry and IP restriction of the token.
+func (s *LinkService) Verify(token string, clientIp string) (*LinkClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidLink
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, s.mac(parts[0])) {
+		return nil, ErrInvalidLink
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidLink
+	}
+	var claims LinkClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidLink
+	}
+	if time.Now().Unix() > claims.Expires {
+		return nil, ErrLinkExpired
+	}
+	if claims.IP != "" && claims.IP != clientIp {
+		return nil, ErrLinkForbidden
+	}
+	return &claims, nil
+}
+
+// CountDownload charges the bytes about to be served to a limited link. The link allows
+// MaxDownloads times the file size, so seeking with Range requests costs only what is read,
+// and no choice of range serves more than that. A request that would cross the budget is
+// refused and not charged.
+func (s *LinkService) CountDownload(claims *LinkClaims, fileSize int64, served int64) error {
+	if claims.MaxDownloads <= 0 {
+		return nil
+	}
+	// an empty file costs one byte per download
+	if fileSize < 1 {
+		fileSize = 1
+	}
+	if served < 1 {
+		served = 1
+	}
+	budget := int64(claims.MaxDownloads) * fileSize
+	ttl := time.Until(time.Unix(claims.Expires, 0)) + time.Minute
+	key := "link:" + claims.Nonce + ":bytes"
+	count, err := s.counter.IncrBy(key, served, ttl)
+	if err != nil {
+		return err
+	}
+	if count > budget {
+		log.Println("Signed link", claims.Nonce, "exceeded", strconv.Itoa(claims.MaxDownloads), "downloads")
+		if _, err := s.counter.IncrBy(key, -served, ttl); err != nil {
+			log.Println("Fail to refund refused download of link", claims.Nonce, "by error", err.Error())
+		}
+		return ErrLinkExhausted
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// memoryCounter counts in a map, like the Redis INCRBY the service uses.
+type memoryCounter map[string]int64
+
+func (m memoryCounter) IncrBy(key string, n int64, ttl time.Duration) (int64, error) {
+	m[key] += n
+	return m[key], nil
+}
+
+func TestCountDownload(t *testing.T) {
+	const fileSize = 1000
+	tests := []struct {
+		name         string
+		maxDownloads int
+		fileSize     int64
+		// bytes asked by each request
+		requests []int64
+		// indexes of the requests refused
+		refused []int
+	}{
+		{"unlimited", 0, fileSize, []int64{fileSize, fileSize, fileSize}, nil},
+		{"whole downloads up to the limit", 2, fileSize, []int64{fileSize, fileSize, fileSize}, []int{2}},
+		{"ranges cost what they read", 1, fileSize, []int64{250, 250, 250, 250, 1}, []int{4}},
+		{"one byte ranges cannot bypass the limit", 1, fileSize, repeat(1, fileSize+1), []int{fileSize}},
+		{"range crossing the limit is refused", 1, fileSize, []int64{999, 500}, []int{1}},
+		{"refused bytes are not charged", 1, fileSize, []int64{999, 500, 1, 1}, []int{1, 3}},
+		{"empty file", 2, 0, []int64{0, 0, 0}, []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &LinkService{counter: memoryCounter{}}
+			claims := &LinkClaims{Nonce: "nonce", MaxDownloads: tt.maxDownloads, Expires: time.Now().Add(time.Hour).Unix()}
+			refused := make(map[int]bool)
+			for _, i := range tt.refused {
+				refused[i] = true
+			}
+			for i, served := range tt.requests {
+				err := s.CountDownload(claims, tt.fileSize, served)
+				if refused[i] {
+					if err != ErrLinkExhausted {
+						t.Fatalf("request %d: expected ErrLinkExhausted, got %v", i, err)
+					}
+				} else if err != nil {
+					t.Fatalf("request %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func repeat(n int64, count int) []int64 {
+	values := make([]int64, count)
+	for i := range values {
+		values[i] = n
+	}
+	return values
+}
+
+func TestVerifyLink(t *testing.T) {
+	s := &LinkService{secret: []byte("secret")}
+	valid, _ := s.sign(LinkClaims{FileIndexId: "f", Expires: time.Now().Add(time.Hour).Unix(), Nonce: "n"})
+	expired, _ := s.sign(LinkClaims{FileIndexId: "f", Expires: time.Now().Add(-time.Minute).Unix(), Nonce: "n"})
+	pinned, _ := s.sign(LinkClaims{FileIndexId: "f", Expires: time.Now().Add(time.Hour).Unix(), IP: "1.2.3.4", Nonce: "n"})
+	other, _ := (&LinkService{secret: []byte("other")}).sign(LinkClaims{FileIndexId: "f", Expires: time.Now().Add(time.Hour).Unix(), Nonce: "n"})
+	parts := strings.Split(valid, ".")
+	forged, _ := (&LinkService{secret: []byte("other")}).sign(LinkClaims{FileIndexId: "g", Expires: time.Now().Add(time.Hour).Unix(), Nonce: "n"})
+
+	tests := []struct {
+		name  string
+		token string
+		ip    string
+		err   error
+	}{
+		{"valid", valid, "5.6.7.8", nil},
+		{"expired", expired, "5.6.7.8", ErrLinkExpired},
+		{"pinned to the client", pinned, "1.2.3.4", nil},
+		{"pinned to another client", pinned, "5.6.7.8", ErrLinkForbidden},
+		{"signed with another secret", other, "5.6.7.8", ErrInvalidLink},
+		{"payload swapped", strings.Split(forged, ".")[0] + "." + parts[1], "5.6.7.8", ErrInvalidLink},
+		{"not a token", "garbage", "5.6.7.8", ErrInvalidLink},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Verify(tt.token, tt.ip); err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
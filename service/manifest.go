@@ -0,0 +1,331 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StorageChunked marks a FileIndex whose content is split in parts described by a FileManifest.
+const StorageChunked = "chunked"
+
+// ChunkPartMimeType is given to part and shard files on Drive so account indexing can skip them.
+const ChunkPartMimeType = "application/x-drive-manager-part"
+
+var ErrRangeNotSatisfiable = errors.New("RangeNotSatisfiable")
+
+type FileManifest struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	Owner     primitive.ObjectID `json:"owner" bson:"owner"`
+	Name      string             `json:"name" bson:"name"`
+	MimeType  string             `json:"mimeType" bson:"mimeType"`
+	Size      int64              `json:"size" bson:"size"`
+	Parts     []ManifestPart     `json:"parts" bson:"parts"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	// the upload that wrote it, so a retried completion finds it again
+	UploadId string `json:"-" bson:"uploadId,omitempty"`
+}
+
+// ManifestPart is the byte range [Offset, Offset+Size) of the object, stored as one Drive file.
+type ManifestPart struct {
+	Index     int                `json:"index" bson:"index"`
+	AccountId primitive.ObjectID `json:"accountId" bson:"accountId"`
+	FileId    string             `json:"fileId" bson:"fileId"`
+	Offset    int64              `json:"offset" bson:"offset"`
+	Size      int64              `json:"size" bson:"size"`
+	Md5       string             `json:"md5" bson:"md5"`
+}
+
+func FindManifest(id primitive.ObjectID) (*FileManifest, error) {
+	var m FileManifest
+	if err := dao.FileManifest().FindOne(context.Background(), bson.D{{"_id", id}}).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func partName(name string, index int) string {
+	return fmt.Sprintf("%s.part%04d", name, index)
+}
+
+// PlanParts spreads size bytes over the owner's accounts, biggest free space first and degraded
+// accounts last. Part sizes are
+// multiples of UploadChunkSize so client chunks never split a part off a 256KiB boundary.
+func (s *AccountService) PlanParts(owner primitive.ObjectID, size int64) ([]*UploadPart, error) {
+	var accounts []entity.DriveAccount
+	if cursor, err := dao.DriveAccount().Find(context.Background(), bson.D{
+		{"owner", owner},
+		storageTypeFilter(),
+		{"disabled", bson.D{{"$ne", true}}},
+		{"readOnly", bson.D{{"$ne", true}}},
+		healthyFilter(),
+		closedCircuitFilter(),
+		{"available", bson.D{{"$gt", UploadBuffer}}},
+	}, options.Find().SetSort(bson.D{{"available", -1}})); err != nil {
+		return nil, err
+	} else if err := cursor.All(context.Background(), &accounts); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(accounts, func(i, j int) bool {
+		return healthRank(&accounts[i]) < healthRank(&accounts[j])
+	})
+
+	parts := make([]*UploadPart, 0)
+	var offset int64
+	for _, account := range accounts {
+		if offset >= size {
+			break
+		}
+		free := account.Limit - account.Usage - UploadBuffer
+		if account.Available-UploadBuffer < free {
+			free = account.Available - UploadBuffer
+		}
+		free -= free % UploadChunkSize
+		if free <= 0 {
+			continue
+		}
+		partSize := size - offset
+		if partSize > free {
+			partSize = free
+		}
+		parts = append(parts, &UploadPart{
+			Index:     len(parts),
+			AccountId: account.Id,
+			Offset:    offset,
+			Size:      partSize,
+		})
+		offset += partSize
+	}
+	if offset < size {
+		log.Println("Pool of user", owner.Hex(), "cannot hold", size, "bytes, missing", size-offset)
+		return nil, ErrNoSuitableAccount
+	}
+	return parts, nil
+}
+
+// parseByteRange reads a single "bytes=" range against size. ok is false when no range is requested.
+func parseByteRange(value string, size int64) (start int64, end int64, ok bool, err error) {
+	if value == "" {
+		return 0, size - 1, false, nil
+	}
+	if !strings.HasPrefix(value, "bytes=") || strings.Contains(value, ",") {
+		return 0, 0, false, ErrRangeNotSatisfiable
+	}
+	spec := strings.SplitN(strings.TrimPrefix(value, "bytes="), "-", 2)
+	if len(spec) != 2 {
+		return 0, 0, false, ErrRangeNotSatisfiable
+	}
+	if spec[0] == "" {
+		suffix, err := strconv.ParseInt(spec[1], 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false, ErrRangeNotSatisfiable
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, true, nil
+	}
+	start, err = strconv.ParseInt(spec[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, ErrRangeNotSatisfiable
+	}
+	end = size - 1
+	if spec[1] != "" {
+		end, err = strconv.ParseInt(spec[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, ErrRangeNotSatisfiable
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	return start, end, true, nil
+}
+
+// openManifest answers like Drive would for the whole object, reading the parts lazily in order.
+func openManifest(fi *FileIndex, byteRange string) (*http.Response, error) {
+	m, err := FindManifest(*fi.ManifestId)
+	if err != nil {
+		log.Println("Fail to find manifest of file", fi.Id.Hex(), "by error", err.Error())
+		return nil, err
+	}
+	return mediaResponse(m.Size, m.MimeType, byteRange, func(start int64, end int64) (io.ReadCloser, error) {
+		reader := &manifestReader{
+			manifest: m,
+			pos:      start,
+			end:      end,
+			backends: make(map[primitive.ObjectID]helper.DriveBackend),
+		}
+		// open the first part now so an unreachable account fails the request instead of the body
+		if start <= end {
+			if err := reader.openPart(); err != nil {
+				return nil, err
+			}
+		}
+		return reader, nil
+	})
+}
+
+// mediaResponse builds the response Drive would give for a file of the given size, with the
+// body of the requested bytes [start, end] provided by open.
+func mediaResponse(size int64, mimeType string, byteRange string, open func(start int64, end int64) (io.ReadCloser, error)) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Content-Type", mimeType)
+	start, end, partial, err := parseByteRange(byteRange, size)
+	if err != nil {
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return &http.Response{
+			Status:     "416 Requested Range Not Satisfiable",
+			StatusCode: http.StatusRequestedRangeNotSatisfiable,
+			Header:     header,
+			Body:       http.NoBody,
+		}, nil
+	}
+	body, err := open(start, end)
+	if err != nil {
+		return nil, err
+	}
+	status := http.StatusOK
+	if partial {
+		status = http.StatusPartialContent
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	length := end - start + 1
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Header:        header,
+		ContentLength: length,
+		Body:          body,
+	}, nil
+}
+
+type manifestReader struct {
+	manifest  *FileManifest
+	pos       int64
+	end       int64
+	body      io.ReadCloser
+	remaining int64
+	backends  map[primitive.ObjectID]helper.DriveBackend
+}
+
+func (r *manifestReader) backend(accountId primitive.ObjectID) (helper.DriveBackend, error) {
+	if b, ok := r.backends[accountId]; ok {
+		return b, nil
+	}
+	acc, err := GetAccountService().FindAccount(accountId.Hex())
+	if err != nil {
+		return nil, err
+	}
+	b, err := GetAccountService().GetDriveBackend(acc)
+	if err != nil {
+		return nil, err
+	}
+	r.backends[accountId] = b
+	return b, nil
+}
+
+func (r *manifestReader) openPart() error {
+	for _, part := range r.manifest.Parts {
+		if r.pos < part.Offset || r.pos >= part.Offset+part.Size {
+			continue
+		}
+		last := part.Offset + part.Size - 1
+		if last > r.end {
+			last = r.end
+		}
+		backend, err := r.backend(part.AccountId)
+		if err != nil {
+			return err
+		}
+		res, err := backend.Download(part.FileId, fmt.Sprintf("bytes=%d-%d", r.pos-part.Offset, last-part.Offset))
+		if err != nil {
+			log.Println("Fail to open part", part.Index, "of manifest", r.manifest.Id.Hex(), "by error", err.Error())
+			return err
+		}
+		r.body = res.Body
+		r.remaining = last - r.pos + 1
+		return nil
+	}
+	return fmt.Errorf("manifest %s has no part at offset %d", r.manifest.Id.Hex(), r.pos)
+}
+
+func (r *manifestReader) Read(p []byte) (int, error) {
+	if r.pos > r.end {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		if err := r.openPart(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	r.remaining -= int64(n)
+	if r.remaining == 0 {
+		r.body.Close()
+		r.body = nil
+		return n, nil
+	}
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *manifestReader) Close() error {
+	if r.body != nil {
+		err := r.body.Close()
+		r.body = nil
+		return err
+	}
+	return nil
+}
+
+// deleteManifest removes the part files from Drive, then the manifest itself.
+func (s *AccountService) deleteManifest(m *FileManifest) error {
+	for _, part := range m.Parts {
+		if err := s.deletePart(part.AccountId, part.FileId); err != nil {
+			log.Println("Fail to delete part", part.Index, "of manifest", m.Id.Hex(), "by error", err.Error())
+			return err
+		}
+		if err := s.UpdateCachedQuotaByAccountId(part.AccountId.Hex()); err != nil {
+			log.Println("Fail to update quota of account", part.AccountId.Hex(), "by error", err.Error())
+		}
+	}
+	return s.store.DeleteManifest(m.Id)
+}
+
+// deletePart deletes one Drive file, a file already gone counts as deleted.
+func (s *AccountService) deletePart(accountId primitive.ObjectID, fileId string) error {
+	acc, err := s.store.FindAccount(accountId)
+	if err != nil {
+		return err
+	}
+	backend, err := s.GetDriveBackend(acc)
+	if err != nil {
+		return err
+	}
+	if err := backend.DeleteFile(fileId); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	const size = 100
+	tests := []struct {
+		value      string
+		start, end int64
+		partial    bool
+		err        error
+	}{
+		{"", 0, 99, false, nil},
+		{"bytes=0-9", 0, 9, true, nil},
+		{"bytes=90-", 90, 99, true, nil},
+		{"bytes=-10", 90, 99, true, nil},
+		{"bytes=-1000", 0, 99, true, nil},
+		{"bytes=50-1000", 50, 99, true, nil},
+		{"bytes=100-", 0, 0, false, ErrRangeNotSatisfiable},
+		{"bytes=9-0", 0, 0, false, ErrRangeNotSatisfiable},
+		{"bytes=0-1,5-6", 0, 0, false, ErrRangeNotSatisfiable},
+		{"items=0-1", 0, 0, false, ErrRangeNotSatisfiable},
+		{"bytes=-0", 0, 0, false, ErrRangeNotSatisfiable},
+	}
+	for _, tt := range tests {
+		start, end, partial, err := parseByteRange(tt.value, size)
+		if err != tt.err || (err == nil && (start != tt.start || end != tt.end || partial != tt.partial)) {
+			t.Errorf("parseByteRange(%q) = %d, %d, %v, %v", tt.value, start, end, partial, err)
+		}
+	}
+}
+
+// fakeManifest stores content in parts of the given sizes, each on its own fake account.
+func fakeManifest(content []byte, sizes []int64) (*FileManifest, map[primitive.ObjectID]helper.DriveBackend) {
+	m := &FileManifest{Id: primitive.NewObjectID(), Size: int64(len(content)), MimeType: "application/octet-stream"}
+	backends := make(map[primitive.ObjectID]helper.DriveBackend)
+	var offset int64
+	for i, size := range sizes {
+		fake := helper.NewFakeDriveBackend(1 << 20)
+		file := fake.PutFile(partName("file", i), ChunkPartMimeType, content[offset:offset+size])
+		part := ManifestPart{Index: i, AccountId: primitive.NewObjectID(), FileId: file.Id, Offset: offset, Size: size}
+		backends[part.AccountId] = fake
+		m.Parts = append(m.Parts, part)
+		offset += size
+	}
+	return m, backends
+}
+
+func TestManifestRanges(t *testing.T) {
+	content := []byte("abcdefghijklmnopqrstuvwxyz")
+	m, backends := fakeManifest(content, []int64{10, 10, 6})
+
+	tests := []struct {
+		byteRange string
+		status    int
+		body      string
+	}{
+		{"", 200, string(content)},
+		{"bytes=0-9", 206, "abcdefghij"},
+		{"bytes=8-12", 206, "ijklm"},
+		{"bytes=5-22", 206, "fghijklmnopqrstuvw"},
+		{"bytes=-3", 206, "xyz"},
+		{"bytes=20-", 206, "uvwxyz"},
+		{"bytes=26-", 416, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.byteRange, func(t *testing.T) {
+			res, err := mediaResponse(m.Size, m.MimeType, tt.byteRange, func(start int64, end int64) (io.ReadCloser, error) {
+				return &manifestReader{manifest: m, pos: start, end: end, backends: backends}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.status || string(body) != tt.body {
+				t.Fatalf("got %d %q, expected %d %q", res.StatusCode, body, tt.status, tt.body)
+			}
+			if tt.status != http.StatusRequestedRangeNotSatisfiable && res.ContentLength != int64(len(tt.body)) {
+				t.Fatalf("content length %d", res.ContentLength)
+			}
+		})
+	}
+}
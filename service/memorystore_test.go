@@ -0,0 +1,225 @@
+package service
+
+import (
+	"fmt"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sort"
+	"time"
+)
+
+// memoryStore is a Store kept in maps, so the flows over it run without Mongo.
+type memoryStore struct {
+	accounts  map[primitive.ObjectID]*entity.DriveAccount
+	users     map[primitive.ObjectID]*entity.User
+	files     map[primitive.ObjectID]*FileIndex
+	manifests map[primitive.ObjectID]*FileManifest
+	layouts   map[primitive.ObjectID]*ErasureLayout
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		accounts:  make(map[primitive.ObjectID]*entity.DriveAccount),
+		users:     make(map[primitive.ObjectID]*entity.User),
+		files:     make(map[primitive.ObjectID]*FileIndex),
+		manifests: make(map[primitive.ObjectID]*FileManifest),
+		layouts:   make(map[primitive.ObjectID]*ErasureLayout),
+	}
+}
+
+// newStoreAccountService runs an AccountService over the store, each account on its fake backend.
+func newStoreAccountService(store Store, backends map[primitive.ObjectID]*helper.FakeDriveBackend) *AccountService {
+	return &AccountService{
+		store: store,
+		backend: func(acc *entity.DriveAccount) (helper.DriveBackend, error) {
+			backend, ok := backends[acc.Id]
+			if !ok {
+				return nil, fmt.Errorf("no fake backend for account %s", acc.Id.Hex())
+			}
+			return backend, nil
+		},
+	}
+}
+
+// addAccount stores a storage account of the owner on a new fake backend.
+func (m *memoryStore) addAccount(backends map[primitive.ObjectID]*helper.FakeDriveBackend, owner primitive.ObjectID, limit int64) *entity.DriveAccount {
+	acc := &entity.DriveAccount{
+		Id:        primitive.NewObjectID(),
+		Type:      helper.KeyTypeServiceAccount,
+		Owner:     owner,
+		Limit:     limit,
+		Available: limit,
+	}
+	m.accounts[acc.Id] = acc
+	backends[acc.Id] = helper.NewFakeDriveBackend(limit)
+	return acc
+}
+
+// indexedNames lists the names of the files indexed for the account, sorted.
+func (m *memoryStore) indexedNames(accountId primitive.ObjectID) []string {
+	names := make([]string, 0)
+	for _, fi := range m.files {
+		if fi.AccountId == accountId {
+			names = append(names, fi.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *memoryStore) FindAccount(id primitive.ObjectID) (*entity.DriveAccount, error) {
+	acc, ok := m.accounts[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	copied := *acc
+	return &copied, nil
+}
+
+func (m *memoryStore) FindUploadAccounts(owner primitive.ObjectID, driveOnly bool, size int64) ([]*entity.DriveAccount, error) {
+	accounts := make([]*entity.DriveAccount, 0)
+	for _, acc := range m.accounts {
+		if acc.Owner != owner || acc.Disabled || acc.ReadOnly || acc.Available < size+UploadBuffer {
+			continue
+		}
+		if (driveOnly && acc.Type != helper.KeyTypeServiceAccount) || !isStorageAccount(acc.Type) {
+			continue
+		}
+		if acc.HealthStatus == HealthKeyInvalid || acc.HealthStatus == HealthNotFound || GetAccountBreaker().IsOpen(acc.Id) {
+			continue
+		}
+		copied := *acc
+		accounts = append(accounts, &copied)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Id.Hex() < accounts[j].Id.Hex() })
+	return accounts, nil
+}
+
+func (m *memoryStore) SaveQuota(accountId primitive.ObjectID, quota *helper.Quota, updatedAt time.Time) error {
+	acc, ok := m.accounts[accountId]
+	if !ok {
+		return nil
+	}
+	acc.Usage = quota.Usage
+	acc.Limit = quota.Limit
+	acc.Available = quota.Limit - quota.Usage - acc.Reserved
+	acc.QuotaUpdateTimestamp = updatedAt
+	return nil
+}
+
+func (m *memoryStore) SaveChangesPageToken(accountId primitive.ObjectID, token string) error {
+	if acc, ok := m.accounts[accountId]; ok {
+		acc.ChangesPageToken = token
+		acc.ChangesSyncTimestamp = time.Now()
+	}
+	return nil
+}
+
+func (m *memoryStore) FindUser(id primitive.ObjectID) (*entity.User, error) {
+	user, ok := m.users[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return user, nil
+}
+
+func (m *memoryStore) UpsertFileIndex(fi *FileIndex) error {
+	for _, existing := range m.files {
+		if existing.AccountId == fi.AccountId && existing.FileId == fi.FileId {
+			replicas := existing.Replicas
+			*existing = *fi
+			existing.Replicas = replicas
+			return nil
+		}
+	}
+	copied := *fi
+	copied.Id = primitive.NewObjectID()
+	m.files[copied.Id] = &copied
+	return nil
+}
+
+func (m *memoryStore) DeleteFileIndex(id primitive.ObjectID) error {
+	delete(m.files, id)
+	return nil
+}
+
+func (m *memoryStore) DeleteAccountFile(accountId primitive.ObjectID, fileId string) error {
+	for id, fi := range m.files {
+		if fi.AccountId == accountId && fi.FileId == fileId {
+			delete(m.files, id)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteStaleFileIndex(accountId primitive.ObjectID, syncTime time.Time) (int64, error) {
+	var deleted int64
+	for id, fi := range m.files {
+		if fi.AccountId == accountId && fi.SyncTime.Before(syncTime) {
+			delete(m.files, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *memoryStore) IsReplicaFile(accountId primitive.ObjectID, fileId string) (bool, error) {
+	return m.replicaFileIds(accountId)[fileId], nil
+}
+
+func (m *memoryStore) ReplicaFileIds(accountId primitive.ObjectID) (map[string]bool, error) {
+	return m.replicaFileIds(accountId), nil
+}
+
+func (m *memoryStore) replicaFileIds(accountId primitive.ObjectID) map[string]bool {
+	ids := make(map[string]bool)
+	for _, fi := range m.files {
+		for _, r := range fi.Replicas {
+			if r.AccountId == accountId {
+				ids[r.FileId] = true
+			}
+		}
+	}
+	return ids
+}
+
+func (m *memoryStore) RemoveReplica(accountId primitive.ObjectID, fileId string) error {
+	for _, fi := range m.files {
+		kept := fi.Replicas[:0]
+		for _, r := range fi.Replicas {
+			if r.AccountId != accountId || r.FileId != fileId {
+				kept = append(kept, r)
+			}
+		}
+		fi.Replicas = kept
+	}
+	return nil
+}
+
+func (m *memoryStore) FindManifest(id primitive.ObjectID) (*FileManifest, error) {
+	manifest, ok := m.manifests[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return manifest, nil
+}
+
+func (m *memoryStore) DeleteManifest(id primitive.ObjectID) error {
+	delete(m.manifests, id)
+	return nil
+}
+
+func (m *memoryStore) FindErasureLayout(id primitive.ObjectID) (*ErasureLayout, error) {
+	layout, ok := m.layouts[id]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return layout, nil
+}
+
+func (m *memoryStore) DeleteErasureLayout(id primitive.ObjectID) error {
+	delete(m.layouts, id)
+	return nil
+}
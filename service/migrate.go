@@ -0,0 +1,277 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+)
+
+// Kinds of Drive files the index points to.
+const (
+	StoredPrimary = "primary"
+	StoredReplica = "replica"
+	StoredPart    = "part"
+	StoredShard   = "shard"
+)
+
+var ErrMigrationConflict = errors.New("MigrationConflict")
+
+// StoredFile is one Drive file referenced by the index: the primary copy or a replica of a
+// FileIndex, a part of a manifest or a shard of an erasure layout (ParentId and Index tell which).
+type StoredFile struct {
+	Kind        string             `json:"kind" bson:"kind"`
+	FileIndexId primitive.ObjectID `json:"fileIndexId,omitempty" bson:"fileIndexId,omitempty"`
+	ParentId    primitive.ObjectID `json:"parentId,omitempty" bson:"parentId,omitempty"`
+	Index       int                `json:"index" bson:"index"`
+	AccountId   primitive.ObjectID `json:"accountId" bson:"accountId"`
+	FileId      string             `json:"fileId" bson:"fileId"`
+	Name        string             `json:"name" bson:"name"`
+	Size        int64              `json:"size" bson:"size"`
+	// accounts holding the other copies, parts or shards, which a move must not land on
+	Siblings []primitive.ObjectID `json:"-" bson:"-"`
+}
+
+// ListStoredFiles returns every Drive file of the account the index knows about.
+func ListStoredFiles(accountId primitive.ObjectID) ([]*StoredFile, error) {
+	files := make([]*StoredFile, 0)
+
+	var indexes []FileIndex
+	if cursor, err := dao.FileIndex().Find(context.Background(), bson.D{
+		{"$or", bson.A{
+			bson.D{{"accountId", accountId}},
+			bson.D{{"replicas.accountId", accountId}},
+		}},
+		{"storage", bson.D{{"$in", bson.A{nil, ""}}}},
+	}); err != nil {
+		return nil, err
+	} else if err := cursor.All(context.Background(), &indexes); err != nil {
+		return nil, err
+	}
+	for _, fi := range indexes {
+		copies := fi.Copies()
+		siblings := make([]primitive.ObjectID, 0, len(copies))
+		for _, c := range copies {
+			siblings = append(siblings, c.AccountId)
+		}
+		for i, c := range copies {
+			if c.AccountId != accountId {
+				continue
+			}
+			kind := StoredPrimary
+			if i > 0 {
+				kind = StoredReplica
+			}
+			files = append(files, &StoredFile{
+				Kind:        kind,
+				FileIndexId: fi.Id,
+				Index:       i,
+				AccountId:   c.AccountId,
+				FileId:      c.FileId,
+				Name:        fi.Name,
+				Size:        fi.Size,
+				Siblings:    siblings,
+			})
+		}
+	}
+
+	var manifests []FileManifest
+	if cursor, err := dao.FileManifest().Find(context.Background(), bson.D{{"parts.accountId", accountId}}); err != nil {
+		return nil, err
+	} else if err := cursor.All(context.Background(), &manifests); err != nil {
+		return nil, err
+	}
+	for _, m := range manifests {
+		for _, part := range m.Parts {
+			if part.AccountId != accountId {
+				continue
+			}
+			files = append(files, &StoredFile{
+				Kind:      StoredPart,
+				ParentId:  m.Id,
+				Index:     part.Index,
+				AccountId: part.AccountId,
+				FileId:    part.FileId,
+				Name:      partName(m.Name, part.Index),
+				Size:      part.Size,
+			})
+		}
+	}
+
+	var layouts []ErasureLayout
+	if cursor, err := dao.ErasureLayout().Find(context.Background(), bson.D{{"shards.accountId", accountId}}); err != nil {
+		return nil, err
+	} else if err := cursor.All(context.Background(), &layouts); err != nil {
+		return nil, err
+	}
+	for _, l := range layouts {
+		siblings := make([]primitive.ObjectID, 0, len(l.Shards))
+		for _, shard := range l.Shards {
+			siblings = append(siblings, shard.AccountId)
+		}
+		for _, shard := range l.Shards {
+			if shard.AccountId != accountId || shard.Missing {
+				continue
+			}
+			files = append(files, &StoredFile{
+				Kind:      StoredShard,
+				ParentId:  l.Id,
+				Index:     shard.Index,
+				AccountId: shard.AccountId,
+				FileId:    shard.FileId,
+				Name:      shardName(l.Name, shard.Index),
+				Size:      l.ShardSize,
+				Siblings:  siblings,
+			})
+		}
+	}
+	return files, nil
+}
+
+// MigrateFile copies the stored file to the target account, checks size and md5 against the
+// source, points the index (and browse items) to the copy, then deletes the source.
+// If the reference changed meanwhile the copy is dropped and ErrMigrationConflict returned.
+func MigrateFile(file *StoredFile, target *entity.DriveAccount) (string, error) {
+	as := GetAccountService()
+	source, err := as.FindAccount(file.AccountId.Hex())
+	if err != nil {
+		return "", err
+	}
+	sourceBackend, err := as.GetDriveBackend(source)
+	if err != nil {
+		return "", err
+	}
+	targetBackend, err := as.GetDriveBackend(target)
+	if err != nil {
+		return "", err
+	}
+	original, err := sourceBackend.GetFile(file.FileId)
+	if err != nil {
+		return "", err
+	}
+	res, err := sourceBackend.Download(file.FileId, "")
+	if err != nil {
+		return "", err
+	}
+	description := ""
+	if file.Kind == StoredReplica {
+		description = "replica of " + file.FileIndexId.Hex()
+	}
+	copied, err := targetBackend.UploadFileFromStream(original.Name, description, original.MimeType, res.Body)
+	res.Body.Close()
+	if err != nil {
+		log.Println("Fail to copy", file.Kind, file.FileId, "to account", target.Id.Hex(), "by error", err.Error())
+		return "", err
+	}
+	if copied.Size != original.Size || (original.Md5Checksum != "" && copied.Md5Checksum != original.Md5Checksum) {
+		targetBackend.DeleteFile(copied.Id)
+		return "", fmt.Errorf("copy of %s %s does not match the source: size %d/%d, md5 %s/%s",
+			file.Kind, file.FileId, copied.Size, original.Size, copied.Md5Checksum, original.Md5Checksum)
+	}
+	if err := repointStoredFile(file, target, copied.Id, copied.Md5Checksum); err != nil {
+		targetBackend.DeleteFile(copied.Id)
+		return "", err
+	}
+	if err := sourceBackend.DeleteFile(file.FileId); err != nil && !isNotFound(err) {
+		// the index already points to the copy, the source is only wasted space
+		log.Println("Fail to delete migrated source", file.FileId, "on account", source.Id.Hex(), "by error", err.Error())
+	}
+	for _, accountId := range []primitive.ObjectID{source.Id, target.Id} {
+		if err := as.UpdateCachedQuotaByAccountId(accountId.Hex()); err != nil {
+			log.Println("Fail to update quota of account", accountId.Hex(), "by error", err.Error())
+		}
+	}
+	log.Println("Migrated", file.Kind, file.Name, "from account", source.Id.Hex(), "to", target.Id.Hex(), "as", copied.Id)
+	return copied.Id, nil
+}
+
+// repointStoredFile swaps the reference, matching on the old location so a concurrent change is detected.
+func repointStoredFile(file *StoredFile, target *entity.DriveAccount, fileId string, md5 string) error {
+	ctx := context.Background()
+	matched := int64(0)
+	switch file.Kind {
+	case StoredPrimary:
+		res, err := dao.FileIndex().UpdateOne(ctx, bson.D{
+			{"_id", file.FileIndexId},
+			{"accountId", file.AccountId},
+			{"fileId", file.FileId},
+		}, bson.D{{"$set", bson.D{
+			{"accountId", target.Id},
+			{"projectId", target.ProjectId},
+			{"fileId", fileId},
+		}}})
+		if err != nil {
+			return err
+		}
+		matched = res.MatchedCount
+		if matched > 0 {
+			// browse items keep a copy of the file index
+			if _, err := dao.Item().UpdateMany(ctx, bson.D{{"file._id", file.FileIndexId}}, bson.D{{"$set", bson.D{
+				{"file.accountId", target.Id},
+				{"file.projectId", target.ProjectId},
+				{"file.fileId", fileId},
+			}}}); err != nil {
+				log.Println("Fail to update browse items of file", file.FileIndexId.Hex(), "by error", err.Error())
+			}
+		}
+	case StoredReplica:
+		res, err := dao.FileIndex().UpdateOne(ctx, bson.D{
+			{"_id", file.FileIndexId},
+			{"replicas", bson.D{{"$elemMatch", bson.D{
+				{"accountId", file.AccountId},
+				{"fileId", file.FileId},
+			}}}},
+		}, bson.D{{"$set", bson.D{
+			{"replicas.$.accountId", target.Id},
+			{"replicas.$.projectId", target.ProjectId},
+			{"replicas.$.fileId", fileId},
+		}}})
+		if err != nil {
+			return err
+		}
+		matched = res.MatchedCount
+	case StoredPart:
+		res, err := dao.FileManifest().UpdateOne(ctx, bson.D{
+			{"_id", file.ParentId},
+			{"parts", bson.D{{"$elemMatch", bson.D{
+				{"accountId", file.AccountId},
+				{"fileId", file.FileId},
+			}}}},
+		}, bson.D{{"$set", bson.D{
+			{"parts.$.accountId", target.Id},
+			{"parts.$.fileId", fileId},
+			{"parts.$.md5", md5},
+		}}})
+		if err != nil {
+			return err
+		}
+		matched = res.MatchedCount
+	case StoredShard:
+		res, err := dao.ErasureLayout().UpdateOne(ctx, bson.D{
+			{"_id", file.ParentId},
+			{"shards", bson.D{{"$elemMatch", bson.D{
+				{"accountId", file.AccountId},
+				{"fileId", file.FileId},
+			}}}},
+		}, bson.D{{"$set", bson.D{
+			{"shards.$.accountId", target.Id},
+			{"shards.$.projectId", target.ProjectId},
+			{"shards.$.fileId", fileId},
+			{"shards.$.md5", md5},
+		}}})
+		if err != nil {
+			return err
+		}
+		matched = res.MatchedCount
+	default:
+		return fmt.Errorf("unknown stored file kind %s", file.Kind)
+	}
+	if matched == 0 {
+		return ErrMigrationConflict
+	}
+	return nil
+}
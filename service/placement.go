@@ -0,0 +1,314 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+const (
+	PlacementRandom          = "random"
+	PlacementLeastUsed       = "least-used"
+	PlacementMostFree        = "most-free"
+	PlacementRoundRobin      = "round-robin"
+	PlacementProjectWeighted = "project-weighted"
+	PlacementSameFolder      = "same-folder"
+)
+
+const DefaultPlacementStrategy = PlacementRandom
+
+var ErrUnknownPlacementStrategy = errors.New("UnknownPlacementStrategy")
+
+// PlacementRequest describes the file to place. FolderId is the browse folder the file goes to, if any.
+type PlacementRequest struct {
+	Owner    primitive.ObjectID  `json:"owner"`
+	Size     int64               `json:"size"`
+	FolderId *primitive.ObjectID `json:"folderId,omitempty"`
+	// accounts not to place on
+	Exclude []primitive.ObjectID `json:"-"`
+	// only Google accounts, the client uploads to Drive itself
+	DriveOnly bool `json:"-"`
+}
+
+// AccountSelector picks one of the candidates, all of which have room for the file,
+// and tells why it was picked.
+type AccountSelector interface {
+	Select(req *PlacementRequest, candidates []*entity.DriveAccount) (*entity.DriveAccount, string, error)
+}
+
+type Placement struct {
+	Strategy   string               `json:"strategy"`
+	Account    *entity.DriveAccount `json:"account"`
+	Reason     string               `json:"reason"`
+	Candidates int                  `json:"candidates"`
+	// set when the size was reserved on the account
+	Reservation *entity.QuotaReservation `json:"reservation,omitempty"`
+}
+
+type randomSelector struct{}
+
+func (randomSelector) Select(req *PlacementRequest, candidates []*entity.DriveAccount) (*entity.DriveAccount, string, error) {
+	return candidates[rand.Intn(len(candidates))], fmt.Sprintf("random pick of %d candidates", len(candidates)), nil
+}
+
+type leastUsedSelector struct{}
+
+func (leastUsedSelector) Select(req *PlacementRequest, candidates []*entity.DriveAccount) (*entity.DriveAccount, string, error) {
+	best := candidates[0]
+	for _, acc := range candidates[1:] {
+		if usageRatio(acc) < usageRatio(best) {
+			best = acc
+		}
+	}
+	return best, fmt.Sprintf("lowest usage ratio %.1f%% of %d candidates", usageRatio(best)*100, len(candidates)), nil
+}
+
+func usageRatio(acc *entity.DriveAccount) float64 {
+	if acc.Limit <= 0 {
+		return 1
+	}
+	return float64(acc.Usage) / float64(acc.Limit)
+}
+
+type mostFreeSelector struct{}
+
+func (mostFreeSelector) Select(req *PlacementRequest, candidates []*entity.DriveAccount) (*entity.DriveAccount, string, error) {
+	best := candidates[0]
+	for _, acc := range candidates[1:] {
+		if acc.Available > best.Available {
+			best = acc
+		}
+	}
+	return best, fmt.Sprintf("most available space %d bytes of %d candidates", best.Available, len(candidates)), nil
+}
+
+// roundRobinSelector cycles through the accounts of each owner in id order. The position is
+// kept in memory, so it restarts with the process.
+type roundRobinSelector struct {
+	mutex sync.Mutex
+	last  map[primitive.ObjectID]primitive.ObjectID
+}
+
+func (s *roundRobinSelector) Select(req *PlacementRequest, candidates []*entity.DriveAccount) (*entity.DriveAccount, string, error) {
+	sorted := make([]*entity.DriveAccount, len(candidates))
+	copy(sorted, candidates)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Id.Hex() < sorted[j].Id.Hex()
+	})
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	last := s.last[req.Owner]
+	next := sorted[0]
+	for _, acc := range sorted {
+		if acc.Id.Hex() > last.Hex() {
+			next = acc
+			break
+		}
+	}
+	s.last[req.Owner] = next.Id
+	return next, fmt.Sprintf("next account after %s in rotation of %d candidates", last.Hex(), len(sorted)), nil
+}
+
+// projectWeightedSelector picks a project at random, weighted by the free space of its
+// candidate accounts, then the account with the most free space in it. This spreads
+// uploads, and the API quota they use, across projects.
+type projectWeightedSelector struct{}
+
+func (projectWeightedSelector) Select(req *PlacementRequest, candidates []*entity.DriveAccount) (*entity.DriveAccount, string, error) {
+	free := make(map[primitive.ObjectID]int64)
+	best := make(map[primitive.ObjectID]*entity.DriveAccount)
+	projects := make([]primitive.ObjectID, 0)
+	total := int64(0)
+	for _, acc := range candidates {
+		if _, ok := best[acc.ProjectId]; !ok {
+			projects = append(projects, acc.ProjectId)
+		}
+		free[acc.ProjectId] += acc.Available
+		total += acc.Available
+		if b := best[acc.ProjectId]; b == nil || acc.Available > b.Available {
+			best[acc.ProjectId] = acc
+		}
+	}
+	chosen := projects[0]
+	if total > 0 {
+		pick := rand.Int63n(total)
+		for _, p := range projects {
+			if pick < free[p] {
+				chosen = p
+				break
+			}
+			pick -= free[p]
+		}
+	}
+	share := float64(0)
+	if total > 0 {
+		share = float64(free[chosen]) / float64(total) * 100
+	}
+	return best[chosen], fmt.Sprintf("project %s drawn with weight %.1f%% of free space over %d projects",
+		chosen.Hex(), share, len(projects)), nil
+}
+
+// sameFolderSelector keeps a folder on as few accounts as possible: it picks the candidate
+// holding the most files of the target folder, or falls back to the most free account.
+type sameFolderSelector struct{}
+
+func (sameFolderSelector) Select(req *PlacementRequest, candidates []*entity.DriveAccount) (*entity.DriveAccount, string, error) {
+	if req.FolderId == nil {
+		acc, reason, err := mostFreeSelector{}.Select(req, candidates)
+		return acc, "no folder given, " + reason, err
+	}
+	var siblings []struct {
+		File struct {
+			AccountId primitive.ObjectID `bson:"accountId"`
+		} `bson:"file"`
+	}
+	if cursor, err := dao.Item().Find(context.Background(), bson.D{
+		{"owner", req.Owner},
+		{"parent", *req.FolderId},
+		{"type", "file"},
+		{"deleted", bson.D{{"$ne", true}}},
+	}); err != nil {
+		return nil, "", err
+	} else if err := cursor.All(context.Background(), &siblings); err != nil {
+		return nil, "", err
+	}
+	count := make(map[primitive.ObjectID]int)
+	for _, s := range siblings {
+		count[s.File.AccountId]++
+	}
+	var best *entity.DriveAccount
+	for _, acc := range candidates {
+		if count[acc.Id] == 0 {
+			continue
+		}
+		if best == nil || count[acc.Id] > count[best.Id] ||
+			(count[acc.Id] == count[best.Id] && acc.Available > best.Available) {
+			best = acc
+		}
+	}
+	if best == nil {
+		acc, reason, err := mostFreeSelector{}.Select(req, candidates)
+		return acc, "no sibling file on an account with room, " + reason, err
+	}
+	return best, fmt.Sprintf("holds %d of %d files of folder %s", count[best.Id], len(siblings), req.FolderId.Hex()), nil
+}
+
+var placementStrategies = map[string]AccountSelector{
+	PlacementRandom:          randomSelector{},
+	PlacementLeastUsed:       leastUsedSelector{},
+	PlacementMostFree:        mostFreeSelector{},
+	PlacementRoundRobin:      &roundRobinSelector{last: make(map[primitive.ObjectID]primitive.ObjectID)},
+	PlacementProjectWeighted: projectWeightedSelector{},
+	PlacementSameFolder:      sameFolderSelector{},
+}
+
+func PlacementStrategies() []string {
+	names := make([]string, 0, len(placementStrategies))
+	for name := range placementStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func IsPlacementStrategy(name string) bool {
+	_, ok := placementStrategies[name]
+	return ok
+}
+
+// UserPlacementStrategy returns the strategy saved for the user, or the default one.
+func UserPlacementStrategy(owner primitive.ObjectID) string {
+	return GetAccountService().userPlacementStrategy(owner)
+}
+
+func (s *AccountService) userPlacementStrategy(owner primitive.ObjectID) string {
+	user, err := s.store.FindUser(owner)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Println("Fail to load placement strategy of user", owner.Hex(), "by error", err.Error())
+		}
+		return DefaultPlacementStrategy
+	}
+	if !IsPlacementStrategy(user.PlacementStrategy) {
+		return DefaultPlacementStrategy
+	}
+	return user.PlacementStrategy
+}
+
+func SetUserPlacementStrategy(owner primitive.ObjectID, strategy string) error {
+	if strategy != "" && !IsPlacementStrategy(strategy) {
+		return ErrUnknownPlacementStrategy
+	}
+	update := bson.D{{"$set", bson.D{{"placementStrategy", strategy}}}}
+	if strategy == "" {
+		update = bson.D{{"$unset", bson.D{{"placementStrategy", ""}}}}
+	}
+	_, err := dao.User().UpdateOne(context.Background(), bson.D{{"_id", owner}}, update)
+	return err
+}
+
+// uploadCandidates lists the enabled, writable accounts of the owner with room for size plus UploadBuffer.
+// Degraded accounts are listed only when no other account qualifies.
+func (s *AccountService) uploadCandidates(req *PlacementRequest) ([]*entity.DriveAccount, error) {
+	size, exclude := req.Size, req.Exclude
+	accounts, err := s.store.FindUploadAccounts(req.Owner, req.DriveOnly, size)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]*entity.DriveAccount, 0, len(accounts))
+	degraded := make([]*entity.DriveAccount, 0)
+	for _, account := range accounts {
+		if account.Limit-account.Usage > size && !containsId(exclude, account.Id) {
+			if healthRank(account) > 0 {
+				degraded = append(degraded, account)
+			} else {
+				candidates = append(candidates, account)
+			}
+		}
+	}
+	// degraded accounts only take uploads nothing else has room for
+	if len(candidates) == 0 {
+		return degraded, nil
+	}
+	return candidates, nil
+}
+
+// PlaceUpload chooses the account for an upload with the given strategy, or with the
+// strategy of the user when it is empty.
+func (s *AccountService) PlaceUpload(req *PlacementRequest, strategy string) (*Placement, error) {
+	if strategy == "" {
+		strategy = s.userPlacementStrategy(req.Owner)
+	}
+	selector, ok := placementStrategies[strategy]
+	if !ok {
+		return nil, ErrUnknownPlacementStrategy
+	}
+	candidates, err := s.uploadCandidates(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoSuitableAccount
+	}
+	account, reason, err := selector.Select(req, candidates)
+	if err != nil {
+		log.Println("Fail to place upload with strategy", strategy, "by error", err.Error())
+		return nil, err
+	}
+	return &Placement{
+		Strategy:   strategy,
+		Account:    account,
+		Reason:     reason,
+		Candidates: len(candidates),
+	}, nil
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func testAccount(project primitive.ObjectID, usage int64, limit int64) *entity.DriveAccount {
+	return &entity.DriveAccount{
+		Id:        primitive.NewObjectID(),
+		ProjectId: project,
+		Usage:     usage,
+		Limit:     limit,
+		Available: limit - usage,
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	project := primitive.NewObjectID()
+	// most free in bytes, but the fullest by ratio
+	big := testAccount(project, 600, 1000)
+	// least used by ratio
+	small := testAccount(project, 10, 100)
+	full := testAccount(project, 90, 100)
+	candidates := []*entity.DriveAccount{full, big, small}
+	req := &PlacementRequest{Owner: primitive.NewObjectID(), Size: 1}
+
+	tests := []struct {
+		strategy string
+		expected *entity.DriveAccount
+	}{
+		{PlacementLeastUsed, small},
+		{PlacementMostFree, big},
+		// no folder given
+		{PlacementSameFolder, big},
+		// a single project, its account with the most free space
+		{PlacementProjectWeighted, big},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			acc, reason, err := placementStrategies[tt.strategy].Select(req, candidates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if acc != tt.expected {
+				t.Fatalf("picked %+v (%s)", acc, reason)
+			}
+		})
+	}
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	project := primitive.NewObjectID()
+	candidates := []*entity.DriveAccount{
+		testAccount(project, 0, 100),
+		testAccount(project, 0, 100),
+		testAccount(project, 0, 100),
+	}
+	s := &roundRobinSelector{last: make(map[primitive.ObjectID]primitive.ObjectID)}
+	req := &PlacementRequest{Owner: primitive.NewObjectID()}
+	// ids grow with creation, so the rotation follows the slice order
+	for round := 0; round < 2; round++ {
+		for i, expected := range candidates {
+			acc, _, err := s.Select(req, candidates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if acc != expected {
+				t.Fatalf("round %d pick %d is %s, expected %s", round, i, acc.Id.Hex(), expected.Id.Hex())
+			}
+		}
+	}
+}
+
+func TestProjectWeightedSelectorSkipsFullProjects(t *testing.T) {
+	full := primitive.NewObjectID()
+	free := primitive.NewObjectID()
+	expected := testAccount(free, 0, 100)
+	candidates := []*entity.DriveAccount{
+		testAccount(full, 100, 100),
+		testAccount(full, 100, 100),
+		testAccount(free, 50, 100),
+		expected,
+	}
+	for i := 0; i < 20; i++ {
+		acc, _, err := projectWeightedSelector{}.Select(&PlacementRequest{}, candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acc != expected {
+			t.Fatalf("picked %s in a project without free space", acc.Id.Hex())
+		}
+	}
+}
+
+func TestPlaceUpload(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		setup    func(store *memoryStore, accounts []*entity.DriveAccount, req *PlacementRequest)
+		// index of the expected account, -1 for an error
+		expected int
+		err      error
+	}{
+		{"most free", PlacementMostFree, nil, 1, nil},
+		{"strategy of the user", "", func(store *memoryStore, accounts []*entity.DriveAccount, req *PlacementRequest) {
+			store.users[req.Owner] = &entity.User{Id: req.Owner, PlacementStrategy: PlacementMostFree}
+		}, 1, nil},
+		{"skips disabled", PlacementMostFree, func(store *memoryStore, accounts []*entity.DriveAccount, req *PlacementRequest) {
+			accounts[1].Disabled = true
+		}, 0, nil},
+		{"skips read only", PlacementMostFree, func(store *memoryStore, accounts []*entity.DriveAccount, req *PlacementRequest) {
+			accounts[1].ReadOnly = true
+		}, 0, nil},
+		{"skips broken", PlacementMostFree, func(store *memoryStore, accounts []*entity.DriveAccount, req *PlacementRequest) {
+			accounts[1].HealthStatus = HealthKeyInvalid
+		}, 0, nil},
+		{"degraded after the others", PlacementMostFree, func(store *memoryStore, accounts []*entity.DriveAccount, req *PlacementRequest) {
+			accounts[1].HealthStatus = HealthDegraded
+		}, 0, nil},
+		{"degraded when nothing else has room", PlacementMostFree, func(store *memoryStore, accounts []*entity.DriveAccount, req *PlacementRequest) {
+			accounts[1].HealthStatus = HealthDegraded
+			req.Size = 6 * UploadBuffer
+		}, 1, nil},
+		{"skips excluded", PlacementMostFree, func(store *memoryStore, accounts []*entity.DriveAccount, req *PlacementRequest) {
+			req.Exclude = []primitive.ObjectID{accounts[1].Id}
+		}, 0, nil},
+		{"skips other owners", PlacementMostFree, func(store *memoryStore, accounts []*entity.DriveAccount, req *PlacementRequest) {
+			accounts[1].Owner = primitive.NewObjectID()
+		}, 0, nil},
+		{"drive only skips local storage", PlacementMostFree, func(store *memoryStore, accounts []*entity.DriveAccount, req *PlacementRequest) {
+			accounts[1].Type = helper.KeyTypeLocal
+			req.DriveOnly = true
+		}, 0, nil},
+		{"no room anywhere", PlacementMostFree, func(store *memoryStore, accounts []*entity.DriveAccount, req *PlacementRequest) {
+			req.Size = 8 * UploadBuffer
+		}, -1, ErrNoSuitableAccount},
+		{"unknown strategy", "fullest", nil, -1, ErrUnknownPlacementStrategy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			backends := make(map[primitive.ObjectID]*helper.FakeDriveBackend)
+			req := &PlacementRequest{Owner: primitive.NewObjectID(), Size: UploadBuffer}
+			// free space in UploadBuffer units
+			var accounts []*entity.DriveAccount
+			for _, free := range []int64{5, 8, 3} {
+				accounts = append(accounts, store.addAccount(backends, req.Owner, free*UploadBuffer))
+			}
+			if tt.setup != nil {
+				tt.setup(store, accounts, req)
+			}
+			placement, err := newStoreAccountService(store, backends).PlaceUpload(req, tt.strategy)
+			if tt.expected < 0 {
+				if err != tt.err {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if placement.Account.Id != accounts[tt.expected].Id {
+				t.Fatalf("placed on %s (%s), expected account %d", placement.Account.Id.Hex(), placement.Reason, tt.expected)
+			}
+		})
+	}
+}
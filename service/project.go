@@ -8,6 +8,7 @@ import (
 	"github.com/ndphu/drive-manager-api/dao"
 	"github.com/ndphu/drive-manager-api/entity"
 	"github.com/ndphu/drive-manager-api/helper"
+	"github.com/ndphu/drive-manager-api/keyring"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -16,7 +17,6 @@ import (
 	"google.golang.org/api/option"
 	"google.golang.org/api/serviceusage/v1"
 	"log"
-	"math/rand"
 	"strconv"
 	"time"
 )
@@ -35,40 +35,59 @@ func GetProjectService() *ProjectService {
 	return projectService
 }
 
-func (s *ProjectService) CreateProject(displayName string, key []byte, numberOfAccounts int, owner primitive.ObjectID) (*entity.Project, error) {
+// CreateProject stores the project and its admin account. Accounts asked for are provisioned by
+// a background job, returned when there is one.
+func (s *ProjectService) CreateProject(displayName string, key []byte, numberOfAccounts int, owner primitive.ObjectID) (*entity.Project, *entity.Job, error) {
 	kd := KeyDetails{}
 	if err := json.Unmarshal(key, &kd); err != nil {
 		log.Println("Fail to parse project admin key by error", err.Error())
-		return nil, err
+		return nil, nil, err
 	}
 	// validate project ID from key file should be unique
 	if count, err := dao.Project().CountDocuments(context.Background(), bson.D{{"projectId", kd.ProjectId}}); err != nil {
 		log.Println("Fail to check key unique with database", err.Error())
-		return nil, err
+		return nil, nil, err
 	} else if count > 0 {
 		log.Println("Project ID", kd.ProjectId, "is not unique")
-		return nil, errors.New("DuplicatedGoogleProjectId")
+		return nil, nil, errors.New("DuplicatedGoogleProjectId")
 	}
 
 	if err := enableRequiredAPIs(key); err != nil {
 		log.Println("Fail to enable required API by error", err.Error())
-		return nil, err
+		return nil, nil, err
 	}
 
-	project, account, err := s.insertProject(displayName, key, owner)
+	project, _, err := s.insertProject(displayName, key, owner)
 	if err != nil {
 		log.Println("Fail to insert project to database by error", err.Error())
-		return nil, err
+		return nil, nil, err
 	}
 
 	if numberOfAccounts > 0 {
-		if err := s.ProvisionProject(project, account, numberOfAccounts); err != nil {
+		params := map[string]string{
+			"projectId": project.Id.Hex(),
+			"count":     strconv.Itoa(numberOfAccounts),
+		}
+		job, err := GetJobService().Enqueue(owner, JobProvisionProject, params)
+		if err != nil {
+			// the project exists now, the accounts can still be added with newAccount
 			log.Println("Fail to provision project by error", err.Error())
-			return nil, err
+			now := time.Now()
+			return project, &entity.Job{
+				Owner:      owner,
+				Type:       JobProvisionProject,
+				Params:     params,
+				Status:     JobFailed,
+				Error:      err.Error(),
+				CreatedAt:  now,
+				FinishedAt: &now,
+				UpdatedAt:  now,
+			}, nil
 		}
+		return project, job, nil
 	}
 
-	return project, nil
+	return project, nil, nil
 }
 
 func (s *ProjectService) insertProject(displayName string, key []byte, owner primitive.ObjectID) (*entity.Project, *entity.DriveAccount, error) {
@@ -85,11 +104,15 @@ func (s *ProjectService) insertProject(displayName string, key []byte, owner pri
 		Owner:       owner,
 	}
 
+	sealedKey, err := keyring.Encrypt(key)
+	if err != nil {
+		return nil, nil, err
+	}
 	acc := entity.DriveAccount{
 		Id:          accountId,
 		ProjectId:   pid,
 		Name:        "admin-account",
-		Key:         string(key),
+		Key:         sealedKey,
 		Desc:        "Admin Account",
 		Type:        "service_account_admin",
 		ClientEmail: kd.ClientEmail,
@@ -161,43 +184,7 @@ func enableRequiredAPIs(key []byte) error {
 	return nil
 }
 
-func (s *ProjectService) ProvisionProject(project *entity.Project, adminAccount *entity.DriveAccount, numberOfAccounts int) error {
-	accSrv := GetAccountService()
-
-	config, err := google.JWTConfigFromJSON([]byte(adminAccount.Key), iam.CloudPlatformScope)
-	if err != nil {
-		log.Println("Fail to initialize with project admin key", err.Error())
-		return nil
-	}
-
-	iamService, err := iam.NewService(context.Background(), option.WithTokenSource(config.TokenSource(context.Background())))
-	if err != nil {
-		log.Println("Fail to create IAM service instance", err.Error())
-		return err
-	}
-
-	for i := 0; i < numberOfAccounts; i++ {
-		if err := createServiceAccountAutomate(iamService, project, accSrv); err != nil {
-			log.Println("Fail to create service account by error", err.Error())
-			return err
-		}
-	}
-
-	return nil
-
-	//
-	//jobs := make(chan int, numberOfAccounts)
-	//
-	//for w := 1; w <= 4; w++ {
-	//	go worker(w, jobs, iamSrv, project, accSrv)
-	//}
-	//
-	//for i := 0; i < numberOfAccounts; i++ {
-	//	jobs <- i
-	//}
-}
-
-func (s *ProjectService) SyncProject(projectId string, userId string) error {
+func (s *ProjectService) SyncProject(projectId string, userId string, full bool, progress Progress) error {
 	var p entity.Project
 	projectIdHex, _ := primitive.ObjectIDFromHex(projectId)
 	userIdHex, _ := primitive.ObjectIDFromHex(userId)
@@ -219,12 +206,24 @@ func (s *ProjectService) SyncProject(projectId string, userId string) error {
 		}
 	}
 
+	progress.SetTotal(len(accList))
 	for _, acc := range accList {
-		if err := accountService.IndexAccountFiles(acc); err != nil {
+		if progress.Cancelled() {
+			return ErrJobCancelled
+		}
+		var err error
+		if full {
+			err = accountService.ReindexAccountFiles(acc)
+		} else {
+			err = accountService.SyncAccountChanges(acc)
+		}
+		if err != nil {
 			log.Println("Fail to sync account", acc.Id.Hex(), "by error", err.Error())
+			progress.ItemFailed(acc.ClientEmail, err)
+			continue
 		}
+		progress.ItemDone(acc.ClientEmail)
 	}
-	// TODO: should aggregate error here!
 	return nil
 }
 
@@ -237,7 +236,7 @@ func (s *ProjectService) ListAccounts(projectId string) ([]*iam.ServiceAccount,
 		return nil, err
 	}
 
-	var key []byte
+	sealed := p.AdminKey
 	var admin entity.DriveAccount
 	hex_, _ := primitive.ObjectIDFromHex(projectId)
 	if err := dao.DriveAccount().FindOne(context.Background(), bson.D{
@@ -245,9 +244,12 @@ func (s *ProjectService) ListAccounts(projectId string) ([]*iam.ServiceAccount,
 		{"type", "service_account_admin"},
 	}).Decode(&admin); err != nil {
 		log.Println("No admin account for project", projectId)
-		key = []byte(p.AdminKey)
 	} else {
-		key = []byte(admin.Key)
+		sealed = admin.Key
+	}
+	key, err := keyring.Decrypt(sealed)
+	if err != nil {
+		return nil, err
 	}
 
 	is, err := helper.NewIamService(key)
@@ -289,7 +291,9 @@ func (s *ProjectService) DeleteProject(projectId string) error {
 	return nil
 }
 
-func (s *ProjectService) SyncProjectWithGoogle(projectId string) error {
+// SyncProjectWithGoogle rebuilds the project from scratch: every account, index and key is replaced.
+// ReconcileProject is the non-destructive alternative.
+func (s *ProjectService) SyncProjectWithGoogle(projectId string, progress Progress) error {
 	proj, err := s.GetProject(projectId)
 	if err != nil {
 		log.Println("Project not found by error", err.Error())
@@ -324,9 +328,14 @@ func (s *ProjectService) SyncProjectWithGoogle(projectId string) error {
 		log.Println("Fail to get service accounts for proj", projectId)
 		return err
 	}
+	progress.SetTotal(len(remoteAccounts))
 	for idx, acc := range remoteAccounts {
+		if progress.Cancelled() {
+			return ErrJobCancelled
+		}
 		if acc.UniqueId == is.KeyDetails.ClientId {
 			log.Println("Ignore admin account", acc.UniqueId)
+			progress.ItemDone(acc.Email)
 			continue
 		}
 
@@ -336,16 +345,19 @@ func (s *ProjectService) SyncProjectWithGoogle(projectId string) error {
 		key, err := is.CreateServiceAccountKey(acc)
 		if err != nil {
 			log.Println("Fail to create service account key by error", err.Error())
-			return err
+			progress.ItemFailed(acc.Email, err)
+			continue
 		}
 		if en, err := s.InsertDriveAccount(proj, acc, key); err != nil {
 			log.Println("Fail to insert drive account by error", err.Error())
-			return err
+			progress.ItemFailed(acc.Email, err)
+			continue
 		} else {
-			if err := accountService.IndexAccountFiles(*en); err != nil {
+			if err := accountService.ReindexAccountFiles(*en); err != nil {
 				log.Println("Fail to index account's files by error", err.Error())
 			}
 		}
+		progress.ItemDone(acc.Email)
 		log.Println("Synchronized", idx+1, "of", len(remoteAccounts), "accounts")
 	}
 
@@ -361,9 +373,8 @@ func (s *ProjectService) InsertDriveAccount(proj *entity.Project, sa *iam.Servic
 	newAcc.Name = sa.DisplayName
 	newAcc.Owner = proj.Owner
 	newAcc.ProjectId = proj.Id
-	newAcc.Key = string(key)
 
-	srv, err := helper.GetDriveService(key)
+	srv, err := helper.NewDriveBackend(key)
 	if err != nil {
 		log.Println("Fail to get drive service from account key by error", err.Error())
 		return nil, err
@@ -403,15 +414,18 @@ func (s *ProjectService) GetProject(id string) (*entity.Project, error) {
 }
 
 func (s *ProjectService) GetIamService(project *entity.Project) (*helper.IamService, error) {
+	if project.Type == ProjectTypeStorage {
+		return nil, ErrNotGoogleProject
+	}
 	if project.AdminKey != "" {
-		return helper.NewIamService([]byte(project.AdminKey))
+		return GetServiceCache().IamService(project.Id, project.AdminKey)
 	}
 	account, err := accountService.FindAdminAccount(project.Id.Hex())
 	if err != nil {
 		log.Println("No admin account found for project", project.Id.Hex())
 		return nil, err
 	}
-	return helper.NewIamService([]byte(account.Key))
+	return GetServiceCache().IamService(account.Id, account.Key)
 }
 
 func (s *ProjectService) SyncProjectQuota(projectId string) error {
@@ -471,73 +485,6 @@ func (s *ProjectService) setProjectDisabled(projectId string, disabled bool) err
 	return nil
 }
 
-func worker(id int, jobs <-chan int, iamSrv *iam.Service, project *entity.Project, accSrv *AccountService) {
-	log.Println("started worker", id)
-	for i := range jobs {
-		log.Println("creating service account", i)
-		createServiceAccountAutomate(iamSrv, project, accSrv)
-	}
-}
-
-func createServiceAccountAutomate(iamSrv *iam.Service, project *entity.Project, accSrv *AccountService) error {
-	accountName := "sa-" + strconv.FormatInt(time.Now().Unix()+int64(rand.Intn(100000)), 16)
-	account, err := createServiceAccount(iamSrv, project.ProjectId, accountName, accountName)
-	if err != nil {
-		// TODO: write provision_event FAIL TO CREATE SERVICE ACCOUNT
-		log.Println("Fail to create service account by error", err.Error())
-		return err
-	}
-	serviceAccountKey, err := createKeyFile(iamSrv, account)
-	if err != nil {
-		// TODO: write provision_event FAIL TO GENERATE KEY FILE
-		log.Println("Fail to generate service account key file by error", err.Error())
-		return err
-	}
-	newAcc := entity.DriveAccount{}
-	if err := accSrv.InitializeKey(&newAcc, serviceAccountKey); err != nil {
-		// TODO: write provision_event FAIL TO PARSE GENERATED KEY FILE
-		log.Println("Fail to parse service account key file by error", err.Error())
-		return err
-	}
-	newAcc.Name = accountName
-	newAcc.Owner = project.Owner
-	newAcc.ProjectId = project.Id
-	newAcc.Key = string(serviceAccountKey)
-
-	srv, err := helper.GetDriveService(serviceAccountKey)
-	if err != nil {
-		log.Println("Fail to get drive service from account key by error", err.Error())
-		return err
-	}
-	tries := 0
-	for {
-		tries++
-		log.Println("Retrieving quota usage for account", newAcc.ClientId)
-		quota, err := srv.GetQuotaUsage()
-		if err != nil {
-			log.Println("Account may not ready at this moment. Error=", err.Error(), ". Tries:", tries)
-			time.Sleep(2 * time.Second)
-		} else {
-			log.Println("Account is now available")
-			newAcc.Usage = quota.Usage
-			newAcc.Limit = quota.Limit
-			newAcc.QuotaUpdateTimestamp = time.Now()
-			break
-		}
-		if tries >= 30 {
-			return err
-		}
-	}
-
-	if err := accSrv.Save(&newAcc); err != nil {
-		// TODO: write provision_event FAIL TO SAVE NEW ACCOUNT TO DB
-		log.Println("Fail to save new service account to DB")
-		return err
-	}
-
-	return nil
-}
-
 func createServiceAccount(s *iam.Service, projectId string, name string, displayName string) (*iam.ServiceAccount, error) {
 	req := iam.CreateServiceAccountRequest{}
 	req.AccountId = name
@@ -571,3 +518,75 @@ func parseKeyDetails(key []byte) (*KeyDetails, error) {
 	}
 	return &kd, nil
 }
+
+const (
+	JobSyncProjectWithGoogle = "project.syncGoogle"
+	JobSyncProject           = "project.sync"
+	JobProvisionProject      = "project.provision"
+	JobReconcileProject      = "project.reconcile"
+	JobPlanReconcile         = "project.reconcile.plan"
+)
+
+var ErrProjectNotFound = errors.New("ProjectNotFound")
+
+func registerProjectJobs(js *JobService) {
+	ps := GetProjectService()
+	js.Register(JobSyncProjectWithGoogle, func(job *JobContext) error {
+		return ps.SyncProjectWithGoogle(job.Param("projectId"), job)
+	})
+	js.Register(JobReconcileProject, func(job *JobContext) error {
+		return ps.ReconcileProject(job.Param("projectId"), job.Param("planId"), job.Job.Id, job)
+	})
+	js.Register(JobPlanReconcile, func(job *JobContext) error {
+		// a retried attempt keeps the plan the first one stored
+		if _, err := ps.FindReconcilePlan(job.Job.Owner, job.Param("projectId"), job.Param("planId")); err == nil {
+			return nil
+		}
+		_, _, err := ps.savePlan(job.Param("projectId"), job.Param("planId"))
+		return err
+	})
+	js.Register(JobSyncProject, func(job *JobContext) error {
+		return ps.SyncProject(job.Param("projectId"), job.Job.Owner.Hex(), job.Param("full") == "true", job)
+	})
+	js.Register(JobProvisionProject, func(job *JobContext) error {
+		project, err := ps.GetProject(job.Param("projectId"))
+		if err != nil {
+			return err
+		}
+		admin, err := accountService.FindAdminAccount(project.Id.Hex())
+		if err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(job.Param("count"))
+		if err != nil {
+			return err
+		}
+		return ps.ProvisionProject(project, admin, count, job)
+	})
+}
+
+// EnqueueProjectJob checks the project belongs to the owner and queues the operation on it.
+func (s *ProjectService) EnqueueProjectJob(owner primitive.ObjectID, projectId string, jobType string, params map[string]string) (*entity.Job, error) {
+	projectIdHex, err := primitive.ObjectIDFromHex(projectId)
+	if err != nil {
+		return nil, ErrProjectNotFound
+	}
+	var project entity.Project
+	if err := dao.Project().FindOne(context.Background(), bson.D{
+		{"_id", projectIdHex},
+		{"owner", owner},
+	}).Decode(&project); err == mongo.ErrNoDocuments {
+		return nil, ErrProjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	// every project job works on the Google project
+	if project.Type == ProjectTypeStorage {
+		return nil, ErrNotGoogleProject
+	}
+	if params == nil {
+		params = make(map[string]string)
+	}
+	params["projectId"] = projectId
+	return GetJobService().Enqueue(owner, jobType, params)
+}
@@ -0,0 +1,291 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iam/v1"
+	"log"
+	"sync"
+	"time"
+)
+
+// Steps of provisioning one account, in order.
+const (
+	ProvisionCreateAccount = "create_service_account"
+	ProvisionCreateKey     = "create_key"
+	ProvisionWaitDrive     = "wait_drive"
+	ProvisionSave          = "save"
+
+	ProvisionOk     = "ok"
+	ProvisionFailed = "failed"
+)
+
+// a new service account takes a while before Drive accepts its key
+const (
+	driveReadyTries    = 30
+	driveReadyInterval = 2 * time.Second
+)
+
+// provisionSlot is where one account of a provisioning job got to, rebuilt from its events.
+type provisionSlot struct {
+	index int
+	name  string
+	email string
+	keyId string
+	saved bool
+}
+
+// ProvisionProject creates numberOfAccounts service accounts for the project, PROVISION_CONCURRENCY
+// at a time. Each step is written as a provision_event; a failed account does not stop the others
+// and the job is retried, resuming every account from its last successful step.
+func (s *ProjectService) ProvisionProject(project *entity.Project, adminAccount *entity.DriveAccount, numberOfAccounts int, job *JobContext) error {
+	is, err := GetServiceCache().IamService(adminAccount.Id, adminAccount.Key)
+	if err != nil {
+		log.Println("Fail to initialize IAM service with project admin key by error", err.Error())
+		return err
+	}
+	slots, err := provisionSlots(job.Job.Id, numberOfAccounts)
+	if err != nil {
+		return err
+	}
+
+	job.SetTotal(numberOfAccounts)
+	concurrency := intFromEnv("PROVISION_CONCURRENCY", 4)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	failed := 0
+	cancelled := false
+	for _, slot := range slots {
+		if job.Cancelled() {
+			cancelled = true
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(slot *provisionSlot) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := s.provisionSlot(is, project, job, slot); err != nil {
+				log.Println("Fail to provision account", slot.name, "of project", project.Id.Hex(), "by error", err.Error())
+				job.ItemFailed(slot.name, err)
+				mutex.Lock()
+				failed++
+				mutex.Unlock()
+				return
+			}
+			job.ItemDone(slot.name)
+		}(slot)
+	}
+	wg.Wait()
+	if cancelled {
+		return ErrJobCancelled
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d accounts could not be provisioned", failed, numberOfAccounts)
+	}
+	return nil
+}
+
+func provisionSlots(jobId primitive.ObjectID, count int) ([]*provisionSlot, error) {
+	slots := make([]*provisionSlot, count)
+	for i := range slots {
+		// account ids are 6-30 lowercase letters, digits or dashes; the job id keeps them stable across attempts
+		slots[i] = &provisionSlot{index: i, name: fmt.Sprintf("sa-%s-%d", jobId.Hex()[16:], i)}
+	}
+	var events []entity.ProvisionEvent
+	if cursor, err := dao.ProvisionEvent().Find(context.Background(), bson.D{
+		{"jobId", jobId},
+		{"status", ProvisionOk},
+	}, options.Find().SetSort(bson.D{{"createdAt", 1}})); err != nil {
+		return nil, err
+	} else if err := cursor.All(context.Background(), &events); err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		if e.Slot < 0 || e.Slot >= count {
+			continue
+		}
+		slot := slots[e.Slot]
+		switch e.Step {
+		case ProvisionCreateAccount:
+			slot.email = e.Email
+		case ProvisionCreateKey:
+			slot.keyId = e.KeyId
+		case ProvisionSave:
+			slot.saved = true
+		}
+	}
+	return slots, nil
+}
+
+func (s *ProjectService) provisionSlot(is *helper.IamService, project *entity.Project, job *JobContext, slot *provisionSlot) error {
+	if slot.saved {
+		return nil
+	}
+	record := func(step string, err error) {
+		e := entity.ProvisionEvent{
+			Id:          primitive.NewObjectID(),
+			JobId:       job.Job.Id,
+			ProjectId:   project.Id,
+			Owner:       project.Owner,
+			Slot:        slot.index,
+			AccountName: slot.name,
+			Email:       slot.email,
+			KeyId:       slot.keyId,
+			Step:        step,
+			Status:      ProvisionOk,
+			Attempt:     job.Job.Attempts,
+			CreatedAt:   time.Now(),
+		}
+		if err != nil {
+			e.Status = ProvisionFailed
+			e.Error = err.Error()
+		}
+		if _, err := dao.ProvisionEvent().InsertOne(context.Background(), e); err != nil {
+			log.Println("Fail to write provision event", step, "of", slot.name, "by error", err.Error())
+		}
+	}
+
+	account, err := s.provisionServiceAccount(is, project, slot)
+	if err != nil {
+		record(ProvisionCreateAccount, err)
+		return err
+	}
+	if slot.email == "" {
+		slot.email = account.Email
+		record(ProvisionCreateAccount, nil)
+	}
+
+	// saved by an attempt that died before writing its event
+	if count, err := dao.DriveAccount().CountDocuments(context.Background(), bson.D{
+		{"projectId", project.Id},
+		{"clientEmail", account.Email},
+	}); err != nil {
+		return err
+	} else if count > 0 {
+		record(ProvisionSave, nil)
+		return nil
+	}
+
+	if slot.keyId != "" {
+		// the key material of an earlier attempt is lost, do not leave the key behind
+		if err := is.DeleteServiceAccountKey(account.Email, slot.keyId); err != nil && !isNotFound(err) {
+			log.Println("Fail to delete orphan key", slot.keyId, "of", account.Email, "by error", err.Error())
+		}
+		slot.keyId = ""
+	}
+	key, err := is.CreateServiceAccountKey(account)
+	if err != nil {
+		record(ProvisionCreateKey, err)
+		return err
+	}
+	var kd helper.KeyDetails
+	if err := json.Unmarshal(key, &kd); err != nil {
+		record(ProvisionCreateKey, err)
+		return err
+	}
+	slot.keyId = kd.PrivateKeyId
+	record(ProvisionCreateKey, nil)
+
+	newAcc := entity.DriveAccount{}
+	if err := accountService.InitializeKey(&newAcc, key); err != nil {
+		record(ProvisionSave, err)
+		return err
+	}
+	newAcc.Name = slot.name
+	newAcc.Desc = account.DisplayName
+	newAcc.Owner = project.Owner
+	newAcc.ProjectId = project.Id
+
+	if err := waitDriveReady(key, &newAcc); err != nil {
+		record(ProvisionWaitDrive, err)
+		return err
+	}
+	record(ProvisionWaitDrive, nil)
+
+	if err := accountService.Save(&newAcc); err != nil {
+		record(ProvisionSave, err)
+		return err
+	}
+	record(ProvisionSave, nil)
+	log.Println("Provisioned account", newAcc.ClientEmail, "for project", project.Id.Hex())
+	return nil
+}
+
+// provisionServiceAccount returns the service account of the slot, creating it unless an earlier
+// attempt already did.
+func (s *ProjectService) provisionServiceAccount(is *helper.IamService, project *entity.Project, slot *provisionSlot) (*iam.ServiceAccount, error) {
+	if slot.email != "" {
+		account, err := is.GetServiceAccount(slot.email)
+		if err == nil {
+			return account, nil
+		}
+		if !isNotFound(err) {
+			return nil, err
+		}
+		log.Println("Service account", slot.email, "is gone, creating it again")
+		slot.email = ""
+		slot.keyId = ""
+	}
+	account, err := is.CreateServiceAccount(project.ProjectId, slot.name, slot.name)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == 409 {
+		return is.GetServiceAccount(slot.name + "@" + project.ProjectId + ".iam.gserviceaccount.com")
+	}
+	return account, err
+}
+
+func waitDriveReady(key []byte, acc *entity.DriveAccount) error {
+	srv, err := helper.NewDriveBackend(key)
+	if err != nil {
+		return err
+	}
+	for tries := 1; ; tries++ {
+		quota, err := srv.GetQuotaUsage()
+		if err == nil {
+			acc.Usage = quota.Usage
+			acc.Limit = quota.Limit
+			acc.Available = quota.Limit - quota.Usage
+			acc.QuotaUpdateTimestamp = time.Now()
+			return nil
+		}
+		if tries >= driveReadyTries {
+			log.Println("Account", acc.ClientEmail, "is not ready after", tries, "tries")
+			return err
+		}
+		time.Sleep(driveReadyInterval)
+	}
+}
+
+func FindProvisionEvents(owner primitive.ObjectID, projectId primitive.ObjectID, jobId *primitive.ObjectID) ([]*entity.ProvisionEvent, error) {
+	filter := bson.D{
+		{"owner", owner},
+		{"projectId", projectId},
+	}
+	if jobId != nil {
+		filter = append(filter, bson.E{Key: "jobId", Value: *jobId})
+	}
+	events := make([]*entity.ProvisionEvent, 0)
+	cursor, err := dao.ProvisionEvent().Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{"createdAt", -1}}).SetLimit(1000))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,320 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
+)
+
+const (
+	ReservationPending   = "pending"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+	ReservationExpired   = "expired"
+)
+
+var ErrQuotaExhausted = errors.New("QuotaExhausted")
+
+var ErrReservationNotFound = errors.New("ReservationNotFound")
+
+// placement retries when the chosen account was filled by a concurrent upload
+const maxReservationAttempts = 5
+
+type QuotaService struct {
+	ReservationTTL time.Duration
+	SweepInterval  time.Duration
+}
+
+var quotaService *QuotaService
+
+func GetQuotaService() *QuotaService {
+	if quotaService == nil {
+		quotaService = &QuotaService{
+			ReservationTTL: durationFromEnv("QUOTA_RESERVATION_TTL", 24*time.Hour),
+			SweepInterval:  durationFromEnv("QUOTA_RESERVATION_SWEEP_INTERVAL", time.Minute),
+		}
+	}
+	return quotaService
+}
+
+// roomFor matches the accounts able to take size bytes while keeping UploadBuffer free. Placement
+// and Reserve share it, so an account planned for a part can always reserve it.
+func roomFor(size int64) bson.E {
+	return bson.E{Key: "available", Value: bson.D{{"$gte", size + UploadBuffer}}}
+}
+
+// Reserve takes size bytes from the available space of the account, keeping UploadBuffer free.
+// It fails with ErrQuotaExhausted when a concurrent upload got the space first.
+func (s *QuotaService) Reserve(owner primitive.ObjectID, accountId primitive.ObjectID, size int64) (*entity.QuotaReservation, error) {
+	res, err := dao.DriveAccount().UpdateOne(context.Background(), bson.D{
+		{"_id", accountId},
+		roomFor(size),
+	}, bson.D{
+		{"$inc", bson.D{
+			{"available", -size},
+			{"reserved", size},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, ErrQuotaExhausted
+	}
+	now := time.Now()
+	r := &entity.QuotaReservation{
+		Id:        primitive.NewObjectID(),
+		AccountId: accountId,
+		Owner:     owner,
+		Size:      size,
+		Status:    ReservationPending,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ReservationTTL),
+	}
+	if _, err := dao.QuotaReservation().InsertOne(context.Background(), r); err != nil {
+		log.Println("Fail to record reservation on account", accountId.Hex(), "by error", err.Error())
+		s.giveBack(accountId, size)
+		return nil, err
+	}
+	return r, nil
+}
+
+// Commit turns the reservation into usage once the file of actualSize is on Drive. Only a
+// reservation of the owner on the account is used, otherwise it fails with ErrReservationNotFound.
+// A reservation already expired or released gave its bytes back, so the full size is taken again.
+func (s *QuotaService) Commit(owner primitive.ObjectID, accountId primitive.ObjectID, id primitive.ObjectID, fileId string, actualSize int64) error {
+	var r entity.QuotaReservation
+	now := time.Now()
+	if err := dao.QuotaReservation().FindOneAndUpdate(context.Background(), bson.D{
+		{"_id", id},
+		{"owner", owner},
+		{"accountId", accountId},
+		{"status", ReservationPending},
+	}, bson.D{
+		{"$set", bson.D{
+			{"status", ReservationCommitted},
+			{"fileId", fileId},
+			{"completedAt", now},
+		}},
+	}).Decode(&r); err == mongo.ErrNoDocuments {
+		if err := dao.QuotaReservation().FindOne(context.Background(), bson.D{
+			{"_id", id},
+			{"owner", owner},
+			{"accountId", accountId},
+		}).Decode(&r); err == mongo.ErrNoDocuments {
+			return ErrReservationNotFound
+		} else if err != nil {
+			return err
+		}
+		if r.Status == ReservationCommitted {
+			return nil
+		}
+		return GetAccountService().UpdateCachedQuotaByAccountIdAndAdditionalSize(r.AccountId.Hex(), actualSize)
+	} else if err != nil {
+		return err
+	}
+	_, err := dao.DriveAccount().UpdateOne(context.Background(), bson.D{{"_id", r.AccountId}}, bson.D{
+		{"$inc", bson.D{
+			{"usage", actualSize},
+			{"available", r.Size - actualSize},
+			{"reserved", -r.Size},
+		}},
+	})
+	return err
+}
+
+// CommitFile commits the reservation of a file synced by a client. Without a reservation id the
+// oldest pending reservation of the same size on the account is used; without any the size is
+// simply added to the account usage.
+func (s *QuotaService) CommitFile(owner primitive.ObjectID, accountId primitive.ObjectID, reservationId string, fileId string, size int64) error {
+	if reservationId != "" {
+		id, err := primitive.ObjectIDFromHex(reservationId)
+		if err != nil {
+			return err
+		}
+		return s.Commit(owner, accountId, id, fileId, size)
+	}
+	var r entity.QuotaReservation
+	err := dao.QuotaReservation().FindOne(context.Background(), bson.D{
+		{"owner", owner},
+		{"accountId", accountId},
+		{"status", ReservationPending},
+		{"size", size},
+	}, options.FindOne().SetSort(bson.D{{"createdAt", 1}})).Decode(&r)
+	if err == mongo.ErrNoDocuments {
+		return GetAccountService().UpdateCachedQuotaByAccountIdAndAdditionalSize(accountId.Hex(), size)
+	} else if err != nil {
+		return err
+	}
+	return s.Commit(owner, accountId, r.Id, fileId, size)
+}
+
+// Release gives the bytes of a pending reservation back to the account.
+func (s *QuotaService) Release(id primitive.ObjectID) error {
+	return s.finish(id, ReservationReleased)
+}
+
+// ReleaseOwned releases a reservation of the owner, for clients giving up a direct upload.
+func (s *QuotaService) ReleaseOwned(owner primitive.ObjectID, id primitive.ObjectID) error {
+	var r entity.QuotaReservation
+	if err := dao.QuotaReservation().FindOne(context.Background(), bson.D{
+		{"_id", id},
+		{"owner", owner},
+	}).Decode(&r); err != nil {
+		return err
+	}
+	return s.Release(r.Id)
+}
+
+func (s *QuotaService) finish(id primitive.ObjectID, status string) error {
+	var r entity.QuotaReservation
+	if err := dao.QuotaReservation().FindOneAndUpdate(context.Background(), bson.D{
+		{"_id", id},
+		{"status", ReservationPending},
+	}, bson.D{
+		{"$set", bson.D{
+			{"status", status},
+			{"completedAt", time.Now()},
+		}},
+	}).Decode(&r); err == mongo.ErrNoDocuments {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return s.giveBack(r.AccountId, r.Size)
+}
+
+func (s *QuotaService) giveBack(accountId primitive.ObjectID, size int64) error {
+	_, err := dao.DriveAccount().UpdateOne(context.Background(), bson.D{{"_id", accountId}}, bson.D{
+		{"$inc", bson.D{
+			{"available", size},
+			{"reserved", -size},
+		}},
+	})
+	if err != nil {
+		log.Println("Fail to give back", size, "reserved bytes to account", accountId.Hex(), "by error", err.Error())
+	}
+	return err
+}
+
+// SweepExpired releases the reservations of uploads never completed.
+func (s *QuotaService) SweepExpired() (int, error) {
+	var expired []entity.QuotaReservation
+	if cursor, err := dao.QuotaReservation().Find(context.Background(), bson.D{
+		{"status", ReservationPending},
+		{"expiresAt", bson.D{{"$lt", time.Now()}}},
+	}); err != nil {
+		return 0, err
+	} else if err := cursor.All(context.Background(), &expired); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, r := range expired {
+		if err := s.finish(r.Id, ReservationExpired); err != nil {
+			log.Println("Fail to expire reservation", r.Id.Hex(), "by error", err.Error())
+			continue
+		}
+		count++
+	}
+	if count > 0 {
+		log.Println("Expired", count, "quota reservations")
+	}
+	return count, nil
+}
+
+func (s *QuotaService) FindReservations(owner primitive.ObjectID, accountId primitive.ObjectID) ([]*entity.QuotaReservation, error) {
+	reservations := make([]*entity.QuotaReservation, 0)
+	cursor, err := dao.QuotaReservation().Find(context.Background(), bson.D{
+		{"owner", owner},
+		{"accountId", accountId},
+		{"status", ReservationPending},
+	}, options.Find().SetSort(bson.D{{"createdAt", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &reservations); err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+// Start sweeps expired reservations on SweepInterval, and starts the refresher that reconciles
+// accounts with the storage quota reported by Drive. A zero interval disables the sweep.
+func (s *QuotaService) Start() {
+	if s.SweepInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(s.SweepInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if _, err := s.SweepExpired(); err != nil {
+					log.Println("Fail to sweep quota reservations by error", err.Error())
+				}
+			}
+		}()
+	}
+	GetQuotaRefresher().Start()
+}
+
+// ReserveUpload places the upload like PlaceUpload and reserves its size on the chosen account,
+// placing again without that account if a concurrent upload filled it first.
+func (s *AccountService) ReserveUpload(req *PlacementRequest, strategy string) (*Placement, error) {
+	for attempt := 0; attempt < maxReservationAttempts; attempt++ {
+		placement, err := s.PlaceUpload(req, strategy)
+		if err != nil {
+			return nil, err
+		}
+		r, err := GetQuotaService().Reserve(req.Owner, placement.Account.Id, req.Size)
+		if err == ErrQuotaExhausted {
+			log.Println("Account", placement.Account.Id.Hex(), "was filled meanwhile, placing again")
+			req.Exclude = append(req.Exclude, placement.Account.Id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		placement.Reservation = r
+		return placement, nil
+	}
+	return nil, ErrNoSuitableAccount
+}
+
+// reserveParts reserves the planned parts or shards of an upload, releasing them all if one fails.
+func reserveParts(owner primitive.ObjectID, parts []*UploadPart) error {
+	qs := GetQuotaService()
+	for _, part := range parts {
+		r, err := qs.Reserve(owner, part.AccountId, part.Size)
+		if err != nil {
+			releaseParts(parts)
+			return err
+		}
+		part.ReservationId = &r.Id
+	}
+	return nil
+}
+
+func releaseParts(parts []*UploadPart) {
+	for _, part := range parts {
+		if part.ReservationId == nil {
+			continue
+		}
+		if err := GetQuotaService().Release(*part.ReservationId); err != nil {
+			log.Println("Fail to release reservation of part", part.Index, "by error", err.Error())
+		}
+		part.ReservationId = nil
+	}
+}
+
+// commitPart accounts a stored part on its account, through its reservation when it has one.
+func commitPart(owner primitive.ObjectID, part *UploadPart) error {
+	if part.ReservationId != nil {
+		return GetQuotaService().Commit(owner, part.AccountId, *part.ReservationId, part.FileId, part.Size)
+	}
+	return GetAccountService().UpdateCachedQuotaByAccountIdAndAdditionalSize(part.AccountId.Hex(), part.Size)
+}
@@ -0,0 +1,405 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	RebalancePlanned   = "planned"
+	RebalanceRunning   = "running"
+	RebalanceCompleted = "completed"
+	RebalanceCancelled = "cancelled"
+
+	MovePending = "pending"
+	MoveDone    = "done"
+	MoveFailed  = "failed"
+	MoveSkipped = "skipped"
+)
+
+const DefaultRebalanceTolerance = 0.1
+
+var ErrRebalanceRunning = errors.New("RebalanceRunning")
+
+type RebalanceOptions struct {
+	DryRun bool `json:"dryRun"`
+	// accounts whose usage ratio is above the pool ratio by more than Tolerance give files away
+	Tolerance float64 `json:"tolerance"`
+	MaxMoves  int     `json:"maxMoves"`
+	MaxBytes  int64   `json:"maxBytes"`
+	// accounts to empty completely; when set, only these accounts give files away
+	DrainAccountIds []primitive.ObjectID `json:"drainAccountIds"`
+}
+
+type RebalanceMove struct {
+	File          StoredFile         `json:"file" bson:"file"`
+	FromAccountId primitive.ObjectID `json:"fromAccountId" bson:"fromAccountId"`
+	ToAccountId   primitive.ObjectID `json:"toAccountId" bson:"toAccountId"`
+	Status        string             `json:"status" bson:"status"`
+	NewFileId     string             `json:"newFileId,omitempty" bson:"newFileId,omitempty"`
+	Error         string             `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+type RebalanceRun struct {
+	Id         primitive.ObjectID `json:"id" bson:"_id"`
+	Owner      primitive.ObjectID `json:"owner" bson:"owner"`
+	Status     string             `json:"status" bson:"status"`
+	Options    RebalanceOptions   `json:"options" bson:"options"`
+	PoolRatio  float64            `json:"poolRatio" bson:"poolRatio"`
+	Moves      []*RebalanceMove   `json:"moves" bson:"moves"`
+	TotalBytes int64              `json:"totalBytes" bson:"totalBytes"`
+	Done       int                `json:"done" bson:"done"`
+	DoneBytes  int64              `json:"doneBytes" bson:"doneBytes"`
+	Failed     int                `json:"failed" bson:"failed"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	StartedAt  *time.Time         `json:"startedAt,omitempty" bson:"startedAt,omitempty"`
+	FinishedAt *time.Time         `json:"finishedAt,omitempty" bson:"finishedAt,omitempty"`
+}
+
+type RebalanceService struct {
+	mutex   sync.Mutex
+	running map[primitive.ObjectID]bool
+}
+
+var rebalanceService *RebalanceService
+
+func GetRebalanceService() *RebalanceService {
+	if rebalanceService == nil {
+		rebalanceService = &RebalanceService{
+			running: make(map[primitive.ObjectID]bool),
+		}
+	}
+	return rebalanceService
+}
+
+// simAccount is an account of the pool with the usage it would have after the moves planned so far.
+type simAccount struct {
+	account entity.DriveAccount
+	usage   int64
+	drain   bool
+}
+
+func (a *simAccount) ratio() float64 {
+	if a.account.Limit <= 0 {
+		return 1
+	}
+	return float64(a.usage) / float64(a.account.Limit)
+}
+
+// Plan computes moves from the fullest accounts to the emptiest using the cached quota of drive_account.
+// Files move largest first, until the source is back within Tolerance of the pool ratio.
+func (s *RebalanceService) Plan(owner primitive.ObjectID, opts RebalanceOptions) (*RebalanceRun, error) {
+	if opts.Tolerance <= 0 {
+		opts.Tolerance = DefaultRebalanceTolerance
+	}
+	var accounts []entity.DriveAccount
+	if cursor, err := dao.DriveAccount().Find(context.Background(), bson.D{
+		{"owner", owner},
+		storageTypeFilter(),
+		{"disabled", bson.D{{"$ne", true}}},
+	}); err != nil {
+		return nil, err
+	} else if err := cursor.All(context.Background(), &accounts); err != nil {
+		return nil, err
+	}
+	drain := make(map[primitive.ObjectID]bool)
+	for _, id := range opts.DrainAccountIds {
+		drain[id] = true
+	}
+	pool := make([]*simAccount, 0, len(accounts))
+	var totalUsage, totalLimit int64
+	for _, acc := range accounts {
+		pool = append(pool, &simAccount{account: acc, usage: acc.Usage, drain: drain[acc.Id]})
+		totalUsage += acc.Usage
+		if !drain[acc.Id] && !acc.ReadOnly {
+			totalLimit += acc.Limit
+		}
+	}
+	run := &RebalanceRun{
+		Id:        primitive.NewObjectID(),
+		Owner:     owner,
+		Status:    RebalancePlanned,
+		Options:   opts,
+		Moves:     make([]*RebalanceMove, 0),
+		CreatedAt: time.Now(),
+	}
+	if totalLimit <= 0 {
+		return run, nil
+	}
+	run.PoolRatio = float64(totalUsage) / float64(totalLimit)
+	// drained accounts first, then the fullest
+	sources := make([]*simAccount, len(pool))
+	copy(sources, pool)
+	sort.SliceStable(sources, func(i, j int) bool {
+		if sources[i].drain != sources[j].drain {
+			return sources[i].drain
+		}
+		return sources[i].ratio() > sources[j].ratio()
+	})
+	limitReached := func() bool {
+		return (opts.MaxMoves > 0 && len(run.Moves) >= opts.MaxMoves) ||
+			(opts.MaxBytes > 0 && run.TotalBytes >= opts.MaxBytes)
+	}
+	for _, source := range sources {
+		if !source.drain && (len(drain) > 0 || source.ratio() <= run.PoolRatio+opts.Tolerance) {
+			continue
+		}
+		files, err := ListStoredFiles(source.account.Id)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Size > files[j].Size
+		})
+		for _, file := range files {
+			if limitReached() || (!source.drain && source.ratio() <= run.PoolRatio+opts.Tolerance) {
+				break
+			}
+			if opts.MaxBytes > 0 && run.TotalBytes+file.Size > opts.MaxBytes {
+				continue
+			}
+			target := pickRebalanceTarget(pool, file, run.PoolRatio, source.drain)
+			if target == nil {
+				continue
+			}
+			source.usage -= file.Size
+			target.usage += file.Size
+			run.TotalBytes += file.Size
+			run.Moves = append(run.Moves, &RebalanceMove{
+				File:          *file,
+				FromAccountId: source.account.Id,
+				ToAccountId:   target.account.Id,
+				Status:        MovePending,
+			})
+			// later files of this source may be siblings of the one just moved
+			for _, f := range files {
+				if f.FileIndexId == file.FileIndexId && f.ParentId == file.ParentId {
+					f.Siblings = append(f.Siblings, target.account.Id)
+				}
+			}
+		}
+		if limitReached() {
+			break
+		}
+	}
+	for _, move := range run.Moves {
+		log.Println("Rebalance plan", run.Id.Hex(), "move", move.File.Kind, move.File.Name, move.File.Size,
+			"bytes from", move.FromAccountId.Hex(), "to", move.ToAccountId.Hex())
+	}
+	log.Println("Rebalance plan", run.Id.Hex(), "has", len(run.Moves), "moves,", run.TotalBytes, "bytes, pool ratio", run.PoolRatio)
+	return run, nil
+}
+
+// pickRebalanceTarget returns the emptiest account that stays at or below the pool ratio after
+// receiving the file (any account with room when draining) and holds no sibling of it.
+func pickRebalanceTarget(pool []*simAccount, file *StoredFile, poolRatio float64, draining bool) *simAccount {
+	var best *simAccount
+	for _, a := range pool {
+		if a.drain || a.account.ReadOnly || isUnhealthy(a.account.HealthStatus) || GetAccountBreaker().IsOpen(a.account.Id) || a.account.Id == file.AccountId || containsId(file.Siblings, a.account.Id) {
+			continue
+		}
+		if a.account.Limit-a.usage-file.Size <= UploadBuffer {
+			continue
+		}
+		after := float64(a.usage+file.Size) / float64(a.account.Limit)
+		if !draining && after > poolRatio {
+			continue
+		}
+		if best == nil || a.ratio() < best.ratio() {
+			best = a
+		}
+	}
+	return best
+}
+
+func containsId(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Rebalance plans and, unless DryRun, saves the run and executes it in the background.
+func (s *RebalanceService) Rebalance(owner primitive.ObjectID, opts RebalanceOptions) (*RebalanceRun, error) {
+	run, err := s.Plan(owner, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DryRun {
+		return run, nil
+	}
+	s.mutex.Lock()
+	if s.running[owner] {
+		s.mutex.Unlock()
+		return nil, ErrRebalanceRunning
+	}
+	s.running[owner] = true
+	s.mutex.Unlock()
+	if _, err := dao.RebalanceRun().InsertOne(context.Background(), run); err != nil {
+		s.release(owner)
+		return nil, err
+	}
+	go func() {
+		defer s.release(owner)
+		s.execute(run)
+	}()
+	return run, nil
+}
+
+// RebalanceAndWait is Rebalance without the background goroutine, for callers that need the outcome.
+func (s *RebalanceService) RebalanceAndWait(owner primitive.ObjectID, opts RebalanceOptions) (*RebalanceRun, error) {
+	opts.DryRun = false
+	run, err := s.Plan(owner, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	if s.running[owner] {
+		s.mutex.Unlock()
+		return nil, ErrRebalanceRunning
+	}
+	s.running[owner] = true
+	s.mutex.Unlock()
+	defer s.release(owner)
+	if _, err := dao.RebalanceRun().InsertOne(context.Background(), run); err != nil {
+		return nil, err
+	}
+	s.execute(run)
+	return run, nil
+}
+
+func (s *RebalanceService) release(owner primitive.ObjectID) {
+	s.mutex.Lock()
+	delete(s.running, owner)
+	s.mutex.Unlock()
+}
+
+// execute performs the moves one by one, saving progress after each so the run can be followed.
+func (s *RebalanceService) execute(run *RebalanceRun) {
+	started := time.Now()
+	run.Status = RebalanceRunning
+	run.StartedAt = &started
+	s.setStatus(run)
+	s.save(run)
+	for i, move := range run.Moves {
+		if s.cancelled(run.Id) {
+			log.Println("Rebalance", run.Id.Hex(), "cancelled")
+			run.Status = RebalanceCancelled
+			break
+		}
+		if move.Status != MovePending {
+			continue
+		}
+		target, err := GetAccountService().FindAccount(move.ToAccountId.Hex())
+		if err == nil && (target.Disabled || target.Limit-target.Usage-move.File.Size <= UploadBuffer) {
+			move.Status = MoveSkipped
+			move.Error = "target account has no room anymore"
+		} else if err == nil {
+			move.NewFileId, err = MigrateFile(&run.Moves[i].File, target)
+		}
+		if err != nil {
+			log.Println("Rebalance", run.Id.Hex(), "fail to move", move.File.FileId, "by error", err.Error())
+			move.Status = MoveFailed
+			move.Error = err.Error()
+			run.Failed++
+		} else if move.Status == MovePending {
+			move.Status = MoveDone
+			run.Done++
+			run.DoneBytes += move.File.Size
+		}
+		s.save(run)
+	}
+	if run.Status == RebalanceRunning {
+		run.Status = RebalanceCompleted
+		s.setStatus(run)
+	}
+	finished := time.Now()
+	run.FinishedAt = &finished
+	s.save(run)
+	log.Println("Rebalance", run.Id.Hex(), run.Status, "moved", run.Done, "files,", run.DoneBytes, "bytes,", run.Failed, "failed")
+}
+
+func (s *RebalanceService) save(run *RebalanceRun) {
+	if _, err := dao.RebalanceRun().UpdateOne(context.Background(), bson.D{{"_id", run.Id}}, bson.D{
+		{"$set", bson.D{
+			{"moves", run.Moves},
+			{"done", run.Done},
+			{"doneBytes", run.DoneBytes},
+			{"failed", run.Failed},
+			{"startedAt", run.StartedAt},
+			{"finishedAt", run.FinishedAt},
+		}},
+	}); err != nil {
+		log.Println("Fail to save rebalance run", run.Id.Hex(), "by error", err.Error())
+	}
+}
+
+// setStatus never overrides a cancellation requested meanwhile.
+func (s *RebalanceService) setStatus(run *RebalanceRun) {
+	if _, err := dao.RebalanceRun().UpdateOne(context.Background(), bson.D{
+		{"_id", run.Id},
+		{"status", bson.D{{"$ne", RebalanceCancelled}}},
+	}, bson.D{{"$set", bson.D{{"status", run.Status}}}}); err != nil {
+		log.Println("Fail to save rebalance run", run.Id.Hex(), "by error", err.Error())
+	}
+}
+
+func (s *RebalanceService) cancelled(id primitive.ObjectID) bool {
+	var run RebalanceRun
+	if err := dao.RebalanceRun().FindOne(context.Background(), bson.D{{"_id", id}},
+		options.FindOne().SetProjection(bson.D{{"status", 1}})).Decode(&run); err != nil {
+		return false
+	}
+	return run.Status == RebalanceCancelled
+}
+
+// Cancel stops a running rebalance after the move in progress.
+func (s *RebalanceService) Cancel(owner primitive.ObjectID, id primitive.ObjectID) error {
+	res, err := dao.RebalanceRun().UpdateOne(context.Background(), bson.D{
+		{"_id", id},
+		{"owner", owner},
+		{"status", bson.D{{"$in", bson.A{RebalancePlanned, RebalanceRunning}}}},
+	}, bson.D{{"$set", bson.D{{"status", RebalanceCancelled}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (s *RebalanceService) FindRun(owner primitive.ObjectID, id primitive.ObjectID) (*RebalanceRun, error) {
+	var run RebalanceRun
+	if err := dao.RebalanceRun().FindOne(context.Background(), bson.D{
+		{"_id", id},
+		{"owner", owner},
+	}).Decode(&run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// FindRuns lists the runs of the user, newest first, without their moves.
+func (s *RebalanceService) FindRuns(owner primitive.ObjectID) ([]*RebalanceRun, error) {
+	runs := make([]*RebalanceRun, 0)
+	if cursor, err := dao.RebalanceRun().Find(context.Background(), bson.D{{"owner", owner}},
+		options.Find().SetSort(bson.D{{"createdAt", -1}}).SetLimit(50).SetProjection(bson.D{{"moves", 0}})); err != nil {
+		return nil, err
+	} else if err := cursor.All(context.Background(), &runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
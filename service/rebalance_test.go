@@ -0,0 +1,68 @@
+package service
+
+import (
+	"github.com/ndphu/drive-manager-api/entity"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func simPool(usages ...int64) []*simAccount {
+	pool := make([]*simAccount, 0, len(usages))
+	for _, usage := range usages {
+		account := entity.DriveAccount{Id: primitive.NewObjectID(), Limit: 100 * UploadBuffer}
+		pool = append(pool, &simAccount{account: account, usage: usage * UploadBuffer})
+	}
+	return pool
+}
+
+func TestPickRebalanceTarget(t *testing.T) {
+	tests := []struct {
+		name string
+		// usage of each account in UploadBuffer units, out of 100
+		usages   []int64
+		fileSize int64
+		// the file is on account 0
+		siblingOf int
+		draining  bool
+		setup     func(pool []*simAccount)
+		// index of the expected target, -1 for none
+		expected int
+	}{
+		{"emptiest account", []int64{80, 40, 20}, 5, -1, false, nil, 2},
+		{"skips the account holding a sibling", []int64{80, 40, 20}, 5, 2, false, nil, 1},
+		{"stays under the pool ratio", []int64{80, 40, 45}, 10, -1, false, nil, 1},
+		{"no account under the pool ratio after the move", []int64{80, 55, 55}, 10, -1, false, nil, -1},
+		{"draining ignores the pool ratio", []int64{80, 55, 55}, 10, -1, true, nil, 1},
+		{"not enough room", []int64{80, 95, 95}, 10, -1, true, nil, -1},
+		{"skips read only", []int64{80, 40, 20}, 5, -1, false, func(pool []*simAccount) { pool[2].account.ReadOnly = true }, 1},
+		{"skips degraded", []int64{80, 40, 20}, 5, -1, false, func(pool []*simAccount) { pool[2].account.HealthStatus = HealthDegraded }, 1},
+		{"skips draining accounts", []int64{80, 40, 20}, 5, -1, false, func(pool []*simAccount) { pool[2].drain = true }, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := simPool(tt.usages...)
+			if tt.setup != nil {
+				tt.setup(pool)
+			}
+			var total, limit int64
+			for _, a := range pool {
+				total += a.usage
+				limit += a.account.Limit
+			}
+			file := &StoredFile{AccountId: pool[0].account.Id, Size: tt.fileSize * UploadBuffer}
+			if tt.siblingOf >= 0 {
+				file.Siblings = []primitive.ObjectID{pool[tt.siblingOf].account.Id}
+			}
+			target := pickRebalanceTarget(pool, file, float64(total)/float64(limit), tt.draining)
+			if tt.expected < 0 {
+				if target != nil {
+					t.Fatalf("picked %s", target.account.Id.Hex())
+				}
+				return
+			}
+			if target != pool[tt.expected] {
+				t.Fatalf("picked %v, expected account %d", target, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,480 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/api/iam/v1"
+	"log"
+	"strings"
+	"time"
+)
+
+// Actions a reconciliation takes on an account.
+const (
+	ReconcileNone          = "none"
+	ReconcileCreateAccount = "create_account"
+	ReconcileCreateKey     = "create_key"
+	ReconcileDisable       = "disable"
+)
+
+// Status of a stored reconciliation plan.
+const (
+	ReconcilePlanned  = "planned"
+	ReconcileApplying = "applying"
+	ReconcileApplied  = "applied"
+	ReconcileFailed   = "failed"
+)
+
+var (
+	ErrReconcilePlanNotFound = errors.New("ReconcilePlanNotFound")
+	ErrReconcilePlanExpired  = errors.New("ReconcilePlanExpired")
+	ErrReconcilePlanApplied  = errors.New("ReconcilePlanApplied")
+)
+
+// reconcilePlanTTL is how long a reviewed plan may wait to be applied before IAM has likely moved on.
+var reconcilePlanTTL = durationFromEnv("RECONCILE_PLAN_TTL", time.Hour)
+
+type ReconcileItem struct {
+	Email       string              `json:"email" bson:"email"`
+	DisplayName string              `json:"-" bson:"displayName,omitempty"`
+	AccountId   *primitive.ObjectID `json:"accountId,omitempty" bson:"accountId,omitempty"`
+	Action      string              `json:"action" bson:"action"`
+	Reason      string              `json:"reason" bson:"reason"`
+}
+
+func (i *ReconcileItem) serviceAccount() *iam.ServiceAccount {
+	return &iam.ServiceAccount{Email: i.Email, DisplayName: i.DisplayName}
+}
+
+// ReconcileReport compares the service accounts of the GCP project with its drive_account records.
+// It is stored as the plan a reconciliation applies.
+type ReconcileReport struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	Owner     primitive.ObjectID `json:"owner" bson:"owner"`
+	ProjectId primitive.ObjectID `json:"projectId" bson:"projectId"`
+	Status    string             `json:"status" bson:"status"`
+	Remote    int                `json:"remote" bson:"remote"`
+	Local     int                `json:"local" bson:"local"`
+	InSync    int                `json:"inSync" bson:"inSync"`
+	// remote accounts without a drive_account
+	Missing []*ReconcileItem `json:"missing" bson:"missing"`
+	// drive_accounts whose service account is gone
+	Orphaned []*ReconcileItem `json:"orphaned" bson:"orphaned"`
+	// service accounts disabled in IAM
+	Disabled []*ReconcileItem `json:"disabled" bson:"disabled"`
+	// drive_accounts whose key was deleted, disabled or expired in IAM
+	InvalidKey []*ReconcileItem `json:"invalidKey" bson:"invalidKey"`
+	CreatedAt  time.Time        `json:"createdAt" bson:"createdAt"`
+	AppliedAt  *time.Time       `json:"appliedAt,omitempty" bson:"appliedAt,omitempty"`
+	// job applying the plan, which may resume it after a failed attempt
+	JobId *primitive.ObjectID `json:"jobId,omitempty" bson:"jobId,omitempty"`
+	// changes already made, by email, skipped when the plan is resumed
+	Applied []string `json:"applied,omitempty" bson:"applied,omitempty"`
+	// changes that failed in the last run
+	Failures []*ReconcileFailure `json:"failures,omitempty" bson:"failures,omitempty"`
+	// set by each run, so a run that was taken over does not record its outcome
+	applyToken primitive.ObjectID
+}
+
+type ReconcileFailure struct {
+	Email  string `json:"email" bson:"email"`
+	Action string `json:"action" bson:"action"`
+	Error  string `json:"error" bson:"error"`
+}
+
+// Changes returns the items the reconciliation would act on.
+func (r *ReconcileReport) Changes() []*ReconcileItem {
+	changes := make([]*ReconcileItem, 0)
+	for _, group := range [][]*ReconcileItem{r.Missing, r.InvalidKey, r.Disabled, r.Orphaned} {
+		for _, item := range group {
+			if item.Action != ReconcileNone {
+				changes = append(changes, item)
+			}
+		}
+	}
+	return changes
+}
+
+// pendingChanges returns the changes not made by an earlier run of the plan.
+func (r *ReconcileReport) pendingChanges() []*ReconcileItem {
+	applied := make(map[string]bool)
+	for _, email := range r.Applied {
+		applied[email] = true
+	}
+	pending := make([]*ReconcileItem, 0)
+	for _, item := range r.Changes() {
+		if !applied[item.Email] {
+			pending = append(pending, item)
+		}
+	}
+	return pending
+}
+
+// finishedStatus is the status a run leaves the plan in. A run that stopped early leaves it to be
+// resumed, one with failed changes marks it failed so it is planned again against IAM.
+func finishedStatus(err error, failures []*ReconcileFailure) string {
+	switch {
+	case err != nil:
+		return ReconcilePlanned
+	case len(failures) > 0:
+		return ReconcileFailed
+	default:
+		return ReconcileApplied
+	}
+}
+
+// PlanReconcile queues a job listing what a reconciliation would change without changing
+// anything. The plan is stored under the returned id once the job is done.
+func (s *ProjectService) PlanReconcile(owner primitive.ObjectID, projectId string) (*entity.Job, primitive.ObjectID, error) {
+	planId := primitive.NewObjectID()
+	job, err := s.EnqueueProjectJob(owner, projectId, JobPlanReconcile, map[string]string{
+		"planId": planId.Hex(),
+	})
+	return job, planId, err
+}
+
+// ApplyReconcile queues the job applying a stored plan, exactly as it was reviewed.
+func (s *ProjectService) ApplyReconcile(owner primitive.ObjectID, projectId string, planId string) (*entity.Job, error) {
+	plan, err := s.FindReconcilePlan(owner, projectId, planId)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPlanApplicable(plan); err != nil {
+		return nil, err
+	}
+	return s.EnqueueProjectJob(owner, projectId, JobReconcileProject, map[string]string{
+		"planId": planId,
+	})
+}
+
+func (s *ProjectService) FindReconcilePlan(owner primitive.ObjectID, projectId string, planId string) (*ReconcileReport, error) {
+	id, err := primitive.ObjectIDFromHex(planId)
+	if err != nil {
+		return nil, ErrReconcilePlanNotFound
+	}
+	projectIdHex, err := primitive.ObjectIDFromHex(projectId)
+	if err != nil {
+		return nil, ErrReconcilePlanNotFound
+	}
+	var plan ReconcileReport
+	if err := dao.ReconcilePlan().FindOne(context.Background(), bson.D{
+		{"_id", id},
+		{"owner", owner},
+		{"projectId", projectIdHex},
+	}).Decode(&plan); err == mongo.ErrNoDocuments {
+		return nil, ErrReconcilePlanNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+func checkPlanApplicable(plan *ReconcileReport) error {
+	if plan.Status != ReconcilePlanned {
+		return ErrReconcilePlanApplied
+	}
+	if time.Since(plan.CreatedAt) > reconcilePlanTTL {
+		return ErrReconcilePlanExpired
+	}
+	return nil
+}
+
+// savePlan computes the plan of the project and stores it under planId.
+func (s *ProjectService) savePlan(projectId string, planId string) (*ReconcileReport, *helper.IamService, error) {
+	proj, err := s.GetProject(projectId)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := primitive.ObjectIDFromHex(planId)
+	if err != nil {
+		return nil, nil, ErrReconcilePlanNotFound
+	}
+	report, is, err := s.planReconcile(proj)
+	if err != nil {
+		return nil, nil, err
+	}
+	report.Id = id
+	report.Owner = proj.Owner
+	report.Status = ReconcilePlanned
+	report.CreatedAt = time.Now()
+	if _, err := dao.ReconcilePlan().InsertOne(context.Background(), report); err != nil {
+		log.Println("Fail to save reconcile plan of project", projectId, "by error", err.Error())
+		return nil, nil, err
+	}
+	log.Println("Planned reconciliation", planId, "of project", projectId+":", len(report.Changes()), "changes")
+	return report, is, nil
+}
+
+func (s *ProjectService) planReconcile(proj *entity.Project) (*ReconcileReport, *helper.IamService, error) {
+	projectId := proj.Id.Hex()
+	is, err := s.GetIamService(proj)
+	if err != nil {
+		log.Println("Fail to get iam service for proj", projectId, "by error", err.Error())
+		return nil, nil, err
+	}
+	remoteAccounts, err := is.ListServiceAccounts(proj.ProjectId)
+	if err != nil {
+		log.Println("Fail to get service accounts for proj", projectId, "by error", err.Error())
+		return nil, nil, err
+	}
+	localAccounts := make([]*entity.DriveAccount, 0)
+	cursor, err := dao.DriveAccount().Find(context.Background(), bson.D{
+		{"projectId", proj.Id},
+		{"type", "service_account"},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cursor.All(context.Background(), &localAccounts); err != nil {
+		return nil, nil, err
+	}
+	local := make(map[string]*entity.DriveAccount)
+	for _, acc := range localAccounts {
+		local[strings.ToLower(acc.ClientEmail)] = acc
+	}
+
+	report := &ReconcileReport{
+		ProjectId:  proj.Id,
+		Local:      len(localAccounts),
+		Missing:    make([]*ReconcileItem, 0),
+		Orphaned:   make([]*ReconcileItem, 0),
+		Disabled:   make([]*ReconcileItem, 0),
+		InvalidKey: make([]*ReconcileItem, 0),
+	}
+	for _, sa := range remoteAccounts {
+		if sa.UniqueId == is.KeyDetails.ClientId {
+			continue
+		}
+		report.Remote++
+		email := strings.ToLower(sa.Email)
+		acc := local[email]
+		delete(local, email)
+		item := &ReconcileItem{Email: sa.Email, DisplayName: sa.DisplayName}
+		if acc != nil {
+			item.AccountId = &acc.Id
+		}
+		switch {
+		case sa.Disabled:
+			item.Action = ReconcileNone
+			item.Reason = "service account is disabled in IAM"
+			if acc != nil && !acc.Disabled {
+				item.Action = ReconcileDisable
+			}
+			report.Disabled = append(report.Disabled, item)
+		case acc == nil:
+			item.Action = ReconcileCreateAccount
+			item.Reason = "no drive account for service account"
+			report.Missing = append(report.Missing, item)
+		default:
+			valid, reason, err := hasValidKey(is, acc)
+			if err != nil {
+				log.Println("Fail to list keys of", sa.Email, "by error", err.Error())
+				return nil, nil, err
+			}
+			if valid {
+				report.InSync++
+				continue
+			}
+			item.Action = ReconcileCreateKey
+			item.Reason = reason
+			report.InvalidKey = append(report.InvalidKey, item)
+		}
+	}
+	for _, acc := range local {
+		id := acc.Id
+		item := &ReconcileItem{
+			Email:     acc.ClientEmail,
+			AccountId: &id,
+			Action:    ReconcileNone,
+			Reason:    "service account no longer exists",
+		}
+		if !acc.Disabled {
+			item.Action = ReconcileDisable
+		}
+		report.Orphaned = append(report.Orphaned, item)
+	}
+	return report, is, nil
+}
+
+// hasValidKey tells whether the key stored on the account is still an enabled, unexpired key in IAM.
+func hasValidKey(is *helper.IamService, acc *entity.DriveAccount) (bool, string, error) {
+	keyId, err := storedKeyId(acc)
+	if err != nil || keyId == "" {
+		return false, "stored key is unreadable", nil
+	}
+	keys, err := is.ListServiceAccountKeys(acc.ClientEmail)
+	if err != nil {
+		return false, "", err
+	}
+	for _, key := range keys {
+		if !strings.HasSuffix(key.Name, "/keys/"+keyId) {
+			continue
+		}
+		if key.ValidBeforeTime != "" {
+			if expiry, err := time.Parse(time.RFC3339, key.ValidBeforeTime); err == nil && expiry.Before(time.Now()) {
+				return false, "stored key expired at " + key.ValidBeforeTime, nil
+			}
+		}
+		return true, "", nil
+	}
+	return false, "stored key no longer exists in IAM", nil
+}
+
+// ReconcileProject brings drive_account in line with IAM without touching anything that is in sync:
+// accounts are added for new service accounts, keys are only created where the stored one is no
+// longer valid, and accounts of deleted or disabled service accounts are disabled, never removed.
+// With a planId the stored plan is applied as reviewed, otherwise a plan is made and applied at once.
+// A retried attempt of the same job resumes the plan, skipping the changes already made.
+func (s *ProjectService) ReconcileProject(projectId string, planId string, jobId primitive.ObjectID, progress Progress) (err error) {
+	proj, err := s.GetProject(projectId)
+	if err != nil {
+		return err
+	}
+	var report *ReconcileReport
+	var is *helper.IamService
+	if planId == "" {
+		if report, is, err = s.savePlan(projectId, primitive.NewObjectID().Hex()); err != nil {
+			return err
+		}
+	} else if is, err = s.GetIamService(proj); err != nil {
+		return err
+	}
+	if report, err = s.startApplying(proj, report, planId, jobId); err != nil {
+		return err
+	}
+	failures := make([]*ReconcileFailure, 0)
+	defer func() {
+		s.finishApplying(report, err, failures)
+	}()
+	changes := report.pendingChanges()
+	progress.SetTotal(len(changes))
+	log.Println("Reconciling project", projectId+":", report.InSync, "in sync,", len(report.Applied), "already changed,", len(changes), "to change")
+	for _, item := range changes {
+		if progress.Cancelled() {
+			return ErrJobCancelled
+		}
+		if err := s.applyReconcileItem(is, proj, item); err != nil {
+			log.Println("Fail to", item.Action, "for", item.Email, "by error", err.Error())
+			failures = append(failures, &ReconcileFailure{Email: item.Email, Action: item.Action, Error: err.Error()})
+			progress.ItemFailed(item.Email, err)
+			continue
+		}
+		s.markItemApplied(report, item)
+		progress.ItemDone(item.Email)
+	}
+	return nil
+}
+
+// startApplying marks the plan as being applied, so it runs once even if queued twice. The job
+// that owns a plan being applied may take it again, which is how a retried attempt resumes it.
+func (s *ProjectService) startApplying(proj *entity.Project, report *ReconcileReport, planId string, jobId primitive.ObjectID) (*ReconcileReport, error) {
+	id := primitive.NilObjectID
+	if report != nil {
+		id = report.Id
+	} else if parsed, err := primitive.ObjectIDFromHex(planId); err == nil {
+		id = parsed
+	}
+	token := primitive.NewObjectID()
+	var plan ReconcileReport
+	if err := dao.ReconcilePlan().FindOneAndUpdate(context.Background(), bson.D{
+		{"_id", id},
+		{"projectId", proj.Id},
+		{"$or", bson.A{
+			bson.D{
+				{"status", ReconcilePlanned},
+				{"createdAt", bson.D{{"$gte", time.Now().Add(-reconcilePlanTTL)}}},
+			},
+			bson.D{
+				{"status", ReconcileApplying},
+				{"jobId", jobId},
+			},
+		}},
+	}, bson.D{
+		{"$set", bson.D{{"status", ReconcileApplying}, {"jobId", jobId}, {"applyToken", token}}},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&plan); err == mongo.ErrNoDocuments {
+		var stored ReconcileReport
+		if err := dao.ReconcilePlan().FindOne(context.Background(), bson.D{{"_id", id}}).Decode(&stored); err != nil {
+			return nil, ErrReconcilePlanNotFound
+		}
+		return nil, checkPlanApplicable(&stored)
+	} else if err != nil {
+		return nil, err
+	}
+	plan.applyToken = token
+	return &plan, nil
+}
+
+func (s *ProjectService) markItemApplied(plan *ReconcileReport, item *ReconcileItem) {
+	if _, err := dao.ReconcilePlan().UpdateOne(context.Background(), bson.D{{"_id", plan.Id}}, bson.D{
+		{"$addToSet", bson.D{{"applied", item.Email}}},
+	}); err != nil {
+		log.Println("Fail to record", item.Action, "of", item.Email, "on reconcile plan", plan.Id.Hex(), "by error", err.Error())
+	}
+}
+
+// finishApplying records the outcome of the run, unless another run took the plan over meanwhile.
+func (s *ProjectService) finishApplying(plan *ReconcileReport, err error, failures []*ReconcileFailure) {
+	status := finishedStatus(err, failures)
+	set := bson.D{{"status", status}, {"failures", failures}}
+	if status == ReconcileApplied {
+		set = append(set, bson.E{Key: "appliedAt", Value: time.Now()})
+	}
+	update := bson.D{{"$set", set}}
+	if status == ReconcilePlanned {
+		update = append(update, bson.E{Key: "$unset", Value: bson.D{{"jobId", ""}}})
+	}
+	res, updateErr := dao.ReconcilePlan().UpdateOne(context.Background(), bson.D{
+		{"_id", plan.Id},
+		{"status", ReconcileApplying},
+		{"applyToken", plan.applyToken},
+	}, update)
+	if updateErr != nil {
+		log.Println("Fail to mark reconcile plan", plan.Id.Hex(), status, "by error", updateErr.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		log.Println("Reconcile plan", plan.Id.Hex(), "was taken over by another run, leaving its status")
+		return
+	}
+	log.Println("Reconcile plan", plan.Id.Hex(), status+":", len(failures), "failed")
+}
+
+func (s *ProjectService) applyReconcileItem(is *helper.IamService, proj *entity.Project, item *ReconcileItem) error {
+	switch item.Action {
+	case ReconcileCreateAccount:
+		key, err := is.CreateServiceAccountKey(item.serviceAccount())
+		if err != nil {
+			return err
+		}
+		acc, err := s.InsertDriveAccount(proj, item.serviceAccount(), key)
+		if err != nil {
+			return err
+		}
+		if err := accountService.ReindexAccountFiles(*acc); err != nil {
+			log.Println("Fail to index account's files by error", err.Error())
+		}
+	case ReconcileCreateKey:
+		key, err := is.CreateServiceAccountKey(item.serviceAccount())
+		if err != nil {
+			return err
+		}
+		if err := accountService.UpdateKey(item.AccountId.Hex(), key); err != nil {
+			return err
+		}
+	case ReconcileDisable:
+		if _, err := dao.DriveAccount().UpdateOne(context.Background(), bson.D{{"_id", *item.AccountId}}, bson.D{
+			{"$set", bson.D{{"disabled", true}}},
+		}); err != nil {
+			return err
+		}
+	}
+	log.Println("Reconciled", item.Email+":", item.Action)
+	return nil
+}
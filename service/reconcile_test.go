@@ -0,0 +1,59 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPendingChanges(t *testing.T) {
+	plan := &ReconcileReport{
+		Missing:    []*ReconcileItem{{Email: "new@x", Action: ReconcileCreateAccount}},
+		InvalidKey: []*ReconcileItem{{Email: "key@x", Action: ReconcileCreateKey}},
+		Disabled:   []*ReconcileItem{{Email: "off@x", Action: ReconcileNone}},
+		Orphaned:   []*ReconcileItem{{Email: "gone@x", Action: ReconcileDisable}},
+	}
+	tests := []struct {
+		name     string
+		applied  []string
+		expected []string
+	}{
+		{"first run", nil, []string{"new@x", "key@x", "gone@x"}},
+		{"resumed run", []string{"new@x"}, []string{"key@x", "gone@x"}},
+		{"everything applied", []string{"new@x", "key@x", "gone@x"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan.Applied = tt.applied
+			emails := make([]string, 0)
+			for _, item := range plan.pendingChanges() {
+				emails = append(emails, item.Email)
+			}
+			if !reflect.DeepEqual(emails, tt.expected) {
+				t.Fatalf("pending %v, expected %v", emails, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFinishedStatus(t *testing.T) {
+	failed := []*ReconcileFailure{{Email: "key@x", Action: ReconcileCreateKey, Error: "denied"}}
+	tests := []struct {
+		name     string
+		err      error
+		failures []*ReconcileFailure
+		expected string
+	}{
+		{"every change made", nil, nil, ReconcileApplied},
+		{"some changes failed", nil, failed, ReconcileFailed},
+		{"cancelled", ErrJobCancelled, nil, ReconcilePlanned},
+		{"attempt failed", errors.New("iam unavailable"), failed, ReconcilePlanned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := finishedStatus(tt.err, tt.failures); status != tt.expected {
+				t.Fatalf("status %q, expected %q", status, tt.expected)
+			}
+		})
+	}
+}
@@ -32,8 +32,63 @@ func GetRedisService() (*RedisService, error) {
 }
 
 func (s *RedisService) Save(key, value string) error {
-	err := s.rdb.Set(ctx, key, value, 30*time.Minute).Err()
-	return err
+	return s.SaveWithTTL(key, value, 30*time.Minute)
+}
+
+func (s *RedisService) SaveWithTTL(key, value string, ttl time.Duration) error {
+	return s.rdb.Set(ctx, key, value, ttl).Err()
+}
+
+// Incr increments the counter and sets its expiry when the key is created.
+func (s *RedisService) Incr(key string, ttl time.Duration) (int64, error) {
+	return s.IncrBy(key, 1, ttl)
+}
+
+// IncrBy adds n to the counter and sets its expiry when the key is created.
+func (s *RedisService) IncrBy(key string, n int64, ttl time.Duration) (int64, error) {
+	value, err := s.rdb.IncrBy(ctx, key, n).Result()
+	if err != nil {
+		return 0, err
+	}
+	if value == n {
+		if err := s.rdb.Expire(ctx, key, ttl).Err(); err != nil {
+			return value, err
+		}
+	}
+	return value, nil
+}
+
+// SetIfAbsent stores the value only when the key does not exist and tells whether it did.
+func (s *RedisService) SetIfAbsent(key, value string, ttl time.Duration) (bool, error) {
+	return s.rdb.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (s *RedisService) Delete(keys ...string) error {
+	return s.rdb.Del(ctx, keys...).Err()
+}
+
+func (s *RedisService) Expire(key string, ttl time.Duration) error {
+	return s.rdb.Expire(ctx, key, ttl).Err()
+}
+
+func (s *RedisService) AddToSet(key string, members ...string) error {
+	values := make([]interface{}, len(members))
+	for i, m := range members {
+		values[i] = m
+	}
+	return s.rdb.SAdd(ctx, key, values...).Err()
+}
+
+func (s *RedisService) RemoveFromSet(key string, members ...string) error {
+	values := make([]interface{}, len(members))
+	for i, m := range members {
+		values[i] = m
+	}
+	return s.rdb.SRem(ctx, key, values...).Err()
+}
+
+func (s *RedisService) SetMembers(key string) ([]string, error) {
+	return s.rdb.SMembers(ctx, key).Result()
 }
 
 
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	RefreshRunning   = "running"
+	RefreshCompleted = "completed"
+
+	RefreshTriggerSchedule = "schedule"
+	RefreshTriggerManual   = "manual"
+)
+
+// errors kept on a run, the counters still cover every failure
+const maxRefreshErrors = 100
+
+var ErrRefreshRunning = errors.New("RefreshRunning")
+
+// QuotaRefresher asks Drive for the quota of accounts whose cached values are older than MaxAge.
+// At most Concurrency calls run at once and a new one starts at most every Spacing, so a large
+// pool is refreshed gradually instead of in one burst.
+type QuotaRefresher struct {
+	Interval    time.Duration
+	MaxAge      time.Duration
+	Concurrency int
+	Spacing     time.Duration
+	BatchSize   int
+
+	mutex   sync.Mutex
+	running bool
+}
+
+var quotaRefresher *QuotaRefresher
+
+func GetQuotaRefresher() *QuotaRefresher {
+	if quotaRefresher == nil {
+		quotaRefresher = &QuotaRefresher{
+			Interval:    durationFromEnv("QUOTA_REFRESH_INTERVAL", 10*time.Minute),
+			MaxAge:      durationFromEnv("QUOTA_REFRESH_MAX_AGE", time.Hour),
+			Concurrency: intFromEnv("QUOTA_REFRESH_CONCURRENCY", 4),
+			Spacing:     durationFromEnv("QUOTA_REFRESH_SPACING", 250*time.Millisecond),
+			BatchSize:   intFromEnv("QUOTA_REFRESH_BATCH_SIZE", 500),
+		}
+		if quotaRefresher.Concurrency < 1 {
+			quotaRefresher.Concurrency = 1
+		}
+	}
+	return quotaRefresher
+}
+
+// Start refreshes stale accounts on Interval. A zero interval disables it.
+func (s *QuotaRefresher) Start() {
+	if s.Interval <= 0 {
+		log.Println("Quota refresh is disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			run, err := s.begin(RefreshTriggerSchedule)
+			if err == ErrRefreshRunning {
+				continue
+			}
+			if err != nil {
+				log.Println("Fail to start quota refresh by error", err.Error())
+				continue
+			}
+			s.execute(run)
+		}
+	}()
+}
+
+// Trigger starts a refresh run now and returns it while it runs in the background.
+func (s *QuotaRefresher) Trigger() (*entity.QuotaRefreshRun, error) {
+	run, err := s.begin(RefreshTriggerManual)
+	if err != nil {
+		return nil, err
+	}
+	go s.execute(run)
+	return run, nil
+}
+
+func (s *QuotaRefresher) begin(trigger string) (*entity.QuotaRefreshRun, error) {
+	s.mutex.Lock()
+	if s.running {
+		s.mutex.Unlock()
+		return nil, ErrRefreshRunning
+	}
+	s.running = true
+	s.mutex.Unlock()
+
+	run := &entity.QuotaRefreshRun{
+		Id:        primitive.NewObjectID(),
+		Trigger:   trigger,
+		Status:    RefreshRunning,
+		MaxAge:    s.MaxAge.String(),
+		StartedAt: time.Now(),
+	}
+	if _, err := dao.QuotaRefreshRun().InsertOne(context.Background(), run); err != nil {
+		s.done()
+		return nil, err
+	}
+	return run, nil
+}
+
+func (s *QuotaRefresher) done() {
+	s.mutex.Lock()
+	s.running = false
+	s.mutex.Unlock()
+}
+
+func (s *QuotaRefresher) staleAccounts() ([]*entity.DriveAccount, error) {
+	accounts := make([]*entity.DriveAccount, 0)
+	cursor, err := dao.DriveAccount().Find(context.Background(), bson.D{
+		storageTypeFilter(),
+		{"disabled", bson.D{{"$ne", true}}},
+		{"$or", bson.A{
+			bson.D{{"quotaUpdateTimestamp", bson.D{{"$lt", time.Now().Add(-s.MaxAge)}}}},
+			bson.D{{"quotaUpdateTimestamp", bson.D{{"$exists", false}}}},
+		}},
+	}, options.Find().
+		SetSort(bson.D{{"quotaUpdateTimestamp", 1}}).
+		SetLimit(int64(s.BatchSize)))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (s *QuotaRefresher) execute(run *entity.QuotaRefreshRun) {
+	defer s.done()
+	accounts, err := s.staleAccounts()
+	if err != nil {
+		log.Println("Fail to list stale accounts by error", err.Error())
+		run.Failed = 1
+		run.Errors = append(run.Errors, entity.QuotaRefreshError{Error: err.Error()})
+		s.finish(run)
+		return
+	}
+	run.Candidates = len(accounts)
+	s.save(run)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, s.Concurrency)
+	for i, acc := range accounts {
+		if i > 0 && s.Spacing > 0 {
+			time.Sleep(s.Spacing)
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(acc *entity.DriveAccount) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			err := GetAccountService().UpdateCachedQuota(acc)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				log.Println("Fail to refresh quota of account", acc.Id.Hex(), "by error", err.Error())
+				run.Failed++
+				if len(run.Errors) < maxRefreshErrors {
+					run.Errors = append(run.Errors, entity.QuotaRefreshError{AccountId: acc.Id, Error: err.Error()})
+				}
+				return
+			}
+			run.Refreshed++
+		}(acc)
+	}
+	wg.Wait()
+	s.finish(run)
+	log.Println("Quota refresh", run.Id.Hex(), "refreshed", run.Refreshed, "of", run.Candidates, "accounts,", run.Failed, "failed")
+}
+
+func (s *QuotaRefresher) finish(run *entity.QuotaRefreshRun) {
+	now := time.Now()
+	run.Status = RefreshCompleted
+	run.FinishedAt = &now
+	s.save(run)
+}
+
+func (s *QuotaRefresher) save(run *entity.QuotaRefreshRun) {
+	if _, err := dao.QuotaRefreshRun().ReplaceOne(context.Background(), bson.D{{"_id", run.Id}}, run); err != nil {
+		log.Println("Fail to save quota refresh run", run.Id.Hex(), "by error", err.Error())
+	}
+}
+
+func (s *QuotaRefresher) FindRuns(limit int64) ([]*entity.QuotaRefreshRun, error) {
+	runs := make([]*entity.QuotaRefreshRun, 0)
+	cursor, err := dao.QuotaRefreshRun().Find(context.Background(), bson.D{},
+		options.Find().SetSort(bson.D{{"startedAt", -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+func (s *QuotaRefresher) FindRun(id primitive.ObjectID) (*entity.QuotaRefreshRun, error) {
+	var run entity.QuotaRefreshRun
+	if err := dao.QuotaRefreshRun().FindOne(context.Background(), bson.D{{"_id", id}}).Decode(&run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
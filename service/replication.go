@@ -0,0 +1,586 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const MaxReplicas = 5
+
+var ErrInvalidReplicaCount = errors.New("InvalidReplicaCount")
+var ErrNoHealthyCopy = errors.New("NoHealthyCopy")
+
+var errCopyAccountDisabled = errors.New("copy is on a disabled account")
+
+// FileReplica is a copy of the file on another account. The primary copy stays in FileIndex.AccountId/FileId.
+type FileReplica struct {
+	AccountId primitive.ObjectID `json:"accountId" bson:"accountId"`
+	ProjectId primitive.ObjectID `json:"projectId" bson:"projectId"`
+	FileId    string             `json:"fileId" bson:"fileId"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// Copies lists the primary first, then the replicas, which is the order reads try them in.
+func (fi *FileIndex) Copies() []FileReplica {
+	copies := []FileReplica{{
+		AccountId: fi.AccountId,
+		ProjectId: fi.ProjectId,
+		FileId:    fi.FileId,
+		CreatedAt: fi.CreatedTime,
+	}}
+	return append(copies, fi.Replicas...)
+}
+
+type ReplicationStatus struct {
+	FileIndexId primitive.ObjectID `json:"fileIndexId"`
+	Target      int                `json:"target"`
+	Copies      []FileReplica      `json:"copies"`
+}
+
+type ReplicationService struct {
+	DefaultReplicas int
+	RepairInterval  time.Duration
+	mutex           sync.Mutex
+	running         bool
+}
+
+var replicationService *ReplicationService
+
+func GetReplicationService() *ReplicationService {
+	if replicationService == nil {
+		replicationService = &ReplicationService{
+			DefaultReplicas: 1,
+			RepairInterval:  durationFromEnv("REPLICATION_REPAIR_INTERVAL", time.Hour),
+		}
+	}
+	return replicationService
+}
+
+func (s *ReplicationService) FindPolicies(owner primitive.ObjectID) ([]*entity.ReplicationPolicy, error) {
+	policies := make([]*entity.ReplicationPolicy, 0)
+	if cursor, err := dao.ReplicationPolicy().Find(context.Background(), bson.D{{"owner", owner}}); err != nil {
+		return nil, err
+	} else if err := cursor.All(context.Background(), &policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// SetPolicy stores the replica count for the user (folderId nil) or for a folder.
+func (s *ReplicationService) SetPolicy(owner primitive.ObjectID, folderId *primitive.ObjectID, replicas int) (*entity.ReplicationPolicy, error) {
+	if replicas < 1 || replicas > MaxReplicas {
+		return nil, ErrInvalidReplicaCount
+	}
+	if folderId != nil {
+		if err := dao.Item().FindOne(context.Background(), bson.D{
+			{"_id", *folderId},
+			{"owner", owner},
+			{"type", "folder"},
+		}).Err(); err != nil {
+			return nil, err
+		}
+	}
+	var policy entity.ReplicationPolicy
+	if err := dao.ReplicationPolicy().FindOneAndUpdate(context.Background(), bson.D{
+		{"owner", owner},
+		{"folderId", folderId},
+	}, bson.D{
+		{"$set", bson.D{
+			{"replicas", replicas},
+			{"updatedAt", time.Now()},
+		}},
+		{"$setOnInsert", bson.D{
+			{"_id", primitive.NewObjectID()},
+		}},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (s *ReplicationService) DeletePolicy(owner primitive.ObjectID, folderId *primitive.ObjectID) error {
+	_, err := dao.ReplicationPolicy().DeleteOne(context.Background(), bson.D{
+		{"owner", owner},
+		{"folderId", folderId},
+	})
+	return err
+}
+
+type folderNode struct {
+	Id     primitive.ObjectID `bson:"_id"`
+	Parent primitive.ObjectID `bson:"parent"`
+}
+
+type fileItem struct {
+	Parent primitive.ObjectID `bson:"parent"`
+	File   struct {
+		Id primitive.ObjectID `bson:"_id"`
+	} `bson:"file"`
+}
+
+// targets resolves the replica count of every file of the owner placed in the browse tree.
+// A file without a folder policy above it gets the user default.
+func (s *ReplicationService) targets(owner primitive.ObjectID) (int, map[primitive.ObjectID]int, error) {
+	policies, err := s.FindPolicies(owner)
+	if err != nil {
+		return 0, nil, err
+	}
+	userTarget := s.DefaultReplicas
+	folderPolicy := make(map[primitive.ObjectID]int)
+	for _, p := range policies {
+		if p.FolderId == nil {
+			userTarget = p.Replicas
+		} else {
+			folderPolicy[*p.FolderId] = p.Replicas
+		}
+	}
+	fileTarget := make(map[primitive.ObjectID]int)
+	if len(folderPolicy) == 0 {
+		return userTarget, fileTarget, nil
+	}
+
+	var folders []folderNode
+	if cursor, err := dao.Item().Find(context.Background(), bson.D{
+		{"owner", owner},
+		{"type", "folder"},
+		{"deleted", bson.D{{"$ne", true}}},
+	}); err != nil {
+		return 0, nil, err
+	} else if err := cursor.All(context.Background(), &folders); err != nil {
+		return 0, nil, err
+	}
+	parents := make(map[primitive.ObjectID]primitive.ObjectID)
+	for _, f := range folders {
+		parents[f.Id] = f.Parent
+	}
+	folderTarget := func(id primitive.ObjectID) int {
+		// the nearest folder with a policy wins; the depth bound guards against cycles
+		for depth := 0; !id.IsZero() && depth < len(parents)+1; depth++ {
+			if replicas, ok := folderPolicy[id]; ok {
+				return replicas
+			}
+			id = parents[id]
+		}
+		return userTarget
+	}
+
+	var files []fileItem
+	if cursor, err := dao.Item().Find(context.Background(), bson.D{
+		{"owner", owner},
+		{"type", "file"},
+		{"deleted", bson.D{{"$ne", true}}},
+	}); err != nil {
+		return 0, nil, err
+	} else if err := cursor.All(context.Background(), &files); err != nil {
+		return 0, nil, err
+	}
+	for _, f := range files {
+		// a file placed in several folders keeps the highest count asked for
+		if t := folderTarget(f.Parent); t > fileTarget[f.File.Id] {
+			fileTarget[f.File.Id] = t
+		}
+	}
+	return userTarget, fileTarget, nil
+}
+
+func (s *ReplicationService) Target(fi *FileIndex) (int, error) {
+	userTarget, fileTarget, err := s.targets(fi.Owner)
+	if err != nil {
+		return 0, err
+	}
+	if t, ok := fileTarget[fi.Id]; ok {
+		return t, nil
+	}
+	return userTarget, nil
+}
+
+func (s *ReplicationService) Status(owner primitive.ObjectID, id primitive.ObjectID) (*ReplicationStatus, error) {
+	fi, err := GetContentService().FindFileIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Owner != owner {
+		return nil, mongo.ErrNoDocuments
+	}
+	target, err := s.Target(fi)
+	if err != nil {
+		return nil, err
+	}
+	status := &ReplicationStatus{
+		FileIndexId: fi.Id,
+		Target:      target,
+		Copies:      make([]FileReplica, 0),
+	}
+	if fi.Storage == "" {
+		status.Copies = fi.Copies()
+	}
+	return status, nil
+}
+
+// Start runs the repair of every user on RepairInterval. A zero interval disables it.
+func (s *ReplicationService) Start() {
+	if s.RepairInterval <= 0 {
+		log.Println("Replication repair is disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.RepairInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.RepairAll()
+		}
+	}()
+}
+
+func (s *ReplicationService) RepairAll() {
+	owners, err := dao.ReplicationPolicy().Distinct(context.Background(), "owner", bson.D{
+		{"replicas", bson.D{{"$gt", 1}}},
+	})
+	if err != nil {
+		log.Println("Fail to list replication owners by error", err.Error())
+		return
+	}
+	for _, o := range owners {
+		if owner, ok := o.(primitive.ObjectID); ok {
+			if err := s.RepairOwner(owner); err != nil {
+				log.Println("Fail to repair replicas of user", owner.Hex(), "by error", err.Error())
+			}
+		}
+	}
+}
+
+// RepairOwner brings every file of the user back to its replica target. Only one repair runs at a time.
+func (s *ReplicationService) RepairOwner(owner primitive.ObjectID) error {
+	s.mutex.Lock()
+	if s.running {
+		s.mutex.Unlock()
+		log.Println("Replication repair already running, skip user", owner.Hex())
+		return nil
+	}
+	s.running = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.running = false
+		s.mutex.Unlock()
+	}()
+
+	userTarget, fileTarget, err := s.targets(owner)
+	if err != nil {
+		return err
+	}
+	cursor, err := dao.FileIndex().Find(context.Background(), bson.D{
+		{"owner", owner},
+		{"storage", bson.D{{"$in", bson.A{nil, ""}}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+	repaired, failed := 0, 0
+	for cursor.Next(context.Background()) {
+		var fi FileIndex
+		if err := cursor.Decode(&fi); err != nil {
+			return err
+		}
+		target, ok := fileTarget[fi.Id]
+		if !ok {
+			target = userTarget
+		}
+		if target <= 1 && len(fi.Replicas) == 0 {
+			continue
+		}
+		if changed, err := s.Repair(&fi, target); err != nil {
+			log.Println("Fail to repair replicas of file", fi.Id.Hex(), "by error", err.Error())
+			failed++
+		} else if changed {
+			repaired++
+		}
+	}
+	log.Println("Replication repair of user", owner.Hex(), "repaired", repaired, "files,", failed, "failed")
+	return cursor.Err()
+}
+
+func (s *ReplicationService) RepairFile(owner primitive.ObjectID, id primitive.ObjectID) (*ReplicationStatus, error) {
+	fi, err := GetContentService().FindFileIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Owner != owner {
+		return nil, mongo.ErrNoDocuments
+	}
+	if fi.Storage == "" {
+		target, err := s.Target(fi)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.Repair(fi, target); err != nil {
+			return nil, err
+		}
+	}
+	return s.Status(owner, id)
+}
+
+// Repair checks every copy, drops the ones gone from Drive, promotes a replica when the primary
+// is lost, then copies or trims until the file has target copies. It reports whether anything changed.
+func (s *ReplicationService) Repair(fi *FileIndex, target int) (bool, error) {
+	healthy := make([]FileReplica, 0)
+	// copies on disabled accounts are kept but do not count, they come back with the account
+	parked := make([]FileReplica, 0)
+	lost := 0
+	primaryParked := false
+	for i, c := range fi.Copies() {
+		ok, err := s.verifyCopy(c)
+		if err == errCopyAccountDisabled {
+			parked = append(parked, c)
+			primaryParked = primaryParked || i == 0
+			continue
+		}
+		if err != nil {
+			// unknown state, keep it and retry on the next run
+			log.Println("Fail to verify copy", c.FileId, "of file", fi.Id.Hex(), "by error", err.Error())
+			healthy = append(healthy, c)
+			continue
+		}
+		if ok {
+			healthy = append(healthy, c)
+		} else {
+			log.Println("Copy", c.FileId, "on account", c.AccountId.Hex(), "of file", fi.Id.Hex(), "is lost")
+			lost++
+		}
+	}
+	if len(healthy) == 0 {
+		return false, ErrNoHealthyCopy
+	}
+	// a copy that can be served becomes the primary
+	changed := lost > 0 || primaryParked
+	for len(healthy) > target {
+		extra := healthy[len(healthy)-1]
+		if err := GetAccountService().deletePart(extra.AccountId, extra.FileId); err != nil {
+			return changed, err
+		}
+		if err := GetAccountService().UpdateCachedQuotaByAccountId(extra.AccountId.Hex()); err != nil {
+			log.Println("Fail to update quota of account", extra.AccountId.Hex(), "by error", err.Error())
+		}
+		healthy = healthy[:len(healthy)-1]
+		changed = true
+	}
+	if changed {
+		if err := saveCopies(fi, append(append([]FileReplica{}, healthy...), parked...)); err != nil {
+			return changed, err
+		}
+	}
+	for len(healthy) < target {
+		replica, err := s.addReplica(fi, healthy)
+		if err != nil {
+			return changed, err
+		}
+		healthy = append(healthy, *replica)
+		changed = true
+	}
+	return changed, nil
+}
+
+// verifyCopy returns false only when the copy is known to be gone. A copy on a disabled
+// account cannot be checked and is reported with errCopyAccountDisabled.
+func (s *ReplicationService) verifyCopy(c FileReplica) (bool, error) {
+	acc, err := GetAccountService().FindAccount(c.AccountId.Hex())
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if acc.Disabled {
+		return false, errCopyAccountDisabled
+	}
+	backend, err := GetAccountService().GetDriveBackend(acc)
+	if err != nil {
+		return false, err
+	}
+	file, err := backend.GetFile(c.FileId)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !file.Trashed, nil
+}
+
+// saveCopies writes copies back, the first becoming the primary.
+func saveCopies(fi *FileIndex, copies []FileReplica) error {
+	primary := copies[0]
+	replicas := copies[1:]
+	if _, err := dao.FileIndex().UpdateOne(context.Background(), bson.D{{"_id", fi.Id}}, bson.D{
+		{"$set", bson.D{
+			{"accountId", primary.AccountId},
+			{"projectId", primary.ProjectId},
+			{"fileId", primary.FileId},
+			{"replicas", replicas},
+		}},
+	}); err != nil {
+		return err
+	}
+	if primary.FileId != fi.FileId {
+		log.Println("Promoted copy", primary.FileId, "on account", primary.AccountId.Hex(), "as primary of file", fi.Id.Hex())
+	}
+	fi.AccountId = primary.AccountId
+	fi.ProjectId = primary.ProjectId
+	fi.FileId = primary.FileId
+	fi.Replicas = replicas
+	return nil
+}
+
+// addReplica copies the file to the account with most free space, preferring projects
+// that hold no copy yet so one deleted project cannot take every copy. Degraded accounts come last.
+func (s *ReplicationService) addReplica(fi *FileIndex, existing []FileReplica) (*FileReplica, error) {
+	var accounts []entity.DriveAccount
+	if cursor, err := dao.DriveAccount().Find(context.Background(), bson.D{
+		{"owner", fi.Owner},
+		storageTypeFilter(),
+		{"disabled", bson.D{{"$ne", true}}},
+		{"readOnly", bson.D{{"$ne", true}}},
+		healthyFilter(),
+		closedCircuitFilter(),
+		{"available", bson.D{{"$gt", fi.Size + UploadBuffer}}},
+	}); err != nil {
+		return nil, err
+	} else if err := cursor.All(context.Background(), &accounts); err != nil {
+		return nil, err
+	}
+	usedAccounts := make(map[primitive.ObjectID]bool)
+	usedProjects := make(map[primitive.ObjectID]bool)
+	for _, c := range existing {
+		usedAccounts[c.AccountId] = true
+		usedProjects[c.ProjectId] = true
+	}
+	candidates := make([]entity.DriveAccount, 0)
+	for _, acc := range accounts {
+		if !usedAccounts[acc.Id] && acc.Limit-acc.Usage > fi.Size {
+			candidates = append(candidates, acc)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoSuitableAccount
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if healthRank(&candidates[i]) != healthRank(&candidates[j]) {
+			return healthRank(&candidates[i]) < healthRank(&candidates[j])
+		}
+		if usedProjects[candidates[i].ProjectId] != usedProjects[candidates[j].ProjectId] {
+			return !usedProjects[candidates[i].ProjectId]
+		}
+		return candidates[i].Available > candidates[j].Available
+	})
+	target := candidates[0]
+
+	res, err := openCopies(fi, routeCopies(existing), "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	backend, err := GetAccountService().GetDriveBackend(&target)
+	if err != nil {
+		return nil, err
+	}
+	file, err := backend.UploadFileFromStream(fi.Name, "replica of "+fi.Id.Hex(), fi.MimeType, res.Body)
+	if err != nil {
+		log.Println("Fail to copy file", fi.Id.Hex(), "to account", target.Id.Hex(), "by error", err.Error())
+		return nil, err
+	}
+	if file.Size != fi.Size {
+		backend.DeleteFile(file.Id)
+		return nil, fmt.Errorf("replica of file %s has size %d, expected %d", fi.Id.Hex(), file.Size, fi.Size)
+	}
+	replica := FileReplica{
+		AccountId: target.Id,
+		ProjectId: target.ProjectId,
+		FileId:    file.Id,
+		CreatedAt: time.Now(),
+	}
+	if _, err := dao.FileIndex().UpdateOne(context.Background(), bson.D{{"_id", fi.Id}}, bson.D{
+		{"$push", bson.D{{"replicas", replica}}},
+	}); err != nil {
+		backend.DeleteFile(file.Id)
+		return nil, err
+	}
+	fi.Replicas = append(fi.Replicas, replica)
+	if err := GetAccountService().UpdateCachedQuotaByAccountIdAndAdditionalSize(target.Id.Hex(), file.Size); err != nil {
+		log.Println("Fail to update quota after replication by error", err.Error())
+	}
+	log.Println("Replicated file", fi.Id.Hex(), "to account", target.Id.Hex(), "as", file.Id)
+	return &replica, nil
+}
+
+// isReplicaFile tells whether the Drive file is a replica tracked by another file index,
+// so account indexing does not list it as a file of its own.
+func isReplicaFile(accountId primitive.ObjectID, fileId string) (bool, error) {
+	count, err := dao.FileIndex().CountDocuments(context.Background(), bson.D{
+		{"replicas", bson.D{{"$elemMatch", bson.D{
+			{"accountId", accountId},
+			{"fileId", fileId},
+		}}}},
+	})
+	return count > 0, err
+}
+
+// replicaFileIds lists the Drive files of the account tracked as replicas, read once for a
+// whole account listing instead of once per file.
+func replicaFileIds(accountId primitive.ObjectID) (map[string]bool, error) {
+	cursor, err := dao.FileIndex().Find(context.Background(), bson.D{
+		{"replicas.accountId", accountId},
+	}, options.Find().SetProjection(bson.D{{"replicas", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var entries []FileIndex
+	if err := cursor.All(context.Background(), &entries); err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool)
+	for _, fi := range entries {
+		for _, r := range fi.Replicas {
+			if r.AccountId == accountId {
+				ids[r.FileId] = true
+			}
+		}
+	}
+	return ids, nil
+}
+
+func removeReplica(accountId primitive.ObjectID, fileId string) error {
+	_, err := dao.FileIndex().UpdateMany(context.Background(), bson.D{
+		{"replicas.fileId", fileId},
+	}, bson.D{
+		{"$pull", bson.D{{"replicas", bson.D{
+			{"accountId", accountId},
+			{"fileId", fileId},
+		}}}},
+	})
+	return err
+}
+
+// replicateNewFile brings a freshly uploaded file to its replica target right away
+// instead of waiting for the next repair run.
+func replicateNewFile(fi *FileIndex) {
+	rs := GetReplicationService()
+	target, err := rs.Target(fi)
+	if err != nil || target <= 1 {
+		return
+	}
+	if _, err := rs.Repair(fi, target); err != nil {
+		log.Println("Fail to replicate new file", fi.Id.Hex(), "by error", err.Error())
+	}
+}
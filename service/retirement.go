@@ -0,0 +1,278 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/api/googleapi"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	RetirementRunning   = "running"
+	RetirementFailed    = "failed"
+	RetirementCompleted = "completed"
+
+	StepPending = "pending"
+	StepRunning = "running"
+	StepDone    = "done"
+	StepFailed  = "failed"
+)
+
+// Retirement steps, in order.
+const (
+	StepMarkReadOnly         = "mark_read_only"
+	StepReindex              = "reindex"
+	StepMigrateFiles         = "migrate_files"
+	StepVerifyEmpty          = "verify_empty"
+	StepDeleteKeys           = "delete_keys"
+	StepDeleteServiceAccount = "delete_service_account"
+	StepRemoveAccount        = "remove_account"
+)
+
+var retirementSteps = []string{
+	StepMarkReadOnly,
+	StepReindex,
+	StepMigrateFiles,
+	StepVerifyEmpty,
+	StepDeleteKeys,
+	StepDeleteServiceAccount,
+	StepRemoveAccount,
+}
+
+var (
+	ErrRetirementRunning = errors.New("RetirementRunning")
+	ErrCannotRetire      = errors.New("CannotRetire")
+)
+
+type RetirementService struct {
+	mutex   sync.Mutex
+	running map[primitive.ObjectID]bool
+}
+
+var retirementService *RetirementService
+
+func GetRetirementService() *RetirementService {
+	if retirementService == nil {
+		retirementService = &RetirementService{
+			running: make(map[primitive.ObjectID]bool),
+		}
+	}
+	return retirementService
+}
+
+func (s *RetirementService) FindRetirement(owner primitive.ObjectID, accountId primitive.ObjectID) (*entity.AccountRetirement, error) {
+	var r entity.AccountRetirement
+	if err := dao.AccountRetirement().FindOne(context.Background(), bson.D{
+		{"accountId", accountId},
+		{"owner", owner},
+	}).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Retire starts the retirement of the account, or resumes it from the first step not done,
+// and runs the steps in the background.
+func (s *RetirementService) Retire(owner primitive.ObjectID, accountId primitive.ObjectID) (*entity.AccountRetirement, error) {
+	r, err := s.FindRetirement(owner, accountId)
+	if err == mongo.ErrNoDocuments {
+		acc, err := GetAccountService().FindAccountById(accountId, owner)
+		if err != nil {
+			return nil, err
+		}
+		if !isStorageAccount(acc.Type) {
+			return nil, ErrCannotRetire
+		}
+		now := time.Now()
+		r = &entity.AccountRetirement{
+			Id:          primitive.NewObjectID(),
+			AccountId:   acc.Id,
+			Owner:       acc.Owner,
+			ProjectId:   acc.ProjectId,
+			ClientEmail: acc.ClientEmail,
+			Status:      RetirementRunning,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		for _, name := range retirementSteps {
+			r.Steps = append(r.Steps, entity.RetirementStep{Name: name, Status: StepPending})
+		}
+		if _, err := dao.AccountRetirement().InsertOne(context.Background(), r); err != nil {
+			return nil, err
+		}
+		log.Println("Retiring account", acc.Id.Hex(), acc.ClientEmail)
+	} else if err != nil {
+		return nil, err
+	} else if r.Status == RetirementCompleted {
+		return r, nil
+	}
+
+	s.mutex.Lock()
+	if s.running[accountId] {
+		s.mutex.Unlock()
+		return r, ErrRetirementRunning
+	}
+	s.running[accountId] = true
+	s.mutex.Unlock()
+
+	r.Status = RetirementRunning
+	s.save(r)
+	go func() {
+		defer func() {
+			s.mutex.Lock()
+			delete(s.running, accountId)
+			s.mutex.Unlock()
+		}()
+		s.run(r)
+	}()
+	return r, nil
+}
+
+func (s *RetirementService) run(r *entity.AccountRetirement) {
+	for i := range r.Steps {
+		step := &r.Steps[i]
+		if step.Status == StepDone {
+			continue
+		}
+		started := time.Now()
+		step.Status = StepRunning
+		step.StartedAt = &started
+		step.Attempts++
+		step.Error = ""
+		s.save(r)
+
+		detail, err := s.runStep(r, step.Name)
+		finished := time.Now()
+		step.FinishedAt = &finished
+		step.Detail = detail
+		if err != nil {
+			log.Println("Retirement of account", r.AccountId.Hex(), "failed at", step.Name, "by error", err.Error())
+			step.Status = StepFailed
+			step.Error = err.Error()
+			r.Status = RetirementFailed
+			s.save(r)
+			return
+		}
+		step.Status = StepDone
+		s.save(r)
+	}
+	r.Status = RetirementCompleted
+	s.save(r)
+	log.Println("Retired account", r.AccountId.Hex(), r.ClientEmail)
+}
+
+func (s *RetirementService) runStep(r *entity.AccountRetirement, name string) (string, error) {
+	as := GetAccountService()
+	switch name {
+	case StepMarkReadOnly:
+		_, err := dao.DriveAccount().UpdateOne(context.Background(), bson.D{{"_id", r.AccountId}}, bson.D{
+			{"$set", bson.D{{"readOnly", true}}},
+		})
+		return "", err
+
+	case StepReindex:
+		acc, err := as.FindAccount(r.AccountId.Hex())
+		if err != nil {
+			return "", err
+		}
+		// files uploaded outside the API must be known to be migrated
+		return "", as.ReindexAccountFiles(*acc)
+
+	case StepMigrateFiles:
+		run, err := GetRebalanceService().RebalanceAndWait(r.Owner, RebalanceOptions{
+			DrainAccountIds: []primitive.ObjectID{r.AccountId},
+		})
+		if err != nil {
+			return "", err
+		}
+		detail := fmt.Sprintf("rebalance %s moved %d of %d files", run.Id.Hex(), run.Done, len(run.Moves))
+		if run.Failed > 0 {
+			return detail, fmt.Errorf("%d files could not be migrated", run.Failed)
+		}
+		return detail, nil
+
+	case StepVerifyEmpty:
+		files, err := ListStoredFiles(r.AccountId)
+		if err != nil {
+			return "", err
+		}
+		if len(files) > 0 {
+			return "", fmt.Errorf("%d indexed files are still on the account", len(files))
+		}
+		acc, err := as.FindAccount(r.AccountId.Hex())
+		if err != nil {
+			return "", err
+		}
+		backend, err := as.GetDriveBackend(acc)
+		if err != nil {
+			return "", err
+		}
+		page, err := backend.ListFilePage(helper.ListOptions{Query: helper.QueryNotTrashed, PageSize: 10})
+		if err != nil {
+			return "", err
+		}
+		if len(page.Files) > 0 {
+			return "", fmt.Errorf("drive still holds files, first one %s (%s)", page.Files[0].Name, page.Files[0].Id)
+		}
+		return "", nil
+
+	case StepDeleteKeys, StepDeleteServiceAccount:
+		if acc, err := GetAccountService().FindAccount(r.AccountId.Hex()); err == nil && !isGoogleAccount(acc.Type) {
+			return "not a Google account", nil
+		}
+		is, err := s.iamService(r)
+		if err != nil {
+			return "", err
+		}
+		if name == StepDeleteKeys {
+			err = is.DeleteServiceAccountKeys(r.ClientEmail)
+		} else {
+			err = is.DeleteServiceAccount(r.ClientEmail)
+		}
+		if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+			return "already deleted", nil
+		}
+		return "", err
+
+	case StepRemoveAccount:
+		if _, err := dao.FileIndex().DeleteMany(context.Background(), bson.D{{"accountId", r.AccountId}}); err != nil {
+			return "", err
+		}
+		_, err := dao.DriveAccount().DeleteOne(context.Background(), bson.D{{"_id", r.AccountId}})
+		GetServiceCache().Invalidate(r.AccountId)
+		GetTokenBroker().Evict(r.ClientEmail)
+		return "", err
+	}
+	return "", fmt.Errorf("unknown retirement step %s", name)
+}
+
+func (s *RetirementService) iamService(r *entity.AccountRetirement) (*helper.IamService, error) {
+	project, err := GetProjectService().GetProject(r.ProjectId.Hex())
+	if err != nil {
+		log.Println("Fail to find project", r.ProjectId.Hex(), "of retired account by error", err.Error())
+		return nil, err
+	}
+	return GetProjectService().GetIamService(project)
+}
+
+func (s *RetirementService) save(r *entity.AccountRetirement) {
+	r.UpdatedAt = time.Now()
+	if _, err := dao.AccountRetirement().UpdateOne(context.Background(), bson.D{{"_id", r.Id}}, bson.D{
+		{"$set", bson.D{
+			{"status", r.Status},
+			{"steps", r.Steps},
+			{"updatedAt", r.UpdatedAt},
+		}},
+	}); err != nil {
+		log.Println("Fail to save retirement of account", r.AccountId.Hex(), "by error", err.Error())
+	}
+}
@@ -0,0 +1,331 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"github.com/ndphu/drive-manager-api/keyring"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/api/iam/v1"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	JobRotateAccountKey  = "account.rotateKey"
+	JobRotateProjectKeys = "project.rotateKeys"
+)
+
+var (
+	ErrCannotRotate = errors.New("CannotRotateKey")
+	ErrKeyChanged   = errors.New("KeyChangedDuringRotation")
+)
+
+// KeyRotationService replaces the key of service accounts. Keys older than MaxAge are rotated
+// by a project job every Interval.
+type KeyRotationService struct {
+	MaxAge   time.Duration
+	Interval time.Duration
+}
+
+var keyRotationService *KeyRotationService
+
+func GetKeyRotationService() *KeyRotationService {
+	if keyRotationService == nil {
+		keyRotationService = &KeyRotationService{
+			MaxAge:   durationFromEnv("KEY_ROTATION_MAX_AGE", 90*24*time.Hour),
+			Interval: durationFromEnv("KEY_ROTATION_INTERVAL", 6*time.Hour),
+		}
+	}
+	return keyRotationService
+}
+
+func registerKeyRotationJobs(js *JobService) {
+	js.Register(JobRotateAccountKey, func(job *JobContext) error {
+		s := GetKeyRotationService()
+		accountId, err := primitive.ObjectIDFromHex(job.Param("accountId"))
+		if err != nil {
+			return err
+		}
+		acc, err := accountService.FindAccountById(accountId, job.Job.Owner)
+		if err != nil {
+			return err
+		}
+		job.SetTotal(1)
+		if err := s.RotateAccountKey(acc); err != nil {
+			job.ItemFailed(acc.ClientEmail, err)
+			return err
+		}
+		job.ItemDone(acc.ClientEmail)
+		return nil
+	})
+	js.Register(JobRotateProjectKeys, func(job *JobContext) error {
+		var maxAge time.Duration
+		if v := job.Param("maxAge"); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			maxAge = parsed
+		}
+		return GetKeyRotationService().RotateProjectKeys(job.Param("projectId"), maxAge, job)
+	})
+}
+
+// Start enqueues a rotation of the expired keys of every project on Interval. A zero interval
+// or max age disables it.
+func (s *KeyRotationService) Start() {
+	if s.Interval <= 0 || s.MaxAge <= 0 {
+		log.Println("Automatic key rotation is disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.enqueueDue(); err != nil {
+				log.Println("Fail to schedule key rotation by error", err.Error())
+			}
+		}
+	}()
+}
+
+func (s *KeyRotationService) enqueueDue() error {
+	var due []struct {
+		Id    primitive.ObjectID `bson:"_id"`
+		Owner primitive.ObjectID `bson:"owner"`
+	}
+	cursor, err := dao.DriveAccount().Aggregate(context.Background(), mongo.Pipeline{
+		{{"$match", s.dueFilter(s.MaxAge)}},
+		{{"$group", bson.D{
+			{"_id", "$projectId"},
+			{"owner", bson.D{{"$first", "$owner"}}},
+		}}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(context.Background(), &due); err != nil {
+		return err
+	}
+	for _, p := range due {
+		if pending, err := dao.Job().CountDocuments(context.Background(), bson.D{
+			{"type", JobRotateProjectKeys},
+			{"params.projectId", p.Id.Hex()},
+			{"status", bson.D{{"$in", bson.A{JobQueued, JobRunning}}}},
+		}); err != nil || pending > 0 {
+			continue
+		}
+		if _, err := GetProjectService().EnqueueProjectJob(p.Owner, p.Id.Hex(), JobRotateProjectKeys, map[string]string{
+			"maxAge": s.MaxAge.String(),
+		}); err != nil {
+			log.Println("Fail to enqueue key rotation of project", p.Id.Hex(), "by error", err.Error())
+		}
+	}
+	return nil
+}
+
+// dueFilter matches the enabled service accounts whose key is older than maxAge, or of unknown age.
+func (s *KeyRotationService) dueFilter(maxAge time.Duration) bson.D {
+	return bson.D{
+		{"type", "service_account"},
+		{"disabled", bson.D{{"$ne", true}}},
+		{"$or", bson.A{
+			bson.D{{"keyCreatedAt", bson.D{{"$lt", time.Now().Add(-maxAge)}}}},
+			bson.D{{"keyCreatedAt", bson.D{{"$exists", false}}}},
+		}},
+	}
+}
+
+// RotateProjectKeys rotates the keys of the service accounts of the project. With a maxAge only
+// the keys older than that are rotated, otherwise all of them.
+func (s *KeyRotationService) RotateProjectKeys(projectId string, maxAge time.Duration, progress Progress) error {
+	proj, err := GetProjectService().GetProject(projectId)
+	if err != nil {
+		return ErrProjectNotFound
+	}
+	is, err := GetProjectService().GetIamService(proj)
+	if err != nil {
+		return err
+	}
+	filter := bson.D{
+		{"type", "service_account"},
+		{"disabled", bson.D{{"$ne", true}}},
+	}
+	if maxAge > 0 {
+		filter = s.dueFilter(maxAge)
+	}
+	filter = append(filter, bson.E{Key: "projectId", Value: proj.Id})
+	accounts := make([]*entity.DriveAccount, 0)
+	cursor, err := dao.DriveAccount().Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(context.Background(), &accounts); err != nil {
+		return err
+	}
+	progress.SetTotal(len(accounts))
+	for _, acc := range accounts {
+		if progress.Cancelled() {
+			return ErrJobCancelled
+		}
+		if maxAge > 0 && acc.KeyCreatedAt == nil {
+			// accounts from before the key age was tracked
+			if young, err := s.backfillKeyAge(is, acc, maxAge); err != nil {
+				log.Println("Fail to find age of key of", acc.ClientEmail, "by error", err.Error())
+			} else if young {
+				progress.ItemDone(acc.ClientEmail)
+				continue
+			}
+		}
+		if err := s.rotate(is, acc); err != nil {
+			log.Println("Fail to rotate key of", acc.ClientEmail, "by error", err.Error())
+			progress.ItemFailed(acc.ClientEmail, err)
+			continue
+		}
+		progress.ItemDone(acc.ClientEmail)
+	}
+	return nil
+}
+
+// backfillKeyAge stores the creation time IAM has for the key of the account and tells whether
+// it is younger than maxAge.
+func (s *KeyRotationService) backfillKeyAge(is *helper.IamService, acc *entity.DriveAccount, maxAge time.Duration) (bool, error) {
+	keyId, err := storedKeyId(acc)
+	if err != nil {
+		return false, err
+	}
+	keys, err := is.ListServiceAccountKeys(acc.ClientEmail)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if !strings.HasSuffix(key.Name, "/keys/"+keyId) {
+			continue
+		}
+		createdAt, err := time.Parse(time.RFC3339, key.ValidAfterTime)
+		if err != nil {
+			return false, err
+		}
+		if _, err := dao.DriveAccount().UpdateOne(context.Background(), bson.D{
+			{"_id", acc.Id},
+			{"key", acc.Key},
+		}, bson.D{{"$set", bson.D{{"keyCreatedAt", createdAt}}}}); err != nil {
+			return false, err
+		}
+		return time.Since(createdAt) < maxAge, nil
+	}
+	// the stored key is gone from IAM, rotating replaces it
+	return false, nil
+}
+
+// RotateAccountKey replaces the key of one service account.
+func (s *KeyRotationService) RotateAccountKey(acc *entity.DriveAccount) error {
+	if acc.Type != "service_account" {
+		return ErrCannotRotate
+	}
+	proj, err := GetProjectService().GetProject(acc.ProjectId.Hex())
+	if err != nil {
+		return err
+	}
+	is, err := GetProjectService().GetIamService(proj)
+	if err != nil {
+		return err
+	}
+	return s.rotate(is, acc)
+}
+
+// rotate creates a key, checks Drive accepts it, swaps it in only if the stored key is still the
+// one rotated, then deletes the old key from IAM.
+func (s *KeyRotationService) rotate(is *helper.IamService, acc *entity.DriveAccount) error {
+	oldKeyId, err := storedKeyId(acc)
+	if err != nil {
+		log.Println("Stored key of", acc.ClientEmail, "is unreadable, replacing it anyway")
+	}
+	key, err := is.CreateServiceAccountKey(&iam.ServiceAccount{Email: acc.ClientEmail})
+	if err != nil {
+		return err
+	}
+	var kd helper.KeyDetails
+	if err := json.Unmarshal(key, &kd); err != nil {
+		return err
+	}
+	discard := func() {
+		if err := is.DeleteServiceAccountKey(acc.ClientEmail, kd.PrivateKeyId); err != nil && !isNotFound(err) {
+			log.Println("Fail to delete unused key", kd.PrivateKeyId, "of", acc.ClientEmail, "by error", err.Error())
+		}
+	}
+
+	probe := *acc
+	if err := waitDriveReady(key, &probe); err != nil {
+		discard()
+		return fmt.Errorf("new key has no Drive access: %v", err)
+	}
+
+	sealed, err := keyring.Encrypt(key)
+	if err != nil {
+		discard()
+		return err
+	}
+	now := time.Now()
+	res, err := dao.DriveAccount().UpdateOne(context.Background(), bson.D{
+		{"_id", acc.Id},
+		{"key", acc.Key},
+	}, bson.D{{"$set", bson.D{
+		{"key", sealed},
+		{"keyCreatedAt", now},
+	}}})
+	if err != nil {
+		discard()
+		return err
+	}
+	if res.MatchedCount == 0 {
+		discard()
+		return ErrKeyChanged
+	}
+	acc.Key = sealed
+	acc.KeyCreatedAt = &now
+	GetServiceCache().Invalidate(acc.Id)
+	GetTokenBroker().Evict(acc.ClientEmail)
+	log.Println("Rotated key of", acc.ClientEmail, "to", kd.PrivateKeyId)
+
+	if oldKeyId != "" && oldKeyId != kd.PrivateKeyId {
+		if err := is.DeleteServiceAccountKey(acc.ClientEmail, oldKeyId); err != nil && !isNotFound(err) {
+			return fmt.Errorf("key rotated but old key %s was not deleted: %v", oldKeyId, err)
+		}
+	}
+	return nil
+}
+
+func storedKeyId(acc *entity.DriveAccount) (string, error) {
+	key, err := keyring.Decrypt(acc.Key)
+	if err != nil {
+		return "", err
+	}
+	var kd helper.KeyDetails
+	if err := json.Unmarshal(key, &kd); err != nil {
+		return "", err
+	}
+	return kd.PrivateKeyId, nil
+}
+
+// EnqueueAccountRotation checks the account belongs to the owner and queues the rotation of its key.
+func (s *KeyRotationService) EnqueueAccountRotation(owner primitive.ObjectID, accountId primitive.ObjectID) (*entity.Job, error) {
+	acc, err := accountService.FindAccountById(accountId, owner)
+	if err != nil {
+		return nil, err
+	}
+	if acc.Type != "service_account" {
+		return nil, ErrCannotRotate
+	}
+	return GetJobService().Enqueue(owner, JobRotateAccountKey, map[string]string{
+		"accountId": accountId.Hex(),
+	})
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"crypto/sha256"
+	"github.com/ndphu/drive-manager-api/helper"
+	"github.com/ndphu/drive-manager-api/keyring"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync"
+)
+
+// ServiceCache keeps one Drive backend and one IAM service per account, so the key is parsed and
+// the client built once per process. An entry is rebuilt when the stored key of the account changes.
+type ServiceCache struct {
+	mutex sync.Mutex
+	drive map[primitive.ObjectID]*cachedDrive
+	iam   map[primitive.ObjectID]*cachedIam
+}
+
+type cachedDrive struct {
+	fingerprint [sha256.Size]byte
+	backend     helper.DriveBackend
+}
+
+type cachedIam struct {
+	fingerprint [sha256.Size]byte
+	service     *helper.IamService
+}
+
+var serviceCache *ServiceCache
+
+func GetServiceCache() *ServiceCache {
+	if serviceCache == nil {
+		serviceCache = &ServiceCache{
+			drive: make(map[primitive.ObjectID]*cachedDrive),
+			iam:   make(map[primitive.ObjectID]*cachedIam),
+		}
+	}
+	return serviceCache
+}
+
+// DriveBackend returns the backend of the account holding storedKey, as stored in the database.
+func (c *ServiceCache) DriveBackend(id primitive.ObjectID, storedKey string) (helper.DriveBackend, error) {
+	fingerprint := sha256.Sum256([]byte(storedKey))
+	c.mutex.Lock()
+	if cached, ok := c.drive[id]; ok && cached.fingerprint == fingerprint {
+		c.mutex.Unlock()
+		return cached.backend, nil
+	}
+	c.mutex.Unlock()
+	key, err := keyring.Decrypt(storedKey)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := helper.NewDriveBackend(key)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.drive[id] = &cachedDrive{fingerprint: fingerprint, backend: backend}
+	c.mutex.Unlock()
+	return backend, nil
+}
+
+// IamService returns the IAM service of the admin key storedKey, id being the account or project
+// holding it.
+func (c *ServiceCache) IamService(id primitive.ObjectID, storedKey string) (*helper.IamService, error) {
+	fingerprint := sha256.Sum256([]byte(storedKey))
+	c.mutex.Lock()
+	if cached, ok := c.iam[id]; ok && cached.fingerprint == fingerprint {
+		c.mutex.Unlock()
+		return cached.service, nil
+	}
+	c.mutex.Unlock()
+	key, err := keyring.Decrypt(storedKey)
+	if err != nil {
+		return nil, err
+	}
+	service, err := helper.NewIamService(key)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.iam[id] = &cachedIam{fingerprint: fingerprint, service: service}
+	c.mutex.Unlock()
+	return service, nil
+}
+
+// Invalidate drops the services of the account, for when its key was replaced or deleted.
+func (c *ServiceCache) Invalidate(id primitive.ObjectID) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.drive, id)
+	delete(c.iam, id)
+}
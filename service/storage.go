@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"strings"
+	"time"
+)
+
+// ProjectTypeStorage marks a project grouping local or S3 accounts, with no Google project behind it.
+const ProjectTypeStorage = "storage"
+
+// StorageAccountTypes are the account types making up the storage pool. Admin accounts are not part of it.
+var StorageAccountTypes = bson.A{helper.KeyTypeServiceAccount, helper.KeyTypeLocal, helper.KeyTypeS3}
+
+var ErrNotGoogleProject = errors.New("project has no Google project behind it")
+
+var ErrInvalidStorageKey = errors.New("storage key type must be local or s3")
+
+var ErrLocalRootInUse = errors.New("local root is used by another account")
+
+// storageTypeFilter keeps a drive_account query to the accounts of the storage pool.
+func storageTypeFilter() bson.E {
+	return bson.E{Key: "type", Value: bson.D{{"$in", StorageAccountTypes}}}
+}
+
+func isStorageAccount(accountType string) bool {
+	for _, t := range StorageAccountTypes {
+		if t == accountType {
+			return true
+		}
+	}
+	return false
+}
+
+func isGoogleAccount(accountType string) bool {
+	return accountType == helper.KeyTypeServiceAccount
+}
+
+// CreateStorageProject creates an empty project to hold local or S3 accounts.
+func (s *ProjectService) CreateStorageProject(displayName string, owner primitive.ObjectID) (*entity.Project, error) {
+	project := &entity.Project{
+		Id:          primitive.NewObjectID(),
+		DisplayName: displayName,
+		Owner:       owner,
+		Type:        ProjectTypeStorage,
+	}
+	if _, err := dao.Project().InsertOne(context.Background(), project); err != nil {
+		return nil, err
+	}
+	log.Println("Created storage project", project.Id.Hex(), displayName)
+	return project, nil
+}
+
+// AddStorageAccount adds a local or S3 account to a project of the owner. The key is checked by
+// reading the quota through it, then the files already stored are indexed.
+func (s *AccountService) AddStorageAccount(owner primitive.ObjectID, projectId string, name string, key []byte) (*entity.DriveAccount, error) {
+	t := helper.KeyType(key)
+	if t != helper.KeyTypeLocal && t != helper.KeyTypeS3 {
+		return nil, ErrInvalidStorageKey
+	}
+	pid, err := primitive.ObjectIDFromHex(projectId)
+	if err != nil {
+		return nil, ErrProjectNotFound
+	}
+	if count, err := dao.Project().CountDocuments(context.Background(), bson.D{
+		{"_id", pid},
+		{"owner", owner},
+	}); err != nil {
+		return nil, err
+	} else if count == 0 {
+		return nil, ErrProjectNotFound
+	}
+	if t == helper.KeyTypeLocal {
+		if key, err = claimLocalRoot(key); err != nil {
+			return nil, err
+		}
+	}
+	backend, err := helper.NewDriveBackend(key)
+	if err != nil {
+		return nil, err
+	}
+	quota, err := backend.GetQuotaUsage()
+	if err != nil {
+		log.Println("Fail to read quota with storage key by error", err.Error())
+		return nil, err
+	}
+	acc := entity.DriveAccount{}
+	if err := s.InitializeKey(&acc, key); err != nil {
+		return nil, err
+	}
+	acc.Name = strings.TrimSpace(name)
+	if acc.Name == "" {
+		acc.Name = acc.ClientEmail
+	}
+	acc.Owner = owner
+	acc.ProjectId = pid
+	acc.Usage = quota.Usage
+	acc.Limit = quota.Limit
+	acc.Available = quota.Limit - quota.Usage
+	acc.QuotaUpdateTimestamp = time.Now()
+	if err := s.Save(&acc); err != nil {
+		return nil, err
+	}
+	log.Println("Added", acc.Type, "account", acc.Id.Hex(), acc.ClientEmail, "to project", projectId)
+	if err := s.ReindexAccountFiles(acc); err != nil {
+		log.Println("Fail to index files of account", acc.Id.Hex(), "by error", err.Error())
+	}
+	return &acc, nil
+}
+
+// claimLocalRoot rewrites the key with its root resolved under the storage base, and refuses a root
+// that is, holds or sits in the root of another local account of any user.
+func claimLocalRoot(key []byte) ([]byte, error) {
+	var lk helper.LocalKey
+	if err := json.Unmarshal(key, &lk); err != nil {
+		return nil, err
+	}
+	root, err := helper.ResolveLocalRoot(lk.Root)
+	if err != nil {
+		return nil, err
+	}
+	var accounts []entity.DriveAccount
+	cursor, err := dao.DriveAccount().Find(context.Background(), bson.D{
+		{"type", helper.KeyTypeLocal},
+	}, options.Find().SetProjection(bson.D{{"clientEmail", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &accounts); err != nil {
+		return nil, err
+	}
+	for _, acc := range accounts {
+		// the label of a local account is local:<root>
+		if other := strings.TrimPrefix(acc.ClientEmail, "local:"); helper.LocalRootsOverlap(root, other) {
+			return nil, ErrLocalRootInUse
+		}
+	}
+	lk.Root = root
+	return json.Marshal(&lk)
+}
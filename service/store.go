@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/entity"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
+)
+
+// Store holds the records read and written by account indexing, upload placement and file
+// deletion. The services use the Mongo store, tests give them one kept in memory.
+type Store interface {
+	FindAccount(id primitive.ObjectID) (*entity.DriveAccount, error)
+	// FindUploadAccounts lists the enabled, writable accounts of the owner not known to be
+	// broken, with room for size.
+	FindUploadAccounts(owner primitive.ObjectID, driveOnly bool, size int64) ([]*entity.DriveAccount, error)
+	SaveQuota(accountId primitive.ObjectID, quota *helper.Quota, updatedAt time.Time) error
+	SaveChangesPageToken(accountId primitive.ObjectID, token string) error
+	FindUser(id primitive.ObjectID) (*entity.User, error)
+
+	// UpsertFileIndex saves the entry of a Drive file, matched on account and file id.
+	UpsertFileIndex(fi *FileIndex) error
+	DeleteFileIndex(id primitive.ObjectID) error
+	DeleteAccountFile(accountId primitive.ObjectID, fileId string) error
+	// DeleteStaleFileIndex removes the entries of the account not synced since syncTime.
+	DeleteStaleFileIndex(accountId primitive.ObjectID, syncTime time.Time) (int64, error)
+	IsReplicaFile(accountId primitive.ObjectID, fileId string) (bool, error)
+	ReplicaFileIds(accountId primitive.ObjectID) (map[string]bool, error)
+	RemoveReplica(accountId primitive.ObjectID, fileId string) error
+
+	FindManifest(id primitive.ObjectID) (*FileManifest, error)
+	DeleteManifest(id primitive.ObjectID) error
+	FindErasureLayout(id primitive.ObjectID) (*ErasureLayout, error)
+	DeleteErasureLayout(id primitive.ObjectID) error
+}
+
+type mongoStore struct {
+}
+
+func (mongoStore) FindAccount(id primitive.ObjectID) (*entity.DriveAccount, error) {
+	var res entity.DriveAccount
+	if err := dao.DriveAccount().FindOne(context.Background(), bson.D{{"_id", id}}).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (mongoStore) FindUploadAccounts(owner primitive.ObjectID, driveOnly bool, size int64) ([]*entity.DriveAccount, error) {
+	typeFilter := storageTypeFilter()
+	if driveOnly {
+		typeFilter = bson.E{Key: "type", Value: helper.KeyTypeServiceAccount}
+	}
+	var accounts []*entity.DriveAccount
+	if cursor, err := dao.DriveAccount().Find(context.Background(), bson.D{
+		{"owner", owner},
+		typeFilter,
+		{"disabled", bson.D{{"$ne", true}}},
+		{"readOnly", bson.D{{"$ne", true}}},
+		healthyFilter(),
+		closedCircuitFilter(),
+		roomFor(size),
+	}); err != nil {
+		return nil, err
+	} else if err := cursor.All(context.Background(), &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (mongoStore) SaveQuota(accountId primitive.ObjectID, quota *helper.Quota, updatedAt time.Time) error {
+	// pending reservations stay out of available; the pipeline reads them in the same write
+	if update, err := dao.DriveAccount().UpdateOne(
+		context.Background(),
+		bson.D{{"_id", accountId}},
+		mongo.Pipeline{
+			{{"$set", bson.D{
+				{"usage", quota.Usage},
+				{"limit", quota.Limit},
+				{"available", bson.D{{"$subtract", bson.A{
+					quota.Limit - quota.Usage,
+					bson.D{{"$ifNull", bson.A{"$reserved", 0}}},
+				}}}},
+				{"quotaUpdateTimestamp", updatedAt},
+			}}},
+		}); err != nil {
+		return err
+	} else {
+		log.Println("UpdateCachedQuota completed with ModifiedCount=", update.ModifiedCount)
+		return nil
+	}
+}
+
+func (mongoStore) SaveChangesPageToken(accountId primitive.ObjectID, token string) error {
+	return saveChangesPageToken(accountId, token)
+}
+
+func (mongoStore) FindUser(id primitive.ObjectID) (*entity.User, error) {
+	var user entity.User
+	if err := dao.User().FindOne(context.Background(), bson.D{{"_id", id}}).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (mongoStore) UpsertFileIndex(fi *FileIndex) error {
+	_, err := dao.FileIndex().UpdateOne(context.Background(), bson.D{
+		{"accountId", fi.AccountId},
+		{"fileId", fi.FileId},
+	}, bson.D{
+		{"$set", bson.D{
+			{"name", fi.Name},
+			{"size", fi.Size},
+			{"mimeType", fi.MimeType},
+			{"owner", fi.Owner},
+			{"projectId", fi.ProjectId},
+			{"createdTime", fi.CreatedTime},
+			{"modifiedTime", fi.ModifiedTime},
+			{"syncTime", fi.SyncTime},
+		}},
+		{"$setOnInsert", bson.D{
+			{"_id", primitive.NewObjectID()},
+		}},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (mongoStore) DeleteFileIndex(id primitive.ObjectID) error {
+	_, err := dao.FileIndex().DeleteOne(context.Background(), bson.D{{"_id", id}})
+	return err
+}
+
+func (mongoStore) DeleteAccountFile(accountId primitive.ObjectID, fileId string) error {
+	_, err := dao.FileIndex().DeleteMany(context.Background(), bson.D{
+		{"accountId", accountId},
+		{"fileId", fileId},
+	})
+	return err
+}
+
+func (mongoStore) DeleteStaleFileIndex(accountId primitive.ObjectID, syncTime time.Time) (int64, error) {
+	res, err := dao.FileIndex().DeleteMany(context.Background(), bson.D{
+		{"accountId", accountId},
+		{"syncTime", bson.D{{"$lt", syncTime}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (mongoStore) IsReplicaFile(accountId primitive.ObjectID, fileId string) (bool, error) {
+	return isReplicaFile(accountId, fileId)
+}
+
+func (mongoStore) ReplicaFileIds(accountId primitive.ObjectID) (map[string]bool, error) {
+	return replicaFileIds(accountId)
+}
+
+func (mongoStore) RemoveReplica(accountId primitive.ObjectID, fileId string) error {
+	return removeReplica(accountId, fileId)
+}
+
+func (mongoStore) FindManifest(id primitive.ObjectID) (*FileManifest, error) {
+	return FindManifest(id)
+}
+
+func (mongoStore) DeleteManifest(id primitive.ObjectID) error {
+	_, err := dao.FileManifest().DeleteOne(context.Background(), bson.D{{"_id", id}})
+	return err
+}
+
+func (mongoStore) FindErasureLayout(id primitive.ObjectID) (*ErasureLayout, error) {
+	return FindErasureLayout(id)
+}
+
+func (mongoStore) DeleteErasureLayout(id primitive.ObjectID) error {
+	_, err := dao.ErasureLayout().DeleteOne(context.Background(), bson.D{{"_id", id}})
+	return err
+}
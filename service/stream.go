@@ -0,0 +1,259 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/helper"
+	"github.com/nu7hatch/gouuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"os"
+	"time"
+)
+
+const tokenRefreshWindow = 5 * time.Minute
+
+var ErrStreamSessionNotFound = errors.New("StreamSessionNotFound")
+
+type StreamSession struct {
+	Id          string             `json:"id"`
+	Owner       primitive.ObjectID `json:"owner"`
+	FileIndexId primitive.ObjectID `json:"fileIndexId"`
+	AccountId   primitive.ObjectID `json:"accountId"`
+	FileId      string             `json:"fileId"`
+	Name        string             `json:"name"`
+	MimeType    string             `json:"mimeType"`
+	Size        int64              `json:"size"`
+	CreatedAt   time.Time          `json:"createdAt"`
+	ExpiresAt   time.Time          `json:"expiresAt"`
+	TokenExpiry time.Time          `json:"tokenExpiry"`
+	Storage     string             `json:"storage,omitempty"`
+	Proxied     bool               `json:"proxied,omitempty"`
+}
+
+type StreamService struct {
+	redis      *RedisService
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+}
+
+var streamService *StreamService
+
+func GetStreamService() *StreamService {
+	if streamService == nil {
+		rs, _ := GetRedisService()
+		streamService = &StreamService{
+			redis:      rs,
+			DefaultTTL: durationFromEnv("STREAM_SESSION_TTL", 30*time.Minute),
+			MaxTTL:     durationFromEnv("STREAM_SESSION_MAX_TTL", 24*time.Hour),
+		}
+	}
+	return streamService
+}
+
+func durationFromEnv(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Println("Invalid duration", value, "for", name, "using", defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+func streamSessionKey(id string) string {
+	return "stream:" + id
+}
+
+func userStreamsKey(owner primitive.ObjectID) string {
+	return "user:" + owner.Hex() + ":streams"
+}
+
+func (s *StreamService) CreateSession(owner primitive.ObjectID, fileIndexId string, ttl time.Duration) (*StreamSession, error) {
+	if ttl <= 0 {
+		ttl = s.DefaultTTL
+	}
+	if ttl > s.MaxTTL {
+		ttl = s.MaxTTL
+	}
+	var fi FileIndex
+	fileIndexIdHex, _ := primitive.ObjectIDFromHex(fileIndexId)
+	if err := dao.FileIndex().FindOne(context.Background(), bson.D{
+		{"_id", fileIndexIdHex},
+		{"owner", owner},
+	}).Decode(&fi); err != nil {
+		log.Println("Fail to find file index", fileIndexId, "by error", err.Error())
+		return nil, err
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	session := &StreamSession{
+		Id:          id.String(),
+		Owner:       owner,
+		FileIndexId: fi.Id,
+		AccountId:   fi.AccountId,
+		FileId:      fi.FileId,
+		Name:        fi.Name,
+		MimeType:    fi.MimeType,
+		Size:        fi.Size,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+		Storage:     fi.Storage,
+	}
+	if session.Storage != "" {
+		// parts or shards live on several accounts, the stream is read through ContentService
+		return s.createProxiedSession(session)
+	}
+	// start on the first copy whose account still hands out tokens
+	for _, c := range routeCopies(fi.Copies()) {
+		session.AccountId = c.AccountId
+		session.FileId = c.FileId
+		if err = s.refreshToken(session); err == nil || err == helper.ErrNoAccessToken {
+			break
+		}
+	}
+	if err == helper.ErrNoAccessToken {
+		// local and S3 accounts have no token to hand out, the stream is read through ContentService
+		session.Proxied = true
+		return s.createProxiedSession(session)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.redis.SaveWithTTL("file:"+session.Id+":url", driveFileLink(session.FileId), ttl); err != nil {
+		return nil, err
+	}
+	if err := s.redis.AddToSet(userStreamsKey(owner), session.Id); err != nil {
+		return nil, err
+	}
+	log.Println("Created stream session", session.Id, "for file", fi.Id.Hex(), "expires at", session.ExpiresAt)
+	return session, nil
+}
+
+func (s *StreamService) createProxiedSession(session *StreamSession) (*StreamSession, error) {
+	if err := s.saveSession(session); err != nil {
+		return nil, err
+	}
+	if err := s.redis.AddToSet(userStreamsKey(session.Owner), session.Id); err != nil {
+		return nil, err
+	}
+	log.Println("Created proxied stream session", session.Id, "for file", session.FileIndexId.Hex(), "expires at", session.ExpiresAt)
+	return session, nil
+}
+
+// refreshToken writes a new access token for the session and stores the session record.
+func (s *StreamService) refreshToken(session *StreamSession) error {
+	acc, err := GetAccountService().FindAccount(session.AccountId.Hex())
+	if err != nil {
+		log.Println("Fail to find account", session.AccountId.Hex(), "for stream session by error", err.Error())
+		return err
+	}
+	backend, err := GetAccountService().GetDriveBackend(acc)
+	if err != nil {
+		return err
+	}
+	token, err := backend.GetToken()
+	if err != nil {
+		log.Println("Fail to get access token for stream session by error", err.Error())
+		return err
+	}
+	session.TokenExpiry = token.Expiry
+	ttl := time.Until(session.ExpiresAt)
+	if ttl <= 0 {
+		return ErrStreamSessionNotFound
+	}
+	if err := s.redis.SaveWithTTL("file:"+session.Id+":auth", token.AccessToken, ttl); err != nil {
+		return err
+	}
+	return s.saveSession(session)
+}
+
+func (s *StreamService) saveSession(session *StreamSession) error {
+	ttl := time.Until(session.ExpiresAt)
+	if ttl <= 0 {
+		return ErrStreamSessionNotFound
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return s.redis.SaveWithTTL(streamSessionKey(session.Id), string(data), ttl)
+}
+
+func (s *StreamService) GetSession(id string) (*StreamSession, error) {
+	data, err := s.redis.Get(streamSessionKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if data == "" {
+		return nil, ErrStreamSessionNotFound
+	}
+	var session StreamSession
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// RefreshIfNeeded renews the cached access token when it expires within tokenRefreshWindow.
+// Streams without a session record are left untouched.
+func (s *StreamService) RefreshIfNeeded(id string) error {
+	session, err := s.GetSession(id)
+	if err == ErrStreamSessionNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if session.Storage != "" || session.Proxied || time.Until(session.TokenExpiry) > tokenRefreshWindow {
+		return nil
+	}
+	log.Println("Refreshing access token of stream session", id)
+	return s.refreshToken(session)
+}
+
+func (s *StreamService) ListSessions(owner primitive.ObjectID) ([]*StreamSession, error) {
+	ids, err := s.redis.SetMembers(userStreamsKey(owner))
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*StreamSession, 0)
+	for _, id := range ids {
+		session, err := s.GetSession(id)
+		if err == ErrStreamSessionNotFound {
+			// expired, drop it from the user's set
+			s.redis.RemoveFromSet(userStreamsKey(owner), id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (s *StreamService) RevokeSession(owner primitive.ObjectID, id string) error {
+	session, err := s.GetSession(id)
+	if err != nil {
+		return err
+	}
+	if session.Owner != owner {
+		return ErrStreamSessionNotFound
+	}
+	if err := s.redis.Delete("file:"+id+":url", "file:"+id+":auth", streamSessionKey(id)); err != nil {
+		return err
+	}
+	log.Println("Revoked stream session", id)
+	return s.redis.RemoveFromSet(userStreamsKey(owner), id)
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/ndphu/drive-manager-api/helper"
+	"github.com/ndphu/drive-manager-api/keyring"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TokenBroker hands out one access token per service account key and scope set, refreshing it
+// RefreshAhead before it expires. With Shared the tokens go through Redis so every API instance
+// reuses them instead of minting its own, sealed with the keyring. A source unused for IdleTimeout
+// is dropped, the services still holding it keep working.
+type TokenBroker struct {
+	RefreshAhead time.Duration
+	Shared       bool
+	IdleTimeout  time.Duration
+
+	mutex   sync.Mutex
+	sources map[string]*brokeredTokenSource
+}
+
+type brokeredTokenSource struct {
+	// unix nanoseconds of the last Token call, read without the mutex held. First for 64-bit
+	// alignment of atomic access.
+	lastUsed int64
+
+	broker *TokenBroker
+	key    string
+	config *jwt.Config
+
+	mutex sync.Mutex
+	token *oauth2.Token
+}
+
+var tokenBroker *TokenBroker
+
+func GetTokenBroker() *TokenBroker {
+	if tokenBroker == nil {
+		tokenBroker = &TokenBroker{
+			RefreshAhead: durationFromEnv("TOKEN_REFRESH_AHEAD", 5*time.Minute),
+			Shared:       os.Getenv("TOKEN_SHARED_CACHE") == "true",
+			IdleTimeout:  durationFromEnv("TOKEN_SOURCE_IDLE_TIMEOUT", time.Hour),
+			sources:      make(map[string]*brokeredTokenSource),
+		}
+	}
+	return tokenBroker
+}
+
+// Install makes every Drive and IAM service built from now on take its tokens from the broker.
+func (b *TokenBroker) Install() {
+	helper.NewTokenSource = b.TokenSource
+	if b.Shared {
+		log.Println("Sharing access tokens through Redis")
+	}
+}
+
+func (b *TokenBroker) TokenSource(config *jwt.Config) oauth2.TokenSource {
+	key := tokenKey(config)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.dropIdle()
+	source, ok := b.sources[key]
+	if !ok {
+		source = &brokeredTokenSource{broker: b, key: key, config: config, lastUsed: time.Now().UnixNano()}
+		b.sources[key] = source
+	}
+	return source
+}
+
+// Evict drops the sources of the service account, for when it is deleted or its key replaced.
+func (b *TokenBroker) Evict(email string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for key, source := range b.sources {
+		if source.config.Email == email {
+			delete(b.sources, key)
+		}
+	}
+}
+
+// dropIdle forgets the sources no one asked a token from for IdleTimeout. b.mutex must be held.
+func (b *TokenBroker) dropIdle() {
+	if b.IdleTimeout <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-b.IdleTimeout).UnixNano()
+	for key, source := range b.sources {
+		if atomic.LoadInt64(&source.lastUsed) < cutoff {
+			delete(b.sources, key)
+		}
+	}
+}
+
+// tokenKey identifies the key by its id, so a rotated key never gets the token of the old one.
+func tokenKey(config *jwt.Config) string {
+	sum := sha256.Sum256([]byte(config.Email + "\n" + config.PrivateKeyID + "\n" + strings.Join(config.Scopes, " ")))
+	return "token:" + hex.EncodeToString(sum[:16])
+}
+
+func (t *brokeredTokenSource) Token() (*oauth2.Token, error) {
+	atomic.StoreInt64(&t.lastUsed, time.Now().UnixNano())
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.broker.fresh(t.token) {
+		return t.token, nil
+	}
+	token, err := t.broker.obtain(t.key, t.config)
+	if err != nil {
+		if t.token.Valid() {
+			log.Println("Fail to refresh access token of", t.config.Email, "by error", err.Error(), "keeping the current one")
+			return t.token, nil
+		}
+		return nil, err
+	}
+	t.token = token
+	return token, nil
+}
+
+func (b *TokenBroker) fresh(token *oauth2.Token) bool {
+	return token != nil && token.AccessToken != "" && token.Expiry.After(time.Now().Add(b.RefreshAhead))
+}
+
+// obtain reads the shared token, or mints one. Only the instance holding the refresh lock mints
+// when Shared, the others wait briefly for its token before minting their own.
+func (b *TokenBroker) obtain(key string, config *jwt.Config) (*oauth2.Token, error) {
+	if !b.Shared {
+		return mintToken(config)
+	}
+	rs, err := GetRedisService()
+	if err != nil {
+		return nil, err
+	}
+	if token := b.loadShared(rs, key); token != nil {
+		return token, nil
+	}
+	locked, err := rs.SetIfAbsent(key+":lock", "1", 10*time.Second)
+	if err != nil {
+		log.Println("Fail to lock token refresh by error", err.Error())
+		return mintToken(config)
+	}
+	if !locked {
+		for i := 0; i < 10; i++ {
+			time.Sleep(200 * time.Millisecond)
+			if token := b.loadShared(rs, key); token != nil {
+				return token, nil
+			}
+		}
+	} else {
+		defer rs.Delete(key + ":lock")
+	}
+	token, err := mintToken(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.saveShared(rs, key, token); err != nil {
+		log.Println("Fail to share access token by error", err.Error())
+	}
+	return token, nil
+}
+
+func (b *TokenBroker) loadShared(rs *RedisService, key string) *oauth2.Token {
+	data, err := rs.Get(key)
+	if err != nil {
+		log.Println("Fail to read shared access token by error", err.Error())
+		return nil
+	}
+	if data == "" {
+		return nil
+	}
+	plain, err := keyring.Decrypt(data)
+	if err != nil {
+		log.Println("Fail to open shared access token by error", err.Error())
+		return nil
+	}
+	var token oauth2.Token
+	if err := json.Unmarshal(plain, &token); err != nil || !b.fresh(&token) {
+		return nil
+	}
+	return &token
+}
+
+func (b *TokenBroker) saveShared(rs *RedisService, key string, token *oauth2.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	sealed, err := keyring.Encrypt(data)
+	if err != nil {
+		return err
+	}
+	return rs.SaveWithTTL(key, sealed, time.Until(token.Expiry))
+}
+
+// mintToken asks Google for a new token, a fresh jwt source has none cached.
+func mintToken(config *jwt.Config) (*oauth2.Token, error) {
+	return config.TokenSource(context.Background()).Token()
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBroker() *TokenBroker {
+	return &TokenBroker{
+		RefreshAhead: 5 * time.Minute,
+		IdleTimeout:  time.Hour,
+		sources:      make(map[string]*brokeredTokenSource),
+	}
+}
+
+func TestTokenBrokerSources(t *testing.T) {
+	b := newTestBroker()
+	first := &jwt.Config{Email: "a@p.iam", PrivateKeyID: "k1", Scopes: []string{"drive"}}
+	tests := []struct {
+		name   string
+		config *jwt.Config
+		shared bool
+	}{
+		{"same key and scopes", &jwt.Config{Email: "a@p.iam", PrivateKeyID: "k1", Scopes: []string{"drive"}}, true},
+		{"rotated key", &jwt.Config{Email: "a@p.iam", PrivateKeyID: "k2", Scopes: []string{"drive"}}, false},
+		{"other scopes", &jwt.Config{Email: "a@p.iam", PrivateKeyID: "k1", Scopes: []string{"iam"}}, false},
+		{"other account", &jwt.Config{Email: "b@p.iam", PrivateKeyID: "k1", Scopes: []string{"drive"}}, false},
+	}
+	source := b.TokenSource(first)
+	for _, tt := range tests {
+		if got := b.TokenSource(tt.config) == source; got != tt.shared {
+			t.Errorf("%s: shared = %v", tt.name, got)
+		}
+	}
+}
+
+func TestTokenBrokerEvict(t *testing.T) {
+	b := newTestBroker()
+	evicted := b.TokenSource(&jwt.Config{Email: "a@p.iam", PrivateKeyID: "k1"})
+	b.TokenSource(&jwt.Config{Email: "a@p.iam", PrivateKeyID: "k1", Scopes: []string{"iam"}})
+	kept := b.TokenSource(&jwt.Config{Email: "b@p.iam", PrivateKeyID: "k1"})
+	b.Evict("a@p.iam")
+	if len(b.sources) != 1 {
+		t.Fatalf("%d sources left", len(b.sources))
+	}
+	if b.TokenSource(&jwt.Config{Email: "b@p.iam", PrivateKeyID: "k1"}) != kept {
+		t.Fatal("source of another account evicted")
+	}
+	if b.TokenSource(&jwt.Config{Email: "a@p.iam", PrivateKeyID: "k1"}) == evicted {
+		t.Fatal("evicted source handed out again")
+	}
+}
+
+func TestTokenBrokerDropsIdleSources(t *testing.T) {
+	b := newTestBroker()
+	idle := b.TokenSource(&jwt.Config{Email: "idle@p.iam"}).(*brokeredTokenSource)
+	used := b.TokenSource(&jwt.Config{Email: "used@p.iam"}).(*brokeredTokenSource)
+	atomic.StoreInt64(&idle.lastUsed, time.Now().Add(-2*time.Hour).UnixNano())
+	b.TokenSource(&jwt.Config{Email: "new@p.iam"})
+	if _, ok := b.sources[idle.key]; ok {
+		t.Fatal("idle source kept")
+	}
+	if _, ok := b.sources[used.key]; !ok {
+		t.Fatal("source in use dropped")
+	}
+}
+
+func TestTokenBrokerFresh(t *testing.T) {
+	b := newTestBroker()
+	tests := []struct {
+		name  string
+		token *oauth2.Token
+		fresh bool
+	}{
+		{"none", nil, false},
+		{"empty", &oauth2.Token{Expiry: time.Now().Add(time.Hour)}, false},
+		{"valid for long", &oauth2.Token{AccessToken: "t", Expiry: time.Now().Add(time.Hour)}, true},
+		{"expiring within RefreshAhead", &oauth2.Token{AccessToken: "t", Expiry: time.Now().Add(time.Minute)}, false},
+		{"expired", &oauth2.Token{AccessToken: "t", Expiry: time.Now().Add(-time.Minute)}, false},
+	}
+	for _, tt := range tests {
+		if got := b.fresh(tt.token); got != tt.fresh {
+			t.Errorf("%s: fresh = %v", tt.name, got)
+		}
+	}
+}
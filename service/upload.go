@@ -0,0 +1,685 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ndphu/drive-manager-api/dao"
+	"github.com/ndphu/drive-manager-api/helper"
+	"github.com/nu7hatch/gouuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/api/drive/v3"
+	"io"
+	"log"
+	"time"
+)
+
+// Drive keeps resumable sessions for a week.
+const uploadSessionTTL = 7 * 24 * time.Hour
+
+// Chunks must be multiples of 256KiB, except the last one.
+const UploadChunkSize = 8 * 1024 * 1024
+
+const UploadChunkAlign = 256 * 1024
+
+var (
+	ErrUploadNotFound       = errors.New("UploadNotFound")
+	ErrUploadOffsetMismatch = errors.New("UploadOffsetMismatch")
+	ErrInvalidContentRange  = errors.New("InvalidContentRange")
+	ErrInvalidChunkSize     = errors.New("InvalidChunkSize")
+)
+
+// UploadState is the server side record of a proxied resumable upload, kept in Redis.
+type UploadState struct {
+	Id           string              `json:"id"`
+	Owner        primitive.ObjectID  `json:"owner"`
+	AccountId    primitive.ObjectID  `json:"accountId"`
+	SessionUri   string              `json:"-"`
+	Name         string              `json:"name"`
+	MimeType     string              `json:"mimeType"`
+	Size         int64               `json:"size"`
+	Offset       int64               `json:"offset"`
+	ChunkSize    int64               `json:"chunkSize"`
+	Complete     bool                `json:"complete"`
+	FileIndexId  *primitive.ObjectID `json:"fileIndexId,omitempty"`
+	Chunked      bool                `json:"chunked"`
+	Erasure      bool                `json:"erasure"`
+	DataShards   int                 `json:"dataShards,omitempty"`
+	ParityShards int                 `json:"parityShards,omitempty"`
+	BlockSize    int64               `json:"blockSize,omitempty"`
+	Parts        []*UploadPart       `json:"parts,omitempty"`
+	// quota reserved on AccountId for a single file upload
+	ReservationId *primitive.ObjectID `json:"reservationId,omitempty"`
+	CreatedAt    time.Time           `json:"createdAt"`
+	UpdatedAt    time.Time           `json:"updatedAt"`
+}
+
+// UploadPart is one Drive file of a chunked upload, holding the bytes [Offset, Offset+Size) of the object.
+// For erasure coded uploads it is a shard and Received tracks how much of it Drive has.
+type UploadPart struct {
+	Index      int                `json:"index"`
+	AccountId  primitive.ObjectID `json:"accountId"`
+	Offset     int64              `json:"offset"`
+	Size       int64              `json:"size"`
+	SessionUri string             `json:"-"`
+	FileId     string             `json:"fileId,omitempty"`
+	Md5        string             `json:"md5,omitempty"`
+	Complete   bool               `json:"complete"`
+	Received   int64              `json:"received,omitempty"`
+	Failed     bool               `json:"failed,omitempty"`
+	ReservationId *primitive.ObjectID `json:"reservationId,omitempty"`
+}
+
+// uploadStateRecord is what is stored, including the session uris hidden from API responses.
+type uploadStateRecord struct {
+	UploadState
+	SessionUri      string   `json:"sessionUri"`
+	PartSessionUris []string `json:"partSessionUris,omitempty"`
+}
+
+type UploadService struct {
+	redis uploadRedis
+}
+
+// uploadRedis is the part of RedisService holding upload states.
+type uploadRedis interface {
+	SaveWithTTL(key, value string, ttl time.Duration) error
+	Get(key string) (string, error)
+	Delete(keys ...string) error
+	SetIfAbsent(key, value string, ttl time.Duration) (bool, error)
+}
+
+var uploadService *UploadService
+
+func GetUploadService() *UploadService {
+	if uploadService == nil {
+		rs, _ := GetRedisService()
+		uploadService = &UploadService{
+			redis: rs,
+		}
+	}
+	return uploadService
+}
+
+func uploadKey(id string) string {
+	return "upload:" + id
+}
+
+// uploadCompleteKey holds uploadCompleting while a single file upload is being indexed, then
+// the id of its file index.
+func uploadCompleteKey(id string) string {
+	return uploadKey(id) + ":complete"
+}
+
+const uploadCompleting = "completing"
+
+// Start opens an upload on the account chosen by the placement strategy (the user's one when empty).
+// folderId is the browse folder the file is meant for and only guides placement.
+func (s *UploadService) Start(owner primitive.ObjectID, name string, size int64, mimeType string, strategy string, folderId *primitive.ObjectID) (*UploadState, error) {
+	as := GetAccountService()
+	placement, err := as.ReserveUpload(&PlacementRequest{Owner: owner, Size: size, FolderId: folderId}, strategy)
+	if err == ErrNoSuitableAccount {
+		log.Println("No single account can hold", size, "bytes, splitting", name, "in parts")
+		return s.startChunked(owner, name, size, mimeType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	account := placement.Account
+	log.Println("Placing upload", name, "on account", account.Id.Hex(), "with strategy", placement.Strategy+":", placement.Reason)
+	reservationId := placement.Reservation.Id
+	release := func() {
+		if err := GetQuotaService().Release(reservationId); err != nil {
+			log.Println("Fail to release reservation", reservationId.Hex(), "by error", err.Error())
+		}
+	}
+	backend, err := as.GetDriveBackend(account)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	sessionUri, err := backend.CreateUploadSession(name, mimeType, size)
+	if err != nil {
+		log.Println("Fail to create upload session on account", account.Id.Hex(), "by error", err.Error())
+		release()
+		return nil, err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	now := time.Now()
+	state := &UploadState{
+		Id:         id.String(),
+		Owner:      owner,
+		AccountId:  account.Id,
+		SessionUri: sessionUri,
+		Name:       name,
+		MimeType:   mimeType,
+		Size:       size,
+		ChunkSize:  UploadChunkSize,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+
+		ReservationId: &reservationId,
+	}
+	if err := s.save(state); err != nil {
+		release()
+		return nil, err
+	}
+	log.Println("Started upload", state.Id, "of", name, size, "bytes on account", account.Id.Hex())
+	return state, nil
+}
+
+// startChunked opens one resumable session per part. Clients upload to it exactly like a single file.
+func (s *UploadService) startChunked(owner primitive.ObjectID, name string, size int64, mimeType string) (*UploadState, error) {
+	as := GetAccountService()
+	parts, err := as.PlanParts(owner, size)
+	if err != nil {
+		return nil, err
+	}
+	if err := reserveParts(owner, parts); err != nil {
+		log.Println("Fail to reserve quota for parts of", name, "by error", err.Error())
+		return nil, err
+	}
+	for _, part := range parts {
+		account, err := as.FindAccount(part.AccountId.Hex())
+		if err != nil {
+			releaseParts(parts)
+			return nil, err
+		}
+		backend, err := as.GetDriveBackend(account)
+		if err != nil {
+			releaseParts(parts)
+			return nil, err
+		}
+		part.SessionUri, err = backend.CreateUploadSession(partName(name, part.Index), ChunkPartMimeType, part.Size)
+		if err != nil {
+			log.Println("Fail to create upload session for part", part.Index, "on account", account.Id.Hex(), "by error", err.Error())
+			releaseParts(parts)
+			return nil, err
+		}
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		releaseParts(parts)
+		return nil, err
+	}
+	now := time.Now()
+	state := &UploadState{
+		Id:        id.String(),
+		Owner:     owner,
+		Name:      name,
+		MimeType:  mimeType,
+		Size:      size,
+		ChunkSize: UploadChunkSize,
+		Chunked:   true,
+		Parts:     parts,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.save(state); err != nil {
+		releaseParts(parts)
+		return nil, err
+	}
+	log.Println("Started chunked upload", state.Id, "of", name, size, "bytes in", len(parts), "parts")
+	return state, nil
+}
+
+func (s *UploadService) save(state *UploadState) error {
+	state.UpdatedAt = time.Now()
+	record := uploadStateRecord{UploadState: *state, SessionUri: state.SessionUri}
+	for _, part := range state.Parts {
+		record.PartSessionUris = append(record.PartSessionUris, part.SessionUri)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.redis.SaveWithTTL(uploadKey(state.Id), string(data), uploadSessionTTL)
+}
+
+func (s *UploadService) Get(owner primitive.ObjectID, id string) (*UploadState, error) {
+	data, err := s.redis.Get(uploadKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if data == "" {
+		return nil, ErrUploadNotFound
+	}
+	var record uploadStateRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, err
+	}
+	if record.Owner != owner {
+		return nil, ErrUploadNotFound
+	}
+	state := record.UploadState
+	state.SessionUri = record.SessionUri
+	for i, uri := range record.PartSessionUris {
+		if i < len(state.Parts) {
+			state.Parts[i].SessionUri = uri
+		}
+	}
+	return &state, nil
+}
+
+// ParseContentRange reads "bytes start-end/total".
+func ParseContentRange(value string) (int64, int64, int64, error) {
+	var start, end, total int64
+	if _, err := fmt.Sscanf(value, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return 0, 0, 0, ErrInvalidContentRange
+	}
+	if start < 0 || end < start || end >= total {
+		return 0, 0, 0, ErrInvalidContentRange
+	}
+	return start, end, total, nil
+}
+
+// chunkRange checks the Content-Range of the next chunk of the upload.
+func chunkRange(state *UploadState, contentRange string) (start int64, end int64, err error) {
+	start, end, total, err := ParseContentRange(contentRange)
+	if err != nil {
+		return 0, 0, err
+	}
+	if total != state.Size {
+		return 0, 0, ErrInvalidContentRange
+	}
+	if start != state.Offset {
+		return 0, 0, ErrUploadOffsetMismatch
+	}
+	// Drive refuses such a chunk only once it is sent
+	if end+1 < total && (end-start+1)%UploadChunkAlign != 0 {
+		return 0, 0, ErrInvalidChunkSize
+	}
+	return start, end, nil
+}
+
+// WriteChunk forwards one chunk to Drive. The chunk must start at the current offset;
+// on ErrUploadOffsetMismatch the returned state tells the client where to resume.
+func (s *UploadService) WriteChunk(owner primitive.ObjectID, id string, contentRange string, chunk io.Reader) (*UploadState, error) {
+	state, err := s.Get(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if state.Complete {
+		return state, nil
+	}
+	start, end, err := chunkRange(state, contentRange)
+	if err != nil {
+		return state, err
+	}
+	total := state.Size
+	if state.Chunked {
+		return s.writeParts(state, chunk, end)
+	}
+	if state.Erasure {
+		return s.writeStripes(state, chunk, start, end)
+	}
+	backend, err := s.backend(state)
+	if err != nil {
+		return nil, err
+	}
+	progress, err := backend.UploadChunk(state.SessionUri, chunk, start, end, total)
+	if err != nil {
+		log.Println("Fail to upload chunk", contentRange, "of upload", id, "by error", err.Error())
+		// Drive may have kept part of the chunk, ask where to continue
+		if p, e := backend.QueryUpload(state.SessionUri, state.Size); e == nil {
+			state.Offset = p.Offset
+			s.save(state)
+		}
+		return state, err
+	}
+	state.Offset = progress.Offset
+	if progress.File != nil {
+		if err := s.complete(state, progress); err != nil {
+			return state, err
+		}
+	}
+	if err := s.save(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Status asks Drive how much was received, so an interrupted client can resume.
+func (s *UploadService) Status(owner primitive.ObjectID, id string) (*UploadState, error) {
+	state, err := s.Get(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if state.Complete {
+		return state, nil
+	}
+	if state.Chunked {
+		return s.queryParts(state)
+	}
+	if state.Erasure {
+		return s.queryShards(state)
+	}
+	backend, err := s.backend(state)
+	if err != nil {
+		return nil, err
+	}
+	progress, err := backend.QueryUpload(state.SessionUri, state.Size)
+	if err != nil {
+		return nil, err
+	}
+	state.Offset = progress.Offset
+	if progress.File != nil {
+		if err := s.complete(state, progress); err != nil {
+			return state, err
+		}
+	}
+	if err := s.save(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// writeParts forwards the chunk ending at end to the part sessions it overlaps.
+func (s *UploadService) writeParts(state *UploadState, chunk io.Reader, end int64) (*UploadState, error) {
+	for state.Offset <= end {
+		part := currentPart(state)
+		backend, err := s.accountBackend(part.AccountId)
+		if err != nil {
+			return nil, err
+		}
+		partEnd := part.Offset + part.Size - 1
+		if partEnd > end {
+			partEnd = end
+		}
+		sent := partEnd - state.Offset + 1
+		progress, err := backend.UploadChunk(part.SessionUri, io.LimitReader(chunk, sent), state.Offset-part.Offset, partEnd-part.Offset, part.Size)
+		if err != nil {
+			log.Println("Fail to upload part", part.Index, "of upload", state.Id, "by error", err.Error())
+			if p, e := backend.QueryUpload(part.SessionUri, part.Size); e == nil {
+				state.Offset = part.Offset + p.Offset
+				s.save(state)
+			}
+			return state, err
+		}
+		state.Offset = part.Offset + progress.Offset
+		if progress.File != nil {
+			if err := completePart(state, part, progress.File); err != nil {
+				return state, err
+			}
+		}
+		if state.Offset < partEnd+1 {
+			// Drive kept less than sent, the client resumes from state.Offset
+			break
+		}
+	}
+	if allPartsComplete(state) {
+		if err := s.completeChunked(state); err != nil {
+			return state, err
+		}
+	}
+	if err := s.save(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s *UploadService) queryParts(state *UploadState) (*UploadState, error) {
+	for !allPartsComplete(state) {
+		part := currentPart(state)
+		backend, err := s.accountBackend(part.AccountId)
+		if err != nil {
+			return nil, err
+		}
+		progress, err := backend.QueryUpload(part.SessionUri, part.Size)
+		if err != nil {
+			return nil, err
+		}
+		state.Offset = part.Offset + progress.Offset
+		if progress.File == nil {
+			break
+		}
+		if err := completePart(state, part, progress.File); err != nil {
+			return state, err
+		}
+	}
+	if allPartsComplete(state) {
+		if err := s.completeChunked(state); err != nil {
+			return state, err
+		}
+	}
+	if err := s.save(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func currentPart(state *UploadState) *UploadPart {
+	for _, part := range state.Parts {
+		if !part.Complete {
+			return part
+		}
+	}
+	return state.Parts[len(state.Parts)-1]
+}
+
+func allPartsComplete(state *UploadState) bool {
+	for _, part := range state.Parts {
+		if !part.Complete {
+			return false
+		}
+	}
+	return true
+}
+
+func completePart(state *UploadState, part *UploadPart, file *drive.File) error {
+	if file.Size != part.Size {
+		log.Println("Part", part.Index, "of upload", state.Id, "has", file.Size, "bytes, expected", part.Size)
+		return fmt.Errorf("part %d of upload %s has size %d, expected %d", part.Index, state.Id, file.Size, part.Size)
+	}
+	part.Complete = true
+	part.FileId = file.Id
+	part.Md5 = file.Md5Checksum
+	state.Offset = part.Offset + part.Size
+	log.Println("Completed part", part.Index, "of upload", state.Id, "as file", file.Id)
+	return nil
+}
+
+// insertOnce inserts doc unless a document matches filter already. It returns the id of the
+// document kept and whether it was inserted by this call.
+func insertOnce(collection *mongo.Collection, filter bson.D, doc interface{}) (primitive.ObjectID, bool, error) {
+	res, err := collection.UpdateOne(context.Background(), filter, bson.D{
+		{"$setOnInsert", doc},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return primitive.NilObjectID, false, err
+	}
+	if id, ok := res.UpsertedID.(primitive.ObjectID); ok {
+		return id, true, nil
+	}
+	var existing struct {
+		Id primitive.ObjectID `bson:"_id"`
+	}
+	err = collection.FindOne(context.Background(), filter).Decode(&existing)
+	return existing.Id, false, err
+}
+
+// completeChunked writes the manifest and the file index pointing to it. A completion retried
+// after the state failed to save finds both again instead of indexing the file twice.
+func (s *UploadService) completeChunked(state *UploadState) error {
+	now := time.Now()
+	manifest := FileManifest{
+		Id:        primitive.NewObjectID(),
+		Owner:     state.Owner,
+		Name:      state.Name,
+		MimeType:  state.MimeType,
+		Size:      state.Size,
+		CreatedAt: now,
+		UploadId:  state.Id,
+	}
+	for _, part := range state.Parts {
+		manifest.Parts = append(manifest.Parts, ManifestPart{
+			Index:     part.Index,
+			AccountId: part.AccountId,
+			FileId:    part.FileId,
+			Offset:    part.Offset,
+			Size:      part.Size,
+			Md5:       part.Md5,
+		})
+	}
+	manifestId, _, err := insertOnce(dao.FileManifest(), bson.D{{"uploadId", state.Id}}, manifest)
+	if err != nil {
+		log.Println("Fail to insert manifest of upload", state.Id, "by error", err.Error())
+		return err
+	}
+	manifest.Id = manifestId
+	fi := FileIndex{
+		Id:           primitive.NewObjectID(),
+		Name:         state.Name,
+		Size:         state.Size,
+		MimeType:     state.MimeType,
+		Owner:        state.Owner,
+		CreatedTime:  now,
+		ModifiedTime: now,
+		SyncTime:     now,
+		Storage:      StorageChunked,
+		ManifestId:   &manifest.Id,
+	}
+	fileIndexId, inserted, err := insertOnce(dao.FileIndex(), bson.D{{"manifestId", manifest.Id}}, fi)
+	if err != nil {
+		log.Println("Fail to insert file index of upload", state.Id, "by error", err.Error())
+		return err
+	}
+	if inserted {
+		for _, part := range state.Parts {
+			if err := commitPart(state.Owner, part); err != nil {
+				log.Println("Fail to update quota after upload", state.Id, "by error", err.Error())
+			}
+		}
+	}
+	state.Complete = true
+	state.FileIndexId = &fileIndexId
+	log.Println("Completed chunked upload", state.Id, "with manifest", manifest.Id.Hex())
+	return nil
+}
+
+// Cancel forgets the upload. Open resumable sessions are cancelled and parts or shards
+// already stored on Drive are deleted.
+func (s *UploadService) Cancel(owner primitive.ObjectID, id string) error {
+	state, err := s.Get(owner, id)
+	if err != nil {
+		return err
+	}
+	if !state.Complete && state.SessionUri != "" {
+		s.cancelSession(state.AccountId, state.SessionUri)
+	}
+	if (state.Chunked || state.Erasure) && !state.Complete {
+		for _, part := range state.Parts {
+			if !part.Complete {
+				if part.SessionUri != "" {
+					s.cancelSession(part.AccountId, part.SessionUri)
+				}
+				continue
+			}
+			if err := GetAccountService().deletePart(part.AccountId, part.FileId); err != nil {
+				log.Println("Fail to delete part", part.Index, "of cancelled upload", id, "by error", err.Error())
+				return err
+			}
+		}
+		releaseParts(state.Parts)
+	}
+	if state.ReservationId != nil && !state.Complete {
+		if err := GetQuotaService().Release(*state.ReservationId); err != nil {
+			log.Println("Fail to release reservation of cancelled upload", id, "by error", err.Error())
+		}
+	}
+	return s.redis.Delete(uploadKey(id), uploadCompleteKey(id))
+}
+
+// cancelSession drops a resumable session. Failing is only logged, an abandoned Drive
+// session expires after a week.
+func (s *UploadService) cancelSession(accountId primitive.ObjectID, sessionUri string) {
+	backend, err := s.accountBackend(accountId)
+	if err == nil {
+		err = backend.CancelUpload(sessionUri)
+	}
+	if err != nil {
+		log.Println("Fail to cancel upload session on account", accountId.Hex(), "by error", err.Error())
+	}
+}
+
+func (s *UploadService) backend(state *UploadState) (helper.DriveBackend, error) {
+	return s.accountBackend(state.AccountId)
+}
+
+func (s *UploadService) accountBackend(accountId primitive.ObjectID) (helper.DriveBackend, error) {
+	return accountBackend(accountId)
+}
+
+// accountBackend opens the backend of an account by id. It can be swapped to return fakes.
+var accountBackend = func(accountId primitive.ObjectID) (helper.DriveBackend, error) {
+	as := GetAccountService()
+	account, err := as.FindAccount(accountId.Hex())
+	if err != nil {
+		return nil, err
+	}
+	return as.GetDriveBackend(account)
+}
+
+// complete indexes the uploaded file and accounts its size on the account quota.
+// complete indexes the uploaded file. The completion first moves the upload out of progress
+// with a compare-and-set, so a retried or concurrent one takes the stored file instead of
+// indexing and replicating it again.
+func (s *UploadService) complete(state *UploadState, progress *helper.UploadProgress) error {
+	claimed, err := s.redis.SetIfAbsent(uploadCompleteKey(state.Id), uploadCompleting, uploadSessionTTL)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return s.completed(state)
+	}
+	as := GetAccountService()
+	fi, err := as.SyncFile(state.Owner.Hex(), state.AccountId.Hex(), *progress.File)
+	if err != nil {
+		// back in progress, so the next attempt indexes it
+		if err := s.redis.Delete(uploadCompleteKey(state.Id)); err != nil {
+			log.Println("Fail to reset completion of upload", state.Id, "by error", err.Error())
+		}
+		return err
+	}
+	if err := s.redis.SaveWithTTL(uploadCompleteKey(state.Id), fi.Id.Hex(), uploadSessionTTL); err != nil {
+		log.Println("Fail to save completion of upload", state.Id, "by error", err.Error())
+	}
+	if state.ReservationId != nil {
+		err = GetQuotaService().Commit(state.Owner, state.AccountId, *state.ReservationId, progress.File.Id, progress.File.Size)
+	} else {
+		err = as.UpdateCachedQuotaByAccountIdAndAdditionalSize(state.AccountId.Hex(), progress.File.Size)
+	}
+	if err != nil {
+		log.Println("Fail to update quota after upload", state.Id, "by error", err.Error())
+	}
+	state.Complete = true
+	state.FileIndexId = &fi.Id
+	go replicateNewFile(fi)
+	log.Println("Completed upload", state.Id, "as file", progress.File.Id, "on account", state.AccountId.Hex())
+	return nil
+}
+
+// completed takes the file indexed by the completion that got the upload first. While that one
+// is still indexing, the upload stays incomplete with every byte received and the client asks again.
+func (s *UploadService) completed(state *UploadState) error {
+	value, err := s.redis.Get(uploadCompleteKey(state.Id))
+	if err != nil {
+		return err
+	}
+	fileIndexId, err := primitive.ObjectIDFromHex(value)
+	if err != nil {
+		log.Println("Upload", state.Id, "is being completed by another request")
+		return nil
+	}
+	state.Complete = true
+	state.FileIndexId = &fileIndexId
+	return nil
+}
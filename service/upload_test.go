@@ -0,0 +1,97 @@
+package service
+
+import (
+	"fmt"
+	"github.com/ndphu/drive-manager-api/helper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/api/drive/v3"
+	"testing"
+	"time"
+)
+
+func TestChunkRange(t *testing.T) {
+	const size = 3*UploadChunkAlign + 100
+	tests := []struct {
+		name         string
+		offset       int64
+		contentRange string
+		err          error
+	}{
+		{"whole file", 0, fmt.Sprintf("bytes 0-%d/%d", size-1, size), nil},
+		{"aligned chunk", 0, fmt.Sprintf("bytes 0-%d/%d", 2*UploadChunkAlign-1, size), nil},
+		{"short last chunk", 3 * UploadChunkAlign, fmt.Sprintf("bytes %d-%d/%d", 3*UploadChunkAlign, size-1, size), nil},
+		{"misaligned chunk", 0, fmt.Sprintf("bytes 0-%d/%d", UploadChunkAlign+99, size), ErrInvalidChunkSize},
+		{"chunk not at the offset", UploadChunkAlign, fmt.Sprintf("bytes 0-%d/%d", UploadChunkAlign-1, size), ErrUploadOffsetMismatch},
+		{"other total", 0, fmt.Sprintf("bytes 0-%d/%d", UploadChunkAlign-1, size+1), ErrInvalidContentRange},
+		{"end past the total", 0, fmt.Sprintf("bytes 0-%d/%d", size, size), ErrInvalidContentRange},
+		{"malformed", 0, "bytes=0-1", ErrInvalidContentRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &UploadState{Size: size, Offset: tt.offset}
+			if _, _, err := chunkRange(state, tt.contentRange); err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+// memoryRedis keeps upload states in a map, ttls are ignored.
+type memoryRedis map[string]string
+
+func (m memoryRedis) SaveWithTTL(key, value string, ttl time.Duration) error {
+	m[key] = value
+	return nil
+}
+
+func (m memoryRedis) Get(key string) (string, error) {
+	return m[key], nil
+}
+
+func (m memoryRedis) Delete(keys ...string) error {
+	for _, key := range keys {
+		delete(m, key)
+	}
+	return nil
+}
+
+func (m memoryRedis) SetIfAbsent(key, value string, ttl time.Duration) (bool, error) {
+	if _, ok := m[key]; ok {
+		return false, nil
+	}
+	m[key] = value
+	return true, nil
+}
+
+func TestCompleteTakesStoredFile(t *testing.T) {
+	fileIndexId := primitive.NewObjectID()
+	tests := []struct {
+		name string
+		// completion status left by an earlier request
+		status   string
+		complete bool
+	}{
+		{"already complete", fileIndexId.Hex(), true},
+		{"completing in another request", uploadCompleting, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redis := memoryRedis{uploadCompleteKey("upload"): tt.status}
+			s := &UploadService{redis: redis}
+			state := &UploadState{Id: "upload", Size: 10, Offset: 10}
+			// a completion indexing the file again would reach Mongo and fail
+			if err := s.complete(state, &helper.UploadProgress{Offset: 10, File: &drive.File{Id: "file"}}); err != nil {
+				t.Fatal(err)
+			}
+			if state.Complete != tt.complete {
+				t.Fatalf("complete = %v", state.Complete)
+			}
+			if tt.complete && *state.FileIndexId != fileIndexId {
+				t.Fatalf("file index %s, expected the stored one", state.FileIndexId.Hex())
+			}
+			if redis[uploadCompleteKey("upload")] != tt.status {
+				t.Fatal("completion status changed")
+			}
+		})
+	}
+}